@@ -0,0 +1,404 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAdminTTL the ttl of values stored through the admin api if none is specified
+const DefaultAdminTTL = time.Hour
+
+// Admin serves a json api that can be used to inspect and manage a running dht.
+// It provides no authentication, so should only be served on a unix socket or a loopback address
+type Admin struct {
+	dht *DHT
+	mux *http.ServeMux
+}
+
+// the json representation of a node in the routing table
+type adminPeer struct {
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	Bucket       int       `json:"bucket"`
+	LatencyMS    float64   `json:"latency_ms"`
+	Seen         time.Time `json:"seen"`
+	Version      uint32    `json:"version"`
+	Capabilities uint64    `json:"capabilities"`
+	Client       bool      `json:"client"`
+}
+
+type adminBucket struct {
+	Index  int `json:"index"`
+	Nodes  int `json:"nodes"`
+	Cached int `json:"cached"`
+}
+
+type adminStorage struct {
+	Keys    uint64 `json:"keys"`
+	Values  uint64 `json:"values"`
+	Bytes   uint64 `json:"bytes"`
+	Expired uint64 `json:"expired"`
+}
+
+type adminValues struct {
+	Values [][]byte `json:"values"`
+}
+
+type adminLookupNode struct {
+	ID       string  `json:"id"`
+	Address  string  `json:"address"`
+	Distance int     `json:"distance"`
+	RTTMS    float64 `json:"rtt_ms,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type adminPingRequest struct {
+	Address string `json:"address"`
+}
+
+type adminPingResponse struct {
+	ID    string  `json:"id"`
+	RTTMS float64 `json:"rtt_ms"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// NewAdmin creates an admin api for a dht
+func NewAdmin(d *DHT) *Admin {
+	a := &Admin{
+		dht: d,
+		mux: http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("GET /v1/values/{key}", a.get)
+	a.mux.HandleFunc("PUT /v1/values/{key}", a.put)
+	a.mux.HandleFunc("DELETE /v1/values/{key}", a.delete)
+	a.mux.HandleFunc("GET /v1/lookup/{key}", a.lookup)
+	a.mux.HandleFunc("GET /v1/peers", a.peers)
+	a.mux.HandleFunc("GET /v1/buckets", a.buckets)
+	a.mux.HandleFunc("GET /v1/storage", a.storage)
+	a.mux.HandleFunc("POST /v1/ping", a.ping)
+	a.mux.HandleFunc("POST /v1/refresh", a.refresh)
+	a.mux.HandleFunc("POST /v1/leave", a.leave)
+
+	return a
+}
+
+// ServeHTTP serves an admin api request. requests must be sent to a unix socket or a loopback host, and
+// posts must have a json body, so web pages the operator visits can't use the api through dns rebinding
+// or cross site requests, as browsers won't send a json body to another site without asking it first
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminLocal(r) {
+		adminRespond(w, http.StatusForbidden, adminError{Error: "requests must be sent to a unix socket or loopback address"})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mt != "application/json" {
+			adminRespond(w, http.StatusUnsupportedMediaType, adminError{Error: "content type must be application/json"})
+			return
+		}
+	}
+
+	a.mux.ServeHTTP(w, r)
+}
+
+// finds the values of a key. values can be filtered to those created after a time with the from
+// parameter, and the number of values and whether to only search this node can be set with the
+// limit and local parameters
+func (a *Admin) get(w http.ResponseWriter, r *http.Request) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return
+	}
+
+	var opts []FindOption
+
+	from := r.URL.Query().Get("from")
+	if from != "" {
+		f, err := time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			adminRespond(w, http.StatusBadRequest, adminError{Error: "invalid from time"})
+			return
+		}
+		opts = append(opts, ValuesFrom(f))
+	}
+
+	limit := r.URL.Query().Get("limit")
+	if limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil {
+			adminRespond(w, http.StatusBadRequest, adminError{Error: "invalid limit"})
+			return
+		}
+		opts = append(opts, MaxResults(l))
+	}
+
+	if r.URL.Query().Get("local") == "true" {
+		opts = append(opts, LocalOnly())
+	}
+
+	values, err := a.dht.FindAll(key, opts...)
+	if err != nil {
+		adminRespond(w, http.StatusNotFound, adminError{Error: err.Error()})
+		return
+	}
+
+	adminRespond(w, http.StatusOK, adminValues{Values: values})
+}
+
+// stores the body of the request as a value of the key, using the ttl parameter if provided
+func (a *Admin) put(w http.ResponseWriter, r *http.Request) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return
+	}
+
+	ttl := DefaultAdminTTL
+
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		var err error
+
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl <= 0 {
+			adminRespond(w, http.StatusBadRequest, adminError{Error: "invalid ttl"})
+			return
+		}
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, VALUE_BYTES))
+	if err != nil {
+		adminRespond(w, http.StatusRequestEntityTooLarge, adminError{Error: "value must be less than 32kb in length"})
+		return
+	}
+
+	ch := make(chan error, 1)
+
+	a.dht.Store(key, value, ttl, func(err error) {
+		ch <- err
+	})
+
+	err = <-ch
+	if err != nil {
+		adminRespond(w, http.StatusBadGateway, adminError{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deletes the values of a key held by this node
+func (a *Admin) delete(w http.ResponseWriter, r *http.Request) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := a.dht.Delete(key)
+
+	switch {
+	case errors.Is(err, ErrDeleteUnsupported):
+		adminRespond(w, http.StatusNotImplemented, adminError{Error: err.Error()})
+	case err != nil:
+		adminRespond(w, http.StatusBadRequest, adminError{Error: err.Error()})
+	case !deleted:
+		adminRespond(w, http.StatusNotFound, adminError{Error: "key not found"})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// searches the network for the nodes closest to a key
+func (a *Admin) lookup(w http.ResponseWriter, r *http.Request) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := a.dht.Lookup(key)
+	if err != nil {
+		adminRespond(w, http.StatusBadGateway, adminError{Error: err.Error()})
+		return
+	}
+
+	nodes := []adminLookupNode{}
+
+	for _, n := range found {
+		an := adminLookupNode{
+			ID:       hex.EncodeToString(n.ID),
+			Address:  n.Address.String(),
+			Distance: n.Distance,
+			RTTMS:    float64(n.RTT) / float64(time.Millisecond),
+		}
+
+		if n.Err != nil {
+			an.Error = n.Err.Error()
+		}
+
+		nodes = append(nodes, an)
+	}
+
+	adminRespond(w, http.StatusOK, nodes)
+}
+
+// dumps the nodes in the routing table
+func (a *Admin) peers(w http.ResponseWriter, r *http.Request) {
+	peers := []adminPeer{}
+
+	for _, p := range a.dht.Peers() {
+		peers = append(peers, adminPeer{
+			ID:           hex.EncodeToString(p.ID),
+			Address:      p.Address.String(),
+			Bucket:       p.Bucket,
+			LatencyMS:    float64(p.Latency) / float64(time.Millisecond),
+			Seen:         p.Seen,
+			Version:      p.Version,
+			Capabilities: uint64(p.Capabilities),
+			Client:       p.Client,
+		})
+	}
+
+	adminRespond(w, http.StatusOK, peers)
+}
+
+// returns the number of nodes in each bucket that holds any nodes
+func (a *Admin) buckets(w http.ResponseWriter, r *http.Request) {
+	buckets := []adminBucket{}
+
+	for _, b := range a.dht.Buckets() {
+		if b.Nodes == 0 && b.Cached == 0 {
+			continue
+		}
+
+		buckets = append(buckets, adminBucket{
+			Index:  b.Index,
+			Nodes:  b.Nodes,
+			Cached: b.Cached,
+		})
+	}
+
+	adminRespond(w, http.StatusOK, buckets)
+}
+
+func (a *Admin) storage(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.dht.storage.(StorageStats)
+	if !ok {
+		adminRespond(w, http.StatusNotImplemented, adminError{Error: "storage does not report stats"})
+		return
+	}
+
+	keys, values, bytes, expired := s.Stats()
+
+	adminRespond(w, http.StatusOK, adminStorage{
+		Keys:    keys,
+		Values:  values,
+		Bytes:   bytes,
+		Expired: expired,
+	})
+}
+
+func (a *Admin) ping(w http.ResponseWriter, r *http.Request) {
+	var req adminPingRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Address == "" {
+		adminRespond(w, http.StatusBadRequest, adminError{Error: "an address must be provided"})
+		return
+	}
+
+	id, rtt, err := a.dht.Ping(req.Address)
+	if err != nil {
+		adminRespond(w, http.StatusBadGateway, adminError{Error: err.Error()})
+		return
+	}
+
+	adminRespond(w, http.StatusOK, adminPingResponse{
+		ID:    hex.EncodeToString(id),
+		RTTMS: float64(rtt) / float64(time.Millisecond),
+	})
+}
+
+// refreshes the routing table in the background, as it may take some time to ping every node
+func (a *Admin) refresh(w http.ResponseWriter, r *http.Request) {
+	go a.dht.Refresh()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// hands off our values and closes the dht in the background
+func (a *Admin) leave(w http.ResponseWriter, r *http.Request) {
+	go func() {
+		err := a.dht.Leave()
+		if err != nil {
+			a.dht.logger.Warn("failed to hand off values when leaving", errAttr(err))
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodes the hex encoded key from the request path
+func adminKey(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	key, err := hex.DecodeString(r.PathValue("key"))
+	if err != nil || len(key) != KEY_BYTES {
+		adminRespond(w, http.StatusBadRequest, adminError{Error: fmt.Sprintf("key must be %d hex encoded bytes", KEY_BYTES)})
+		return nil, false
+	}
+
+	return key, true
+}
+
+// returns true if a request was received on a unix socket, or was sent to a loopback host
+func adminLocal(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if ok && addr.Network() == "unix" {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func adminRespond(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	admin := NewAdmin(dht)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Host = "127.0.0.1:8080"
+		r.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	key := hex.EncodeToString(randomID())
+
+	// store and find a value
+	w := request(http.MethodPut, "/v1/values/"+key+"?ttl=1m", "value")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = request(http.MethodGet, "/v1/values/"+key, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var values adminValues
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &values))
+	assert.Equal(t, [][]byte{[]byte("value")}, values.Values)
+
+	// delete the value from this node, leaving the copy held by the bootstrap node
+	w = request(http.MethodDelete, "/v1/values/"+key, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = request(http.MethodDelete, "/v1/values/"+key, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodGet, "/v1/values/"+key+"?local=true", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(http.MethodGet, "/v1/values/"+key, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// invalid requests
+	w = request(http.MethodGet, "/v1/values/1234", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPut, "/v1/values/"+key+"?ttl=forever", "value")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPut, "/v1/values/"+key, strings.Repeat("a", VALUE_BYTES+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// inspect the routing table
+	w = request(http.MethodGet, "/v1/peers", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var peers []adminPeer
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &peers))
+	require.Len(t, peers, 1)
+	assert.Equal(t, hex.EncodeToString(bc.LocalID), peers[0].ID)
+	assert.Equal(t, bc.ListenAddress, peers[0].Address)
+	assert.Equal(t, uint32(ProtocolVersion), peers[0].Version)
+
+	w = request(http.MethodGet, "/v1/buckets", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var buckets []adminBucket
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &buckets))
+	// the routing table holds this node and the bootstrap node
+	require.Len(t, buckets, 2)
+	assert.Contains(t, buckets, adminBucket{Index: peers[0].Bucket, Nodes: 1})
+
+	w = request(http.MethodGet, "/v1/storage", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var storage adminStorage
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &storage))
+	assert.Equal(t, uint64(0), storage.Keys)
+
+	// ping the bootstrap node
+	w = request(http.MethodPost, "/v1/ping", `{"address": "127.0.0.1:9000"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var pong adminPingResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &pong))
+	assert.Equal(t, hex.EncodeToString(bc.LocalID), pong.ID)
+	assert.Greater(t, pong.RTTMS, 0.0)
+
+	w = request(http.MethodPost, "/v1/ping", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// lookup the nodes closest to a key
+	w = request(http.MethodGet, "/v1/lookup/"+key, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var nodes []adminLookupNode
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &nodes))
+	require.Len(t, nodes, 1)
+	assert.Equal(t, hex.EncodeToString(bc.LocalID), nodes[0].ID)
+	assert.Equal(t, bc.ListenAddress, nodes[0].Address)
+	assert.Empty(t, nodes[0].Error)
+
+	w = request(http.MethodGet, "/v1/values/"+key+"?from=yesterday", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/v1/refresh", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// requests that could have been sent by a web page should be rejected
+	for _, host := range []string{"example.com", "127.0.0.1.example.com:8080", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/peers", nil)
+		r.Host = host
+
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code, host)
+	}
+
+	for _, host := range []string{"localhost", "localhost:8080", "[::1]:8080", "[::1]"} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/peers", nil)
+		r.Host = host
+
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, host)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/refresh", strings.NewReader("address=127.0.0.1:9000"))
+	r.Host = "localhost"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	// any host can be used over a unix socket, as web pages can't connect to one
+	r = httptest.NewRequest(http.MethodGet, "/v1/peers", nil)
+	r.Host = "emo"
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "emo.sock", Net: "unix"}))
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDHTLeave(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	// store values only on the node that is leaving
+	keys := make([][]byte, 100)
+
+	for i := range keys {
+		keys[i] = randomID()
+		require.True(t, dht.storage.Set(keys[i], keys[i], time.Now(), time.Hour))
+	}
+
+	// large values should be split across events that fit within the maximum event size
+	for i := 0; i < 4; i++ {
+		key := randomID()
+		require.True(t, dht.storage.Set(key, make([]byte, 30000), time.Now(), time.Hour))
+		keys = append(keys, key)
+	}
+
+	admin := NewAdmin(dht)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/leave", nil)
+	r.Host = "localhost"
+	r.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	select {
+	case <-dht.Done():
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "node did not leave")
+	}
+
+	// the values should have been handed off to the bootstrap node before the node closed
+	require.Eventually(t, func() bool {
+		for _, k := range keys {
+			_, ok := bdht.storage.Get(k, time.Time{})
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond*10)
+}
@@ -21,6 +21,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/tos-network/emo/protocol"
 )
 
 type bucket struct {
@@ -33,6 +35,7 @@ type bucket struct {
 	// cache holds all nodes that could be promoted to the bucket when
 	// other nodes expire
 	cache []*node
+	clock Clock
 	mu    sync.Mutex
 }
 
@@ -47,7 +50,7 @@ func (b *bucket) insert(id []byte, address *net.UDPAddr,
 	// then update it and add it to the end of the list
 	rn := b.remove(id, false)
 	if rn != nil {
-		rn.seen = time.Now()
+		rn.seen = b.clock.Now()
 		rn.latency = latency
 		rn.testMode = testMode
 		b.nodes[b.size] = rn
@@ -65,7 +68,7 @@ func (b *bucket) insert(id []byte, address *net.UDPAddr,
 
 	// if the bucket is not full, add the new node to the end
 	if !b.full() {
-		n.seen = time.Now()
+		n.seen = b.clock.Now()
 		b.nodes[b.size] = n
 		b.size++
 
@@ -75,7 +78,7 @@ func (b *bucket) insert(id []byte, address *net.UDPAddr,
 	var si int
 	var stale *node
 
-	now := time.Now()
+	now := b.clock.Now()
 
 	// check for any stale entries
 	for i := 0; i < b.size; i++ {
@@ -146,13 +149,58 @@ func (b *bucket) seen(nodeID []byte) bool {
 	n := b.get(nodeID)
 	if n != nil {
 		// todo improve the safety of this
-		n.seen = time.Now()
+		n.seen = b.clock.Now()
 		return true
 	}
 
 	return false
 }
 
+// records the version, capabilities and reachability advertised by a node if it exists in the bucket
+// at the address the advertisement was received from
+func (b *bucket) advertise(nodeID []byte, address *net.UDPAddr, version uint16, capabilities uint64, client bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.get(nodeID)
+	if n != nil && n.at(address) {
+		n.advertise(version, capabilities, client)
+	}
+}
+
+// returns true if the node can be sent an event
+func (b *bucket) supports(nodeID []byte, event protocol.EventType) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.get(nodeID)
+	if n == nil {
+		return true
+	}
+
+	return n.supports(event)
+}
+
+// returns true if the node exists in the bucket at the given address and has advertised the capability
+func (b *bucket) capable(nodeID []byte, address *net.UDPAddr, c Capability) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.get(nodeID)
+
+	return n != nil && n.at(address) && n.has(c)
+}
+
+// returns true if the node is held at the given address
+func (b *bucket) at(nodeID []byte, address *net.UDPAddr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.get(nodeID)
+
+	return n != nil && n.at(address)
+}
+
 // removes a node and returns it if it exists
 func (b *bucket) remove(nodeID []byte, lock bool) *node {
 	if lock {
@@ -178,7 +226,7 @@ func (b *bucket) remove(nodeID []byte, lock bool) *node {
 func (b *bucket) stash(n *node) {
 	for i := range b.cache {
 		if bytes.Equal(b.cache[i].id, n.id) {
-			b.cache[i].seen = time.Now()
+			b.cache[i].seen = b.clock.Now()
 			return
 		}
 	}
@@ -218,11 +266,16 @@ func (b *bucket) fillBucket(d *DHT) {
 
 func (b *bucket) refresh(d *DHT) {
 	b.mu.Lock()
-	nodes := make([]*node, len(b.nodes))
-	copy(nodes, b.nodes)
+	nodes := make([]*node, b.size)
+	copy(nodes, b.nodes[:b.size])
 	b.mu.Unlock()
 
 	for _, n := range nodes {
+		// don't ping ourselves
+		if bytes.Equal(n.id, d.config.LocalID) {
+			continue
+		}
+
 		if !d.pingNode(n) {
 			// Node is unresponsive, remove it
 			b.remove(n.id, true)
@@ -29,6 +29,7 @@ func TestBucketInsertAndGet(t *testing.T) {
 	b := bucket{
 		nodes:  make([]*node, 20),
 		expiry: time.Minute,
+		clock:  systemClock{},
 	}
 
 	ids := make([][]byte, 100)
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tos-network/emo/protocol"
@@ -40,12 +41,23 @@ type request struct {
 type cache struct {
 	requests sync.Map
 	hasher   sync.Pool
+	// the number of requests waiting for a response
+	inflight atomic.Int64
+	metrics  Metrics
+	clock    Clock
+	// closed to stop the cleanup of expired requests, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
 }
 
-func newCache(refresh time.Duration) *cache {
+func newCache(refresh time.Duration, metrics Metrics, clock Clock) *cache {
 	seed := maphash.MakeSeed()
 
 	c := &cache{
+		metrics: metrics,
+		clock:   clock,
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
 		hasher: sync.Pool{
 			New: func() any {
 				var hasher maphash.Hash
@@ -72,7 +84,10 @@ func (c *cache) set(key []byte, ttl time.Time, cb func(*protocol.Event, error) b
 
 	c.hasher.Put(h)
 
-	c.requests.Store(k, r)
+	_, loaded := c.requests.Swap(k, r)
+	if !loaded {
+		c.inflight.Add(1)
+	}
 }
 
 func (c *cache) callback(key []byte, event *protocol.Event, err error) {
@@ -91,25 +106,47 @@ func (c *cache) callback(key []byte, event *protocol.Event, err error) {
 	}
 
 	if r.(*request).callback(event, err) {
-		c.requests.Delete(k)
+		c.remove(k)
+	}
+}
+
+// removes a request, as it may be removed by both
+// a response and a timeout at the same time
+func (c *cache) remove(key any) {
+	_, loaded := c.requests.LoadAndDelete(key)
+	if loaded {
+		c.inflight.Add(-1)
 	}
 }
 
 func (c *cache) cleanup(refresh time.Duration) {
+	defer close(c.stopped)
+
 	for {
-		time.Sleep(refresh)
+		select {
+		case <-c.quit:
+			return
+		case <-c.clock.After(refresh):
+		}
 
-		now := time.Now()
+		now := c.clock.Now()
 
 		c.requests.Range(func(key, value any) bool {
 			v := value.(*request)
 
 			if now.After(v.ttl) {
 				v.callback(nil, ErrRequestTimeout)
-				c.requests.Delete(key)
+				c.remove(key)
+				c.metrics.AddCounter("emo_cache_timeouts_total", 1)
 			}
 
 			return true
 		})
 	}
 }
+
+// stops the cleanup of expired requests and waits for it to finish
+func (c *cache) close() {
+	close(c.quit)
+	<-c.stopped
+}
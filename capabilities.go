@@ -0,0 +1,102 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"sync/atomic"
+
+	"github.com/tos-network/emo/protocol"
+)
+
+// ProtocolVersion the version of the wire protocol implemented by this node.
+// nodes that don't advertise a version implement version 0
+const ProtocolVersion = 1
+
+// Capability a set of optional events that a node supports
+type Capability uint64
+
+const (
+	// CapabilityProviders the node supports ADD_PROVIDER and GET_PROVIDERS events
+	CapabilityProviders Capability = 1 << iota
+	// CapabilitySubscriptions the node supports SUBSCRIBE and NOTIFY events
+	CapabilitySubscriptions
+	// CapabilityErrors the node understands ERROR responses
+	CapabilityErrors
+	// CapabilityNATTraversal the node reports observed addresses and handles dialback, relay and punch pings
+	CapabilityNATTraversal
+)
+
+// the capabilities supported by this node
+const localCapabilities = CapabilityProviders | CapabilitySubscriptions | CapabilityErrors | CapabilityNATTraversal
+
+// returns the capability a node must advertise to be sent an event.
+// events that are part of the original protocol require no capability
+func requiredCapability(event protocol.EventType) Capability {
+	switch event {
+	case protocol.EventTypeADD_PROVIDER, protocol.EventTypeGET_PROVIDERS:
+		return CapabilityProviders
+	case protocol.EventTypeSUBSCRIBE, protocol.EventTypeNOTIFY:
+		return CapabilitySubscriptions
+	case protocol.EventTypeERROR:
+		return CapabilityErrors
+	default:
+		return 0
+	}
+}
+
+// returns true if we know how to handle an event
+func knownEvent(event protocol.EventType) bool {
+	_, ok := protocol.EnumNamesEventType[event]
+	return ok
+}
+
+// records the version, capabilities and reachability a node advertised in a ping or pong
+func (n *node) advertise(version uint16, capabilities uint64, client bool) {
+	var c uint32
+	if client {
+		c = 1
+	}
+
+	atomic.StoreUint32(&n.version, uint32(version))
+	atomic.StoreUint64(&n.capabilities, capabilities)
+	atomic.StoreUint32(&n.client, c)
+	atomic.StoreUint32(&n.negotiated, 1)
+}
+
+// returns true if the node can be sent an event. nodes that have
+// not yet advertised their capabilities are assumed to support it
+func (n *node) supports(event protocol.EventType) bool {
+	if atomic.LoadUint32(&n.negotiated) == 0 {
+		return true
+	}
+
+	c := requiredCapability(event)
+
+	return Capability(atomic.LoadUint64(&n.capabilities))&c == c
+}
+
+// returns true if the node has advertised a capability. unlike supports, nodes
+// that have not yet advertised their capabilities are assumed not to have it
+func (n *node) has(c Capability) bool {
+	return atomic.LoadUint32(&n.negotiated) == 1 && Capability(atomic.LoadUint64(&n.capabilities))&c == c
+}
+
+// returns true if the node has told us it can't receive requests from nodes it hasn't contacted,
+// so it should not be given to other nodes
+func (n *node) isClient() bool {
+	return atomic.LoadUint32(&n.client) == 1
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tos-network/emo/protocol"
+)
+
+func TestNodeSupports(t *testing.T) {
+	n := &node{id: randomID()}
+
+	// nodes that haven't advertised their capabilities are assumed to support everything
+	assert.True(t, n.supports(protocol.EventTypeADD_PROVIDER))
+	assert.True(t, n.supports(protocol.EventTypeSUBSCRIBE))
+
+	n.advertise(ProtocolVersion, uint64(CapabilityProviders), false)
+	assert.True(t, n.supports(protocol.EventTypeGET_PROVIDERS))
+	assert.False(t, n.supports(protocol.EventTypeNOTIFY))
+
+	// nodes running the original protocol don't advertise a version or any capabilities
+	n.advertise(0, 0, false)
+	assert.True(t, n.supports(protocol.EventTypeFIND_VALUE))
+	assert.False(t, n.supports(protocol.EventTypeADD_PROVIDER))
+}
+
+func TestVerifyEventUnknownType(t *testing.T) {
+	buf := flatbuffers.NewBuilder(1024)
+
+	// events added by newer versions of the protocol should still be accepted
+	data := eventPong(buf, randomID(), randomID(), false, false, 0, nil)
+
+	e := protocol.GetRootAsEvent(data, 0)
+	require.True(t, e.MutateEvent(protocol.EventType(100)))
+
+	e, err := verifyEvent(data)
+	require.Nil(t, err)
+	assert.False(t, knownEvent(e.Event()))
+}
+
+func TestDHTCapabilityNegotiation(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+		Timeout:   time.Second,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	// wait for the nodes to ping each other
+	time.Sleep(time.Millisecond * 200)
+
+	peers := map[*DHT][]byte{
+		bdht: c.LocalID,
+		dht:  bc.LocalID,
+	}
+
+	// both nodes should have recorded the others version and capabilities
+	for d, id := range peers {
+		var peer *node
+
+		for _, n := range d.routing.closestN(id, K) {
+			if bytes.Equal(n.id, id) {
+				peer = n
+			}
+		}
+
+		require.NotNil(t, peer)
+		assert.Equal(t, uint32(1), atomic.LoadUint32(&peer.negotiated))
+		assert.Equal(t, uint32(ProtocolVersion), atomic.LoadUint32(&peer.version))
+		assert.Equal(t, uint64(localCapabilities), atomic.LoadUint64(&peer.capabilities))
+	}
+
+	// events we don't know how to handle should be answered with an error
+	buf := flatbuffers.NewBuilder(1024)
+	rid := pseudorandomID()
+
+	data := eventPong(buf, rid, c.LocalID, false, false, 0, nil)
+
+	e := protocol.GetRootAsEvent(data, 0)
+	require.True(t, e.MutateEvent(protocol.EventType(100)))
+	require.True(t, e.MutateResponse(false))
+
+	ch := make(chan error, 1)
+
+	err = dht.listeners[0].request(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}, rid, data, func(event *protocol.Event, err error) bool {
+		ch <- err
+		return true
+	})
+	require.Nil(t, err)
+	assert.ErrorIs(t, <-ch, ErrUnsupportedEvent)
+
+	// nodes that don't advertise support for provider records should not be sent them
+	dht.routing.advertise(bc.LocalID, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}, 0, 0, false)
+
+	dht.Provide(randomID(), func(err error) {
+		ch <- err
+	})
+
+	assert.ErrorIs(t, <-ch, ErrUnsupportedEvent)
+}
+
+func TestDHTSpoofedAdvertise(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 2)
+
+	attacker := &net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 9000}
+	buf := flatbuffers.NewBuilder(1024)
+
+	// a ping that claims to come from a known peer, advertising that it is a client with no capabilities
+	data := eventPing(buf, pseudorandomID(), nodes[1].config.LocalID, true, false, 0)
+	require.True(t, protocol.GetRootAsEvent(data, 0).MutateCapabilities(0))
+
+	nodes[0].listeners[0].handle(attacker, data)
+
+	// should not change what the peer has advertised
+	peers := nodes[0].Peers()
+	require.Len(t, peers, 1)
+	assert.Equal(t, nodes[1].config.LocalID, peers[0].ID)
+	assert.Equal(t, localCapabilities, peers[0].Capabilities)
+	assert.False(t, peers[0].Client)
+	assert.True(t, nodes[0].routing.capable(nodes[1].config.LocalID, peers[0].Address, CapabilityProviders))
+}
@@ -0,0 +1,250 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the dht, and schedules everything it does periodically
+// or after a delay, such as expiring values, timing out requests and refreshing peers
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// Since returns the time elapsed since t
+	Since(t time.Time) time.Duration
+	// Sleep blocks for the duration
+	Sleep(d time.Duration)
+	// After returns a channel that receives the current time after the duration
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine after the duration
+	AfterFunc(d time.Duration, f func()) Timer
+	// NewTicker returns a ticker that sends the current time every period
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer a call scheduled by a Clock
+type Timer interface {
+	// Stop prevents the call from happening, returning false if it has already happened or been stopped
+	Stop() bool
+}
+
+// Ticker periodically sends the time of a Clock
+type Ticker interface {
+	// C returns the channel the ticks are sent on
+	C() <-chan time.Time
+	// Stop turns off the ticker
+	Stop()
+}
+
+// the default clock, which uses the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock a clock that only moves forward when it is advanced, so tests can
+// cover behaviour that happens over hours without waiting for it
+type FakeClock struct {
+	now time.Time
+	// the sleepers, timers and tickers waiting for the clock to reach their deadline
+	waiters []*fakeWaiter
+	// signalled when a waiter is added
+	cond *sync.Cond
+	mu   sync.Mutex
+}
+
+type fakeWaiter struct {
+	clock    *FakeClock
+	deadline time.Time
+	// the period of a ticker
+	period time.Duration
+	// receives the time when the deadline is reached, unless fn is set
+	ch chan time.Time
+	fn func()
+}
+
+// NewFakeClock creates a fake clock set to the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	w := &fakeWaiter{ch: make(chan time.Time, 1)}
+	c.add(w, d)
+	return w.ch
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	w := &fakeWaiter{fn: f}
+	c.add(w, d)
+	return w
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	w := &fakeWaiter{period: d, ch: make(chan time.Time, 1)}
+	c.add(w, d)
+	return fakeTicker{w}
+}
+
+// Advance moves the clock forward, firing every timer and ticker whose deadline is
+// reached in the order of their deadlines. Tickers fire at most once per period, and
+// like a real ticker drop ticks that aren't received
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+
+	for len(c.waiters) > 0 && !c.waiters[0].deadline.After(end) {
+		w := c.waiters[0]
+		c.waiters = c.waiters[1:]
+
+		c.now = w.deadline
+
+		if w.fn != nil {
+			go w.fn()
+		} else {
+			select {
+			case w.ch <- c.now:
+			default:
+			}
+		}
+
+		if w.period > 0 {
+			w.deadline = w.deadline.Add(w.period)
+			c.insert(w)
+		}
+	}
+
+	c.now = end
+}
+
+// BlockUntil blocks until at least n sleepers, timers and tickers are waiting on the clock.
+// It can be used to make sure background goroutines are waiting before advancing the clock
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) add(w *fakeWaiter, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.clock = c
+	w.deadline = c.now.Add(d)
+
+	c.insert(w)
+	c.cond.Broadcast()
+}
+
+// inserts a waiter, keeping the waiters ordered by their deadline. the caller must hold the mutex
+func (c *FakeClock) insert(w *fakeWaiter) {
+	i := sort.Search(len(c.waiters), func(i int) bool {
+		return c.waiters[i].deadline.After(w.deadline)
+	})
+
+	c.waiters = append(c.waiters, nil)
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = w
+}
+
+// removes a waiter, returning false if it was not waiting
+func (c *FakeClock) remove(w *fakeWaiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.waiters {
+		if c.waiters[i] == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *fakeWaiter) Stop() bool {
+	return w.clock.remove(w)
+}
+
+type fakeTicker struct {
+	w *fakeWaiter
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.w.ch
+}
+
+func (t fakeTicker) Stop() {
+	t.w.Stop()
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	after := c.After(time.Minute)
+	ticker := c.NewTicker(time.Hour)
+
+	fired := make(chan struct{}, 1)
+	timer := c.AfterFunc(time.Second, func() {
+		fired <- struct{}{}
+	})
+
+	c.Advance(time.Second / 2)
+	assert.Equal(t, start.Add(time.Second/2), c.Now())
+	assert.Len(t, fired, 0)
+
+	c.Advance(time.Second / 2)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		require.FailNow(t, "timer did not fire")
+	}
+
+	// the timer has already fired
+	assert.False(t, timer.Stop())
+	assert.Len(t, after, 0)
+
+	c.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Minute), <-after)
+	assert.Len(t, ticker.C(), 0)
+
+	// ticks that aren't received are dropped
+	c.Advance(time.Hour * 3)
+	assert.Equal(t, start.Add(time.Hour), <-ticker.C())
+	assert.Len(t, ticker.C(), 0)
+
+	c.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour*4), <-ticker.C())
+
+	ticker.Stop()
+	c.Advance(time.Hour)
+	assert.Len(t, ticker.C(), 0)
+
+	assert.Equal(t, time.Hour*5+time.Minute+time.Second, c.Since(start))
+}
+
+func TestFakeClockSleep(t *testing.T) {
+	c := NewFakeClock(time.Now())
+
+	done := make(chan struct{})
+
+	go func() {
+		c.Sleep(time.Hour)
+		close(done)
+	}()
+
+	// wait for the sleeper before advancing the clock
+	c.BlockUntil(1)
+
+	c.Advance(time.Hour - time.Second)
+
+	select {
+	case <-done:
+		require.FailNow(t, "sleep returned early")
+	default:
+	}
+
+	c.Advance(time.Second)
+	<-done
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tos-network/emo"
+)
+
+// a connection to the network used by the client subcommands, either through
+// an ephemeral node or the admin api of a running daemon
+type client interface {
+	put(key, value []byte, ttl time.Duration) error
+	get(key []byte, from time.Time) ([][]byte, error)
+	ping(address string) ([]byte, time.Duration, error)
+	lookup(key []byte) ([]lookupNode, error)
+	close()
+}
+
+// a node found by a lookup, in the format returned by the admin api
+type lookupNode struct {
+	ID       string  `json:"id"`
+	Address  string  `json:"address"`
+	Distance int     `json:"distance"`
+	RTTMS    float64 `json:"rtt_ms"`
+	Error    string  `json:"error"`
+}
+
+// runs one of the client subcommands, returning the exit code
+func runClient(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	admin := fs.String("admin", "unix:"+emo.AdminSocketPath(emo.DefaultDataDir()), "admin api of the daemon to use, unless bootstrap addresses are provided")
+	bootstrap := fs.String("bootstrap", "", "comma separated addresses of nodes to bootstrap an ephemeral node from, instead of using a daemon")
+	listen := fs.String("listen", "0.0.0.0:0", "address the ephemeral node listens on")
+	network := fs.Uint("network-id", 0, "id of the network the ephemeral node joins")
+	timeout := fs.Duration("timeout", time.Second*10, "request timeout")
+
+	var ttl time.Duration
+	var from string
+
+	var usage string
+
+	switch command {
+	case "put":
+		usage = "put <key> <value|@file>"
+		fs.DurationVar(&ttl, "ttl", emo.DefaultAdminTTL, "amount of time the value will be stored for")
+	case "get":
+		usage = "get <key>"
+		fs.StringVar(&from, "from", "", "only return values created after this RFC3339 time")
+	case "ping":
+		usage = "ping <address>"
+	case "lookup":
+		usage = "lookup <key>"
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: emo %s [flags]\n", usage)
+		fs.PrintDefaults()
+	}
+
+	args = parseArgs(fs, args)
+
+	if len(args) != strings.Count(usage, "<") {
+		fs.Usage()
+		return 2
+	}
+
+	var c client
+	var err error
+
+	if *network > math.MaxUint32 {
+		fmt.Fprintln(os.Stderr, "network id must fit in 32 bits")
+		return 2
+	}
+
+	if *bootstrap != "" {
+		c, err = newNodeClient(*listen, strings.Split(*bootstrap, ","), uint32(*network), *timeout)
+	} else {
+		c, err = newAdminClient(*admin, *timeout)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	defer c.close()
+
+	switch command {
+	case "put":
+		err = put(c, args[0], args[1], ttl)
+	case "get":
+		err = get(c, args[0], from)
+	case "ping":
+		err = ping(c, args[0])
+	case "lookup":
+		err = lookup(c, args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// parses flags that may be mixed with positional arguments, returning the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+
+	for {
+		fs.Parse(args)
+
+		if fs.NArg() == 0 {
+			return positional
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// keys can be provided hex encoded, otherwise the key is the keccak256 hash of the argument
+func parseKey(s string) []byte {
+	key, err := hex.DecodeString(s)
+	if err == nil && len(key) == emo.KEY_BYTES {
+		return key
+	}
+
+	return emo.Keccak256([]byte(s))
+}
+
+func put(c client, key, value string, ttl time.Duration) error {
+	v := []byte(value)
+
+	// values prefixed with @ are read from a file
+	path, ok := strings.CutPrefix(value, "@")
+	if ok {
+		var err error
+
+		v, err = os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.put(parseKey(key), v, ttl)
+}
+
+func get(c client, key, from string) error {
+	var f time.Time
+
+	if from != "" {
+		var err error
+
+		f, err = time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			return fmt.Errorf("invalid from time: %w", err)
+		}
+	}
+
+	values, err := c.get(parseKey(key), f)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		os.Stdout.Write(v)
+		os.Stdout.Write([]byte{'\n'})
+	}
+
+	return nil
+}
+
+func ping(c client, address string) error {
+	id, rtt, err := c.ping(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("pong from %s (%s) in %s\n", address, hex.EncodeToString(id), rtt)
+
+	return nil
+}
+
+func lookup(c client, key string) error {
+	nodes, err := c.lookup(parseKey(key))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tDISTANCE\tRTT")
+
+	for _, n := range nodes {
+		rtt := time.Duration(n.RTTMS * float64(time.Millisecond)).String()
+		if n.Error != "" {
+			rtt = n.Error
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", n.ID, n.Address, n.Distance, rtt)
+	}
+
+	return w.Flush()
+}
+
+// a client that joins the network as a temporary node
+type nodeClient struct {
+	dht *emo.DHT
+}
+
+func newNodeClient(listen string, bootstrap []string, network uint32, timeout time.Duration) (*nodeClient, error) {
+	dht, err := emo.New(&emo.Config{
+		ListenAddress:      listen,
+		BootstrapAddresses: bootstrap,
+		Listeners:          1,
+		Timeout:            timeout,
+		NetworkID:          network,
+		ClientMode:         true,
+		Logger:             slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeClient{dht: dht}, nil
+}
+
+func (c *nodeClient) put(key, value []byte, ttl time.Duration) error {
+	ch := make(chan error, 1)
+
+	c.dht.Store(key, value, ttl, func(err error) {
+		select {
+		case ch <- err:
+		default:
+		}
+	})
+
+	return <-ch
+}
+
+func (c *nodeClient) get(key []byte, from time.Time) ([][]byte, error) {
+	// the ephemeral node doesn't hold any values, so always ask the network
+	opts := []emo.FindOption{emo.SkipLocal()}
+
+	if !from.IsZero() {
+		opts = append(opts, emo.ValuesFrom(from))
+	}
+
+	return c.dht.FindAll(key, opts...)
+}
+
+func (c *nodeClient) ping(address string) ([]byte, time.Duration, error) {
+	return c.dht.Ping(address)
+}
+
+func (c *nodeClient) lookup(key []byte) ([]lookupNode, error) {
+	found, err := c.dht.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]lookupNode, len(found))
+
+	for i, n := range found {
+		nodes[i] = lookupNode{
+			ID:       hex.EncodeToString(n.ID),
+			Address:  n.Address.String(),
+			Distance: n.Distance,
+			RTTMS:    float64(n.RTT) / float64(time.Millisecond),
+		}
+
+		if n.Err != nil {
+			nodes[i].Error = n.Err.Error()
+		}
+	}
+
+	return nodes, nil
+}
+
+func (c *nodeClient) close() {
+	c.dht.Close()
+}
+
+// a client that uses the admin api of a running daemon
+type adminClient struct {
+	http *http.Client
+	base string
+}
+
+func newAdminClient(address string, timeout time.Duration) (*adminClient, error) {
+	if address == "" {
+		return nil, errors.New("either an admin address or bootstrap addresses must be provided")
+	}
+
+	c := &adminClient{
+		http: &http.Client{Timeout: timeout},
+		base: "http://" + address,
+	}
+
+	path, ok := strings.CutPrefix(address, "unix:")
+	if ok {
+		var d net.Dialer
+
+		c.base = "http://emo"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+
+	return c, nil
+}
+
+// sends a request to the admin api, decoding the json response into out if it is not nil
+func (c *adminClient) do(method, path string, body io.Reader, out any) error {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+
+	// the admin api only accepts posts with a json body
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			return fmt.Errorf("admin api returned %s", resp.Status)
+		}
+
+		return errors.New(e.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *adminClient) put(key, value []byte, ttl time.Duration) error {
+	q := url.Values{"ttl": {ttl.String()}}
+	return c.do(http.MethodPut, "/v1/values/"+hex.EncodeToString(key)+"?"+q.Encode(), bytes.NewReader(value), nil)
+}
+
+func (c *adminClient) get(key []byte, from time.Time) ([][]byte, error) {
+	q := url.Values{}
+
+	if !from.IsZero() {
+		q.Set("from", from.Format(time.RFC3339Nano))
+	}
+
+	var resp struct {
+		Values [][]byte `json:"values"`
+	}
+
+	err := c.do(http.MethodGet, "/v1/values/"+hex.EncodeToString(key)+"?"+q.Encode(), nil, &resp)
+
+	return resp.Values, err
+}
+
+func (c *adminClient) ping(address string) ([]byte, time.Duration, error) {
+	body, err := json.Marshal(map[string]string{"address": address})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resp struct {
+		ID    string  `json:"id"`
+		RTTMS float64 `json:"rtt_ms"`
+	}
+
+	err = c.do(http.MethodPost, "/v1/ping", bytes.NewReader(body), &resp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id, err := hex.DecodeString(resp.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return id, time.Duration(resp.RTTMS * float64(time.Millisecond)), nil
+}
+
+func (c *adminClient) lookup(key []byte) ([]lookupNode, error) {
+	var nodes []lookupNode
+	err := c.do(http.MethodGet, "/v1/lookup/"+hex.EncodeToString(key), nil, &nodes)
+	return nodes, err
+}
+
+func (c *adminClient) close() {
+	c.http.CloseIdleConnections()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tos-network/emo"
+	"gopkg.in/yaml.v3"
+)
+
+// the daemon's configuration. each setting can be provided in a config file under the
+// same name as its flag, or by an environment variable of the flag name in upper case,
+// prefixed with EMO_. flags take precedence over environment variables, which take
+// precedence over the config file
+type daemonConfig struct {
+	Listen              string      `json:"listen" yaml:"listen"`
+	Listeners           int         `json:"listeners" yaml:"listeners"`
+	Bootstrap           addressList `json:"bootstrap" yaml:"bootstrap"`
+	NetworkID           uint        `json:"network-id" yaml:"network-id"`
+	LocalID             string      `json:"local-id" yaml:"local-id"`
+	Identity            string      `json:"identity" yaml:"identity"`
+	DataDir             string      `json:"data-dir" yaml:"data-dir"`
+	Storage             string      `json:"storage" yaml:"storage"`
+	LevelDBPath         string      `json:"leveldb-path" yaml:"leveldb-path"`
+	Timeout             duration    `json:"timeout" yaml:"timeout"`
+	SocketBufferSize    int         `json:"socket-buffer-size" yaml:"socket-buffer-size"`
+	SocketBatchSize     int         `json:"socket-batch-size" yaml:"socket-batch-size"`
+	SocketBatchInterval duration    `json:"socket-batch-interval" yaml:"socket-batch-interval"`
+	TCPFallback         bool        `json:"tcp-fallback" yaml:"tcp-fallback"`
+	FallbackThreshold   int         `json:"fallback-threshold" yaml:"fallback-threshold"`
+	RateLimits          bool        `json:"rate-limits" yaml:"rate-limits"`
+	BanThreshold        float64     `json:"ban-threshold" yaml:"ban-threshold"`
+	BanDuration         duration    `json:"ban-duration" yaml:"ban-duration"`
+	ProviderTTL         duration    `json:"provider-ttl" yaml:"provider-ttl"`
+	SubscriptionLease   duration    `json:"subscription-lease" yaml:"subscription-lease"`
+	Metrics             string      `json:"metrics" yaml:"metrics"`
+	MetricsInterval     duration    `json:"metrics-interval" yaml:"metrics-interval"`
+	LogLevel            string      `json:"log-level" yaml:"log-level"`
+	LogFormat           string      `json:"log-format" yaml:"log-format"`
+	Admin               string      `json:"admin" yaml:"admin"`
+}
+
+func defaultDaemonConfig() *daemonConfig {
+	return &daemonConfig{
+		Listen:    "0.0.0.0:9000",
+		Listeners: 4,
+		Timeout:   duration(time.Minute / 2),
+		Storage:   string(emo.LevelDBStorage),
+		LogLevel:  "info",
+		LogFormat: "json",
+		Admin:     "unix:",
+	}
+}
+
+// a duration that can be set from a flag or decoded from a string in a config file
+type duration time.Duration
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+
+	return nil
+}
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// a list of addresses that can be set from a comma separated flag
+type addressList []string
+
+func (a *addressList) Set(s string) error {
+	*a = nil
+
+	for _, address := range strings.Split(s, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			*a = append(*a, address)
+		}
+	}
+
+	return nil
+}
+
+func (a *addressList) String() string {
+	return strings.Join(*a, ",")
+}
+
+// creates the daemon's flags, using the current values of the config as their defaults
+func daemonFlags(name string, c *daemonConfig, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	fs.StringVar(path, "config", *path, "path to a yaml or json config file")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on")
+	fs.IntVar(&c.Listeners, "listeners", c.Listeners, "number of socket listeners")
+	fs.Var(&c.Bootstrap, "bootstrap", "comma separated addresses of the nodes to bootstrap from")
+	fs.UintVar(&c.NetworkID, "network-id", c.NetworkID, "id of the network to join. events from nodes in other networks are dropped")
+	fs.StringVar(&c.LocalID, "local-id", c.LocalID, "hex encoded id of this node, overriding the id of the node's identity")
+	fs.StringVar(&c.Identity, "identity", c.Identity, "path to the node's identity file, which is created if it does not exist. inside the data directory if empty")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "data directory, "+emo.DefaultDataDir()+" if empty")
+	fs.StringVar(&c.Storage, "storage", c.Storage, "storage backend, either leveldb or inmemory")
+	fs.StringVar(&c.LevelDBPath, "leveldb-path", c.LevelDBPath, "path to the leveldb database, inside the data directory if empty")
+	fs.Var(&c.Timeout, "timeout", "request timeout")
+	fs.IntVar(&c.SocketBufferSize, "socket-buffer-size", c.SocketBufferSize, "size of the udp socket send and receive buffers, 32mb if 0")
+	fs.IntVar(&c.SocketBatchSize, "socket-batch-size", c.SocketBatchSize, "number of udp messages written to the socket at once, 1024 if 0")
+	fs.Var(&c.SocketBatchInterval, "socket-batch-interval", "interval that batches of udp messages are written at if not full, 1ms if 0")
+	fs.BoolVar(&c.TCPFallback, "tcp-fallback", c.TCPFallback, "also listen on tcp, sending large events and events to nodes unreachable over udp over it")
+	fs.IntVar(&c.FallbackThreshold, "fallback-threshold", c.FallbackThreshold, "size in bytes above which events are sent over tcp, the default if 0")
+	fs.BoolVar(&c.RateLimits, "rate-limits", c.RateLimits, "rate limit inbound requests with the default limits")
+	fs.Float64Var(&c.BanThreshold, "ban-threshold", c.BanThreshold, "misbehaviour score at which a peer is banned, the default if 0")
+	fs.Var(&c.BanDuration, "ban-duration", "amount of time a misbehaving peer is banned for, the default if 0")
+	fs.Var(&c.ProviderTTL, "provider-ttl", "amount of time other nodes keep our provider records for, the default if 0")
+	fs.Var(&c.SubscriptionLease, "subscription-lease", "amount of time other nodes hold our subscriptions for, the default if 0")
+	fs.StringVar(&c.Metrics, "metrics", c.Metrics, "address to serve prometheus metrics on at /metrics, disabled if empty")
+	fs.Var(&c.MetricsInterval, "metrics-interval", "interval that metrics are sampled at, the default if 0")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of logs to write, one of debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of logs, either json or text")
+	fs.StringVar(&c.Admin, "admin", c.Admin, "unix socket (unix:/path) or loopback address to serve the admin api on, disabled if empty. unix: uses the socket in the data directory")
+
+	return fs
+}
+
+// loads the daemon's config from the config file, environment and flags
+func loadDaemonConfig(name string, args []string) (*daemonConfig, error) {
+	path := os.Getenv("EMO_CONFIG")
+
+	// parse the flags once to find the config file
+	daemonFlags(name, defaultDaemonConfig(), &path).Parse(args)
+
+	c := defaultDaemonConfig()
+
+	if path != "" {
+		err := readConfigFile(path, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fs := daemonFlags(name, c, &path)
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "EMO_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		v, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+
+		if serr := f.Value.Set(v); serr != nil {
+			err = fmt.Errorf("invalid %s: %w", name, serr)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Parse(args)
+
+	return c, nil
+}
+
+// decodes a yaml or json config file, depending on its extension
+func readConfigFile(path string, c *daemonConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("config file %s must have a .yaml, .yml or .json extension", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// converts the config to the dht's config, returning an error if any of it is invalid
+func (c *daemonConfig) dhtConfig() (*emo.Config, error) {
+	cfg := &emo.Config{
+		ListenAddress:       c.Listen,
+		BootstrapAddresses:  c.Bootstrap,
+		Listeners:           c.Listeners,
+		Timeout:             time.Duration(c.Timeout),
+		StorageBackend:      emo.StorageType(c.Storage),
+		LevelDBPath:         c.LevelDBPath,
+		DataDir:             c.dataDir(),
+		SocketBufferSize:    c.SocketBufferSize,
+		SocketBatchSize:     c.SocketBatchSize,
+		SocketBatchInterval: time.Duration(c.SocketBatchInterval),
+		FallbackThreshold:   c.FallbackThreshold,
+		BanThreshold:        c.BanThreshold,
+		BanDuration:         time.Duration(c.BanDuration),
+		ProviderTTL:         time.Duration(c.ProviderTTL),
+		SubscriptionLease:   time.Duration(c.SubscriptionLease),
+		MetricsInterval:     time.Duration(c.MetricsInterval),
+	}
+
+	if c.LocalID != "" {
+		id, err := hex.DecodeString(c.LocalID)
+		if err != nil {
+			return nil, errors.New("local id must be hex encoded")
+		}
+		cfg.LocalID = id
+	}
+
+	if c.NetworkID > math.MaxUint32 {
+		return nil, errors.New("network id must fit in 32 bits")
+	}
+	cfg.NetworkID = uint32(c.NetworkID)
+
+	if c.RateLimits {
+		cfg.RateLimits = emo.DefaultRateLimits()
+	}
+
+	if c.TCPFallback {
+		cfg.Fallback = emo.NewTCPTransport(emo.TCPConfig{})
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *daemonConfig) dataDir() string {
+	if c.DataDir == "" {
+		return emo.DefaultDataDir()
+	}
+	return c.DataDir
+}
+
+func (c *daemonConfig) identityPath() string {
+	if c.Identity == "" {
+		return emo.IdentityPath(c.dataDir())
+	}
+	return c.Identity
+}
+
+// the address of the admin api, with the default socket path filled in
+func (c *daemonConfig) adminAddress() string {
+	if c.Admin == "unix:" {
+		return "unix:" + emo.AdminSocketPath(c.dataDir())
+	}
+	return c.Admin
+}
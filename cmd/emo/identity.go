@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/tos-network/emo"
+)
+
+// loads the daemon's identity, creating it on first run, and returns its node id
+func loadIdentity(dc *daemonConfig, logger *slog.Logger) ([]byte, error) {
+	id, created, err := emo.LoadOrCreateIdentity(dc.identityPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		logger.Info("generated node identity", "path", dc.identityPath(), "id", hex.EncodeToString(id.ID()))
+	}
+
+	return id.ID(), nil
+}
+
+// runs the identity subcommands, returning the exit code. the identity file
+// is found using the same config, environment and flags as the daemon
+func runIdentity(args []string) int {
+	if len(args) < 1 || (args[0] != "show" && args[0] != "rotate") {
+		fmt.Fprintln(os.Stderr, "usage: emo identity show|rotate [daemon flags]")
+		return 2
+	}
+
+	dc, err := loadDaemonConfig("identity "+args[0], args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	path := dc.identityPath()
+
+	switch args[0] {
+	case "show":
+		id, err := emo.LoadIdentity(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Printf("id:         %s\n", hex.EncodeToString(id.ID()))
+		fmt.Printf("public key: %s\n", hex.EncodeToString(id.PublicKey()))
+		fmt.Printf("path:       %s\n", path)
+	case "rotate":
+		old, err := emo.LoadIdentity(path)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		id, err := emo.GenerateIdentity()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		err = id.Save(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if old != nil {
+			fmt.Printf("previous id: %s\n", hex.EncodeToString(old.ID()))
+		}
+
+		fmt.Printf("id:          %s\n", hex.EncodeToString(id.ID()))
+		fmt.Println("restart the daemon to use the new identity")
+	}
+
+	return 0
+}
@@ -1,55 +1,207 @@
 package main
 
 import (
-	"flag"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"path/filepath"
+	"strings"
 
 	"github.com/tos-network/emo"
 )
 
-func main() {
-	daemonCmd := flag.NewFlagSet("daemon", flag.ExitOnError)
-	listenAddress := daemonCmd.String("listen", "0.0.0.0:9000", "address to listen on")
-	listeners := daemonCmd.Int("listeners", 4, "number of socket listeners")
-	timeout := daemonCmd.Duration("timeout", time.Minute/2, "request timeout")
+const usage = `usage: emo <command> [flags]
+
+commands:
+  daemon                         run a node
+  put <key> <value|@file>        store a value
+  get <key>                      find the values of a key
+  ping <address>                 ping a node
+  lookup <key>                   find the nodes closest to a key
+  identity show|rotate           show or replace the daemon's node identity
 
+run emo <command> -h for the flags of each command`
+
+func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("expected 'daemon' subcommand")
+		fmt.Println(usage)
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "daemon":
-		daemonCmd.Parse(os.Args[2:])
+		dc, err := loadDaemonConfig("daemon", os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		logger, err := newLogger(dc.LogLevel, dc.LogFormat)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		cfg, err := dc.dhtConfig()
+		if err != nil {
+			fmt.Println("invalid configuration:", err)
+			os.Exit(1)
+		}
+
+		cfg.Logger = logger
 
-		cfg := &emo.Config{
-			ListenAddress:  *listenAddress,
-			Listeners:      *listeners,
-			Timeout:        *timeout,
-			StorageBackend: emo.LevelDBStorage,
+		// use the id of the node's identity, so the node keeps its position in the keyspace across restarts
+		if cfg.LocalID == nil {
+			cfg.LocalID, err = loadIdentity(dc, logger)
+			if err != nil {
+				logger.Error("failed to load node identity", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		if dc.Metrics != "" {
+			registry := emo.NewRegistry()
+			cfg.Metrics = registry
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", registry.Handler())
+
+			go func() {
+				err := http.ListenAndServe(dc.Metrics, mux)
+				if err != nil {
+					logger.Error("failed to serve metrics", "error", err)
+					os.Exit(1)
+				}
+			}()
+
+			logger.Info("serving metrics", "address", dc.Metrics, "path", "/metrics")
 		}
 
 		dht, err := emo.New(cfg)
 		if err != nil {
-			log.Fatalf("failed to start emo daemon: %v", err)
+			logger.Error("failed to start emo daemon", "error", err)
+			os.Exit(1)
 		}
 
-		log.Printf("emo daemon started on %s\n", *listenAddress)
+		logger.Info("emo daemon started", "address", cfg.ListenAddress, "id", hex.EncodeToString(cfg.LocalID))
+
+		if dc.adminAddress() != "" {
+			l, err := listenAdmin(dc.adminAddress())
+			if err != nil {
+				logger.Error("failed to listen for admin requests", "error", err)
+				os.Exit(1)
+			}
+			defer l.Close()
+
+			go func() {
+				err := http.Serve(l, emo.NewAdmin(dht))
+				if err != nil && !errors.Is(err, net.ErrClosed) {
+					logger.Error("failed to serve admin api", "error", err)
+				}
+			}()
+
+			logger.Info("serving admin api", "address", dc.adminAddress())
+		}
 
 		// Handle shutdown signals
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
-		<-c
 
-		log.Println("emo daemon shutting down...")
-		dht.Close()
-		log.Println("emo daemon stopped.")
+		select {
+		case <-c:
+			logger.Info("emo daemon shutting down")
+
+			err := dht.Close()
+			if err != nil {
+				logger.Error("failed to shut down emo daemon cleanly", "error", err)
+			}
+		case <-dht.Done():
+			// the node left the network through the admin api
+			logger.Info("emo daemon left the network")
+		}
+
+		logger.Info("emo daemon stopped")
+	case "identity":
+		os.Exit(runIdentity(os.Args[2:]))
+	case "put", "get", "ping", "lookup":
+		os.Exit(runClient(os.Args[1], os.Args[2:]))
 	default:
-		fmt.Println("expected 'daemon' subcommand")
+		fmt.Println(usage)
 		os.Exit(1)
 	}
 }
+
+// creates a logger that writes logs at or above the given level to stderr
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// listens for admin requests on a unix socket if the address is prefixed with unix:, otherwise on a tcp
+// address. the admin api isn't authenticated, so tcp addresses must be loopback addresses
+func listenAdmin(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("admin address %q must be a unix socket or loopback address", address)
+		}
+
+		return net.Listen("tcp", address)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the socket left behind by a daemon that didn't shut down cleanly,
+	// leaving anything else at the path for the listen to fail on
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the user running the daemon can use the admin api
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
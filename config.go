@@ -16,7 +16,15 @@
 
 package emo
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/tos-network/emo/protocol"
+)
 
 // Config configuration parameters for the dht
 type Config struct {
@@ -38,12 +46,131 @@ type Config struct {
 	LevelDBPath string
 	// DataDir the path to the data directory
 	DataDir string
+	// Network creates the connections the dht listens on. If not specified, the dht will listen on udp sockets
+	Network Network
 	// SocketBufferSize sets the size of the udp sockets send and receive buffer
 	SocketBufferSize int
 	// SocketBatchSize the batch size of udp messages that will be written to the underlying socket
 	SocketBatchSize int
 	// SocketBatchInterval the period with which the current batch of udp messages will be written to the underlying socket if not full
 	SocketBatchInterval time.Duration
-	// Logging enables basic logging
+	// Fallback a transport, such as a TCPTransport, used to send events larger than FallbackThreshold and to reach
+	// nodes that have stopped responding over udp. If not specified, all events will be sent over udp
+	Fallback Transport
+	// FallbackThreshold the size in bytes above which events are sent over the fallback transport.
+	// If not specified, only events too large to be sent over udp are
+	FallbackThreshold int
+	// NetworkID identifies the network the node belongs to. Every event is marked with it, and events from nodes
+	// in other networks are dropped, so separate networks can run on the same hosts. Defaults to 0
+	NetworkID uint32
+	// ClientMode makes lookups and stores without serving other nodes. The node marks every event it sends as
+	// passive, so other nodes won't add it to their routing tables or store values with it
+	ClientMode bool
+	// RateLimits token bucket limits for each type of inbound request, applied to both the senders
+	// address and node id. If not specified, inbound requests will not be rate limited
+	RateLimits map[protocol.EventType]RateLimit
+	// BanThreshold the misbehaviour score at which a peer will be temporarily banned
+	BanThreshold float64
+	// BanDuration the amount of time a misbehaving peer will be banned for
+	BanDuration time.Duration
+	// ProviderTTL the amount of time other nodes will keep our provider records for
+	ProviderTTL time.Duration
+	// SubscriptionLease the amount of time other nodes will hold our subscriptions for before they must be renewed
+	SubscriptionLease time.Duration
+	// Metrics receives measurements of the dht's listeners, caches, routing table and storage.
+	// NewRegistry can be used to export them in the prometheus format
+	Metrics Metrics
+	// MetricsInterval the interval that the size of the routing table, storage and caches are sampled at
+	MetricsInterval time.Duration
+	// Tracer receives the progress of every find value and find node lookup made by the dht
+	Tracer Tracer
+	// Clock provides the time to the dht and schedules its timeouts, expiries and refreshes.
+	// If not specified, the system clock will be used. NewFakeClock can be used to control time in tests
+	Clock Clock
+	// Logger receives the dht's structured logs. Protocol events are logged at the debug level.
+	// If not specified, the default slog logger will be used
+	Logger *slog.Logger
+	// Logging enables debug logging to stderr if no Logger has been specified.
+	//
+	// Deprecated: use Logger
 	Logging bool
 }
+
+// Validate checks the config for values that would prevent the dht from starting
+// or that New would otherwise ignore, returning an error describing each of them.
+// Unset values are valid, as New will replace them with defaults
+func (c *Config) Validate() error {
+	var errs []error
+
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.LocalID != nil && len(c.LocalID) != KEY_BYTES {
+		invalid("local id must be %d bytes in length", KEY_BYTES)
+	}
+
+	_, err := net.ResolveUDPAddr("udp", c.ListenAddress)
+	if err != nil {
+		invalid("invalid listen address %q: %w", c.ListenAddress, err)
+	}
+
+	for _, a := range c.BootstrapAddresses {
+		_, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			invalid("invalid bootstrap address %q: %w", a, err)
+		}
+	}
+
+	switch c.StorageBackend {
+	case "", InMemoryStorage, LevelDBStorage:
+	default:
+		invalid("unknown storage backend %q", c.StorageBackend)
+	}
+
+	if c.Listeners < 0 {
+		invalid("listeners must not be negative")
+	}
+
+	if c.SocketBufferSize < 0 {
+		invalid("socket buffer size must not be negative")
+	}
+
+	if c.SocketBatchSize < 0 {
+		invalid("socket batch size must not be negative")
+	}
+
+	if c.FallbackThreshold < 0 {
+		invalid("fallback threshold must not be negative")
+	}
+
+	if c.BanThreshold < 0 {
+		invalid("ban threshold must not be negative")
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"timeout", c.Timeout},
+		{"socket batch interval", c.SocketBatchInterval},
+		{"ban duration", c.BanDuration},
+		{"provider ttl", c.ProviderTTL},
+		{"subscription lease", c.SubscriptionLease},
+		{"metrics interval", c.MetricsInterval},
+	}
+
+	for _, d := range durations {
+		if d.value < 0 {
+			invalid("%s must not be negative", d.name)
+		}
+	}
+
+	for t, l := range c.RateLimits {
+		if l.Rate <= 0 || l.Burst < 1 {
+			invalid("rate limit for %s must have a positive rate and burst", t)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tos-network/emo/protocol"
+)
+
+func TestConfigValidate(t *testing.T) {
+	c := &Config{
+		ListenAddress:      "127.0.0.1:9000",
+		BootstrapAddresses: []string{"127.0.0.1:9001"},
+		RateLimits:         DefaultRateLimits(),
+	}
+
+	assert.Nil(t, c.Validate())
+
+	// unset values are replaced with defaults, so are valid
+	assert.Nil(t, (&Config{}).Validate())
+
+	c = &Config{
+		LocalID:            []byte("short"),
+		ListenAddress:      "127.0.0.1:port",
+		BootstrapAddresses: []string{"127.0.0.1:9001", "not-an-address"},
+		StorageBackend:     "memcached",
+		Listeners:          -1,
+		Timeout:            -time.Second,
+		RateLimits: map[protocol.EventType]RateLimit{
+			protocol.EventTypePING: {Rate: 1},
+		},
+	}
+
+	err := c.Validate()
+	require.NotNil(t, err)
+
+	assert.Contains(t, err.Error(), "local id must be 32 bytes in length")
+	assert.Contains(t, err.Error(), `invalid listen address "127.0.0.1:port"`)
+	assert.Contains(t, err.Error(), `invalid bootstrap address "not-an-address"`)
+	assert.NotContains(t, err.Error(), `"127.0.0.1:9001"`)
+	assert.Contains(t, err.Error(), `unknown storage backend "memcached"`)
+	assert.Contains(t, err.Error(), "listeners must not be negative")
+	assert.Contains(t, err.Error(), "timeout must not be negative")
+	assert.Contains(t, err.Error(), "rate limit for PING must have a positive rate and burst")
+}
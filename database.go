@@ -2,41 +2,45 @@ package emo
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
 
-	"hash/maphash"
-
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // database implements the Storage interface using LevelDB.
+// The values of each key are stored together under the key.
 type database struct {
 	db     *leveldb.DB
-	hasher sync.Pool
+	logger *slog.Logger
+	clock  Clock
+	// closed to stop the cleanup of expired entries, which closes stopped once it has stopped
+	quit      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	// serializes updates to the values of a key
+	mu sync.Mutex
 }
 
 // Newdatabase initializes a new database instance.
 func NewDatabase(path string) (*database, error) {
+	return newDatabase(path, systemClock{})
+}
+
+func newDatabase(path string, clock Clock) (*database, error) {
 	db, err := leveldb.OpenFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	seed := maphash.MakeSeed()
-
 	storage := &database{
-		db: db,
-		hasher: sync.Pool{
-			New: func() any {
-				var hasher maphash.Hash
-				hasher.SetSeed(seed)
-				return &hasher
-			},
-		},
+		db:      db,
+		logger:  slog.Default(),
+		clock:   clock,
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
 	// Start a background goroutine to clean up expired entries.
@@ -48,28 +52,8 @@ func NewDatabase(path string) (*database, error) {
 // Get retrieves values associated with the given key.
 // If 'from' is not zero, it filters out values created before the 'from' timestamp.
 func (s *database) Get(k []byte, from time.Time) ([]*Value, bool) {
-	h := s.hasher.Get().(*maphash.Hash)
-	h.Reset()
-	h.Write(k)
-	key := h.Sum64()
-	s.hasher.Put(h)
-
-	keyBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(keyBytes, key)
-
-	data, err := s.db.Get(keyBytes, nil)
-	if err != nil {
-		if err == leveldb.ErrNotFound {
-			return nil, false
-		}
-		return nil, false
-	}
-
-	// Deserialize the stored values.
-	// Assuming values are stored in binary format. Adjust as needed.
-	var values []*Value
-	err = deserializeValues(data, &values)
-	if err != nil {
+	values, err := s.values(k)
+	if err != nil || len(values) == 0 {
 		return nil, false
 	}
 
@@ -91,8 +75,30 @@ func (s *database) Get(k []byte, from time.Time) ([]*Value, bool) {
 	return filtered, true
 }
 
+// reads all values stored under a key
+func (s *database) values(k []byte) ([]*Value, error) {
+	data, err := s.db.Get(k, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []*Value
+	err = deserializeValues(data, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
 // Set stores a key-value pair with a specified TTL.
 func (s *database) Set(k, v []byte, created time.Time, ttl time.Duration) bool {
+	_, ok := s.Insert(k, v, created, ttl)
+	return ok
+}
+
+// Insert stores a value, returning true if the value was not already stored
+func (s *database) Insert(k, v []byte, created time.Time, ttl time.Duration) (bool, bool) {
 	// Create copies of key and value to ensure immutability.
 	kc := make([]byte, len(k))
 	copy(kc, k)
@@ -100,40 +106,40 @@ func (s *database) Set(k, v []byte, created time.Time, ttl time.Duration) bool {
 	vc := make([]byte, len(v))
 	copy(vc, v)
 
-	h := s.hasher.Get().(*maphash.Hash)
-	h.Reset()
-	h.Write(k)
-	key := h.Sum64()
-	s.hasher.Put(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values, err := s.values(k)
+	if err != nil && err != leveldb.ErrNotFound {
+		return false, false
+	}
 
-	keyBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(keyBytes, key)
+	// the value has already been stored
+	for _, ev := range values {
+		if bytes.Equal(ev.Value, vc) {
+			return false, true
+		}
+	}
 
-	value := &Value{
+	// keep the values ordered by the time they were created, so they don't need sorting when read
+	values = insertSorted(values, &Value{
 		Key:     kc,
 		Value:   vc,
 		TTL:     ttl,
 		Created: created,
-		expires: time.Now().Add(ttl),
-	}
+		expires: s.clock.Now().Add(ttl),
+	})
 
-	// Serialize the value.
-	data, err := serializeValue(value)
+	data, err := serializeValues(values)
 	if err != nil {
-		return false
+		return false, false
 	}
 
-	// Atomically update the value in LevelDB.
-	// Using a write batch for atomicity.
-	batch := new(leveldb.Batch)
-	batch.Put(keyBytes, data)
-
-	err = s.db.Write(batch, nil)
-	if err != nil {
-		return false
+	if s.db.Put(kc, data, nil) != nil {
+		return false, false
 	}
 
-	return true
+	return true, true
 }
 
 // Iterate iterates over all stored values and applies the callback.
@@ -142,38 +148,67 @@ func (s *database) Iterate(cb func(v *Value) bool) {
 	iter := s.db.NewIterator(nil, nil)
 	defer iter.Release()
 
+iterate:
 	for iter.Next() {
-		data := iter.Value()
-		var value Value
-		err := deserializeValues(data, &[]*Value{&value})
+		var values []*Value
+		err := deserializeValues(iter.Value(), &values)
 		if err != nil {
 			continue
 		}
 
-		if !cb(&value) {
-			break
+		for _, v := range values {
+			if !cb(v) {
+				break iterate
+			}
 		}
 	}
 
 	if err := iter.Error(); err != nil {
-		log.Println("LevelDB Iteration Error:", err)
+		s.logger.Error("failed to iterate leveldb storage", errAttr(err))
 	}
 }
 
+// Delete removes all values of a key, returning false if the key does not exist.
+func (s *database) Delete(k []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, err := s.db.Has(k, nil)
+	if err != nil || !ok {
+		return false
+	}
+
+	return s.db.Delete(k, nil) == nil
+}
+
 // Close closes the LevelDB database.
 func (s *database) Close() error {
-	return s.db.Close()
+	err := leveldb.ErrClosed
+
+	s.closeOnce.Do(func() {
+		// stop the cleanup before closing the database it's iterating over
+		close(s.quit)
+		<-s.stopped
+
+		err = s.db.Close()
+	})
+
+	return err
 }
 
 // cleanup periodically removes expired entries from the database.
 func (s *database) cleanup() {
-	ticker := time.NewTicker(time.Minute)
+	defer close(s.stopped)
+
+	ticker := s.clock.NewTicker(time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			now := time.Now()
+		case <-s.quit:
+			return
+		case <-ticker.C():
+			now := s.clock.Now()
 			iter := s.db.NewIterator(nil, nil)
 			for iter.Next() {
 				keyBytes := iter.Key()
@@ -187,7 +222,7 @@ func (s *database) cleanup() {
 
 				var valid []*Value
 				for _, v := range values {
-					if v.expires.After(now) {
+					if v.expiry().After(now) {
 						valid = append(valid, v)
 					}
 				}
@@ -209,25 +244,12 @@ func (s *database) cleanup() {
 			}
 			iter.Release()
 			if err := iter.Error(); err != nil {
-				log.Println("LevelDB Cleanup Iteration Error:", err)
+				s.logger.Error("failed to clean up leveldb storage", errAttr(err))
 			}
 		}
 	}
 }
 
-// serializeValue serializes a single Value into a byte slice.
-// Implement this function based on your serialization format.
-func serializeValue(v *Value) ([]byte, error) {
-	// Example using encoding/gob
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(v)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
 // serializeValues serializes multiple Values into a single byte slice.
 // Implement this function based on your serialization format.
 func serializeValues(values []*Value) ([]byte, error) {
@@ -0,0 +1,91 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase(t *testing.T) {
+	db, err := NewDatabase(t.TempDir())
+	require.Nil(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	key := randomID()
+
+	_, ok := db.Get(key, time.Time{})
+	assert.False(t, ok)
+
+	// store multiple values under the same key, ignoring duplicates
+	assert.True(t, db.Set(key, []byte("a"), now, time.Hour))
+	assert.True(t, db.Set(key, []byte("b"), now.Add(time.Second), time.Hour))
+	assert.True(t, db.Set(key, []byte("a"), now, time.Hour))
+
+	// refreshing a value with a new created time should not report it as inserted
+	inserted, ok := db.Insert(key, []byte("a"), now.Add(time.Minute), time.Hour)
+	assert.True(t, ok)
+	assert.False(t, inserted)
+
+	values, ok := db.Get(key, time.Time{})
+	require.True(t, ok)
+	require.Len(t, values, 2)
+	assert.Equal(t, key, values[0].Key)
+	assert.Equal(t, []byte("a"), values[0].Value)
+	assert.Equal(t, []byte("b"), values[1].Value)
+	assert.Equal(t, time.Hour, values[0].TTL)
+
+	values, ok = db.Get(key, now.Add(time.Second))
+	require.True(t, ok)
+	require.Len(t, values, 1)
+	assert.Equal(t, []byte("b"), values[0].Value)
+
+	// values should be held in the order they were created
+	assert.True(t, db.Set(key, []byte("c"), now.Add(-time.Second), time.Hour))
+
+	values, ok = db.Get(key, time.Time{})
+	require.True(t, ok)
+	require.Len(t, values, 3)
+	assert.Equal(t, []byte("c"), values[0].Value)
+	assert.Equal(t, []byte("a"), values[1].Value)
+	assert.Equal(t, []byte("b"), values[2].Value)
+
+	other := randomID()
+	assert.True(t, db.Set(other, []byte("c"), now, time.Hour))
+
+	var count int
+
+	db.Iterate(func(v *Value) bool {
+		count++
+		return true
+	})
+
+	assert.Equal(t, 4, count)
+
+	assert.True(t, db.Delete(key))
+	assert.False(t, db.Delete(key))
+
+	_, ok = db.Get(key, time.Time{})
+	assert.False(t, ok)
+
+	_, ok = db.Get(other, time.Time{})
+	assert.True(t, ok)
+}
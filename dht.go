@@ -21,20 +21,19 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
+	"hash/maphash"
+	"log/slog"
 	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/tos-network/emo/protocol"
 	"golang.org/x/crypto/sha3"
 	"golang.org/x/exp/rand"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/sys/unix"
 )
 
 // DHT represents the distributed hash table
@@ -43,28 +42,51 @@ type DHT struct {
 	config *Config
 	// storage for values that saved to this node
 	storage Storage
+	// storage for provider records announced to this node
+	providers *providerStore
+	// subscriptions to keys
+	pubsub *pubsub
 	// routing table that stores routing information about the network
 	routing *routingTable
 	// cache that tracks requests sent to other nodes
 	cache *cache
 	// manages fragmented packets that are larger than MTU
 	packet *packetManager
+	// rate limits inbound requests and bans misbehaving peers
+	limiter *limiter
+	// tracks what other nodes can see of us through any nat we are behind
+	nat *natTracker
 	// udp listeners that are handling requests to/from other nodes
 	listeners []*listener
 	// latency router for finding the best routes
 	latencyRouter *latencyRouter
+	// sends events over the fallback transport instead of udp when needed
+	fallback *fallbackRouter
+	// logger with the id of this node attached
+	logger *slog.Logger
 	// pool of flatbuffer builder bufs to use when sending requests
 	pool sync.Pool
 	// the current listener to use when sending data
 	cl int32
+	// the number of expired values last reported by the storage
+	expired uint64
+	// the id of the last lookup that was traced
+	lookups uint64
 	// wait group for the dht
 	wg sync.WaitGroup
 	// for shutting down the dht
 	quit chan struct{}
+	// closed once the dht's background tasks have stopped and its storage has been closed
+	stopped chan struct{}
+	// the errors from closing the dht's listeners and storage
+	closeErr error
 	// for shutting down the dht
 	closeOnce sync.Once
 }
 
+// DefaultShutdownTimeout the amount of time Close waits for the dht's background tasks to stop
+const DefaultShutdownTimeout = time.Second * 10
+
 // New creates a new dht
 func New(cfg *Config) (*DHT, error) {
 	if cfg.LocalID == nil {
@@ -85,6 +107,10 @@ func New(cfg *Config) (*DHT, error) {
 		cfg.SocketBufferSize = 32 * 1024 * 1024
 	}
 
+	if cfg.Network == nil {
+		cfg.Network = &udpNetwork{bufferSize: cfg.SocketBufferSize}
+	}
+
 	if cfg.SocketBatchSize < 1 {
 		cfg.SocketBatchSize = 1024
 	}
@@ -93,6 +119,43 @@ func New(cfg *Config) (*DHT, error) {
 		cfg.SocketBatchInterval = time.Millisecond
 	}
 
+	if cfg.BanThreshold <= 0 {
+		cfg.BanThreshold = DefaultBanThreshold
+	}
+
+	if cfg.BanDuration < 1 {
+		cfg.BanDuration = DefaultBanDuration
+	}
+
+	if cfg.ProviderTTL < 1 {
+		cfg.ProviderTTL = DefaultProviderTTL
+	}
+
+	if cfg.SubscriptionLease < 1 {
+		cfg.SubscriptionLease = DefaultSubscriptionLease
+	}
+
+	if cfg.Metrics == nil {
+		cfg.Metrics = noopMetrics{}
+	}
+
+	if cfg.MetricsInterval < 1 {
+		cfg.MetricsInterval = DefaultMetricsInterval
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+
+	if cfg.FallbackThreshold < 1 {
+		cfg.FallbackThreshold = DefaultFallbackThreshold
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+
 	if cfg.Storage == nil {
 		storage, err := InitializeStorage(cfg)
 		if err != nil {
@@ -101,11 +164,6 @@ func New(cfg *Config) (*DHT, error) {
 		cfg.Storage = storage
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", cfg.ListenAddress)
-	if err != nil {
-		return nil, err
-	}
-
 	n := &node{
 		id:        cfg.LocalID,
 		address:   addr,
@@ -114,13 +172,21 @@ func New(cfg *Config) (*DHT, error) {
 		testMode:  false,
 	}
 
+	logger := configLogger(cfg).With(hexAttr(logNode, cfg.LocalID))
+
 	d := &DHT{
-		config:  cfg,
-		routing: newRoutingTable(n),
-		cache:   newCache(cfg.Timeout),
-		storage: cfg.Storage,
-		packet:  newPacketManager(),
-		quit:    make(chan struct{}),
+		config:    cfg,
+		routing:   newRoutingTable(n, cfg.Clock),
+		cache:     newCache(cfg.Timeout, cfg.Metrics, cfg.Clock),
+		storage:   cfg.Storage,
+		providers: newProviderStore(cfg.Clock),
+		pubsub:    newPubSub(logger, cfg.Clock),
+		packet:    newPacketManager(cfg.Metrics, cfg.Clock),
+		limiter:   newLimiter(cfg.RateLimits, cfg.BanThreshold, cfg.BanDuration, cfg.Clock),
+		nat:       newNATTracker(cfg.Clock),
+		logger:    logger,
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
 		pool: sync.Pool{
 			New: func() any {
 				return flatbuffers.NewBuilder(1024)
@@ -129,14 +195,22 @@ func New(cfg *Config) (*DHT, error) {
 	}
 	d.latencyRouter = NewLatencyRouter(d)
 
+	if cfg.Fallback != nil {
+		d.fallback = newFallbackRouter(cfg.Fallback, cfg.FallbackThreshold, cfg.Clock)
+	}
+
 	// start the udp listeners
 	err = d.listen()
 	if err != nil {
+		d.Close()
 		return nil, err
 	}
 
-	// add the local node to our own routing table
-	d.routing.insert(n.id, addr, 0, false)
+	// add the local node to our own routing table, unless we are
+	// a client that doesn't store values for other nodes
+	if !cfg.ClientMode {
+		d.routing.insert(n.id, addr, 0, false)
+	}
 
 	br := make(chan error, len(cfg.BootstrapAddresses))
 	bn := make([]*node, len(cfg.BootstrapAddresses))
@@ -144,6 +218,7 @@ func New(cfg *Config) (*DHT, error) {
 	for i := range cfg.BootstrapAddresses {
 		addr, err := net.ResolveUDPAddr("udp", cfg.BootstrapAddresses[i])
 		if err != nil {
+			d.Close()
 			return nil, err
 		}
 
@@ -152,7 +227,12 @@ func New(cfg *Config) (*DHT, error) {
 
 	// TODO : this should be a recursive lookup, use journey
 	d.findNodes(bn, cfg.LocalID, func(err error) {
-		br <- err
+		// the callback can be invoked more times than there are bootstrap
+		// nodes as the lookup continues, so don't block once we've stopped waiting
+		select {
+		case br <- err:
+		default:
+		}
 	})
 
 	var successes int
@@ -160,13 +240,14 @@ func New(cfg *Config) (*DHT, error) {
 	for range cfg.BootstrapAddresses {
 		err := <-br
 		if err != nil {
-			log.Printf("bootstrap failed: %s\n", err.Error())
+			d.logger.Warn("bootstrap failed", errAttr(err))
 			continue
 		}
 		successes++
 	}
 
 	if successes < 1 && len(cfg.BootstrapAddresses) > 1 {
+		d.Close()
 		return nil, errors.New("bootstrapping failed")
 	}
 
@@ -177,77 +258,115 @@ func New(cfg *Config) (*DHT, error) {
 		d.refreshPeers()
 	}()
 
-	// Add WaitGroup for refreshKeys goroutine
-	d.wg.Add(1)
-	go func() {
-		defer d.wg.Done()
-		d.refreshKeys()
-	}()
+	// clients don't hold values for other nodes or need to be reachable by them
+	if !cfg.ClientMode {
+		// Add WaitGroup for refreshKeys goroutine
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.refreshKeys()
+		}()
+
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.checkReachability()
+		}()
+	}
 
 	return d, nil
 }
 
+// creates a listener that sends events over the given udp transport, or the fallback transport
+func (d *DHT) newListener(udp *udpTransport) *listener {
+	return &listener{
+		udp:        udp,
+		fallback:   d.fallback,
+		routing:    d.routing,
+		cache:      d.cache,
+		storage:    d.storage,
+		providers:  d.providers,
+		pubsub:     d.pubsub,
+		limiter:    d.limiter,
+		nat:        d.nat,
+		clientMode: d.config.ClientMode,
+		network:    d.config.NetworkID,
+		metrics:    d.config.Metrics,
+		buffer:     flatbuffers.NewBuilder(65527),
+		localID:    d.config.LocalID,
+		timeout:    d.config.Timeout,
+		clock:      d.config.Clock,
+		logger:     d.logger,
+	}
+}
+
 func (d *DHT) listen() error {
 	for i := 0; i < d.config.Listeners; i++ {
-		cfg := net.ListenConfig{
-			Control: control,
-		}
+		// start one of several listeners, each with its own udp socket
+		l := d.newListener(newUDPTransport(
+			d.config.Network,
+			d.packet,
+			d.limiter,
+			d.config.Metrics,
+			d.logger,
+			d.config.SocketBatchSize,
+			d.config.SocketBatchInterval,
+		))
 
-		// start one of several listeners
-		c, err := cfg.ListenPacket(context.Background(), "udp", d.config.ListenAddress)
-		if err != nil {
-			return err
-		}
+		d.listeners = append(d.listeners, l)
 
-		err = c.(*net.UDPConn).SetReadBuffer(d.config.SocketBufferSize)
+		err := l.udp.Listen(d.config.ListenAddress, l.handle)
 		if err != nil {
 			return err
 		}
+	}
 
-		err = c.(*net.UDPConn).SetWriteBuffer(d.config.SocketBufferSize)
-		if err != nil {
-			return err
-		}
+	if d.config.Fallback != nil {
+		// events received over the fallback transport are handled by a listener of their
+		// own, which shares the udp socket of the first listener
+		l := d.newListener(d.listeners[0].udp)
 
-		l := &listener{
-			conn:       ipv4.NewPacketConn(c),
-			routing:    d.routing,
-			cache:      d.cache,
-			storage:    d.storage,
-			packet:     d.packet,
-			buffer:     flatbuffers.NewBuilder(65527),
-			localID:    d.config.LocalID,
-			timeout:    d.config.Timeout,
-			logging:    d.config.Logging,
-			bufferSize: d.config.SocketBufferSize,
-			writeBatch: make([]ipv4.Message, d.config.SocketBatchSize),
-			readBatch:  make([]ipv4.Message, d.config.SocketBatchSize),
-			ftimer:     time.NewTicker(d.config.SocketBatchInterval),
-			quit:       make(chan struct{}),
-		}
+		var mu sync.Mutex
 
-		for i := range l.writeBatch {
-			l.readBatch[i].Buffers = [][]byte{make([]byte, 1500)}
-			l.writeBatch[i].Buffers = [][]byte{make([]byte, 1500)}
-		}
+		err := d.config.Fallback.Listen(d.config.ListenAddress, func(from *net.UDPAddr, data []byte) {
+			if d.limiter.banned(from) {
+				return
+			}
 
-		d.wg.Add(2)
-		go func() {
-			defer d.wg.Done()
-			l.flusher()
-		}()
-		go func() {
-			defer d.wg.Done()
-			l.process()
-		}()
+			// the node would have sent a small event over udp if it could reach us,
+			// so it may not be able to receive anything we send to it over udp either
+			if len(data) <= d.config.FallbackThreshold {
+				d.fallback.prefer(from)
+			}
 
-		d.listeners = append(d.listeners, l)
+			// the listener's buffer can only be used by one event at a time
+			mu.Lock()
+			defer mu.Unlock()
+
+			l.handle(from, data)
+		})
+
+		if err != nil {
+			return err
+		}
 	}
 
 	d.wg.Add(1)
 	// monitor the routing table for stale nodes
 	go d.monitor()
 
+	d.wg.Add(1)
+	// request any fragments of incomplete packets that have been lost
+	go d.recoverFragments()
+
+	d.wg.Add(1)
+	// renew the leases of our subscriptions before they expire
+	go d.renewSubscriptions()
+
+	d.wg.Add(1)
+	// sample the size of the routing table, storage and caches
+	go d.reportMetrics()
+
 	return nil
 }
 
@@ -265,7 +384,7 @@ func (d *DHT) Store(key, value []byte, ttl time.Duration, callback func(err erro
 	}
 
 	// TODO  use NTP time for this?
-	created := time.Now()
+	created := d.config.Clock.Now()
 
 	v := []*Value{
 		{
@@ -295,7 +414,16 @@ func (d *DHT) Store(key, value []byte, ttl time.Duration, callback func(err erro
 	for _, n := range ns {
 		// shortcut the request if its to the local node
 		if bytes.Equal(n.id, d.config.LocalID) {
-			d.storage.Set(key, value, created, ttl)
+			inserted, ok := insertValue(d.storage, key, value, created, ttl)
+			if !ok {
+				callback(fmt.Errorf("failed to store value: %w", ErrStorageFailure))
+				return
+			}
+
+			// values that are being refreshed are already held, so subscribers aren't notified again
+			if inserted {
+				d.pubsub.publish(buf, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, key, v, d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].write)
+			}
 
 			if len(ns) == 1 {
 				// we're the only node, so call the callback immediately
@@ -308,7 +436,7 @@ func (d *DHT) Store(key, value []byte, ttl time.Duration, callback func(err erro
 
 		// generate a new random request ID and event
 		rid := pseudorandomID()
-		req := eventStoreRequest(buf, rid, d.config.LocalID, v)
+		req := eventStoreRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, v)
 
 		// select the next listener to send our request
 		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
@@ -342,109 +470,337 @@ func (d *DHT) Store(key, value []byte, ttl time.Duration, callback func(err erro
 	}
 }
 
-// Close shuts down the dht
+// Close shuts down the dht, waiting up to DefaultShutdownTimeout for it to stop
 func (d *DHT) Close() error {
-	var closeErr error
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+
+	return d.Shutdown(ctx)
+}
 
+// Shutdown closes the dht's listeners, stops its background tasks and closes its storage,
+// waiting for them to finish until the context is done. The errors from closing the
+// listeners and storage are returned once everything has stopped
+func (d *DHT) Shutdown(ctx context.Context) error {
 	d.closeOnce.Do(func() {
 		// Signal all goroutines to stop
 		close(d.quit)
 
-		// Close all listeners first
-		for _, l := range d.listeners {
-			l.Close()
+		go func() {
+			var errs []error
+
+			// Close all listeners first
+			for _, l := range d.listeners {
+				err := l.udp.Close()
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
 
-			// Close the underlying connection
-			if err := l.conn.Close(); err != nil {
-				//log.Printf("Error closing listener: %v", err)
-				closeErr = nil
+			if d.config.Fallback != nil {
+				err := d.config.Fallback.Close()
+				if err != nil {
+					errs = append(errs, err)
+				}
 			}
 
-		}
+			// Wait for all goroutines to finish
+			d.wg.Wait()
+
+			d.cache.close()
+			d.packet.close()
+			d.providers.close()
+			d.pubsub.close()
+			d.limiter.close()
+			d.nat.close()
+			d.fallback.close()
 
-		if d.storage != nil {
+			// close the storage once nothing is using it
 			if closer, ok := d.storage.(interface{ Close() error }); ok {
-				if err := closer.Close(); err != nil {
-					closeErr = err
+				err := closer.Close()
+				if err != nil {
+					errs = append(errs, err)
 				}
 			}
-		}
-		// Wait for all goroutines to finish
-		d.wg.Wait()
+
+			d.closeErr = errors.Join(errs...)
+			close(d.stopped)
+		}()
 	})
-	return closeErr
+
+	select {
+	case <-d.stopped:
+		return d.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for the dht to stop: %w", ctx.Err())
+	}
+}
+
+// LimiterStats returns counters describing the inbound requests that have been rate limited or rejected
+func (d *DHT) LimiterStats() LimiterStats {
+	return d.limiter.stats()
 }
 
 // Find finds a value on the network if it exists. If the key being queried has multiple values, the callback will be invoked for each result
 // Any returned value will not be safe to use outside of the callback, so you should copy it if its needed elsewhere
-func (d *DHT) Find(key []byte, callback func(value []byte, err error), opts ...*FindOption) {
+func (d *DHT) Find(key []byte, callback func(value []byte, err error), opts ...FindOption) {
+	q := &findQuery{
+		key:           key,
+		callback:      callback,
+		confirmations: make(map[uint64]map[string]struct{}),
+	}
+
+	q.hasher.SetSeed(maphash.MakeSeed())
+
+	for _, opt := range opts {
+		opt(&q.findOptions)
+	}
+
 	if len(key) != KEY_BYTES {
-		callback(nil, errors.New("key must be 20 bytes in length"))
+		q.fail(errors.New("key must be 20 bytes in length"))
 		return
 	}
 
-	var from time.Time
-
-	// TODO do this properly...
-	if len(opts) > 0 {
-		from = opts[0].from
+	err := q.validate()
+	if err != nil {
+		q.fail(err)
+		return
 	}
 
-	// we should check our own cache first before sending a request
-	vs, ok := d.storage.Get(key, from)
-	if ok {
-		for i := range vs {
-			callback(vs[i].Value, nil)
+	// we should check our own storage first before sending a request
+	if !q.skipLocal {
+		vs, ok := d.storage.Get(key, q.from)
+		if ok {
+			vs = valuesUntil(vs, q.until)
+		}
+
+		// values we hold count as a single replica
+		for _, v := range sortValues(vs) {
+			if !q.add(d.config.LocalID, v.Value) {
+				break
+			}
+		}
+
+		// only query the network if we need more replicas of the values we hold
+		if q.localOnly || (len(vs) > 0 && q.replicas <= 1) {
+			q.fail(errors.New("value not found"))
+			return
 		}
-		return
 	}
 
 	// a correct implementation should send mutiple requests concurrently,
 	// but here we're only send a request to the closest node
 	ns := d.routing.closestN(key, K)
 	if len(ns) == 0 {
-		callback(nil, errors.New("no nodes found"))
+		q.fail(errors.New("no nodes found"))
 		return
 	}
 
 	// K iterations to find the key we want
-	j := newJourney(d.config.LocalID, key, K)
-	j.add(ns)
+	q.journey = newJourney(d.config.LocalID, key, K)
+	q.journey.done = q.done
+	q.journey.add(ns)
 
-	// try lookup to best 3 nodes
-	for _, n := range j.next(3) {
-		// get a spare buffer to generate our requests with
-		buf := d.pool.Get().(*flatbuffers.Builder)
-		defer d.pool.Put(buf)
+	d.trace(q.journey, FindValueLookup, key, q.tracer)
 
-		// generate a new random request ID
-		rid := pseudorandomID()
-		req := eventFindValueRequest(buf, rid, d.config.LocalID, key, from)
+	// try lookup to best 3 nodes
+	routes := q.journey.next(3)
+	if len(routes) == 0 {
+		// the only node we know of is this node
+		if q.journey.finish(true) {
+			q.fail(errors.New("no nodes found"))
+		}
+		return
+	}
 
-		// select the next listener to send our request
-		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
-			n.address,
-			rid,
-			req,
-			d.findValueCallback(n.id, key, from, callback, j),
-		)
+	if q.timeout > 0 {
+		d.config.Clock.AfterFunc(q.timeout, func() {
+			// stop the query, ignoring any responses we receive after this point
+			if q.journey.finish(true) {
+				q.fail(ErrRequestTimeout)
+			}
+		})
+	}
 
+	for _, n := range routes {
+		err := d.findValueRequest(n, q, nil, 0)
 		if err != nil {
 			// if we fail to write to the socket, send the error to the callback immediately
-			callback(nil, err)
+			if q.journey.finish(true) {
+				q.fail(err)
+			}
 			return
 		}
 	}
 }
 
+// tracks the state of a find request
+type findQuery struct {
+	findOptions
+	key []byte
+	// the number of values returned to the user
+	delivered int32
+	// the nodes that have returned each value we have seen
+	confirmations map[uint64]map[string]struct{}
+	hasher        maphash.Hash
+	callback      func(value []byte, err error)
+	journey       *journey
+	mu            sync.Mutex
+}
+
+// records that a node has returned a value, delivering it to the user once it has been returned
+// by the required number of nodes. returns false if the query's limit has been reached
+func (q *findQuery) add(sender, value []byte) bool {
+	q.mu.Lock()
+
+	q.hasher.Reset()
+	q.hasher.Write(value)
+	vh := q.hasher.Sum64()
+
+	c, ok := q.confirmations[vh]
+	if !ok {
+		c = make(map[string]struct{})
+		q.confirmations[vh] = c
+	}
+
+	_, ok = c[string(sender)]
+	if ok {
+		q.mu.Unlock()
+		return true
+	}
+
+	c[string(sender)] = struct{}{}
+
+	confirmed := len(c) == max(q.replicas, 1)
+
+	q.mu.Unlock()
+
+	if !confirmed {
+		return true
+	}
+
+	return q.deliver(value)
+}
+
+// returns true if we have seen values that have not yet been returned by the required number of nodes
+func (q *findQuery) pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.confirmations {
+		if len(c) < q.replicas {
+			return true
+		}
+	}
+
+	return false
+}
+
+// delivers a value to the user, returning false if the query's limit has been reached
+func (q *findQuery) deliver(value []byte) bool {
+	c := atomic.AddInt32(&q.delivered, 1)
+	if q.limit > 0 && int(c) > q.limit {
+		return false
+	}
+
+	q.callback(value, nil)
+
+	return q.limit < 1 || int(c) < q.limit
+}
+
+// the number of values we still want per request, or 0 if there is no limit
+func (q *findQuery) remaining() int {
+	if q.limit < 1 {
+		return 0
+	}
+
+	return max(q.limit-int(atomic.LoadInt32(&q.delivered)), 1)
+}
+
+// returns an error to the user if no values have been returned
+func (q *findQuery) fail(err error) {
+	if atomic.LoadInt32(&q.delivered) > 0 {
+		err = nil
+	}
+
+	if q.journey != nil {
+		q.journey.end(err)
+	} else if q.done != nil {
+		// the query completed without querying the network
+		q.done(err)
+	}
+
+	if err != nil {
+		q.callback(nil, err)
+	}
+}
+
+// returns an error to the user when the query has run out of nodes to ask
+func (q *findQuery) exhausted() {
+	if q.pending() {
+		q.fail(ErrInsufficientReplicas)
+		return
+	}
+
+	q.fail(errors.New("value not found"))
+}
+
+// sends a find value request to a node, optionally requesting the page of values after the cursor.
+// page is the number of pages that have already been requested from the node
+func (d *DHT) findValueRequest(n *node, q *findQuery, cursor []byte, page int) error {
+	// get a spare buffer to generate our requests with
+	buf := d.pool.Get().(*flatbuffers.Builder)
+	defer d.pool.Put(buf)
+
+	// generate a new random request ID
+	rid := pseudorandomID()
+	req := eventFindValueRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, q.key, q.from, q.until, q.remaining(), cursor)
+
+	tq := q.journey.sent(n)
+
+	// select the next listener to send our request
+	return d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+		n.address,
+		rid,
+		req,
+		d.findValueCallback(n, q, tq, cursor, page),
+	)
+}
+
+// sends requests to the next best nodes in the query's journey, finishing the query if there are none left
+func (d *DHT) findValueNext(q *findQuery) {
+	ns := q.journey.next(3)
+	if ns == nil {
+		if q.journey.finish(false) {
+			q.exhausted()
+		}
+		return
+	}
+
+	for _, n := range ns {
+		err := d.findValueRequest(n, q, nil, 0)
+		if err != nil {
+			// if we fail to write to the socket, send the error to the callback immediately
+			if q.journey.finish(false) {
+				q.fail(err)
+				return
+			}
+		}
+	}
+}
+
 // TODO : this is all pretty garbage, refactor!
 // return the callback used to handle responses to our findValue requests, tracking the number of requests we have made
-func (d *DHT) findValueCallback(id, key []byte, from time.Time, callback func(value []byte, err error), j *journey) func(event *protocol.Event, err error) bool {
+func (d *DHT) findValueCallback(n *node, q *findQuery, tq *Query, cursor []byte, page int) func(event *protocol.Event, err error) bool {
+	j := q.journey
+
 	return func(event *protocol.Event, err error) bool {
 		if err != nil {
 			if errors.Is(err, ErrRequestTimeout) {
-				d.routing.remove(id)
+				d.routing.remove(n.id)
 			}
+
+			j.received(tq, 0, 0, err)
 		}
 
 		journeyCompleted, shouldError := j.responseReceived()
@@ -458,26 +814,33 @@ func (d *DHT) findValueCallback(id, key []byte, from time.Time, callback func(va
 		if err != nil {
 			// if there's an actual error, send that to the user
 			if shouldError {
-				callback(nil, err)
+				q.fail(err)
 				return true
 			}
-			return false
+
+			// the node failed to respond to our request, so try the next best nodes
+			d.findValueNext(q)
+
+			return true
 		}
 
 		payloadTable := new(flatbuffers.Table)
 
 		if !event.Payload(payloadTable) {
-			callback(nil, errors.New("invalid response to find value request"))
-			return false
+			q.fail(errors.New("invalid response to find value request"))
+			return true
 		}
 
 		f := new(protocol.FindValue)
 		f.Init(payloadTable.Bytes, payloadTable.Pos)
 
+		j.received(tq, f.ValuesLength(), f.NodesLength(), nil)
+
 		// check if we received the value or if we received a list of closest
 		// neighbours that might have the key
 		if f.ValuesLength() > 0 {
-			// TODO make this better
+			// track the number of values we expect from this node
+			// from the total reported in its first response
 			j.addOutstanding(event.SenderBytes(), int(f.Found()))
 			j.removeOutstanding(event.SenderBytes(), f.ValuesLength())
 
@@ -485,26 +848,60 @@ func (d *DHT) findValueCallback(id, key []byte, from time.Time, callback func(va
 				vd := new(protocol.Value)
 
 				if !f.Values(vd, i) {
-					callback(nil, errors.New("bad find value data"))
-					return false
+					q.fail(errors.New("bad find value data"))
+					return true
+				}
+
+				if !q.add(event.SenderBytes(), vd.ValueBytes()) {
+					// we have returned the maximum number of values
+					if j.finish(true) {
+						j.end(nil)
+					}
+					return true
 				}
+			}
+
+			// if there are more values, request the next page from the same node. the
+			// cursor must advance past the last one, and the number of pages we request
+			// is limited, so a node can't keep the query from completing
+			if f.CursorLength() > 0 && page+1 < maxValuePages && cursorAfter(f.CursorBytes(), cursor) {
+				next := make([]byte, f.CursorLength())
+				copy(next, f.CursorBytes())
+
+				j.requested()
 
-				if !j.seenValue(vd.ValueBytes()) {
-					callback(vd.ValueBytes(), nil)
+				err := d.findValueRequest(n, q, next, page+1)
+				if err != nil && j.finish(true) {
+					q.fail(err)
 				}
+
+				return true
+			}
+
+			// a response without a cursor is the last page the node will send,
+			// and one with a cursor we won't follow is the last page we request
+			j.clearOutstanding(event.SenderBytes())
+
+			// if some values have not been returned by enough nodes, keep asking the next best nodes
+			if q.pending() {
+				d.findValueNext(q)
+				return true
 			}
 
 			// attempt to finish the journey
-			return j.finish(false)
+			if j.finish(false) {
+				j.end(nil)
+			}
+
+			return true
 		} else if f.NodesLength() < 1 {
 			// mark the journey as finished so no more
 			// requests will be made
 			if j.finish(false) {
-				callback(nil, errors.New("value not found"))
-				return true
+				q.exhausted()
 			}
 
-			return false
+			return true
 		}
 
 		// collect the new nodes from the response
@@ -514,66 +911,28 @@ func (d *DHT) findValueCallback(id, key []byte, from time.Time, callback func(va
 			nd := new(protocol.Node)
 
 			if !f.Nodes(nd, i) {
-				callback(nil, errors.New("bad find value node data"))
-				return false
-			}
-
-			nad := &net.UDPAddr{
-				IP:   make(net.IP, 4),
-				Port: int(binary.LittleEndian.Uint16(nd.AddressBytes()[4:])),
+				q.fail(errors.New("bad find value node data"))
+				return true
 			}
 
-			copy(nad.IP, nd.AddressBytes()[:4])
-
+			// the event has been verified, so the node
+			// id and address will be the correct length
 			nid := make([]byte, KEY_BYTES)
 			copy(nid, nd.IdBytes())
 
 			newNodes[i] = &node{
-				id:      id,
-				address: nad,
+				id:      nid,
+				address: decodeAddress(nd.AddressBytes()),
 			}
 		}
 
 		// add them to the journey and then get the next recommended routes to query
 		j.add(newNodes)
 
-		ns := j.next(3)
-		if ns == nil {
-			if j.finish(false) {
-				callback(nil, errors.New("value not found"))
-				return true
-			}
-			return false
-		}
-
-		// the key wasn't found, so send a request to the next node
-		// get a spare buffer to generate our requests with
-		buf := d.pool.Get().(*flatbuffers.Builder)
-		defer d.pool.Put(buf)
-
-		for _, n := range ns {
-			// generate a new random request ID
-			rid := pseudorandomID()
-			req := eventFindValueRequest(buf, rid, d.config.LocalID, key, from)
-
-			// select the next listener to send our request
-			err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
-				n.address,
-				rid,
-				req,
-				d.findValueCallback(n.id, key, from, callback, j),
-			)
-
-			if err != nil {
-				// if we fail to write to the socket, send the error to the callback immediately
-				if j.finish(false) {
-					callback(nil, err)
-					return true
-				}
-			}
-		}
+		// the key wasn't found, so send a request to the next nodes
+		d.findValueNext(q)
 
-		return false
+		return true
 	}
 }
 
@@ -582,6 +941,8 @@ func (d *DHT) findNodes(ns []*node, target []byte, callback func(err error)) {
 	// node as we don't know it's id yet
 	j := newJourney(d.config.LocalID, target, K)
 
+	d.trace(j, FindNodeLookup, target, nil)
+
 	// get a spare buffer to generate our requests with
 	buf := d.pool.Get().(*flatbuffers.Builder)
 	defer d.pool.Put(buf)
@@ -589,60 +950,69 @@ func (d *DHT) findNodes(ns []*node, target []byte, callback func(err error)) {
 	for _, n := range ns {
 		// generate a new random request ID and event
 		rid := pseudorandomID()
-		req := eventFindNodeRequest(buf, rid, d.config.LocalID, target)
+		req := eventFindNodeRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, target)
 
 		// select the next listener to send our request
 		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
 			n.address,
 			rid,
 			req,
-			d.findNodeCallback(target, callback, j),
+			d.findNodeCallback(target, callback, j, j.sent(n)),
 		)
 
 		if err != nil {
 			// if we fail to write to the socket, send the error to the callback immediately
+			j.end(err)
 			callback(err)
 			return
 		}
 	}
 }
 
-func (d *DHT) findNodeCallback(target []byte, callback func(err error), j *journey) func(*protocol.Event, error) bool {
+func (d *DHT) findNodeCallback(target []byte, callback func(err error), j *journey, tq *Query) func(*protocol.Event, error) bool {
 	return func(event *protocol.Event, err error) bool {
 		_, shouldError := j.responseReceived()
 
 		// journey is completed, ignore this response
 		if err != nil {
+			j.received(tq, 0, 0, err)
+
 			// if there's an actual error, send that to the user
 			if shouldError {
+				j.end(err)
 				callback(err)
 				return true
 			}
+
+			// the node failed to respond to our request, so try the next best nodes
+			d.findNodesNext(target, callback, j)
+
 			return false
 		}
 
 		payloadTable := new(flatbuffers.Table)
 
 		if !event.Payload(payloadTable) {
-			callback(errors.New("invalid response to find node request"))
+			err := errors.New("invalid response to find node request")
+			j.end(err)
+			callback(err)
 			return false
 		}
 
 		f := new(protocol.FindNode)
 		f.Init(payloadTable.Bytes, payloadTable.Pos)
 
+		j.received(tq, 0, f.NodesLength(), nil)
+
 		newNodes := make([]*node, f.NodesLength())
 
 		for i := 0; i < f.NodesLength(); i++ {
 			fn := new(protocol.Node)
 
 			if f.Nodes(fn, i) {
-				nad := &net.UDPAddr{
-					IP:   make(net.IP, 4),
-					Port: int(binary.LittleEndian.Uint16(fn.AddressBytes()[4:])),
-				}
-
-				copy(nad.IP, fn.AddressBytes()[:4])
+				// the event has been verified, so the node
+				// id and address will be the correct length
+				nad := decodeAddress(fn.AddressBytes())
 
 				// create a copy of the node id
 				nid := make([]byte, fn.IdLength())
@@ -659,47 +1029,55 @@ func (d *DHT) findNodeCallback(target []byte, callback func(err error), j *journ
 
 		j.add(newNodes)
 
-		ns := j.next(3)
-		if ns == nil {
-			// we've completed our search of nodes
-			if j.finish(false) {
-				callback(nil)
-				return true
-			}
-			return false
+		return d.findNodesNext(target, callback, j)
+	}
+}
+
+// sends requests to the next best nodes in the journey, returning true if there are
+// none left and the search has been completed
+func (d *DHT) findNodesNext(target []byte, callback func(err error), j *journey) bool {
+	ns := j.next(3)
+	if ns == nil {
+		// we've completed our search of nodes
+		if j.finish(false) {
+			j.end(nil)
+			callback(nil)
+			return true
 		}
+		return false
+	}
 
-		buf := d.pool.Get().(*flatbuffers.Builder)
-		defer d.pool.Put(buf)
+	buf := d.pool.Get().(*flatbuffers.Builder)
+	defer d.pool.Put(buf)
 
-		for _, n := range ns {
-			// generate a new random request ID and event
-			rid := pseudorandomID()
-			req := eventFindNodeRequest(buf, rid, d.config.LocalID, target)
+	for _, n := range ns {
+		// generate a new random request ID and event
+		rid := pseudorandomID()
+		req := eventFindNodeRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, target)
 
-			// select the next listener to send our request
-			err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
-				n.address,
-				rid,
-				req,
-				d.findNodeCallback(target, callback, j),
-			)
+		// select the next listener to send our request
+		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+			n.address,
+			rid,
+			req,
+			d.findNodeCallback(target, callback, j, j.sent(n)),
+		)
 
-			if err != nil {
-				// if we fail to write to the socket, send the error to the callback immediately
-				callback(err)
-				return false
-			}
+		if err != nil {
+			// if we fail to write to the socket, send the error to the callback immediately
+			j.end(err)
+			callback(err)
+			return false
 		}
-
-		return false
 	}
+
+	return false
 }
 
 // monitors peers on the network and sends them ping requests
 func (d *DHT) monitor() {
 	defer d.wg.Done()
-	ticker := time.NewTicker(time.Hour / 2)
+	ticker := d.config.Clock.NewTicker(time.Hour / 2)
 	defer ticker.Stop()
 
 	for {
@@ -707,9 +1085,9 @@ func (d *DHT) monitor() {
 		case <-d.quit:
 			// Shutdown signal received, exit the loop
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			// Existing monitoring logic
-			now := time.Now()
+			now := d.config.Clock.Now()
 
 			var nodes []*node
 
@@ -728,7 +1106,7 @@ func (d *DHT) monitor() {
 			for _, n := range nodes {
 				// Send a ping to each node to check if it's still alive
 				rid := pseudorandomID()
-				req := eventPing(buf, rid, d.config.LocalID)
+				req := eventPing(buf, rid, d.config.LocalID, d.nat.client(), d.config.ClientMode, d.config.NetworkID)
 
 				err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
 					n.address,
@@ -739,7 +1117,7 @@ func (d *DHT) monitor() {
 							if errors.Is(err, ErrRequestTimeout) {
 								d.routing.remove(n.id)
 							} else {
-								log.Println(err)
+								d.logger.Warn("failed to ping node", addrAttr(n.address), hexAttr(logPeerID, n.id), errAttr(err))
 							}
 						} else {
 							d.routing.seen(n.id)
@@ -784,27 +1162,30 @@ func Key(k any) []byte {
 	return h[:]
 }
 
-// "borrow" this from github.com/libp2p/go-reuseport as we don't care about other operating systems right now :)
-func control(network, address string, c syscall.RawConn) error {
-	var err error
-
-	c.Control(func(fd uintptr) {
-		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-		if err != nil {
-			return
-		}
+// periodically asks the senders of incomplete packets
+// to retransmit any of the fragments we are missing
+func (d *DHT) recoverFragments() {
+	defer d.wg.Done()
+	ticker := d.config.Clock.NewTicker(nackDelay / 2)
+	defer ticker.Stop()
 
-		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-		if err != nil {
+	for {
+		select {
+		case <-d.quit:
 			return
+		case now := <-ticker.C():
+			for _, n := range d.packet.nacks(now) {
+				err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].udp.writeFrames(n.to, [][]byte{n.data})
+				if err != nil && !errors.Is(err, net.ErrClosed) {
+					d.logger.Warn("failed to request missing fragments", addrAttr(n.to), errAttr(err))
+				}
+			}
 		}
-	})
-
-	return err
+	}
 }
 
 func (d *DHT) refreshPeers() {
-	ticker := time.NewTicker(time.Hour)
+	ticker := d.config.Clock.NewTicker(time.Hour)
 	defer ticker.Stop()
 
 	for {
@@ -812,7 +1193,7 @@ func (d *DHT) refreshPeers() {
 		case <-d.quit:
 			// Shutdown signal received, exit the loop
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			// Perform the peer refresh
 			d.refreshBuckets()
 		}
@@ -833,7 +1214,7 @@ func (d *DHT) pingNode(n *node) bool {
 	buf := d.pool.Get().(*flatbuffers.Builder)
 	defer d.pool.Put(buf)
 
-	req := eventPing(buf, rid, d.config.LocalID)
+	req := eventPing(buf, rid, d.config.LocalID, d.nat.client(), d.config.ClientMode, d.config.NetworkID)
 
 	err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
 		n.address,
@@ -857,7 +1238,9 @@ func (d *DHT) pingNode(n *node) bool {
 	select {
 	case res := <-response:
 		return res
-	case <-time.After(d.config.Timeout):
+	case <-d.config.Clock.After(d.config.Timeout):
+		return false
+	case <-d.quit:
 		return false
 	}
 }
@@ -917,34 +1300,32 @@ func (d *DHT) lookup(targetID []byte) []*node {
 }
 
 func (d *DHT) refreshKeys() {
-	ticker := time.NewTicker(time.Hour / 2) // Refresh every 30 minutes
+	ticker := d.config.Clock.NewTicker(time.Hour / 2) // Refresh every 30 minutes
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-d.quit:
 			return
-		case <-ticker.C:
-			// Get all stored keys
-			var keys [][]byte
+		case <-ticker.C():
+			now := d.config.Clock.Now()
+
+			// Get all stored values
+			var values []*Value
 			d.storage.Iterate(func(value *Value) bool {
-				keys = append(keys, value.Key)
+				values = append(values, value)
 				return true
 			})
 
-			// Refresh each key
-			for _, key := range keys {
-				value, exists := d.storage.Get(key, time.Now())
-				if !exists || len(value) == 0 {
-					continue
-				}
-
+			// Refresh each value
+			for _, value := range values {
 				// Re-store the value with the remaining TTL
-				remainingTTL := time.Until(value[0].expires)
+				remainingTTL := value.expiry().Sub(now)
 				if remainingTTL > 0 {
-					d.Store(key, value[0].Value, remainingTTL, func(err error) {
+					key := value.Key
+					d.Store(key, value.Value, remainingTTL, func(err error) {
 						if err != nil {
-							log.Printf("Failed to refresh key %x: %v", key, err)
+							d.logger.Warn("failed to refresh key", hexAttr(logKey, key), errAttr(err))
 						}
 					})
 				}
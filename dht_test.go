@@ -18,18 +18,24 @@ package emo
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/maphash"
+	"log/slog"
+	"math"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tos-network/emo/protocol"
 )
 
 var (
@@ -465,6 +471,188 @@ func TestDHTClusterStoreFindMultiple(t *testing.T) {
 	}
 }
 
+// storage that never stores any values, used to force
+// a node to query the network for all of its values
+type noopStorage struct{}
+
+func (s *noopStorage) Get(k []byte, from time.Time) ([]*Value, bool) { return nil, false }
+
+func (s *noopStorage) Set(k, v []byte, created time.Time, ttl time.Duration) bool { return true }
+
+func (s *noopStorage) Iterate(cb func(value *Value) bool) {}
+
+func TestDHTClusterStoreFindPaginated(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+		Storage:   &noopStorage{},
+	}
+
+	qdht, err := New(c)
+	require.Nil(t, err)
+	defer qdht.Close()
+
+	ch := make(chan error, 1)
+
+	// store more values than will fit into a single event
+	key := randomID()
+	values := make(map[string]struct{})
+
+	for i := 0; i < 300; i++ {
+		value := make([]byte, 1024)
+		rand.Read(value)
+
+		values[string(value)] = struct{}{}
+
+		bdht.Store(key, value, time.Hour, func(err error) {
+			ch <- err
+		})
+
+		require.Nil(t, <-ch)
+	}
+
+	type resp struct {
+		data []byte
+		err  error
+	}
+
+	ch2 := make(chan resp, 1000)
+
+	qdht.Find(key, func(v []byte, err error) {
+		ch2 <- resp{data: append([]byte(nil), v...), err: err}
+	})
+
+	// every value should be returned exactly once
+	for i := 0; i < 300; i++ {
+		select {
+		case r := <-ch2:
+			require.Nil(t, r.err)
+
+			_, ok := values[string(r.data)]
+			require.True(t, ok)
+
+			delete(values, string(r.data))
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for values")
+		}
+	}
+
+	assert.Empty(t, values)
+
+	// the number of results should be limited
+	var received int32
+
+	qdht.Find(key, func(v []byte, err error) {
+		atomic.AddInt32(&received, 1)
+	}, MaxResults(50))
+
+	time.Sleep(time.Millisecond * 500)
+
+	assert.Equal(t, int32(50), atomic.LoadInt32(&received))
+}
+
+func TestDHTFindUnboundedCursor(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 1)
+
+	// a node that returns the same value with a cursor for every request
+	id := randomID()
+	addr := &net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 9000}
+	key := randomID()
+	value := &Value{Key: key, Value: randomID(), Created: time.Now()}
+
+	packet := newPacketManager(noopMetrics{}, systemClock{})
+	defer packet.close()
+
+	limiter := newLimiter(nil, DefaultBanThreshold, DefaultBanDuration, systemClock{})
+	defer limiter.close()
+
+	udp := newUDPTransport(network, packet, limiter, noopMetrics{}, slog.Default(), 16, time.Millisecond*10)
+	defer udp.Close()
+
+	var requests atomic.Int32
+	var advance atomic.Bool
+
+	buf := flatbuffers.NewBuilder(1024)
+
+	err := udp.Listen(addr.String(), func(from *net.UDPAddr, data []byte) {
+		e := protocol.GetRootAsEvent(data, 0)
+		if e.Event() != protocol.EventTypeFIND_VALUE || e.Response() {
+			return
+		}
+
+		n := requests.Add(1)
+
+		cursor := make([]byte, cursorBytes)
+		binary.LittleEndian.PutUint64(cursor, uint64(value.Created.UnixNano()))
+
+		if advance.Load() {
+			binary.LittleEndian.PutUint32(cursor[8:], uint32(n))
+		}
+
+		udp.Send(from, eventFindValueFoundResponse(buf, e.IdBytes(), id, false, 0, []*Value{value}, math.MaxInt32, cursor))
+	})
+	require.Nil(t, err)
+
+	nodes[0].routing.insert(id, addr, 0, false)
+
+	find := func() ([][]byte, error) {
+		type result struct {
+			values [][]byte
+			err    error
+		}
+
+		ch := make(chan result, 1)
+
+		go func() {
+			vs, err := nodes[0].FindAll(key, SkipLocal())
+			ch <- result{vs, err}
+		}()
+
+		select {
+		case r := <-ch:
+			return r.values, r.err
+		case <-time.After(time.Second * 10):
+			t.Fatal("timed out waiting for find to complete")
+			return nil, nil
+		}
+	}
+
+	// a cursor that doesn't advance should not be followed
+	vs, err := find()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{value.Value}, vs)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// and the number of pages requested from a node should be limited
+	requests.Store(0)
+	advance.Store(true)
+
+	vs, err = find()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{value.Value}, vs)
+	assert.Equal(t, int32(maxValuePages), requests.Load())
+}
+
 func TestDHTClusterStoreFindFromTimestamp(t *testing.T) {
 	bc := &Config{
 		LocalID:       randomID(),
@@ -550,6 +738,124 @@ func TestDHTClusterStoreFindFromTimestamp(t *testing.T) {
 	assert.Equal(t, value, result)
 }
 
+func TestDHTClusterStoreFindOptions(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	var dhts []*DHT
+
+	// add some nodes to the network
+	for i := 0; i < 10; i++ {
+		c := &Config{
+			LocalID:       randomID(),
+			ListenAddress: fmt.Sprintf("127.0.0.1:%d", 9001+i),
+			BootstrapAddresses: []string{
+				bc.ListenAddress,
+			},
+			Listeners: 1,
+		}
+
+		dht, err := New(c)
+		require.Nil(t, err)
+		defer dht.Close()
+
+		dhts = append(dhts, dht)
+	}
+
+	key := randomID()
+	older := make(map[string]struct{})
+	newer := make(map[string]struct{})
+
+	ch := make(chan error, 1)
+
+	store := func(values map[string]struct{}) {
+		for i := 0; i < 5; i++ {
+			value := randomID()
+			values[string(value)] = struct{}{}
+
+			bdht.Store(key, value, time.Hour, func(err error) {
+				ch <- err
+			})
+
+			require.Nil(t, <-ch)
+		}
+	}
+
+	store(older)
+	time.Sleep(time.Millisecond * 10)
+	until := time.Now()
+	time.Sleep(time.Millisecond * 10)
+	store(newer)
+
+	find := func(dht *DHT, count int, opts ...FindOption) ([][]byte, error) {
+		vch := make(chan []byte, 20)
+		ech := make(chan error, 1)
+
+		dht.Find(key, func(v []byte, err error) {
+			if err != nil {
+				ech <- err
+				return
+			}
+			vch <- append([]byte(nil), v...)
+		}, opts...)
+
+		var values [][]byte
+
+		for len(values) < count {
+			select {
+			case v := <-vch:
+				values = append(values, v)
+			case err := <-ech:
+				return values, err
+			}
+		}
+
+		return values, nil
+	}
+
+	// combine filters that are sent to other nodes with the number of replicas required
+	values, err := find(dhts[0], 5, SkipLocal(), ValuesUntil(until), Replicas(3), MaxResults(5))
+	require.Nil(t, err)
+	require.Len(t, values, 5)
+
+	for _, v := range values {
+		assert.Contains(t, older, string(v))
+	}
+
+	values, err = find(dhts[1], 2, SkipLocal(), ValuesFrom(until), MaxResults(2))
+	require.Nil(t, err)
+	require.Len(t, values, 2)
+
+	for _, v := range values {
+		assert.Contains(t, newer, string(v))
+	}
+
+	// more replicas than there are nodes in the network
+	_, err = find(dhts[2], 1, SkipLocal(), Replicas(50))
+	assert.ErrorIs(t, err, ErrInsufficientReplicas)
+
+	// keys we don't hold should not be found when only searching locally
+	key = randomID()
+
+	_, err = find(dhts[0], 1, LocalOnly())
+	assert.NotNil(t, err)
+
+	// conflicting options should be rejected
+	_, err = find(dhts[0], 1, LocalOnly(), SkipLocal())
+	assert.NotNil(t, err)
+}
+
 func TestDHTClusterStoreFindNonExistent(t *testing.T) {
 	bc := &Config{
 		LocalID:       randomID(),
@@ -593,6 +899,32 @@ func TestDHTClusterStoreFindNonExistent(t *testing.T) {
 	require.NotNil(t, <-ch)
 }
 
+func TestDHTFindNoPeers(t *testing.T) {
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	ch := make(chan error, 1)
+
+	// the routing table only holds this node, so the find should fail immediately
+	dht.Find(randomID(), func(v []byte, err error) {
+		ch <- err
+	})
+
+	select {
+	case err := <-ch:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "find did not complete")
+	}
+}
+
 func TestDHTClusterNodeJoin(t *testing.T) {
 	bc := &Config{
 		LocalID:       randomID(),
@@ -1114,37 +1446,64 @@ func BenchmarkDHTClusterFindLargeValue(b *testing.B) {
 }
 
 func TestDHTKeyRefresh(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
 	// Create bootstrap node
 	bootstrapCfg := &Config{
 		LocalID:       randomID(),
 		ListenAddress: "127.0.0.1:9000",
 		Timeout:       time.Second * 5,
+		Clock:         clock,
 	}
 
 	bootstrapDHT, err := New(bootstrapCfg)
 	require.NoError(t, err)
 	defer bootstrapDHT.Close()
 
+	cfg := &Config{
+		LocalID:            randomID(),
+		ListenAddress:      "127.0.0.1:9001",
+		BootstrapAddresses: []string{"127.0.0.1:9000"},
+		Timeout:            time.Second * 5,
+		Clock:              clock,
+	}
+
+	otherDHT, err := New(cfg)
+	require.NoError(t, err)
+	defer otherDHT.Close()
+
 	// Store a value
 	key := randomID()
 	value := []byte("test value")
 	done := make(chan error, 1)
+	stored := clock.Now()
 
-	bootstrapDHT.Store(key, value, time.Minute, func(err error) {
+	bootstrapDHT.Store(key, value, time.Hour*24, func(err error) {
 		done <- err
 	})
 	require.NoError(t, <-done)
 
-	// Wait for a refresh cycle
-	time.Sleep(time.Second * 31)
+	// lose the value from the other node, so it will only hold it again once it has been refreshed
+	require.Eventually(t, func() bool {
+		_, ok := otherDHT.storage.Get(key, time.Time{})
+		return ok
+	}, time.Second, time.Millisecond*10)
 
-	// Verify the value is still available
-	bootstrapDHT.Find(key, func(v []byte, err error) {
-		require.NoError(t, err)
-		assert.Equal(t, value, v)
-		done <- nil
-	})
-	require.NoError(t, <-done)
+	require.True(t, otherDHT.storage.(*storage).Delete(key))
+
+	// Advance through refresh cycles until the value has been stored again
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Hour / 2)
+
+		_, ok := otherDHT.storage.Get(key, time.Time{})
+		return ok
+	}, time.Second*5, time.Millisecond*100)
+
+	// the refreshed value keeps its original expiry
+	values, ok := otherDHT.storage.Get(key, time.Time{})
+	require.True(t, ok)
+	assert.Equal(t, value, values[0].Value)
+	assert.False(t, values[0].expiry().After(stored.Add(time.Hour*24)))
 }
 
 func TestLatencyBasedRouting(t *testing.T) {
@@ -1181,3 +1540,134 @@ func TestLatencyBasedRouting(t *testing.T) {
 		assert.True(t, routes[i-1].latency <= routes[i].latency)
 	}
 }
+
+func TestDHTClientMode(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 16)
+
+	client, err := New(&Config{
+		ListenAddress:      simAddress(100),
+		BootstrapAddresses: []string{simAddress(0)},
+		Listeners:          1,
+		Network:            network,
+		Timeout:            time.Second * 5,
+		ClientMode:         true,
+	})
+	require.Nil(t, err)
+	defer client.Close()
+
+	// the client can still store and find values
+	key := randomID()
+	value := randomID()
+
+	ch := make(chan error, 1)
+
+	client.Store(key, value, time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	values, err := client.FindAll(key)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{value}, values)
+
+	values, err = nodes[len(nodes)-1].FindAll(key)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{value}, values)
+
+	// but isn't added to the routing tables of the nodes it contacted
+	for _, n := range nodes {
+		for _, p := range n.Peers() {
+			assert.NotEqual(t, simAddress(100), p.Address.String())
+		}
+	}
+
+	// and doesn't store anything itself
+	assert.False(t, client.routing.seen(client.config.LocalID))
+
+	// even if another node sends it a value to store
+	buf := flatbuffers.NewBuilder(1024)
+	rid := pseudorandomID()
+
+	req := eventStoreRequest(buf, rid, nodes[0].config.LocalID, false, 0, []*Value{
+		{Key: randomID(), Value: randomID(), TTL: time.Hour, Created: time.Now()},
+	})
+
+	err = nodes[0].listeners[0].request(net.UDPAddrFromAddrPort(netip.MustParseAddrPort(simAddress(100))), rid, req, func(event *protocol.Event, err error) bool {
+		ch <- err
+		return true
+	})
+	require.Nil(t, err)
+
+	assert.ErrorIs(t, <-ch, ErrUnsupportedEvent)
+}
+
+func TestDHTNetworkID(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 16)
+
+	newNode := func(address, bootstrap string) *DHT {
+		dht, err := New(&Config{
+			ListenAddress:      address,
+			BootstrapAddresses: []string{bootstrap},
+			Listeners:          1,
+			Network:            network,
+			Timeout:            time.Millisecond * 500,
+			NetworkID:          1,
+		})
+		require.Nil(t, err)
+		t.Cleanup(func() { dht.Close() })
+		return dht
+	}
+
+	// a node from another network bootstraps into the cluster
+	a := newNode(simAddress(100), simAddress(0))
+
+	assert.Greater(t, nodes[0].LimiterStats().Foreign, uint64(0))
+	assert.Empty(t, a.Peers())
+
+	for _, p := range nodes[0].Peers() {
+		assert.NotEqual(t, simAddress(100), p.Address.String())
+	}
+
+	// but can form its own network on the same hosts
+	b := newNode(simAddress(101), simAddress(100))
+
+	key := randomID()
+	value := randomID()
+
+	ch := make(chan error, 1)
+
+	b.Store(key, value, time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	values, err := a.FindAll(key)
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{value}, values)
+
+	// which the cluster can't see
+	_, err = nodes[len(nodes)-1].FindAll(key)
+	assert.NotNil(t, err)
+}
+
+func TestDHTPassiveEventsDontEvict(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 4)
+
+	require.True(t, nodes[0].routing.seen(nodes[1].config.LocalID))
+
+	// an unsolicited event claiming to be from a known node can't remove it from the routing table
+	buf := flatbuffers.NewBuilder(1024)
+	data := eventPong(buf, randomID(), nodes[1].config.LocalID, true, true, 0, nil)
+
+	nodes[0].listeners[0].handle(&net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: 9000}, data)
+
+	assert.True(t, nodes[0].routing.seen(nodes[1].config.LocalID))
+}
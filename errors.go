@@ -0,0 +1,107 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"errors"
+	"fmt"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/tos-network/emo/protocol"
+)
+
+var (
+	// ErrUnsupportedEvent returned when a node does not support the event sent to it
+	ErrUnsupportedEvent = errors.New("event not supported by node")
+	// ErrMalformedRequest returned when a node could not decode our request
+	ErrMalformedRequest = errors.New("malformed request")
+	// ErrRateLimited returned when a node has rejected our request for exceeding its rate limits.
+	// This node drops requests that exceed its own rate limits without a response, as replying
+	// would only add to its load, but other implementations of the protocol may send them
+	ErrRateLimited = errors.New("request rate limited")
+	// ErrQuotaExceeded returned when a request exceeds the size or number of entries a node will accept
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrStorageFailure returned when a node failed to store a value
+	ErrStorageFailure = errors.New("storage failure")
+)
+
+// RemoteError an error returned by another node in response to one of our requests.
+// It can be compared to the Err* errors of the code it was sent with using errors.Is
+type RemoteError struct {
+	// Code the error code sent by the node
+	Code protocol.ErrorCode
+	// Message a description of the error sent by the node
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %s: %s", e.Code.String(), e.Message)
+}
+
+// Unwrap returns the error that corresponds to the error code
+func (e *RemoteError) Unwrap() error {
+	switch e.Code {
+	case protocol.ErrorCodeUNSUPPORTED:
+		return ErrUnsupportedEvent
+	case protocol.ErrorCodeMALFORMED:
+		return ErrMalformedRequest
+	case protocol.ErrorCodeRATE_LIMITED:
+		return ErrRateLimited
+	case protocol.ErrorCodeQUOTA_EXCEEDED:
+		return ErrQuotaExceeded
+	case protocol.ErrorCodeSTORAGE_FAILURE:
+		return ErrStorageFailure
+	default:
+		return nil
+	}
+}
+
+// returns the error code to send to the sender of a request that failed with an error.
+// returns false if the error is ours and should not be sent to the sender
+func errorCode(err error) (protocol.ErrorCode, bool) {
+	switch {
+	case errors.Is(err, ErrUnsupportedEvent):
+		return protocol.ErrorCodeUNSUPPORTED, true
+	case errors.Is(err, errMalformedEvent):
+		return protocol.ErrorCodeMALFORMED, true
+	case errors.Is(err, ErrRateLimited):
+		return protocol.ErrorCodeRATE_LIMITED, true
+	case errors.Is(err, errOversizedValue), errors.Is(err, ErrQuotaExceeded):
+		return protocol.ErrorCodeQUOTA_EXCEEDED, true
+	case errors.Is(err, ErrStorageFailure):
+		return protocol.ErrorCodeSTORAGE_FAILURE, true
+	default:
+		return protocol.ErrorCodeUNKNOWN, false
+	}
+}
+
+// returns the error that was sent in response to one of our requests
+func responseError(event *protocol.Event) error {
+	payloadTable := new(flatbuffers.Table)
+
+	if !event.Payload(payloadTable) {
+		return fmt.Errorf("invalid error response payload: %w", errMalformedEvent)
+	}
+
+	er := new(protocol.Error)
+	er.Init(payloadTable.Bytes, payloadTable.Pos)
+
+	return &RemoteError{
+		Code:    er.Code(),
+		Message: string(er.Message()),
+	}
+}
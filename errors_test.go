@@ -0,0 +1,148 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tos-network/emo/protocol"
+)
+
+// storage that fails to store any values
+type failingStorage struct {
+	noopStorage
+}
+
+func (s *failingStorage) Set(k, v []byte, created time.Time, ttl time.Duration) bool { return false }
+
+func TestRemoteError(t *testing.T) {
+	err := &RemoteError{Code: protocol.ErrorCodeRATE_LIMITED, Message: "request rate limited"}
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.NotErrorIs(t, err, ErrQuotaExceeded)
+
+	var rerr *RemoteError
+	require.True(t, errors.As(fmt.Errorf("store failed: %w", err), &rerr))
+	assert.Equal(t, protocol.ErrorCodeRATE_LIMITED, rerr.Code)
+
+	// errors caused by a request should be sent to its sender
+	code, ok := errorCode(fmt.Errorf("invalid store request value: %w", errOversizedValue))
+	assert.True(t, ok)
+	assert.Equal(t, protocol.ErrorCodeQUOTA_EXCEEDED, code)
+
+	code, ok = errorCode(fmt.Errorf("find value key: %w", errMalformedEvent))
+	assert.True(t, ok)
+	assert.Equal(t, protocol.ErrorCodeMALFORMED, code)
+
+	// but errors of our own should not
+	_, ok = errorCode(net.ErrClosed)
+	assert.False(t, ok)
+}
+
+func TestDHTErrorResponses(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+		Storage:       &failingStorage{},
+		RateLimits: map[protocol.EventType]RateLimit{
+			protocol.EventTypePING: {Rate: 1, Burst: 1},
+		},
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+		Timeout:   time.Second,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	// wait for the nodes to ping each other
+	time.Sleep(time.Millisecond * 200)
+
+	ch := make(chan error, 1)
+
+	// storage failures should be returned to the node storing the value
+	dht.Store(randomID(), randomID(), time.Hour, func(err error) {
+		ch <- err
+	})
+
+	err = <-ch
+	assert.ErrorIs(t, err, ErrStorageFailure)
+
+	var rerr *RemoteError
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, protocol.ErrorCodeSTORAGE_FAILURE, rerr.Code)
+
+	buf := flatbuffers.NewBuilder(1024)
+	baddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	request := func(rid, data []byte) error {
+		err := dht.listeners[0].request(baddr, rid, data, func(event *protocol.Event, err error) bool {
+			ch <- err
+			return true
+		})
+		require.Nil(t, err)
+
+		return <-ch
+	}
+
+	// requests with a malformed payload should be rejected
+	rid := pseudorandomID()
+	assert.ErrorIs(t, request(rid, eventFindValueRequest(buf, rid, c.LocalID, false, 0, randomID()[:8], time.Now(), time.Time{}, 0, nil)), ErrMalformedRequest)
+
+	// senders that aren't known peers, such as clients, are only told the error code, as their address may be spoofed
+	rid = pseudorandomID()
+	err = request(rid, eventFindValueRequest(buf, rid, randomID(), true, 0, randomID()[:8], time.Now(), time.Time{}, 0, nil))
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	require.True(t, errors.As(err, &rerr))
+	assert.Empty(t, rerr.Message)
+
+	// and senders that don't advertise that they understand errors aren't sent them
+	rid = pseudorandomID()
+	data := eventFindValueRequest(buf, rid, randomID(), true, 0, randomID()[:8], time.Now(), time.Time{}, 0, nil)
+	require.True(t, protocol.GetRootAsEvent(data, 0).MutateCapabilities(0))
+	assert.ErrorIs(t, request(rid, data), ErrRequestTimeout)
+
+	// requests that exceed the nodes rate limits should be dropped without a response
+	rid = pseudorandomID()
+	request(rid, eventPing(buf, rid, c.LocalID, false, false, 0))
+
+	rid = pseudorandomID()
+	assert.ErrorIs(t, request(rid, eventPing(buf, rid, c.LocalID, false, false, 0)), ErrRequestTimeout)
+}
@@ -18,23 +18,58 @@ package emo
 
 import (
 	"encoding/binary"
+	"net"
 	"time"
 
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/tos-network/emo/protocol"
 )
 
-func eventPing(buf *flatbuffers.Builder, id, sender []byte) []byte {
+func eventPing(buf *flatbuffers.Builder, id, sender []byte, client, passive bool, network uint32) []byte {
+	return eventTraversalPing(buf, id, sender, client, passive, network, false, false, nil, nil)
+}
+
+// creates a ping that also asks the receiver to help us traverse a nat. if dialback is set, the receiver asks
+// another node to ping us, to test if we can receive requests from nodes we haven't contacted. if relay is
+// set, the receiver asks the node at that address to ping us, and if punch is set the receiver pings the
+// node at that address, which together open a path through both nodes nats. introduced is set on the pings
+// sent because another node asked us to
+func eventTraversalPing(buf *flatbuffers.Builder, id, sender []byte, client, passive bool, network uint32, dialback, introduced bool, relay, punch *net.UDPAddr) []byte {
 	buf.Reset()
 
 	eid := buf.CreateByteVector(id)
 	snd := buf.CreateByteVector(sender)
 
+	var rly, pnc flatbuffers.UOffsetT
+
+	if relay != nil {
+		rly = buf.CreateByteVector(encodeAddress(relay))
+	}
+
+	if punch != nil {
+		pnc = buf.CreateByteVector(encodeAddress(punch))
+	}
+
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypePING)
 	protocol.EventAddResponse(buf, false)
+	protocol.EventAddVersion(buf, ProtocolVersion)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddClient(buf, client)
+	protocol.EventAddDialback(buf, dialback)
+	protocol.EventAddIntroduced(buf, introduced)
+
+	if relay != nil {
+		protocol.EventAddRelay(buf, rly)
+	}
+
+	if punch != nil {
+		protocol.EventAddPunch(buf, pnc)
+	}
 
 	e := protocol.EventEnd(buf)
 
@@ -43,17 +78,33 @@ func eventPing(buf *flatbuffers.Builder, id, sender []byte) []byte {
 	return buf.FinishedBytes()
 }
 
-func eventPong(buf *flatbuffers.Builder, id, sender []byte) []byte {
+// creates a pong, reporting the address the ping was received from back to its sender
+func eventPong(buf *flatbuffers.Builder, id, sender []byte, client, passive bool, network uint32, observed *net.UDPAddr) []byte {
 	buf.Reset()
 
 	eid := buf.CreateByteVector(id)
 	snd := buf.CreateByteVector(sender)
 
+	var obs flatbuffers.UOffsetT
+
+	if observed != nil {
+		obs = buf.CreateByteVector(encodeAddress(observed))
+	}
+
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypePONG)
 	protocol.EventAddResponse(buf, true)
+	protocol.EventAddVersion(buf, ProtocolVersion)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddClient(buf, client)
+
+	if observed != nil {
+		protocol.EventAddObserved(buf, obs)
+	}
 
 	e := protocol.EventEnd(buf)
 
@@ -62,7 +113,7 @@ func eventPong(buf *flatbuffers.Builder, id, sender []byte) []byte {
 	return buf.FinishedBytes()
 }
 
-func eventStoreRequest(buf *flatbuffers.Builder, id, sender []byte, values []*Value) []byte {
+func eventStoreRequest(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, values []*Value) []byte {
 	buf.Reset()
 
 	// construct the value vector
@@ -100,8 +151,12 @@ func eventStoreRequest(buf *flatbuffers.Builder, id, sender []byte, values []*Va
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeSTORE)
 	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationStore)
 	protocol.EventAddPayload(buf, s)
 
 	e := protocol.EventEnd(buf)
@@ -111,7 +166,7 @@ func eventStoreRequest(buf *flatbuffers.Builder, id, sender []byte, values []*Va
 	return buf.FinishedBytes()
 }
 
-func eventStoreResponse(buf *flatbuffers.Builder, id, sender []byte) []byte {
+func eventStoreResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32) []byte {
 	buf.Reset()
 
 	eid := buf.CreateByteVector(id)
@@ -120,6 +175,8 @@ func eventStoreResponse(buf *flatbuffers.Builder, id, sender []byte) []byte {
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeSTORE)
 	protocol.EventAddResponse(buf, true)
 
@@ -130,7 +187,7 @@ func eventStoreResponse(buf *flatbuffers.Builder, id, sender []byte) []byte {
 	return buf.FinishedBytes()
 }
 
-func eventFindNodeRequest(buf *flatbuffers.Builder, id, sender, key []byte) []byte {
+func eventFindNodeRequest(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, key []byte) []byte {
 	buf.Reset()
 
 	k := buf.CreateByteVector(key)
@@ -147,8 +204,12 @@ func eventFindNodeRequest(buf *flatbuffers.Builder, id, sender, key []byte) []by
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeFIND_NODE)
 	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationFindNode)
 	protocol.EventAddPayload(buf, fn)
 
 	e := protocol.EventEnd(buf)
@@ -158,7 +219,7 @@ func eventFindNodeRequest(buf *flatbuffers.Builder, id, sender, key []byte) []by
 	return buf.FinishedBytes()
 }
 
-func eventFindNodeResponse(buf *flatbuffers.Builder, id, sender []byte, nodes []*node) []byte {
+func eventFindNodeResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, nodes []*node) []byte {
 	buf.Reset()
 
 	// construct the node vector
@@ -167,9 +228,7 @@ func eventFindNodeResponse(buf *flatbuffers.Builder, id, sender []byte, nodes []
 	for i, n := range nodes {
 		// save a few bytes here by using the non-string
 		// representation of port and ip
-		a := make([]byte, 6)
-		copy(a, n.address.IP)
-		binary.LittleEndian.PutUint16(a[4:], uint16(n.address.Port))
+		a := encodeAddress(n.address)
 
 		nid := buf.CreateByteVector(n.id)
 		nad := buf.CreateByteVector(a)
@@ -201,8 +260,11 @@ func eventFindNodeResponse(buf *flatbuffers.Builder, id, sender []byte, nodes []
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeFIND_NODE)
 	protocol.EventAddResponse(buf, true)
+	protocol.EventAddPayloadType(buf, protocol.OperationFindNode)
 	protocol.EventAddPayload(buf, fn)
 
 	e := protocol.EventEnd(buf)
@@ -212,15 +274,27 @@ func eventFindNodeResponse(buf *flatbuffers.Builder, id, sender []byte, nodes []
 	return buf.FinishedBytes()
 }
 
-func eventFindValueRequest(buf *flatbuffers.Builder, id, sender, key []byte, from time.Time) []byte {
+func eventFindValueRequest(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, key []byte, from, until time.Time, limit int, cursor []byte) []byte {
 	buf.Reset()
 
 	// create the find value table
 	k := buf.CreateByteVector(key)
 
+	var c flatbuffers.UOffsetT
+	if len(cursor) > 0 {
+		c = buf.CreateByteVector(cursor)
+	}
+
 	protocol.FindValueStart(buf)
 	protocol.FindValueAddKey(buf, k)
 	protocol.FindValueAddFrom(buf, from.UnixNano())
+	protocol.FindValueAddLimit(buf, int32(limit))
+	if !until.IsZero() {
+		protocol.FindValueAddUntil(buf, until.UnixNano())
+	}
+	if len(cursor) > 0 {
+		protocol.FindValueAddCursor(buf, c)
+	}
 	fv := protocol.FindValueEnd(buf)
 
 	// build the event to send
@@ -230,8 +304,12 @@ func eventFindValueRequest(buf *flatbuffers.Builder, id, sender, key []byte, fro
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeFIND_VALUE)
 	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationFindValue)
 	protocol.EventAddPayload(buf, fv)
 
 	e := protocol.EventEnd(buf)
@@ -241,7 +319,7 @@ func eventFindValueRequest(buf *flatbuffers.Builder, id, sender, key []byte, fro
 	return buf.FinishedBytes()
 }
 
-func eventFindValueFoundResponse(buf *flatbuffers.Builder, id, sender []byte, values []*Value, found int) []byte {
+func eventFindValueFoundResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, values []*Value, found int, cursor []byte) []byte {
 	buf.Reset()
 
 	// construct the value vector
@@ -254,6 +332,7 @@ func eventFindValueFoundResponse(buf *flatbuffers.Builder, id, sender []byte, va
 		protocol.ValueStart(buf)
 		protocol.ValueAddKey(buf, k)
 		protocol.ValueAddValue(buf, v)
+		protocol.ValueAddCreated(buf, value.Created.UnixNano())
 		protocol.ValueAddTtl(buf, int64(value.TTL))
 		vs[i] = protocol.ValueEnd(buf)
 	}
@@ -267,9 +346,18 @@ func eventFindValueFoundResponse(buf *flatbuffers.Builder, id, sender []byte, va
 
 	vv := buf.EndVector(len(values))
 
+	// the cursor for the next page of values, if there is one
+	var c flatbuffers.UOffsetT
+	if len(cursor) > 0 {
+		c = buf.CreateByteVector(cursor)
+	}
+
 	protocol.FindValueStart(buf)
 	protocol.FindValueAddValues(buf, vv)
 	protocol.FindValueAddFound(buf, int64(found))
+	if len(cursor) > 0 {
+		protocol.FindValueAddCursor(buf, c)
+	}
 	fv := protocol.FindValueEnd(buf)
 
 	// construct the response event table
@@ -279,8 +367,11 @@ func eventFindValueFoundResponse(buf *flatbuffers.Builder, id, sender []byte, va
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeFIND_VALUE)
 	protocol.EventAddResponse(buf, true)
+	protocol.EventAddPayloadType(buf, protocol.OperationFindValue)
 	protocol.EventAddPayload(buf, fv)
 
 	e := protocol.EventEnd(buf)
@@ -290,7 +381,7 @@ func eventFindValueFoundResponse(buf *flatbuffers.Builder, id, sender []byte, va
 	return buf.FinishedBytes()
 }
 
-func eventFindValueNotFoundResponse(buf *flatbuffers.Builder, id, sender []byte, nodes []*node) []byte {
+func eventFindValueNotFoundResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, nodes []*node) []byte {
 	buf.Reset()
 
 	// construct the node vector
@@ -299,12 +390,10 @@ func eventFindValueNotFoundResponse(buf *flatbuffers.Builder, id, sender []byte,
 	for i, n := range nodes {
 		// save a few bytes here by using the non-string
 		// representation of port and ip
-		a := make([]byte, 6)
-		copy(a, n.address.IP)
-		binary.LittleEndian.PutUint16(a[4:], uint16(n.address.Port))
+		a := encodeAddress(n.address)
 
 		nid := buf.CreateByteVector(n.id)
-		nad := buf.CreateByteVector([]byte(a))
+		nad := buf.CreateByteVector(a)
 
 		protocol.NodeStart(buf)
 		protocol.NodeAddId(buf, nid)
@@ -333,8 +422,11 @@ func eventFindValueNotFoundResponse(buf *flatbuffers.Builder, id, sender []byte,
 	protocol.EventStart(buf)
 	protocol.EventAddId(buf, eid)
 	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
 	protocol.EventAddEvent(buf, protocol.EventTypeFIND_VALUE)
 	protocol.EventAddResponse(buf, true)
+	protocol.EventAddPayloadType(buf, protocol.OperationFindValue)
 	protocol.EventAddPayload(buf, fn)
 
 	e := protocol.EventEnd(buf)
@@ -343,3 +435,323 @@ func eventFindValueNotFoundResponse(buf *flatbuffers.Builder, id, sender []byte,
 
 	return buf.FinishedBytes()
 }
+
+func eventAddProviderRequest(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, key []byte, ttl time.Duration) []byte {
+	buf.Reset()
+
+	k := buf.CreateByteVector(key)
+
+	protocol.AddProviderStart(buf)
+	protocol.AddProviderAddKey(buf, k)
+	protocol.AddProviderAddTtl(buf, int64(ttl))
+	ap := protocol.AddProviderEnd(buf)
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeADD_PROVIDER)
+	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationAddProvider)
+	protocol.EventAddPayload(buf, ap)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventAddProviderResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32) []byte {
+	buf.Reset()
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeADD_PROVIDER)
+	protocol.EventAddResponse(buf, true)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventGetProvidersRequest(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, key []byte) []byte {
+	buf.Reset()
+
+	k := buf.CreateByteVector(key)
+
+	protocol.GetProvidersStart(buf)
+	protocol.GetProvidersAddKey(buf, k)
+	gp := protocol.GetProvidersEnd(buf)
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeGET_PROVIDERS)
+	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationGetProviders)
+	protocol.EventAddPayload(buf, gp)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventGetProvidersResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, providers []*Provider, nodes []*node) []byte {
+	buf.Reset()
+
+	// construct the provider vector
+	ps := make([]flatbuffers.UOffsetT, len(providers))
+
+	for i, p := range providers {
+		pid := buf.CreateByteVector(p.ID)
+		pad := buf.CreateByteVector(encodeAddress(p.Address))
+
+		protocol.NodeStart(buf)
+		protocol.NodeAddId(buf, pid)
+		protocol.NodeAddAddress(buf, pad)
+		ps[i] = protocol.NodeEnd(buf)
+	}
+
+	protocol.GetProvidersStartProvidersVector(buf, len(providers))
+
+	for i := len(providers) - 1; i >= 0; i-- {
+		buf.PrependUOffsetT(ps[i])
+	}
+
+	pv := buf.EndVector(len(providers))
+
+	// construct the node vector
+	ns := make([]flatbuffers.UOffsetT, len(nodes))
+
+	for i, n := range nodes {
+		nid := buf.CreateByteVector(n.id)
+		nad := buf.CreateByteVector(encodeAddress(n.address))
+
+		protocol.NodeStart(buf)
+		protocol.NodeAddId(buf, nid)
+		protocol.NodeAddAddress(buf, nad)
+		ns[i] = protocol.NodeEnd(buf)
+	}
+
+	protocol.GetProvidersStartNodesVector(buf, len(nodes))
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		buf.PrependUOffsetT(ns[i])
+	}
+
+	nv := buf.EndVector(len(nodes))
+
+	protocol.GetProvidersStart(buf)
+	protocol.GetProvidersAddProviders(buf, pv)
+	protocol.GetProvidersAddNodes(buf, nv)
+	gp := protocol.GetProvidersEnd(buf)
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeGET_PROVIDERS)
+	protocol.EventAddResponse(buf, true)
+	protocol.EventAddPayloadType(buf, protocol.OperationGetProviders)
+	protocol.EventAddPayload(buf, gp)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventSubscribeRequest(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, key []byte, lease time.Duration) []byte {
+	buf.Reset()
+
+	k := buf.CreateByteVector(key)
+
+	protocol.SubscribeStart(buf)
+	protocol.SubscribeAddKey(buf, k)
+	protocol.SubscribeAddLease(buf, int64(lease))
+	sb := protocol.SubscribeEnd(buf)
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeSUBSCRIBE)
+	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationSubscribe)
+	protocol.EventAddPayload(buf, sb)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventSubscribeResponse(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32) []byte {
+	buf.Reset()
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeSUBSCRIBE)
+	protocol.EventAddResponse(buf, true)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventNotify(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, key []byte, values []*Value) []byte {
+	buf.Reset()
+
+	// construct the value vector
+	vs := make([]flatbuffers.UOffsetT, len(values))
+
+	for i, value := range values {
+		k := buf.CreateByteVector(value.Key)
+		v := buf.CreateByteVector(value.Value)
+
+		protocol.ValueStart(buf)
+		protocol.ValueAddKey(buf, k)
+		protocol.ValueAddValue(buf, v)
+		protocol.ValueAddCreated(buf, value.Created.UnixNano())
+		protocol.ValueAddTtl(buf, int64(value.TTL))
+		vs[i] = protocol.ValueEnd(buf)
+	}
+
+	protocol.NotifyStartValuesVector(buf, len(values))
+
+	for i := len(values) - 1; i >= 0; i-- {
+		buf.PrependUOffsetT(vs[i])
+	}
+
+	vv := buf.EndVector(len(values))
+
+	k := buf.CreateByteVector(key)
+
+	protocol.NotifyStart(buf)
+	protocol.NotifyAddKey(buf, k)
+	protocol.NotifyAddValues(buf, vv)
+	n := protocol.NotifyEnd(buf)
+
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeNOTIFY)
+	protocol.EventAddResponse(buf, false)
+	protocol.EventAddCapabilities(buf, uint64(localCapabilities))
+	protocol.EventAddPayloadType(buf, protocol.OperationNotify)
+	protocol.EventAddPayload(buf, n)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+func eventError(buf *flatbuffers.Builder, id, sender []byte, passive bool, network uint32, code protocol.ErrorCode, message string) []byte {
+	buf.Reset()
+
+	if len(message) > maxErrorMessageBytes {
+		message = message[:maxErrorMessageBytes]
+	}
+
+	msg := buf.CreateString(message)
+
+	protocol.ErrorStart(buf)
+	protocol.ErrorAddCode(buf, code)
+	protocol.ErrorAddMessage(buf, msg)
+	er := protocol.ErrorEnd(buf)
+
+	// build the event to send
+	eid := buf.CreateByteVector(id)
+	snd := buf.CreateByteVector(sender)
+
+	protocol.EventStart(buf)
+	protocol.EventAddId(buf, eid)
+	protocol.EventAddSender(buf, snd)
+	protocol.EventAddPassive(buf, passive)
+	protocol.EventAddNetwork(buf, network)
+	protocol.EventAddEvent(buf, protocol.EventTypeERROR)
+	protocol.EventAddResponse(buf, true)
+	protocol.EventAddPayloadType(buf, protocol.OperationError)
+	protocol.EventAddPayload(buf, er)
+
+	e := protocol.EventEnd(buf)
+
+	buf.Finish(e)
+
+	return buf.FinishedBytes()
+}
+
+// encodes an ipv4 udp address as 4 bytes of ip followed by a 2 byte port
+func encodeAddress(addr *net.UDPAddr) []byte {
+	a := make([]byte, nodeAddressBytes)
+
+	ip := addr.IP.To4()
+	if ip != nil {
+		copy(a, ip)
+	}
+
+	binary.LittleEndian.PutUint16(a[4:], uint16(addr.Port))
+
+	return a
+}
+
+// decodes an address encoded with encodeAddress. the provided
+// address must be nodeAddressBytes in length
+func decodeAddress(a []byte) *net.UDPAddr {
+	addr := &net.UDPAddr{
+		IP:   make(net.IP, 4),
+		Port: int(binary.LittleEndian.Uint16(a[4:])),
+	}
+
+	copy(addr.IP, a[:4])
+
+	return addr
+}
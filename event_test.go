@@ -26,7 +26,7 @@ import (
 func TestEventStoreRequest(t *testing.T) {
 	b := flatbuffers.NewBuilder(65535)
 
-	eventStoreRequest(b, randomID(), randomID(), []*Value{
+	eventStoreRequest(b, randomID(), randomID(), false, 0, []*Value{
 		{
 			Key:   randomID(),
 			Value: []byte{},
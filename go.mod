@@ -9,6 +9,7 @@ require (
 	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c
 	golang.org/x/net v0.23.0
 	golang.org/x/sys v0.26.0
+	gopkg.in/yaml.v3 v3.0.0
 )
 
 require (
@@ -16,5 +17,4 @@ require (
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/syndtr/goleveldb v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0 // indirect
 )
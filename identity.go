@@ -0,0 +1,144 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Identity a node's key pair. The id of the node is derived from its public key,
+// so a node that keeps its identity keeps its position in the keyspace
+type Identity struct {
+	// PrivateKey the node's private key
+	PrivateKey ed25519.PrivateKey
+}
+
+// GenerateIdentity generates a new random identity
+func GenerateIdentity() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{PrivateKey: key}, nil
+}
+
+// LoadIdentity reads an identity from a file written by Save
+func LoadIdentity(path string) (*Identity, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// like ssh, refuse to use a key that other users can read
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("identity file %s must not be accessible by other users", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("identity file %s does not contain a valid key", path)
+	}
+
+	return &Identity{PrivateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// LoadOrCreateIdentity loads the identity stored at path, generating and saving
+// a new identity if the file does not exist. Returns true if the identity was created
+func LoadOrCreateIdentity(path string) (*Identity, bool, error) {
+	id, err := LoadIdentity(path)
+	if err == nil {
+		return id, false, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	id, err = GenerateIdentity()
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = id.Save(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return id, true, nil
+}
+
+// Save writes the identity to a file that can only be accessed by the current user,
+// replacing any identity that is already stored there
+func (i *Identity) Save(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	// temp files are created with 0600 permissions, but make sure of it
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.WriteString(hex.EncodeToString(i.PrivateKey.Seed()) + "\n")
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	if cerr != nil {
+		return cerr
+	}
+
+	// rename the file into place so a partially written key is never loaded
+	return os.Rename(f.Name(), path)
+}
+
+// PublicKey returns the public key of the identity
+func (i *Identity) PublicKey() ed25519.PublicKey {
+	return i.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// ID returns the node id derived from the identity's public key
+func (i *Identity) ID() []byte {
+	return Keccak256(i.PublicKey())
+}
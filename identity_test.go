@@ -0,0 +1,70 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "emo.key")
+
+	// the identity is created on first use
+	id, created, err := LoadOrCreateIdentity(path)
+	require.Nil(t, err)
+	assert.True(t, created)
+	assert.Len(t, id.ID(), KEY_BYTES)
+
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// and reloaded afterwards
+	loaded, created, err := LoadOrCreateIdentity(path)
+	require.Nil(t, err)
+	assert.False(t, created)
+	assert.Equal(t, id.ID(), loaded.ID())
+	assert.Equal(t, id.PrivateKey, loaded.PrivateKey)
+
+	// replacing the identity changes the id
+	rotated, err := GenerateIdentity()
+	require.Nil(t, err)
+	require.Nil(t, rotated.Save(path))
+
+	loaded, err = LoadIdentity(path)
+	require.Nil(t, err)
+	assert.Equal(t, rotated.ID(), loaded.ID())
+	assert.NotEqual(t, id.ID(), loaded.ID())
+
+	// keys that can be read by other users are rejected
+	require.Nil(t, os.Chmod(path, 0644))
+
+	_, _, err = LoadOrCreateIdentity(path)
+	assert.NotNil(t, err)
+
+	// as are invalid keys
+	require.Nil(t, os.WriteFile(path, []byte("not a key"), 0600))
+	require.Nil(t, os.Chmod(path, 0600))
+
+	_, err = LoadIdentity(path)
+	assert.NotNil(t, err)
+}
@@ -18,6 +18,7 @@ package emo
 
 import (
 	"bytes"
+	"errors"
 	"hash/maphash"
 	"sort"
 	"sync"
@@ -32,8 +33,6 @@ type journey struct {
 	destination []byte
 	// a set of nodes we have already visited
 	visited map[uint64]struct{}
-	// a set of values we have already seen
-	values map[uint64]struct{}
 	// the amount of values that we are expecting back based on initial successful responses
 	outstanding map[uint64]int
 	// hasher for our list of destinations
@@ -50,7 +49,16 @@ type journey struct {
 	inflight int
 	// the journey has been completed
 	completed bool
-	mu        sync.Mutex
+	// receives the progress of the journey, if it is being traced
+	tracer Tracer
+	lookup *Lookup
+	clock  Clock
+	// called once the journey has ended
+	done func(err error)
+	// the progress of the journey reported to the tracer once it has ended
+	result LookupResult
+	ended  bool
+	mu     sync.Mutex
 }
 
 func newJourney(source, destination []byte, iterations int) *journey {
@@ -61,7 +69,6 @@ func newJourney(source, destination []byte, iterations int) *journey {
 		source:      source,
 		destination: destination,
 		visited:     make(map[uint64]struct{}),
-		values:      make(map[uint64]struct{}),
 		outstanding: make(map[uint64]int),
 		hasher:      hasher,
 		nodes:       make([]*node, K),
@@ -168,6 +175,15 @@ func (j *journey) next(count int) []*node {
 	return next
 }
 
+// tracks an additional inflight request made outside of
+// the journeys routes, such as requesting further values
+func (j *journey) requested() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.inflight++
+}
+
 // marks the journey as completed
 func (j *journey) finish(force bool) bool {
 	j.mu.Lock()
@@ -212,24 +228,6 @@ func (j *journey) responseReceived() (bool, bool) {
 	return j.completed, j.inflight < 1 && j.routes < 1
 }
 
-func (j *journey) seenValue(value []byte) bool {
-	j.mu.Lock()
-	defer j.mu.Unlock()
-
-	j.hasher.Reset()
-	j.hasher.Write(value)
-	vh := j.hasher.Sum64()
-
-	_, ok := j.values[vh]
-	if ok {
-		return true
-	}
-
-	j.values[vh] = struct{}{}
-
-	return false
-}
-
 func (j *journey) addOutstanding(from []byte, outstanding int) {
 	j.mu.Lock()
 	defer j.mu.Unlock()
@@ -260,6 +258,118 @@ func (j *journey) removeOutstanding(from []byte, received int) {
 	j.outstanding[fh] = j.outstanding[fh] - received
 }
 
+// marks a node as having returned all of its values. nodes that don't support paging return
+// every value without a cursor, and values may expire between pages, so the total reported
+// in a nodes first response can't be relied on once it has sent its last page
+func (j *journey) clearOutstanding(from []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.hasher.Reset()
+	j.hasher.Write(from)
+	fh := j.hasher.Sum64()
+
+	j.outstanding[fh] = 0
+}
+
+// attaches a tracer to the journey
+func (j *journey) trace(tracer Tracer, lookup *Lookup, clock Clock) {
+	j.tracer = tracer
+	j.lookup = lookup
+	j.clock = clock
+}
+
+// records a query being sent to a node, returning the query so its response can be traced
+func (j *journey) sent(n *node) *Query {
+	if j.tracer == nil {
+		return nil
+	}
+
+	q := &Query{
+		Lookup:  j.lookup,
+		Peer:    n.id,
+		Address: n.address,
+		Sent:    j.clock.Now(),
+	}
+
+	j.mu.Lock()
+	j.result.Queries++
+	j.mu.Unlock()
+
+	j.tracer.OnQuerySent(q)
+
+	return q
+}
+
+// records the response to a query. responses received after the journey has ended are ignored
+func (j *journey) received(q *Query, values, nodes int, err error) {
+	if q == nil {
+		return
+	}
+
+	timeout := errors.Is(err, ErrRequestTimeout)
+
+	j.mu.Lock()
+
+	if j.ended {
+		j.mu.Unlock()
+		return
+	}
+
+	if timeout {
+		j.result.Timeouts++
+	} else {
+		j.result.Responses++
+		j.result.Values = j.result.Values + values
+	}
+
+	j.mu.Unlock()
+
+	if timeout {
+		j.tracer.OnTimeout(q)
+		return
+	}
+
+	j.tracer.OnResponse(q, &Response{
+		Latency: j.clock.Since(q.Sent),
+		Values:  values,
+		Nodes:   nodes,
+		Err:     err,
+	})
+}
+
+// reports the result of the journey to the tracer, which will only happen once
+func (j *journey) end(err error) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+
+	if j.ended {
+		j.mu.Unlock()
+		return
+	}
+
+	j.ended = true
+	result := j.result
+
+	j.mu.Unlock()
+
+	if j.done != nil {
+		defer j.done(err)
+	}
+
+	if j.tracer == nil {
+		return
+	}
+
+	result.Duration = j.clock.Since(j.lookup.Started)
+	result.Err = err
+
+	j.tracer.OnJourneyFinished(j.lookup, &result)
+}
+
 /*
 func (j *journey) has(n *node) bool {
 	for i := 0; i < j.routes; i++ {
@@ -156,3 +156,19 @@ func BenchmarkJourneyAddRoutes(b *testing.B) {
 		j.add(nodes[i%1000])
 	}
 }
+
+func TestJourneyOutstanding(t *testing.T) {
+	j := newJourney(randomID(), randomID(), 5)
+
+	from := randomID()
+
+	// the journey can't finish until the node has returned the values it reported
+	j.addOutstanding(from, 10)
+	j.removeOutstanding(from, 4)
+	assert.False(t, j.finish(false))
+
+	// unless its last page arrives first, as some of its values have expired
+	// or it is an older node that returned all of its values at once
+	j.clearOutstanding(from)
+	assert.True(t, j.finish(false))
+}
@@ -0,0 +1,425 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// LARGE_CHUNK_BYTES the size of each chunk a large value is split into
+	LARGE_CHUNK_BYTES = VALUE_BYTES
+	// MAX_LARGE_VALUE_BYTES the maximum size of a large value, limited
+	// by the number of chunk hashes that can fit in a single manifest
+	MAX_LARGE_VALUE_BYTES = (VALUE_BYTES - manifestHeaderSize) / KEY_BYTES * LARGE_CHUNK_BYTES
+
+	// identifies a value as a large value manifest
+	manifestMagic = "emoL"
+	// the size of a manifest header, the magic, the size of
+	// the value and the hash of the complete value
+	manifestHeaderSize = 4 + 8 + KEY_BYTES
+	// the number of chunks that will be stored or retrieved concurrently
+	largeConcurrency = 16
+	// the number of request timeouts we will wait for a large value to be retrieved
+	largeTimeoutFactor = 3
+)
+
+var (
+	// ErrInvalidManifest returned when a value found at a key is not a valid large value manifest
+	ErrInvalidManifest = errors.New("invalid large value manifest")
+	// ErrChunkIntegrity returned when a retrieved large value does not match its manifest
+	ErrChunkIntegrity = errors.New("large value failed integrity verification")
+	// ErrClosed returned when a large value could not be stored or retrieved because the dht was closed
+	ErrClosed = errors.New("dht closed")
+)
+
+/*
+A large value is split into chunks of LARGE_CHUNK_BYTES, which are each
+stored under the Keccak256 hash of their contents. A manifest describing
+the chunks is then stored at the users key:
+
+| 4 bytes | 8 bytes | 32 bytes   | 32 bytes * chunks |
+| magic   | size    | value hash | chunk hashes      |
+*/
+type manifest struct {
+	size   int
+	hash   []byte
+	chunks [][]byte
+}
+
+// creates a manifest for a value, returning it along with the chunks it describes
+func newManifest(value []byte) (*manifest, [][]byte) {
+	m := &manifest{
+		size: len(value),
+		hash: Keccak256(value),
+	}
+
+	var chunks [][]byte
+
+	for i := 0; i < len(value); i += LARGE_CHUNK_BYTES {
+		chunk := value[i:min(i+LARGE_CHUNK_BYTES, len(value))]
+
+		chunks = append(chunks, chunk)
+		m.chunks = append(m.chunks, Keccak256(chunk))
+	}
+
+	return m, chunks
+}
+
+func (m *manifest) encode() []byte {
+	data := make([]byte, manifestHeaderSize+len(m.chunks)*KEY_BYTES)
+
+	copy(data, manifestMagic)
+	binary.LittleEndian.PutUint64(data[4:], uint64(m.size))
+	copy(data[12:], m.hash)
+
+	for i, c := range m.chunks {
+		copy(data[manifestHeaderSize+i*KEY_BYTES:], c)
+	}
+
+	return data
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < manifestHeaderSize || string(data[:4]) != manifestMagic {
+		return nil, ErrInvalidManifest
+	}
+
+	size := binary.LittleEndian.Uint64(data[4:])
+	if size > MAX_LARGE_VALUE_BYTES {
+		return nil, ErrInvalidManifest
+	}
+
+	count := (int(size) + LARGE_CHUNK_BYTES - 1) / LARGE_CHUNK_BYTES
+	if len(data) != manifestHeaderSize+count*KEY_BYTES {
+		return nil, ErrInvalidManifest
+	}
+
+	m := &manifest{
+		size:   int(size),
+		hash:   make([]byte, KEY_BYTES),
+		chunks: make([][]byte, count),
+	}
+
+	copy(m.hash, data[12:manifestHeaderSize])
+
+	for i := range m.chunks {
+		m.chunks[i] = make([]byte, KEY_BYTES)
+		copy(m.chunks[i], data[manifestHeaderSize+i*KEY_BYTES:])
+	}
+
+	return m, nil
+}
+
+// StoreLarge stores a value of up to MAX_LARGE_VALUE_BYTES on the network by splitting it into
+// content addressed chunks. The manifest describing the chunks is stored at the provided key
+// once all of the chunks have been stored. The callback will be invoked once
+func (d *DHT) StoreLarge(key, value []byte, ttl time.Duration, callback func(err error)) {
+	if len(key) != KEY_BYTES {
+		callback(errors.New("key must be 32 bytes in length"))
+		return
+	}
+
+	if len(value) > MAX_LARGE_VALUE_BYTES {
+		callback(fmt.Errorf("value must be less than %d bytes in length", MAX_LARGE_VALUE_BYTES))
+		return
+	}
+
+	m, chunks := newManifest(value)
+
+	// chunks with the same contents only need to be stored once
+	unique := make(map[string]int)
+	for i, c := range m.chunks {
+		unique[string(c)] = i
+	}
+
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+
+		sem := make(chan struct{}, largeConcurrency)
+		results := make(chan error, len(unique))
+
+		for _, i := range unique {
+			select {
+			case sem <- struct{}{}:
+			case <-d.quit:
+				callback(ErrClosed)
+				return
+			}
+
+			var done sync.Once
+
+			d.Store(m.chunks[i], chunks[i], ttl, func(err error) {
+				// store may report more than one result, so only use the first
+				done.Do(func() {
+					if err != nil {
+						err = fmt.Errorf("failed to store chunk %d: %w", i, err)
+					}
+
+					<-sem
+					results <- err
+				})
+			})
+		}
+
+		var storeErr error
+
+		// the requests of a closed dht may never complete, so don't wait for them
+		for range unique {
+			select {
+			case err := <-results:
+				if err != nil && storeErr == nil {
+					storeErr = err
+				}
+			case <-d.quit:
+				callback(ErrClosed)
+				return
+			}
+		}
+
+		if storeErr != nil {
+			callback(storeErr)
+			return
+		}
+
+		// only store the manifest once all of the chunks it refers to are available
+		var done sync.Once
+
+		d.Store(key, m.encode(), ttl, func(err error) {
+			done.Do(func() {
+				callback(err)
+			})
+		})
+	}()
+}
+
+// FindLarge finds a value that was stored with StoreLarge. Each chunk is retrieved in parallel and
+// verified against the hash in the values manifest. The callback will be invoked once, with a value
+// that is safe to use outside of the callback
+func (d *DHT) FindLarge(key []byte, callback func(value []byte, err error)) {
+	if len(key) != KEY_BYTES {
+		callback(nil, errors.New("key must be 32 bytes in length"))
+		return
+	}
+
+	r := &largeRetrieval{
+		dht:      d,
+		callback: callback,
+	}
+
+	// a lookup will not report that it has finished if it only
+	// finds values that are not valid, so limit the time we wait
+	r.mu.Lock()
+	r.timer = d.config.Clock.AfterFunc(d.config.Timeout*largeTimeoutFactor, func() {
+		r.finish(nil, ErrRequestTimeout)
+	})
+	r.mu.Unlock()
+
+	d.Find(key, func(value []byte, err error) {
+		if err != nil {
+			r.fail(err)
+			return
+		}
+
+		// the key may hold other values, so use the first valid manifest
+		m, err := decodeManifest(value)
+		if err != nil {
+			return
+		}
+
+		r.start(m)
+	})
+}
+
+// tracks the retrieval of the chunks of a large value
+type largeRetrieval struct {
+	dht      *DHT
+	manifest *manifest
+	value    []byte
+	callback func(value []byte, err error)
+	timer    Timer
+	// the number of chunks that have been retrieved
+	retrieved int
+	started   bool
+	finished  bool
+	mu        sync.Mutex
+}
+
+// starts retrieving the chunks described by a manifest
+func (r *largeRetrieval) start(m *manifest) {
+	r.mu.Lock()
+
+	if r.started || r.finished {
+		r.mu.Unlock()
+		return
+	}
+
+	r.started = true
+	r.manifest = m
+	r.value = make([]byte, m.size)
+
+	r.mu.Unlock()
+
+	if len(m.chunks) == 0 {
+		r.complete()
+		return
+	}
+
+	r.dht.wg.Add(1)
+
+	go func() {
+		defer r.dht.wg.Done()
+
+		sem := make(chan struct{}, largeConcurrency)
+
+		for i := range m.chunks {
+			if r.isFinished() {
+				return
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-r.dht.quit:
+				r.finish(nil, ErrClosed)
+				return
+			}
+
+			// the slot is released once the chunk is found or the lookup completes,
+			// as a lookup that only finds other values completes without an error
+			var done sync.Once
+			var found atomic.Bool
+
+			release := func() {
+				done.Do(func() {
+					<-sem
+				})
+			}
+
+			r.dht.Find(m.chunks[i], func(value []byte, err error) {
+				// errors are reported once the lookup has completed
+				if err != nil {
+					return
+				}
+
+				// ignore any value at the chunks key that is not the chunk we want
+				if !bytes.Equal(Keccak256(value), m.chunks[i]) || !found.CompareAndSwap(false, true) {
+					return
+				}
+
+				release()
+				r.chunk(i, value)
+			}, func(o *findOptions) {
+				o.done = func(err error) {
+					release()
+
+					if found.Load() {
+						return
+					}
+
+					if err == nil {
+						err = ErrChunkIntegrity
+					}
+
+					r.finish(nil, fmt.Errorf("failed to find chunk %d: %w", i, err))
+				}
+			})
+		}
+	}()
+}
+
+// copies a verified chunk into the value
+func (r *largeRetrieval) chunk(i int, data []byte) {
+	r.mu.Lock()
+
+	if r.finished {
+		r.mu.Unlock()
+		return
+	}
+
+	// the size of the chunk must match the size of the value in the manifest
+	offset := i * LARGE_CHUNK_BYTES
+
+	if len(data) != min(LARGE_CHUNK_BYTES, len(r.value)-offset) {
+		r.mu.Unlock()
+		r.finish(nil, ErrChunkIntegrity)
+		return
+	}
+
+	copy(r.value[offset:], data)
+	r.retrieved++
+
+	complete := r.retrieved == len(r.manifest.chunks)
+
+	r.mu.Unlock()
+
+	if complete {
+		r.complete()
+	}
+}
+
+// verifies the complete value matches the manifest
+func (r *largeRetrieval) complete() {
+	if !bytes.Equal(Keccak256(r.value), r.manifest.hash) {
+		r.finish(nil, ErrChunkIntegrity)
+		return
+	}
+
+	r.finish(r.value, nil)
+}
+
+// fails the retrieval if we have not yet found a manifest
+func (r *largeRetrieval) fail(err error) {
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+
+	if !started {
+		r.finish(nil, err)
+	}
+}
+
+func (r *largeRetrieval) isFinished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.finished
+}
+
+// calls the user provided callback if it has not already been called
+func (r *largeRetrieval) finish(value []byte, err error) {
+	r.mu.Lock()
+
+	if r.finished {
+		r.mu.Unlock()
+		return
+	}
+
+	r.finished = true
+	r.timer.Stop()
+
+	r.mu.Unlock()
+
+	r.callback(value, err)
+}
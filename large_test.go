@@ -0,0 +1,159 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestEncodeDecode(t *testing.T) {
+	value := make([]byte, LARGE_CHUNK_BYTES*3+100)
+	rand.Read(value)
+
+	m, chunks := newManifest(value)
+	require.Len(t, chunks, 4)
+	assert.Len(t, chunks[3], 100)
+
+	dm, err := decodeManifest(m.encode())
+	require.Nil(t, err)
+	assert.Equal(t, m, dm)
+
+	for i := range chunks {
+		assert.Equal(t, Keccak256(chunks[i]), dm.chunks[i])
+	}
+
+	// truncated, extended and non manifest values should be rejected
+	data := m.encode()
+
+	_, err = decodeManifest(data[:len(data)-1])
+	assert.ErrorIs(t, err, ErrInvalidManifest)
+
+	_, err = decodeManifest(append(data, 0))
+	assert.ErrorIs(t, err, ErrInvalidManifest)
+
+	_, err = decodeManifest(randomID())
+	assert.ErrorIs(t, err, ErrInvalidManifest)
+}
+
+func TestDHTClusterStoreFindLarge(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	var dhts []*DHT
+
+	// add some nodes to the network
+	for i := 0; i < 2; i++ {
+		c := &Config{
+			LocalID:       randomID(),
+			ListenAddress: fmt.Sprintf("127.0.0.1:%d", 9001+i),
+			BootstrapAddresses: []string{
+				bc.ListenAddress,
+			},
+			Listeners: 1,
+			Timeout:   time.Second,
+		}
+
+		dht, err := New(c)
+		require.Nil(t, err)
+		defer dht.Close()
+
+		dhts = append(dhts, dht)
+	}
+
+	ch := make(chan error, 1)
+
+	// store a value that spans many chunks
+	key := randomID()
+	value := make([]byte, 1<<20+123)
+	rand.Read(value)
+
+	bdht.StoreLarge(key, value, time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	var rv []byte
+
+	dhts[1].FindLarge(key, func(v []byte, err error) {
+		rv = v
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+	assert.Equal(t, value, rv)
+
+	// a key that holds a normal value should not be treated as a large value
+	key = randomID()
+
+	bdht.Store(key, randomID(), time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	dhts[0].FindLarge(key, func(v []byte, err error) {
+		ch <- err
+	})
+
+	assert.NotNil(t, <-ch)
+
+	// chunks that only hold other values should fail the retrieval, even
+	// when there are more of them than are retrieved concurrently
+	key = randomID()
+	value = make([]byte, LARGE_CHUNK_BYTES*(largeConcurrency+1))
+	rand.Read(value)
+
+	m, _ := newManifest(value)
+
+	for _, c := range m.chunks {
+		bdht.Store(c, randomID(), time.Hour, func(err error) {
+			ch <- err
+		})
+
+		require.Nil(t, <-ch)
+	}
+
+	bdht.Store(key, m.encode(), time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	dhts[1].FindLarge(key, func(v []byte, err error) {
+		ch <- err
+	})
+
+	assert.ErrorIs(t, <-ch, ErrChunkIntegrity)
+}
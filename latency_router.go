@@ -43,7 +43,7 @@ func (lr *latencyRouter) measureNodeLatency(n *node) time.Duration {
 		return n.latency
 	}
 
-	start := time.Now()
+	start := lr.dht.config.Clock.Now()
 	done := make(chan error, 1)
 
 	// Use existing ping mechanism
@@ -51,7 +51,7 @@ func (lr *latencyRouter) measureNodeLatency(n *node) time.Duration {
 	buf := lr.dht.pool.Get().(*flatbuffers.Builder)
 	defer lr.dht.pool.Put(buf)
 
-	req := eventPing(buf, rid, lr.dht.config.LocalID)
+	req := eventPing(buf, rid, lr.dht.config.LocalID, lr.dht.nat.client(), lr.dht.config.ClientMode, lr.dht.config.NetworkID)
 	err := lr.dht.listeners[0].request(n.address, rid, req, func(event *protocol.Event, err error) bool {
 		done <- err
 		return true
@@ -68,12 +68,14 @@ func (lr *latencyRouter) measureNodeLatency(n *node) time.Duration {
 			atomic.AddInt32(&n.failCount, 1)
 			return time.Hour
 		}
-		latency := time.Since(start)
+		latency := lr.dht.config.Clock.Since(start)
 		atomic.StoreInt32(&n.failCount, 0)
 		return latency
-	case <-time.After(lr.threshold):
+	case <-lr.dht.config.Clock.After(lr.threshold):
 		atomic.AddInt32(&n.failCount, 1)
 		return time.Hour
+	case <-lr.dht.quit:
+		return time.Hour
 	}
 }
 
@@ -117,14 +119,14 @@ func (lr *latencyRouter) GetBestRoutes(target []byte, count int) []*node {
 }
 
 func (lr *latencyRouter) startLatencyUpdates() {
-	ticker := time.NewTicker(latencyCheckInterval)
+	ticker := lr.dht.config.Clock.NewTicker(latencyCheckInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-lr.dht.quit:
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			lr.updateAllNodeLatencies()
 		}
 	}
@@ -0,0 +1,125 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fails the test run if any of the package's goroutines are still running once every test has finished
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if code == 0 {
+		leaks := leakedGoroutines(nil, time.Second*5)
+		if len(leaks) > 0 {
+			fmt.Fprintf(os.Stderr, "found %d leaked goroutines:\n\n%s\n", len(leaks), strings.Join(leaks, "\n\n"))
+			code = 1
+		}
+	}
+
+	os.Exit(code)
+}
+
+var goroutineID = regexp.MustCompile(`^goroutine (\d+) `)
+
+// returns the stacks of the running goroutines, keyed by their id
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	stacks := make(map[string]string)
+
+	// the first stack is the goroutine calling this
+	for _, stack := range strings.Split(string(buf), "\n\n")[1:] {
+		id := goroutineID.FindStringSubmatch(stack)
+		if id != nil {
+			stacks[id[1]] = stack
+		}
+	}
+
+	return stacks
+}
+
+// returns the stacks of the goroutines running the package's code that are not in the
+// ignored set, waiting up to the timeout for them to stop
+func leakedGoroutines(ignore map[string]string, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var leaks []string
+
+		for id, stack := range goroutines() {
+			_, ok := ignore[id]
+			if !ok && strings.Contains(stack, "github.com/tos-network/emo.") {
+				leaks = append(leaks, stack)
+			}
+		}
+
+		if len(leaks) == 0 || time.Now().After(deadline) {
+			return leaks
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestDHTCloseStopsGoroutines(t *testing.T) {
+	before := goroutines()
+
+	bootstrap, err := New(&Config{
+		ListenAddress:  "127.0.0.1:9000",
+		Listeners:      2,
+		Timeout:        time.Second,
+		StorageBackend: LevelDBStorage,
+		LevelDBPath:    t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	dht, err := New(&Config{
+		ListenAddress:      "127.0.0.1:9001",
+		BootstrapAddresses: []string{"127.0.0.1:9000"},
+		Listeners:          2,
+		Timeout:            time.Second,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, dht.Close())
+	require.NoError(t, bootstrap.Close())
+
+	// closing again is a no-op
+	require.NoError(t, dht.Close())
+
+	assert.Empty(t, leakedGoroutines(before, time.Second*5))
+}
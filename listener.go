@@ -17,174 +17,423 @@
 package emo
 
 import (
-	"encoding/hex"
+	"bytes"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"math/rand"
 	"net"
-	"sync"
 	"time"
 
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/tos-network/emo/protocol"
-	"golang.org/x/net/ipv4"
 )
 
-// a udp socket listener that processes incoming and outgoing packets
+// a listener that handles the events received by a transport and sends events to other nodes
 type listener struct {
-	// udp listener
-	conn *ipv4.PacketConn
+	// udp transport the listener receives events from
+	udp *udpTransport
+	// sends events over the fallback transport instead of udp when needed, nil if there is no fallback
+	fallback *fallbackRouter
 	// routing table
 	routing *routingTable
 	// request cache
 	cache *cache
 	// storage for all values
 	storage Storage
-	// packet manager for large packets
-	packet *packetManager
+	// storage for provider records
+	providers *providerStore
+	// subscriptions to keys
+	pubsub *pubsub
+	// rate limits requests and bans misbehaving peers
+	limiter *limiter
+	// tracks what other nodes can see of us through any nat we are behind
+	nat *natTracker
+	// set if we only make requests and don't store values for other nodes
+	clientMode bool
+	// the network our events are marked with. events from other networks are dropped
+	network uint32
+	// receives measurements of the events we send and receive
+	metrics Metrics
 	// flatbuffers buffer
 	buffer *flatbuffers.Builder
 	// local node id
 	localID []byte
 	// the amount of time before a request expires and times out
 	timeout time.Duration
-	// the size in bytes of the sockets send and receive buffer
-	bufferSize int
-	// collection of messages that will be read to in batch from the underlying socket
-	readBatch []ipv4.Message
-	// collection of messages that will be written in batch to the underlying socket
-	writeBatch []ipv4.Message
-	// size of the current write batch
-	writeBatchSize int
-	// mutex to protect writes to the write batch
-	mu sync.Mutex
-	// timer to schedule flushes to the underlying socket
-	ftimer *time.Ticker
-	// enables basic logging
-	logging bool
-	// channel to signal the listener to shutdown
-	quit chan struct{}
+	// the clock requests expire by
+	clock Clock
+	// logger with the id of this node attached
+	logger *slog.Logger
 }
 
-func (l *listener) process() {
-	for {
-		select {
-		case <-l.quit:
-			return
-		default:
-			bs, err := l.conn.ReadBatch(l.readBatch, 0)
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					// network connection closed, so
-					// we can shutdown
-					return
-				}
-				panic(err)
-			}
+// handles a single event received from another node. any panic caused by
+// the event is recovered so it can't take down the rest of the node
+func (l *listener) handle(addr *net.UDPAddr, data []byte) {
+	var sender []byte
 
-			for i := 0; i < bs; i++ {
-				// if we have a fragmented packet, continue reading data
-				p := l.packet.assemble(l.readBatch[i].Buffers[0][:l.readBatch[i].N])
-				if p == nil {
-					continue
-				}
+	defer func() {
+		r := recover()
+		if r != nil {
+			l.logger.Error("recovered from panic handling event", addrAttr(addr), slog.Any("panic", r))
+			l.limiter.penalize(addr, errMalformedEvent)
+		}
+	}()
 
-				addr := l.readBatch[i].Addr.(*net.UDPAddr)
+	var transferKeys, negotiate bool
 
-				var transferKeys bool
+	// check the event is well formed before we read any of its fields
+	e, err := verifyEvent(data)
+	if err != nil {
+		l.limiter.penalize(addr, err)
 
-				// log.Println("received event from:", addr, "size:", rb)
+		// the header of the event could be read, so let the sender know its request
+		// was malformed if it is a peer we know. the sender of the event is not
+		// authenticated, so replies to unknown senders could be reflected at others
+		if e != nil && !e.Response() {
+			l.reject(e, addr, err)
+		}
 
-				e := protocol.GetRootAsEvent(p.data(), 0)
+		return
+	}
 
-				// attempt to update the node first, but if it doesn't exist, insert it
-				if !l.routing.seen(e.SenderBytes()) {
-					if l.logging {
-						log.Printf("discovered new node id: %s address: %s", hex.EncodeToString(e.SenderBytes()), addr.String())
-					}
+	sender = e.SenderBytes()
 
-					// insert/update the node in the routing table
-					nid := make([]byte, e.SenderLength())
-					copy(nid, e.SenderBytes())
+	// drop events from nodes in other networks before they can
+	// be added to our routing table or count against rate limits
+	if e.Network() != l.network {
+		l.logger.Debug("dropped event from another network", addrAttr(addr), hexAttr(logPeerID, sender), slog.Uint64("network", uint64(e.Network())))
+		l.metrics.AddCounter("emo_listener_events_dropped_total", 1, "reason", "network")
+		l.limiter.dropForeign()
+		return
+	}
 
-					l.routing.insert(nid, addr, time.Duration(0), false)
+	l.metrics.AddCounter("emo_listener_events_received_total", 1, "event", eventLabel(e.Event()))
+	l.metrics.AddCounter("emo_listener_bytes_received_total", float64(len(data)), "event", eventLabel(e.Event()))
+
+	if debugEnabled(l.logger) {
+		l.logger.Debug(
+			"received event",
+			addrAttr(addr),
+			hexAttr(logPeerID, sender),
+			slog.String(logEvent, eventLabel(e.Event())),
+			hexAttr(logRequest, e.IdBytes()),
+			slog.Bool(logResponse, e.Response()),
+			slog.Int(logSize, len(data)),
+		)
+	}
 
-					// this node is new to us, so we should send it any
-					// keys that are closer to it than to us
-					transferKeys = true
-				}
+	// silently drop requests that exceed the senders rate limits before they can be added to
+	// our routing table or handled. replying would only add to the load on an overloaded node.
+	// the sender's node id is only limited once we know the node at this address
+	if !e.Response() {
+		var bound []byte
+		if l.routing.at(sender, addr) {
+			bound = sender
+		}
+
+		if !l.limiter.allow(addr, bound, e.Event()) {
+			return
+		}
+	}
 
-				// if this is a response to a query, send the response event to
-				// the registered callback
-				if e.Response() {
-					// update the senders last seen time in the routing table
-					l.cache.callback(e.IdBytes(), e, nil)
-					l.packet.done(p)
+	// a request from a node we haven't contacted shows that we can be reached
+	if !e.Response() {
+		l.nat.inbound(addr, e.Event() == protocol.EventTypePING && e.Introduced())
+	}
 
-					continue
-				}
+	// attempt to update the node first, but if it doesn't exist, insert it. nodes in client
+	// mode don't serve requests, so they are never added to our routing table
+	if !l.routing.seen(sender) && !e.Passive() {
+		l.logger.Debug("discovered new node", addrAttr(addr), hexAttr(logPeerID, sender))
 
-				// handle request
-				switch e.Event() {
-				case protocol.EventTypePING:
-					err = l.pong(e, addr)
-				case protocol.EventTypeSTORE:
-					err = l.store(e, addr)
-				case protocol.EventTypeFIND_NODE:
-					err = l.findNode(e, addr)
-				case protocol.EventTypeFIND_VALUE:
-					err = l.findValue(e, addr)
-				}
+		// insert/update the node in the routing table
+		nid := make([]byte, e.SenderLength())
+		copy(nid, sender)
 
-				if err != nil {
-					log.Println("failed to handle request: ", err.Error())
-					l.packet.done(p)
-					continue
-				}
+		l.routing.insert(nid, addr, time.Duration(0), false)
 
-				// TODO : this is going to end up with the receiver being ddos'ed
-				// with keys if storage is holding a large amount of values
-				// also, it's going to receive duplicate keys from other nodes?
-				// this will also lock our storage map and make us unresponsive to
-				// requests, potentially taking us out of other nodes routing tables.
-				// that may have a cascading effect...
-				if transferKeys {
-					l.transferKeys(addr, e.SenderBytes())
-				}
+		// this node is new to us, so we should send it any keys that are
+		// closer to it than to us, unless we are a client that stores nothing
+		transferKeys = !l.clientMode
 
-				l.packet.done(p)
-			}
+		// if the node hasn't told us its version and capabilities,
+		// ping it so it will advertise them in its response
+		negotiate = e.Event() != protocol.EventTypePING && e.Event() != protocol.EventTypePONG
+	}
+
+	// pings and pongs advertise the senders version, capabilities and reachability
+	if e.Event() == protocol.EventTypePING || e.Event() == protocol.EventTypePONG {
+		l.routing.advertise(sender, addr, e.Version(), e.Capabilities(), e.Client())
+	}
+
+	// pongs report the address the sender saw our ping come from
+	if e.Event() == protocol.EventTypePONG && e.ObservedLength() == nodeAddressBytes {
+		l.nat.observe(addr, decodeAddress(e.ObservedBytes()))
+	}
+
+	// if this is a response to a query, send the response event to
+	// the registered callback
+	if e.Response() {
+		switch {
+		case e.Event() == protocol.EventTypeERROR:
+			// the request failed, so return the error to the callback
+			l.cache.callback(e.IdBytes(), nil, responseError(e))
+		case knownEvent(e.Event()):
+			// update the senders last seen time in the routing table
+			l.cache.callback(e.IdBytes(), e, nil)
+		}
+
+		if negotiate {
+			l.ping(addr)
 		}
+
+		return
+	}
+
+	// handle request
+	switch e.Event() {
+	case protocol.EventTypePING:
+		err = l.pong(e, addr)
+	case protocol.EventTypeSTORE:
+		err = l.store(e, addr)
+	case protocol.EventTypeFIND_NODE:
+		err = l.findNode(e, addr)
+	case protocol.EventTypeFIND_VALUE:
+		err = l.findValue(e, addr)
+	case protocol.EventTypeADD_PROVIDER:
+		err = l.addProvider(e, addr)
+	case protocol.EventTypeGET_PROVIDERS:
+		err = l.getProviders(e, addr)
+	case protocol.EventTypeSUBSCRIBE:
+		err = l.subscribe(e, addr)
+	case protocol.EventTypeNOTIFY:
+		err = l.notify(e)
+	case protocol.EventTypePONG, protocol.EventTypeERROR:
+		// these are only sent as responses, so there is nothing to handle
+	default:
+		// the event was added by a newer version of the protocol
+		err = fmt.Errorf("unsupported event type %d: %w", e.Event(), ErrUnsupportedEvent)
+	}
+
+	if err != nil {
+		l.logger.Warn(
+			"failed to handle request",
+			addrAttr(addr),
+			hexAttr(logPeerID, sender),
+			slog.String(logEvent, eventLabel(e.Event())),
+			hexAttr(logRequest, e.IdBytes()),
+			errAttr(err),
+		)
+		l.limiter.penalize(addr, err)
+		l.reject(e, addr, err)
+		return
+	}
+
+	if negotiate {
+		l.ping(addr)
+	}
+
+	// TODO : this is going to end up with the receiver being ddos'ed
+	// with keys if storage is holding a large amount of values
+	// also, it's going to receive duplicate keys from other nodes?
+	// this will also lock our storage map and make us unresponsive to
+	// requests, potentially taking us out of other nodes routing tables.
+	// that may have a cascading effect...
+	if transferKeys {
+		l.transferKeys(addr, sender)
 	}
 }
 
-// send a pong response to the sender
+// send a pong response to the sender, then help it traverse any nat it is behind if it asked us to
 func (l *listener) pong(event *protocol.Event, addr *net.UDPAddr) error {
-	resp := eventPong(l.buffer, event.IdBytes(), l.localID)
+	resp := eventPong(l.buffer, event.IdBytes(), l.localID, l.nat.client(), l.clientMode, l.network, addr)
 
-	return l.write(addr, event.IdBytes(), resp)
+	err := l.write(addr, event.IdBytes(), resp)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case event.Dialback():
+		l.dialback(event, addr)
+	case event.RelayLength() == nodeAddressBytes:
+		l.relay(addr, decodeAddress(event.RelayBytes()))
+	case event.PunchLength() == nodeAddressBytes:
+		l.punch(addr, decodeAddress(event.PunchBytes()))
+	}
+
+	return nil
 }
 
-// store a value from the sender and send a response to confirm
+// asks another node to ping the sender, to test whether it can be reached by a node it hasn't contacted
+func (l *listener) dialback(event *protocol.Event, addr *net.UDPAddr) {
+	var candidates []*node
+
+	for _, n := range l.routing.closestN(pseudorandomID(), K) {
+		if bytes.Equal(n.id, l.localID) || bytes.Equal(n.id, event.SenderBytes()) || n.address.IP.Equal(addr.IP) {
+			continue
+		}
+
+		if n.has(CapabilityNATTraversal) && !n.isClient() {
+			candidates = append(candidates, n)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	l.introduce(addr, candidates[rand.Intn(len(candidates))].address)
+}
+
+// asks the node at the target address to ping the sender, opening a path through the targets nat.
+// only nodes we are in contact with are asked, so we can't be used to send pings to anyone
+func (l *listener) relay(from, target *net.UDPAddr) {
+	if !l.nat.recent(target) {
+		return
+	}
+
+	l.introduce(from, target)
+}
+
+// asks the node at the target address to ping a node
+func (l *listener) introduce(from, target *net.UDPAddr) {
+	rid := pseudorandomID()
+	req := eventTraversalPing(l.buffer, rid, l.localID, l.nat.client(), l.clientMode, l.network, false, false, nil, from)
+
+	err := l.write(target, rid, req)
+	if err != nil {
+		l.logger.Warn("failed to relay ping", addrAttr(target), errAttr(err))
+	}
+}
+
+// pings a node a relay has asked us to, opening a path to it through our nat. the ping
+// isn't expected to make it through the other nodes nat, so no response is waited for
+func (l *listener) punch(relay, target *net.UDPAddr) {
+	if !l.nat.punchable(relay) {
+		l.logger.Debug("ignored punch request from relay", addrAttr(relay))
+		return
+	}
+
+	rid := pseudorandomID()
+	req := eventTraversalPing(l.buffer, rid, l.localID, l.nat.client(), l.clientMode, l.network, false, true, nil, nil)
+
+	// the ping opens the path that the target's requests will come through
+	l.nat.contact(target)
+
+	err := l.write(target, rid, req)
+	if err != nil {
+		l.logger.Warn("failed to punch through nat", addrAttr(target), errAttr(err))
+	}
+}
+
+// send a ping to a node so it advertises its version and capabilities in its pong
+func (l *listener) ping(addr *net.UDPAddr) {
+	rid := pseudorandomID()
+	req := eventPing(l.buffer, rid, l.localID, l.nat.client(), l.clientMode, l.network)
+
+	err := l.request(addr, rid, req, func(event *protocol.Event, err error) bool {
+		// the pong is handled like any other ping or pong
+		return true
+	})
+
+	if err != nil {
+		l.logger.Warn("failed to ping node", addrAttr(addr), errAttr(err))
+	}
+}
+
+// lets the sender of a request know why it failed. errors that were caused by us, such as failing to
+// write to the socket, are not sent. requests advertise the capabilities of their sender, so errors can
+// be sent to nodes that aren't in our routing table. as the address of those nodes may be spoofed, they
+// are only sent the error code, so the error is smaller than the request and can't amplify a reflection
+func (l *listener) reject(event *protocol.Event, addr *net.UDPAddr, err error) {
+	code, ok := errorCode(err)
+	if !ok {
+		return
+	}
+
+	message := err.Error()
+
+	if !l.routing.capable(event.SenderBytes(), addr, CapabilityErrors) {
+		if Capability(event.Capabilities())&CapabilityErrors == 0 {
+			return
+		}
+
+		message = ""
+	}
+
+	resp := eventError(l.buffer, event.IdBytes(), l.localID, l.clientMode, l.network, code, message)
+
+	err = l.write(addr, event.IdBytes(), resp)
+	if err != nil {
+		l.logger.Warn("failed to send error response", addrAttr(addr), hexAttr(logRequest, event.IdBytes()), errAttr(err))
+	}
+}
+
+// store a value from the sender and send a response to confirm. nodes in client mode
+// aren't in other nodes routing tables so shouldn't be sent values, and reject any they are
 func (l *listener) store(event *protocol.Event, addr *net.UDPAddr) error {
+	if l.clientMode {
+		return fmt.Errorf("store requests are not served in client mode: %w", ErrUnsupportedEvent)
+	}
+
 	payloadTable := new(flatbuffers.Table)
 
 	if !event.Payload(payloadTable) {
-		return errors.New("invalid store request payload")
+		return fmt.Errorf("invalid store request payload: %w", errMalformedEvent)
 	}
 
 	s := new(protocol.Store)
 	s.Init(payloadTable.Bytes, payloadTable.Pos)
 
+	// reject the entire request if any of the values are too large
 	for i := 0; i < s.ValuesLength(); i++ {
 		v := new(protocol.Value)
-		if s.Values(v, i) {
-			l.storage.Set(v.KeyBytes(), v.ValueBytes(), time.Unix(0, v.Created()), time.Duration(v.Ttl()))
+		if s.Values(v, i) && (v.KeyLength() != KEY_BYTES || v.ValueLength() > VALUE_BYTES) {
+			return fmt.Errorf("invalid store request value: %w", errOversizedValue)
 		}
 	}
 
-	resp := eventStoreResponse(l.buffer, event.IdBytes(), l.localID)
+	// values we didn't already hold, which subscribers to their keys are notified of
+	var inserted []*Value
 
-	return l.write(addr, event.IdBytes(), resp)
+	for i := 0; i < s.ValuesLength(); i++ {
+		v := new(protocol.Value)
+		if !s.Values(v, i) {
+			continue
+		}
+
+		added, ok := insertValue(l.storage, v.KeyBytes(), v.ValueBytes(), time.Unix(0, v.Created()), time.Duration(v.Ttl()))
+		if !ok {
+			return fmt.Errorf("failed to store value: %w", ErrStorageFailure)
+		}
+
+		if added {
+			// copy the value as the event is read from a buffer that will be reused
+			inserted = append(inserted, &Value{
+				Key:     append([]byte(nil), v.KeyBytes()...),
+				Value:   append([]byte(nil), v.ValueBytes()...),
+				TTL:     time.Duration(v.Ttl()),
+				Created: time.Unix(0, v.Created()),
+			})
+		}
+	}
+
+	resp := eventStoreResponse(l.buffer, event.IdBytes(), l.localID, l.clientMode, l.network)
+
+	err := l.write(addr, event.IdBytes(), resp)
+	if err != nil {
+		return err
+	}
+
+	// notify anyone that has subscribed to the keys we have stored. values that are
+	// refreshed or replicated to us are already held, so don't notify them again
+	for _, v := range inserted {
+		l.pubsub.publish(l.buffer, l.localID, l.clientMode, l.network, v.Key, []*Value{v}, l.write)
+	}
+
+	return nil
 }
 
 // find all given nodes
@@ -192,16 +441,16 @@ func (l *listener) findNode(event *protocol.Event, addr *net.UDPAddr) error {
 	payloadTable := new(flatbuffers.Table)
 
 	if !event.Payload(payloadTable) {
-		return errors.New("invalid find node request payload")
+		return fmt.Errorf("invalid find node request payload: %w", errMalformedEvent)
 	}
 
 	f := new(protocol.FindNode)
 	f.Init(payloadTable.Bytes, payloadTable.Pos)
 
 	// find the K closest neighbours to the given target
-	nodes := l.routing.closestN(f.KeyBytes(), K)
+	nodes := l.routing.closestServing(f.KeyBytes(), K)
 
-	resp := eventFindNodeResponse(l.buffer, event.IdBytes(), l.localID, nodes)
+	resp := eventFindNodeResponse(l.buffer, event.IdBytes(), l.localID, l.clientMode, l.network, nodes)
 
 	return l.write(addr, event.IdBytes(), resp)
 }
@@ -210,65 +459,192 @@ func (l *listener) findValue(event *protocol.Event, addr *net.UDPAddr) error {
 	payloadTable := new(flatbuffers.Table)
 
 	if !event.Payload(payloadTable) {
-		return errors.New("invalid find node request payload")
+		return fmt.Errorf("invalid find value request payload: %w", errMalformedEvent)
 	}
 
 	f := new(protocol.FindValue)
 	f.Init(payloadTable.Bytes, payloadTable.Pos)
 
 	vs, ok := l.storage.Get(f.KeyBytes(), time.Unix(0, f.From()))
-	if ok {
-		// we found the key in our storage, so we return it to the requester
-		// construct the find node table
+	if ok && f.Until() > 0 {
+		vs = valuesUntil(vs, time.Unix(0, f.Until()))
+	}
+
+	if ok && len(vs) > 0 {
+		// we found the key in our storage, so we return a single page of its
+		// values ordered by the time they were created, along with a cursor
+		// the requester can use to fetch the next page. the built in storages
+		// keep values in this order, so they are only sorted by custom storages
+		vs = sortValues(vs)
+
+		values, cursor := pageValues(vs, f.CursorBytes(), int(f.Limit()))
+
+		resp := eventFindValueFoundResponse(l.buffer, event.IdBytes(), l.localID, l.clientMode, l.network, values, len(vs), cursor)
+
+		return l.write(addr, event.IdBytes(), resp)
+	}
+
+	// we didn't find the key, so we find the K closest neighbours to the given target
+	nodes := l.routing.closestServing(f.KeyBytes(), K)
+	resp := eventFindValueNotFoundResponse(l.buffer, event.IdBytes(), l.localID, l.clientMode, l.network, nodes)
+
+	return l.write(addr, event.IdBytes(), resp)
+}
+
+// record the sender as a provider of a key, using the address we received the request from
+func (l *listener) addProvider(event *protocol.Event, addr *net.UDPAddr) error {
+	payloadTable := new(flatbuffers.Table)
 
-		vcap := 1100
+	if !event.Payload(payloadTable) {
+		return fmt.Errorf("invalid add provider request payload: %w", errMalformedEvent)
+	}
+
+	a := new(protocol.AddProvider)
+	a.Init(payloadTable.Bytes, payloadTable.Pos)
+
+	// take a copy of the address as it belongs to the read batch
+	paddr := &net.UDPAddr{
+		IP:   append(net.IP(nil), addr.IP...),
+		Port: addr.Port,
+	}
+
+	sender := append([]byte(nil), event.SenderBytes()...)
+	key := append([]byte(nil), a.KeyBytes()...)
+	ttl := time.Duration(a.Ttl())
 
-		if len(vs) < vcap {
-			vcap = len(vs)
+	// the record points other nodes at the address the announcement came from, so
+	// the sender must prove it can be reached there before the record is stored
+	return l.proven(event, paddr, func(buf *flatbuffers.Builder, id []byte) ([]byte, error) {
+		if !l.providers.add(key, sender, paddr, ttl) {
+			return nil, fmt.Errorf("too many provider records: %w", ErrQuotaExceeded)
 		}
 
-		// we can fix a maximum of ~1055 values into a single udp packet, assuming empty values.
-		// calculated as: 65535 - 112 (event overhead) / 62 (value table with value length of 0)
+		return eventAddProviderResponse(buf, id, l.localID, l.clientMode, l.network), nil
+	})
+}
 
-		// TODO we don't need this here, just slice the results from get appropriately
-		values := make([]*Value, 0, vcap)
-		var size int // total size of the current values
+// return the providers we know of for a key, along with the K closest neighbours to it
+func (l *listener) getProviders(event *protocol.Event, addr *net.UDPAddr) error {
+	payloadTable := new(flatbuffers.Table)
 
-		for i := range vs {
-			if size >= MaxEventSize {
-				resp := eventFindValueFoundResponse(l.buffer, event.IdBytes(), l.localID, values, len(vs))
+	if !event.Payload(payloadTable) {
+		return fmt.Errorf("invalid get providers request payload: %w", errMalformedEvent)
+	}
 
-				err := l.write(addr, event.IdBytes(), resp)
-				if err != nil {
-					return err
-				}
+	g := new(protocol.GetProviders)
+	g.Init(payloadTable.Bytes, payloadTable.Pos)
 
-				// reset the values array and size
-				values = values[:0]
-				size = 0
-			}
+	providers := l.providers.get(g.KeyBytes(), MaxProvidersPerKey)
+	nodes := l.routing.closestServing(g.KeyBytes(), K)
 
-			// add the remaining value to the array
-			// for the next packet. 50 is the overhead
-			// of the data in the value table
-			values = append(values, vs[i])
-			size = size + len(vs[i].Key) + len(vs[i].Value) + 50
+	resp := eventGetProvidersResponse(l.buffer, event.IdBytes(), l.localID, l.clientMode, l.network, providers, nodes)
+
+	return l.write(addr, event.IdBytes(), resp)
+}
+
+// register the sender as a subscriber to a key, using the address we received the request from
+func (l *listener) subscribe(event *protocol.Event, addr *net.UDPAddr) error {
+	payloadTable := new(flatbuffers.Table)
+
+	if !event.Payload(payloadTable) {
+		return fmt.Errorf("invalid subscribe request payload: %w", errMalformedEvent)
+	}
+
+	sb := new(protocol.Subscribe)
+	sb.Init(payloadTable.Bytes, payloadTable.Pos)
+
+	// take a copy of the address as it belongs to the read batch
+	saddr := &net.UDPAddr{
+		IP:   append(net.IP(nil), addr.IP...),
+		Port: addr.Port,
+	}
+
+	sender := append([]byte(nil), event.SenderBytes()...)
+	key := append([]byte(nil), sb.KeyBytes()...)
+	lease := time.Duration(sb.Lease())
+
+	// the source address of the request could be spoofed, which would send notifications to another
+	// host, so only accept the subscription once the sender has proven it can be reached there
+	return l.proven(event, saddr, func(buf *flatbuffers.Builder, id []byte) ([]byte, error) {
+		if !l.pubsub.subscribe(key, sender, saddr, lease) {
+			return nil, fmt.Errorf("too many subscribers: %w", ErrQuotaExceeded)
 		}
 
-		// send any unfinished values
-		if len(values) > 0 {
-			resp := eventFindValueFoundResponse(l.buffer, event.IdBytes(), l.localID, values, len(vs))
-			return l.write(addr, event.IdBytes(), resp)
+		return eventSubscribeResponse(buf, id, l.localID, l.clientMode, l.network), nil
+	})
+}
+
+// handles a request that records the address it was sent from once the sender has answered a ping sent
+// to that address, pinging it first if it hasn't done so recently. handle returns the response to send,
+// building it with the given buffer, as it may run after the request's buffer has been reused
+func (l *listener) proven(event *protocol.Event, addr *net.UDPAddr, handle func(buf *flatbuffers.Builder, id []byte) ([]byte, error)) error {
+	if l.pubsub.isProven(addr) {
+		resp, err := handle(l.buffer, event.IdBytes())
+		if err != nil {
+			return err
 		}
 
-		return nil
+		return l.write(addr, event.IdBytes(), resp)
 	}
 
-	// we didn't find the key, so we find the K closest neighbours to the given target
-	nodes := l.routing.closestN(f.KeyBytes(), K)
-	resp := eventFindValueNotFoundResponse(l.buffer, event.IdBytes(), l.localID, nodes)
+	id := append([]byte(nil), event.IdBytes()...)
 
-	return l.write(addr, event.IdBytes(), resp)
+	rid := pseudorandomID()
+	req := eventPing(l.buffer, rid, l.localID, l.nat.client(), l.clientMode, l.network)
+
+	return l.request(addr, rid, req, func(ev *protocol.Event, err error) bool {
+		if err != nil {
+			return true
+		}
+
+		l.pubsub.prove(addr)
+
+		// the callback may not run on this listener, so it can't use our buffer
+		buf := flatbuffers.NewBuilder(128)
+
+		resp, err := handle(buf, id)
+		if err != nil {
+			code, _ := errorCode(err)
+			resp = eventError(buf, id, l.localID, l.clientMode, l.network, code, err.Error())
+		}
+
+		err = l.write(addr, id, resp)
+		if err != nil {
+			l.logger.Warn("failed to send response", addrAttr(addr), hexAttr(logRequest, id), errAttr(err))
+		}
+
+		return true
+	})
+}
+
+// deliver values published by another node to our subscriptions
+func (l *listener) notify(event *protocol.Event) error {
+	payloadTable := new(flatbuffers.Table)
+
+	if !event.Payload(payloadTable) {
+		return fmt.Errorf("invalid notify payload: %w", errMalformedEvent)
+	}
+
+	n := new(protocol.Notify)
+	n.Init(payloadTable.Bytes, payloadTable.Pos)
+
+	values := make([]*Value, 0, n.ValuesLength())
+
+	for i := 0; i < n.ValuesLength(); i++ {
+		v := new(protocol.Value)
+		if n.Values(v, i) {
+			values = append(values, &Value{
+				Key:     v.KeyBytes(),
+				Value:   v.ValueBytes(),
+				TTL:     time.Duration(v.Ttl()),
+				Created: time.Unix(0, v.Created()),
+			})
+		}
+	}
+
+	l.pubsub.notified(event.SenderBytes(), n.KeyBytes(), values)
+
+	return nil
 }
 
 func (l *listener) transferKeys(to *net.UDPAddr, id []byte) {
@@ -291,19 +667,19 @@ func (l *listener) transferKeys(to *net.UDPAddr, id []byte) {
 			// if we cant fit any more values in this event, send it
 			if size >= MaxEventSize {
 				rid := pseudorandomID()
-				req := eventStoreRequest(l.buffer, rid, l.localID, values)
+				req := eventStoreRequest(l.buffer, rid, l.localID, l.clientMode, l.network, values)
 
 				err := l.request(to, rid, req, func(ev *protocol.Event, err error) bool {
 					if err != nil {
 						// just log this error for now, but it might be best to attempt to resend?
-						log.Println(err)
+						l.logger.Warn("failed to transfer keys", addrAttr(to), hexAttr(logPeerID, id), errAttr(err))
 					}
 					return true
 				})
 
 				if err != nil {
 					// log error and stop sending
-					log.Println(err)
+					l.logger.Warn("failed to transfer keys", addrAttr(to), hexAttr(logPeerID, id), errAttr(err))
 					return false
 				}
 
@@ -327,103 +703,60 @@ func (l *listener) transferKeys(to *net.UDPAddr, id []byte) {
 	// send any unfinished values
 	if len(values) > 0 {
 		rid := pseudorandomID()
-		req := eventStoreRequest(l.buffer, rid, l.localID, values)
+		req := eventStoreRequest(l.buffer, rid, l.localID, l.clientMode, l.network, values)
 
 		err := l.request(to, rid, req, func(ev *protocol.Event, err error) bool {
 			if err != nil {
 				// just log this error for now, but it might be best to attempt to resend?
-				log.Println(err)
+				l.logger.Warn("failed to transfer keys", addrAttr(to), hexAttr(logPeerID, id), errAttr(err))
 			}
 			return true
 		})
 
 		if err != nil {
 			// log error and stop sending
-			log.Println(err)
+			l.logger.Warn("failed to transfer keys", addrAttr(to), hexAttr(logPeerID, id), errAttr(err))
 		}
 	}
 }
 
 func (l *listener) request(to *net.UDPAddr, id []byte, data []byte, cb func(event *protocol.Event, err error) bool) error {
-	// register the callback for this request
-	l.cache.set(id, time.Now().Add(l.timeout), cb)
-
-	return l.write(to, id, data)
-}
-
-func (l *listener) write(to *net.UDPAddr, id, data []byte) error {
-	p := l.packet.fragment(id, data)
-	defer l.packet.done(p)
-
-	f := p.next()
-
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	for f != nil {
-		l.writeBatch[l.writeBatchSize].Addr = to
-		// set the len of the buffer without allocating a new buffer
-		l.writeBatch[l.writeBatchSize].Buffers[0] = l.writeBatch[l.writeBatchSize].Buffers[0][:len(f)]
-		// copy the data from the fragment buffer into the message buffer
-		copy(l.writeBatch[l.writeBatchSize].Buffers[0], f)
-
-		l.writeBatchSize++
-
-		if l.writeBatchSize >= len(l.writeBatch) {
-			err := l.flush(false)
-			if err != nil {
-				return err
+	if l.fallback != nil && !l.fallback.use(to, len(data)) {
+		// the node may not be reachable over udp if it repeatedly doesn't
+		// respond, so send it events over the fallback transport
+		inner := cb
+		cb = func(event *protocol.Event, err error) bool {
+			if errors.Is(err, ErrRequestTimeout) {
+				l.fallback.fail(to)
+			} else {
+				l.fallback.succeed(to)
 			}
+			return inner(event, err)
 		}
-
-		f = p.next()
 	}
 
-	return nil
-}
+	// register the callback for this request
+	l.cache.set(id, l.clock.Now().Add(l.timeout), cb)
 
-func (l *listener) flusher() {
-	defer l.ftimer.Stop()
+	l.nat.contact(to)
 
-	for {
-		select {
-		case <-l.quit:
-			return
-		case <-l.ftimer.C:
-			err := l.flush(true)
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
-				}
-				panic(err)
-			}
-		}
-	}
+	return l.write(to, id, data)
 }
 
-func (l *listener) flush(lock bool) error {
-	if lock {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-	}
+func (l *listener) write(to *net.UDPAddr, id, data []byte) error {
+	event := eventLabel(protocol.GetRootAsEvent(data, 0).Event())
 
-	if l.writeBatchSize < 1 {
-		return nil
-	}
+	l.metrics.AddCounter("emo_listener_events_sent_total", 1, "event", event)
+	l.metrics.AddCounter("emo_listener_bytes_sent_total", float64(len(data)), "event", event)
 
-	_, err := l.conn.WriteBatch(l.writeBatch[:l.writeBatchSize], 0)
-	if err != nil {
-		return err
+	if debugEnabled(l.logger) {
+		l.logger.Debug("sent event", addrAttr(to), slog.String(logEvent, event), hexAttr(logRequest, id), slog.Int(logSize, len(data)))
 	}
 
-	// reset the batch
-	l.writeBatchSize = 0
-
-	return nil
-}
+	if l.fallback.use(to, len(data)) {
+		l.metrics.AddCounter("emo_listener_fallback_events_total", 1, "event", event)
+		return l.fallback.transport.Send(to, data)
+	}
 
-// Close shuts down the listener
-func (l *listener) Close() error {
-	close(l.quit)
-	return l.conn.Close()
+	return l.udp.Send(to, data)
 }
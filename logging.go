@@ -0,0 +1,69 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// the names of the attributes attached to log records
+const (
+	logNode     = "node"
+	logPeer     = "peer"
+	logPeerID   = "peer_id"
+	logEvent    = "event"
+	logRequest  = "request"
+	logKey      = "key"
+	logSize     = "size"
+	logResponse = "response"
+	logError    = "error"
+)
+
+// returns the configured logger, falling back to the default logger.
+// if the deprecated Logging option is set, debug logs are written to stderr
+func configLogger(cfg *Config) *slog.Logger {
+	switch {
+	case cfg.Logger != nil:
+		return cfg.Logger
+	case cfg.Logging:
+		return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	default:
+		return slog.Default()
+	}
+}
+
+// returns true if the logger will record debug logs, so that
+// the attributes of protocol events are only built when needed
+func debugEnabled(logger *slog.Logger) bool {
+	return logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+func hexAttr(key string, b []byte) slog.Attr {
+	return slog.String(key, hex.EncodeToString(b))
+}
+
+func addrAttr(addr *net.UDPAddr) slog.Attr {
+	return slog.String(logPeer, addr.String())
+}
+
+func errAttr(err error) slog.Attr {
+	return slog.String(logError, err.Error())
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a buffer that can be written to by several listeners
+type logBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// returns each of the json log records written to the buffer
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []map[string]any
+
+	s := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+
+	for s.Scan() {
+		var r map[string]any
+		require.Nil(t, json.Unmarshal(s.Bytes(), &r))
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func TestDHTLogging(t *testing.T) {
+	var logs logBuffer
+
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+		Logger:        slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+		Logger:    slog.New(slog.NewJSONHandler(&logBuffer{}, nil)),
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	var received, discovered bool
+
+	for _, r := range logs.records(t) {
+		// every record should identify the node that logged it
+		assert.Equal(t, hex.EncodeToString(bc.LocalID), r[logNode])
+
+		switch r["msg"] {
+		case "received event":
+			if r[logEvent] == "FIND_NODE" {
+				received = true
+				assert.Equal(t, "DEBUG", r["level"])
+				assert.Equal(t, c.ListenAddress, r[logPeer])
+				assert.Equal(t, hex.EncodeToString(c.LocalID), r[logPeerID])
+				assert.Len(t, r[logRequest], KEY_BYTES*2)
+			}
+		case "discovered new node":
+			discovered = true
+			assert.Equal(t, hex.EncodeToString(c.LocalID), r[logPeerID])
+		}
+	}
+
+	assert.True(t, received)
+	assert.True(t, discovered)
+}
@@ -0,0 +1,420 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/tos-network/emo/protocol"
+)
+
+var (
+	// ErrDeleteUnsupported returned when deleting a key from a storage that does not implement StorageDeleter
+	ErrDeleteUnsupported = errors.New("storage does not support deleting keys")
+)
+
+// StorageDeleter can be implemented by a Storage to support deleting keys
+type StorageDeleter interface {
+	// Delete removes all values of a key, returning false if the key does not exist
+	Delete(key []byte) bool
+}
+
+// PeerInfo describes a node in the routing table
+type PeerInfo struct {
+	// ID the id of the node
+	ID []byte
+	// Address the udp address of the node
+	Address *net.UDPAddr
+	// Bucket the routing table bucket that holds the node
+	Bucket int
+	// Latency the latency of the node
+	Latency time.Duration
+	// Seen the last time the node responded to us
+	Seen time.Time
+	// Version the protocol version advertised by the node
+	Version uint32
+	// Capabilities the capabilities advertised by the node
+	Capabilities Capability
+	// Client set if the node has advertised that it can't be reached by nodes it hasn't contacted
+	Client bool
+}
+
+// BucketInfo describes a single bucket in the routing table
+type BucketInfo struct {
+	// Index the index of the bucket, which is the number of leading bits its nodes share with this node
+	Index int
+	// Nodes the number of nodes in the bucket
+	Nodes int
+	// Cached the number of nodes waiting to be promoted to the bucket
+	Cached int
+}
+
+// LookupNode a node found by a lookup
+type LookupNode struct {
+	// ID the id of the node
+	ID []byte
+	// Address the udp address of the node
+	Address *net.UDPAddr
+	// Distance the log distance between the node and the key, which
+	// is the number of bits after the prefix they have in common
+	Distance int
+	// RTT the round trip time of a ping sent to the node
+	RTT time.Duration
+	// Err the error returned when pinging the node, if any
+	Err error
+}
+
+// FindAll finds all values of a key, waiting for the request to complete
+func (d *DHT) FindAll(key []byte, opts ...FindOption) ([][]byte, error) {
+	var values [][]byte
+	var mu sync.Mutex
+
+	done := make(chan error, 1)
+
+	opts = append(opts, func(o *findOptions) {
+		o.done = func(err error) {
+			done <- err
+		}
+	})
+
+	d.Find(key, func(value []byte, err error) {
+		if err != nil {
+			return
+		}
+
+		// values are only valid inside of the callback, so keep a copy
+		v := make([]byte, len(value))
+		copy(v, value)
+
+		mu.Lock()
+		values = append(values, v)
+		mu.Unlock()
+	}, opts...)
+
+	err := <-done
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return values, err
+}
+
+// Delete removes all values of a key that are held by this node, returning false if the key does not exist.
+// Copies of the values held by other nodes will remain until they expire
+func (d *DHT) Delete(key []byte) (bool, error) {
+	if len(key) != KEY_BYTES {
+		return false, fmt.Errorf("key must be %d bytes in length", KEY_BYTES)
+	}
+
+	s, ok := d.storage.(StorageDeleter)
+	if !ok {
+		return false, ErrDeleteUnsupported
+	}
+
+	return s.Delete(key), nil
+}
+
+// Lookup searches the network for the K nodes closest to a key, returning them
+// closest first along with the round trip time of a ping sent to each of them
+func (d *DHT) Lookup(key []byte) ([]LookupNode, error) {
+	if len(key) != KEY_BYTES {
+		return nil, fmt.Errorf("key must be %d bytes in length", KEY_BYTES)
+	}
+
+	var ns []*node
+
+	for _, n := range d.routing.closestN(key, K) {
+		if !bytes.Equal(n.id, d.config.LocalID) {
+			ns = append(ns, n)
+		}
+	}
+
+	if len(ns) == 0 {
+		return nil, errors.New("no nodes found")
+	}
+
+	// the callback can be invoked by several of the requests
+	// that fail, so only wait for the first result
+	ch := make(chan error, 1)
+
+	d.findNodes(ns, key, func(err error) {
+		select {
+		case ch <- err:
+		default:
+		}
+	})
+
+	// the search fails if the last nodes queried don't respond, but the nodes that did
+	// respond will still be in the routing table, and any that are unreachable will
+	// be reported by their pings, so wait for the search to complete and continue
+	<-ch
+
+	var nodes []LookupNode
+
+	for _, n := range d.routing.closestN(key, K) {
+		if bytes.Equal(n.id, d.config.LocalID) {
+			continue
+		}
+
+		nodes = append(nodes, LookupNode{
+			ID:       n.id,
+			Address:  n.address,
+			Distance: KEY_BITS - distance(n.id, key),
+		})
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Distance < nodes[j].Distance
+	})
+
+	var wg sync.WaitGroup
+
+	for i := range nodes {
+		wg.Add(1)
+
+		go func(n *LookupNode) {
+			defer wg.Done()
+			_, n.RTT, n.Err = d.Ping(n.Address.String())
+		}(&nodes[i])
+	}
+
+	wg.Wait()
+
+	return nodes, nil
+}
+
+// Peers returns the nodes held in the routing table
+func (d *DHT) Peers() []PeerInfo {
+	var peers []PeerInfo
+
+	for i := range d.routing.buckets {
+		d.routing.buckets[i].iterate(func(n *node) {
+			if bytes.Equal(n.id, d.config.LocalID) {
+				return
+			}
+
+			peers = append(peers, PeerInfo{
+				ID:           n.id,
+				Address:      n.address,
+				Bucket:       i,
+				Latency:      n.latency,
+				Seen:         n.seen,
+				Version:      atomic.LoadUint32(&n.version),
+				Capabilities: Capability(atomic.LoadUint64(&n.capabilities)),
+				Client:       n.isClient(),
+			})
+		})
+	}
+
+	return peers
+}
+
+// Buckets returns the number of nodes held in each bucket of the routing table
+func (d *DHT) Buckets() []BucketInfo {
+	buckets := make([]BucketInfo, len(d.routing.buckets))
+
+	for i := range d.routing.buckets {
+		b := &d.routing.buckets[i]
+
+		b.mu.Lock()
+		buckets[i] = BucketInfo{
+			Index:  i,
+			Nodes:  b.size,
+			Cached: len(b.cache),
+		}
+		b.mu.Unlock()
+	}
+
+	return buckets
+}
+
+// Ping sends a ping to the node at the given address, returning its id and round trip time
+func (d *DHT) Ping(address string) ([]byte, time.Duration, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type pong struct {
+		id  []byte
+		err error
+	}
+
+	ch := make(chan pong, 1)
+
+	buf := d.pool.Get().(*flatbuffers.Builder)
+	defer d.pool.Put(buf)
+
+	rid := pseudorandomID()
+	req := eventPing(buf, rid, d.config.LocalID, d.nat.client(), d.config.ClientMode, d.config.NetworkID)
+
+	sent := d.config.Clock.Now()
+
+	err = d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+		addr,
+		rid,
+		req,
+		func(event *protocol.Event, err error) bool {
+			if err != nil {
+				ch <- pong{err: err}
+				return true
+			}
+
+			id := make([]byte, event.SenderLength())
+			copy(id, event.SenderBytes())
+
+			ch <- pong{id: id}
+
+			return true
+		},
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	p := <-ch
+	if p.err != nil {
+		return nil, 0, p.err
+	}
+
+	return p.id, d.config.Clock.Since(sent), nil
+}
+
+// Refresh pings every node in the routing table, removing any that are unresponsive,
+// and looks up new nodes to fill any buckets that are not full
+func (d *DHT) Refresh() {
+	d.refreshBuckets()
+}
+
+// Done returns a channel that is closed when the dht has been closed
+func (d *DHT) Done() <-chan struct{} {
+	return d.quit
+}
+
+// Leave hands the values held by this node to the other nodes closest to their keys, then closes the dht
+func (d *DHT) Leave() error {
+	now := d.config.Clock.Now()
+
+	// the values to send to each node
+	handoffs := make(map[string][]*Value)
+	nodes := make(map[string]*node)
+
+	d.storage.Iterate(func(v *Value) bool {
+		// only hand off the remaining lifetime of the value
+		ttl := v.expiry().Sub(now)
+		if ttl <= 0 {
+			return true
+		}
+
+		hv := &Value{
+			Key:     v.Key,
+			Value:   v.Value,
+			TTL:     ttl,
+			Created: v.Created,
+		}
+
+		for _, n := range d.routing.closestN(v.Key, K) {
+			if bytes.Equal(n.id, d.config.LocalID) {
+				continue
+			}
+
+			handoffs[string(n.id)] = append(handoffs[string(n.id)], hv)
+			nodes[string(n.id)] = n
+		}
+
+		return true
+	})
+
+	var wg sync.WaitGroup
+	var herr error
+	var mu sync.Mutex
+
+	failed := func(err error) {
+		mu.Lock()
+		if herr == nil {
+			herr = err
+		}
+		mu.Unlock()
+	}
+
+	buf := d.pool.Get().(*flatbuffers.Builder)
+
+	for id, values := range handoffs {
+		for len(values) > 0 {
+			// fit as many values as we can into a single event.
+			// 50 is the overhead of the data in the value table
+			var size, count int
+
+			for count < len(values) {
+				vsize := len(values[count].Key) + len(values[count].Value) + 50
+
+				// always send at least one value so we make progress
+				if count > 0 && size+vsize > maxPageBytes {
+					break
+				}
+
+				size = size + vsize
+				count++
+			}
+
+			rid := pseudorandomID()
+			req := eventStoreRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, values[:count])
+
+			values = values[count:]
+
+			wg.Add(1)
+
+			err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+				nodes[id].address,
+				rid,
+				req,
+				func(event *protocol.Event, err error) bool {
+					if err != nil {
+						failed(err)
+					}
+					wg.Done()
+					return true
+				},
+			)
+
+			if err != nil {
+				wg.Done()
+				failed(err)
+			}
+		}
+	}
+
+	d.pool.Put(buf)
+
+	wg.Wait()
+
+	err := d.Close()
+	if err != nil {
+		return err
+	}
+
+	return herr
+}
@@ -0,0 +1,339 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tos-network/emo/protocol"
+)
+
+// DefaultMetricsInterval the default interval that gauges are sampled at
+const DefaultMetricsInterval = time.Second * 10
+
+// Metrics receives the measurements taken by the dht so they can be exported to a monitoring system.
+// Labels are provided as pairs of names and values. Implementations must be safe for concurrent use
+// and should not block, as they are called when handling packets
+type Metrics interface {
+	// AddCounter increases a counter by the given value
+	AddCounter(name string, value float64, labels ...string)
+	// SetGauge sets a gauge to the given value
+	SetGauge(name string, value float64, labels ...string)
+	// Observe records a sample in a histogram
+	Observe(name string, value float64, labels ...string)
+}
+
+// StorageStats can be implemented by a Storage to report metrics about the values it holds
+type StorageStats interface {
+	// Stats returns the number of keys and values held, the size of the keys and values in bytes,
+	// and the total number of values that have expired
+	Stats() (keys, values, bytes, expired uint64)
+}
+
+// metrics used when none have been configured
+type noopMetrics struct{}
+
+func (noopMetrics) AddCounter(name string, value float64, labels ...string) {}
+func (noopMetrics) SetGauge(name string, value float64, labels ...string)   {}
+func (noopMetrics) Observe(name string, value float64, labels ...string)    {}
+
+// the buckets used by histograms that have not been given their own
+var defaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// the buckets used by the histograms recorded by the dht
+var histogramBuckets = map[string][]float64{
+	"emo_listener_read_batch_size":  {1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024},
+	"emo_listener_write_batch_size": {1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024},
+}
+
+// returns the name used for an event type in metric labels
+func eventLabel(event protocol.EventType) string {
+	name, ok := protocol.EnumNamesEventType[event]
+	if !ok {
+		return "UNKNOWN"
+	}
+	return name
+}
+
+// Registry a Metrics implementation that holds the latest value of each
+// metric and can write them in the prometheus text exposition format
+type Registry struct {
+	families map[string]*family
+	mu       sync.Mutex
+}
+
+// a metric and all of its labelled series
+type family struct {
+	kind    string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labels string
+	value  float64
+	// the cumulative count of samples in each histogram bucket
+	counts []uint64
+	count  uint64
+}
+
+// NewRegistry creates a new registry
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// AddCounter increases a counter by the given value
+func (r *Registry) AddCounter(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.series("counter", name, labels).value += value
+}
+
+// SetGauge sets a gauge to the given value
+func (r *Registry) SetGauge(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.series("gauge", name, labels).value = value
+}
+
+// Observe records a sample in a histogram
+func (r *Registry) Observe(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series("histogram", name, labels)
+
+	for i, b := range r.families[name].buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.value += value
+}
+
+// returns the series of a metric, creating it if it does not exist. the caller must hold the lock
+func (r *Registry) series(kind, name string, labels []string) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{
+			kind:   kind,
+			series: make(map[string]*series),
+		}
+
+		if kind == "histogram" {
+			f.buckets = defaultBuckets
+
+			b, ok := histogramBuckets[name]
+			if ok {
+				f.buckets = b
+			}
+		}
+
+		r.families[name] = f
+	}
+
+	key := strings.Join(labels, "\xff")
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labels: formatLabels(labels),
+			counts: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// WriteTo writes all metrics to the writer in the prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var n int
+
+	for _, name := range names {
+		f := r.families[name]
+
+		c, _ := fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.kind)
+		n += c
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.series[k]
+
+			if f.kind != "histogram" {
+				c, _ = fmt.Fprintf(bw, "%s%s %s\n", name, braces(s.labels), formatValue(s.value))
+				n += c
+				continue
+			}
+
+			for i, b := range f.buckets {
+				c, _ = fmt.Fprintf(bw, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="`+formatValue(b)+`"`)), s.counts[i])
+				n += c
+			}
+
+			c, _ = fmt.Fprintf(bw, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			n += c
+			c, _ = fmt.Fprintf(bw, "%s_sum%s %s\n", name, braces(s.labels), formatValue(s.value))
+			n += c
+			c, _ = fmt.Fprintf(bw, "%s_count%s %d\n", name, braces(s.labels), s.count)
+			n += c
+		}
+	}
+
+	return int64(n), bw.Flush()
+}
+
+// Handler returns a http handler that serves the registry's metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteTo(w)
+	})
+}
+
+// formats pairs of label names and values
+func formatLabels(labels []string) string {
+	var sb strings.Builder
+
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		sb.WriteByte('"')
+	}
+
+	return sb.String()
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// periodically samples the size of the dht's routing table, storage and caches
+func (d *DHT) reportMetrics() {
+	defer d.wg.Done()
+	ticker := d.config.Clock.NewTicker(d.config.MetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C():
+			d.sampleMetrics()
+		}
+	}
+}
+
+func (d *DHT) sampleMetrics() {
+	m := d.config.Metrics
+
+	var total int
+
+	for i := range d.routing.buckets {
+		b := &d.routing.buckets[i]
+
+		b.mu.Lock()
+		size := b.size
+		b.mu.Unlock()
+
+		total = total + size
+
+		m.SetGauge("emo_routing_bucket_nodes", float64(size), "bucket", strconv.Itoa(i))
+	}
+
+	m.SetGauge("emo_routing_nodes", float64(total))
+
+	m.SetGauge("emo_cache_requests_inflight", float64(d.cache.inflight.Load()))
+
+	partial, retained := d.packet.size()
+	m.SetGauge("emo_packet_partial", float64(partial))
+	m.SetGauge("emo_packet_retained", float64(retained))
+
+	s, ok := d.storage.(StorageStats)
+	if ok {
+		keys, values, bytes, expired := s.Stats()
+
+		m.SetGauge("emo_storage_keys", float64(keys))
+		m.SetGauge("emo_storage_values", float64(values))
+		m.SetGauge("emo_storage_bytes", float64(bytes))
+
+		// the storage reports the total number of expirations, so only add the new ones
+		if expired > d.expired {
+			m.AddCounter("emo_storage_expired_total", float64(expired-d.expired))
+			d.expired = expired
+		}
+	}
+}
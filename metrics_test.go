@@ -0,0 +1,132 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	r.AddCounter("test_events_total", 1, "event", "PING")
+	r.AddCounter("test_events_total", 2, "event", "PING")
+	r.AddCounter("test_events_total", 1, "event", `"quoted"`)
+	r.SetGauge("test_nodes", 5)
+	r.SetGauge("test_nodes", 3)
+	r.Observe("emo_listener_write_batch_size", 3)
+	r.Observe("emo_listener_write_batch_size", 2000)
+
+	var buf bytes.Buffer
+
+	_, err := r.WriteTo(&buf)
+	require.Nil(t, err)
+
+	expected := `# TYPE emo_listener_write_batch_size histogram
+emo_listener_write_batch_size_bucket{le="1"} 0
+emo_listener_write_batch_size_bucket{le="2"} 0
+emo_listener_write_batch_size_bucket{le="4"} 1
+emo_listener_write_batch_size_bucket{le="8"} 1
+emo_listener_write_batch_size_bucket{le="16"} 1
+emo_listener_write_batch_size_bucket{le="32"} 1
+emo_listener_write_batch_size_bucket{le="64"} 1
+emo_listener_write_batch_size_bucket{le="128"} 1
+emo_listener_write_batch_size_bucket{le="256"} 1
+emo_listener_write_batch_size_bucket{le="512"} 1
+emo_listener_write_batch_size_bucket{le="1024"} 1
+emo_listener_write_batch_size_bucket{le="+Inf"} 2
+emo_listener_write_batch_size_sum 2003
+emo_listener_write_batch_size_count 2
+# TYPE test_events_total counter
+test_events_total{event="\"quoted\""} 1
+test_events_total{event="PING"} 3
+# TYPE test_nodes gauge
+test_nodes 3
+`
+
+	assert.Equal(t, expected, buf.String())
+
+	// the handler should serve the same metrics
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, expected, w.Body.String())
+}
+
+func TestDHTMetrics(t *testing.T) {
+	registry := NewRegistry()
+
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+		Metrics:       registry,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	ch := make(chan error, 1)
+
+	dht.Store(randomID(), randomID(), time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	bdht.sampleMetrics()
+
+	var buf bytes.Buffer
+
+	_, err = registry.WriteTo(&buf)
+	require.Nil(t, err)
+
+	out := buf.String()
+
+	assert.Contains(t, out, `emo_listener_events_received_total{event="STORE"} 1`)
+	assert.Contains(t, out, `emo_listener_events_sent_total{event="STORE"} 1`)
+	assert.Contains(t, out, `emo_listener_events_received_total{event="FIND_NODE"}`)
+	assert.Contains(t, out, "emo_listener_flush_seconds_count")
+	assert.Contains(t, out, "emo_routing_nodes 2")
+	assert.Contains(t, out, "emo_storage_keys 1")
+	assert.Contains(t, out, "emo_storage_values 1")
+	assert.Contains(t, out, "emo_cache_requests_inflight")
+	assert.Contains(t, out, "emo_packet_partial 0")
+}
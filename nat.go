@@ -0,0 +1,488 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/tos-network/emo/protocol"
+)
+
+// Reachability whether other nodes can send requests to this node without it having contacted them first
+type Reachability int32
+
+const (
+	// ReachabilityUnknown the node has not yet been able to test whether it can be reached
+	ReachabilityUnknown Reachability = iota
+	// ReachabilityPublic the node can receive requests from nodes it has not contacted
+	ReachabilityPublic
+	// ReachabilityPrivate the node is behind a nat or firewall that drops requests from nodes it has not
+	// contacted. It advertises itself as a client, so other nodes won't give its address to anyone else
+	ReachabilityPrivate
+)
+
+const (
+	// the amount of time after we last sent to a node that a nat may still let its packets through
+	natMappingTimeout = time.Minute * 5
+	// the interval that the node tests whether it can be reached
+	reachabilityInterval = time.Minute * 30
+	// the number of nodes asked to have another node ping us when testing reachability
+	reachabilityProbes = 3
+	// the number of nodes whose reports of our address are kept
+	maxObservations = 16
+	// the number of pings sent to a node when punching a path through its nat
+	punchAttempts = 3
+	// the number of nodes we have sent requests to that are tracked
+	maxContacted = 1 << 14
+	// the number of contacts evicted at once when the limit is reached
+	contactEvictBatch = 256
+)
+
+// the rate we will ping nodes that relays have asked us to punch a path through our nat to
+var punchLimit = RateLimit{Rate: 1, Burst: 10}
+
+func (r Reachability) String() string {
+	switch r {
+	case ReachabilityPublic:
+		return "public"
+	case ReachabilityPrivate:
+		return "private"
+	default:
+		return "unknown"
+	}
+}
+
+// an address of ours that another node reported seeing our events come from
+type observation struct {
+	reporter netip.AddrPort
+	address  netip.AddrPort
+}
+
+// tracks what other nodes can see of us through any nat we are behind
+type natTracker struct {
+	// the nodes we have sent requests to, and when we last did
+	contacted map[netip.AddrPort]time.Time
+	// the addresses other nodes have reported seeing us at, oldest first
+	observations []observation
+	// the last time a request was received from a node we had not contacted
+	unsolicited time.Time
+	// the last time a node pinged us because another node asked it to
+	introduced time.Time
+	// signalled when a request is received from a node we had not contacted, or we are pinged by an introduced node
+	signal chan struct{}
+	// the result of the last reachability test
+	reachability int32
+	// limits the pings we send when asked to punch a path through our nat
+	punches tokenBucket
+	clock   Clock
+	// closed to stop the cleanup of old contacts, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+}
+
+func newNATTracker(clock Clock) *natTracker {
+	n := &natTracker{
+		contacted: make(map[netip.AddrPort]time.Time),
+		signal:    make(chan struct{}, 1),
+		clock:     clock,
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go n.cleanup()
+
+	return n
+}
+
+// records that we have sent a request to a node, which opens a path back to us through any nat.
+// replies aren't recorded, so nodes sending spoofed requests can't fill the map
+func (n *natTracker) contact(to *net.UDPAddr) {
+	now := n.clock.Now()
+	k := addrPort(to)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.contacted[k]
+	if !ok && len(n.contacted) >= maxContacted {
+		evictBatch(n.contacted, contactEvictBatch)
+	}
+
+	n.contacted[k] = now
+}
+
+// returns true if we have sent an event to a node recently enough that a nat would let its packets through
+func (n *natTracker) recent(addr *net.UDPAddr) bool {
+	now := n.clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	last, ok := n.contacted[addrPort(addr)]
+
+	return ok && now.Sub(last) < natMappingTimeout
+}
+
+// returns true if we should ping a node that the relay has asked us to punch a path to. only relays we have
+// recently contacted are listened to and punches are rate limited, so we can't be used to ping arbitrary hosts
+func (n *natTracker) punchable(relay *net.UDPAddr) bool {
+	now := n.clock.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	last, ok := n.contacted[addrPort(relay)]
+	if !ok || now.Sub(last) >= natMappingTimeout {
+		return false
+	}
+
+	return n.punches.take(punchLimit, now)
+}
+
+// records a request received from a node. a request from a node we haven't contacted could not
+// have come through a nat, so shows we can be reached. introduced is set if the request was a ping
+// the node sent because another node asked it to
+func (n *natTracker) inbound(from *net.UDPAddr, introduced bool) {
+	recent := n.recent(from)
+	if recent && !introduced {
+		return
+	}
+
+	now := n.clock.Now()
+
+	n.mu.Lock()
+
+	if !recent {
+		n.unsolicited = now
+	}
+
+	if introduced {
+		n.introduced = now
+	}
+
+	n.mu.Unlock()
+
+	select {
+	case n.signal <- struct{}{}:
+	default:
+	}
+}
+
+// returns true if a request has been received from a node we had not contacted since the given time
+func (n *natTracker) reachedSince(t time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return !n.unsolicited.Before(t)
+}
+
+// returns true if we have been pinged by a node that was asked to since the given time
+func (n *natTracker) introducedSince(t time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return !n.introduced.Before(t)
+}
+
+// records the address a node reported seeing our events come from
+func (n *natTracker) observe(reporter, address *net.UDPAddr) {
+	o := observation{
+		reporter: addrPort(reporter),
+		address:  addrPort(address),
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// only the latest report from each node is kept, so one node can't outvote the others
+	for i := range n.observations {
+		if n.observations[i].reporter == o.reporter {
+			n.observations = append(n.observations[:i], n.observations[i+1:]...)
+			break
+		}
+	}
+
+	if len(n.observations) >= maxObservations {
+		n.observations = n.observations[1:]
+	}
+
+	n.observations = append(n.observations, o)
+}
+
+// returns the address most nodes have reported seeing us at, or nil if none have
+func (n *natTracker) observed() *net.UDPAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	counts := make(map[netip.AddrPort]int)
+
+	var best netip.AddrPort
+
+	for _, o := range n.observations {
+		counts[o.address]++
+		// ties are won by the most recent report
+		if counts[o.address] >= counts[best] {
+			best = o.address
+		}
+	}
+
+	if !best.IsValid() {
+		return nil
+	}
+
+	return net.UDPAddrFromAddrPort(best)
+}
+
+func (n *natTracker) get() Reachability {
+	return Reachability(atomic.LoadInt32(&n.reachability))
+}
+
+func (n *natTracker) set(r Reachability) {
+	atomic.StoreInt32(&n.reachability, int32(r))
+}
+
+// returns true if we should advertise ourselves as a client that other nodes can't reach
+func (n *natTracker) client() bool {
+	return n.get() == ReachabilityPrivate
+}
+
+// removes nodes we contacted long enough ago that any nat will have closed its path to us
+func (n *natTracker) cleanup() {
+	defer close(n.stopped)
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-n.clock.After(natMappingTimeout):
+		}
+
+		now := n.clock.Now()
+
+		n.mu.Lock()
+
+		for k, last := range n.contacted {
+			if now.Sub(last) >= natMappingTimeout {
+				delete(n.contacted, k)
+			}
+		}
+
+		n.mu.Unlock()
+	}
+}
+
+// stops the cleanup of old contacts
+func (n *natTracker) close() {
+	close(n.quit)
+	<-n.stopped
+}
+
+// Reachability returns the result of the last test of whether other nodes can reach this node
+func (d *DHT) Reachability() Reachability {
+	return d.nat.get()
+}
+
+// ObservedAddress returns the address that most other nodes have reported seeing this node's events
+// come from, which will differ from the listen address if the node is behind a nat. Returns nil if
+// no nodes have reported an address
+func (d *DHT) ObservedAddress() *net.UDPAddr {
+	return d.nat.observed()
+}
+
+// CheckReachability tests whether nodes that this node hasn't contacted can reach it, by asking some of
+// its peers to have another node ping it. If it can't be reached, it advertises itself as a client so
+// that other nodes won't give its address to anyone else. The result is returned and kept until the
+// next test. The test is run periodically, so this only needs to be called to get an up to date result
+func (d *DHT) CheckReachability() Reachability {
+	var peers []*node
+
+	for _, n := range d.routing.closestN(randomID(), K) {
+		if !bytes.Equal(n.id, d.config.LocalID) && n.has(CapabilityNATTraversal) {
+			peers = append(peers, n)
+		}
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	if len(peers) > reachabilityProbes {
+		peers = peers[:reachabilityProbes]
+	}
+
+	if len(peers) == 0 {
+		return d.nat.get()
+	}
+
+	start := d.config.Clock.Now()
+
+	// drain any signal from before the test started
+	select {
+	case <-d.nat.signal:
+	default:
+	}
+
+	responses := make(chan error, len(peers))
+
+	buf := d.pool.Get().(*flatbuffers.Builder)
+
+	for _, n := range peers {
+		rid := pseudorandomID()
+		req := eventTraversalPing(buf, rid, d.config.LocalID, d.nat.client(), d.config.ClientMode, d.config.NetworkID, true, false, nil, nil)
+
+		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+			n.address,
+			rid,
+			req,
+			func(event *protocol.Event, err error) bool {
+				responses <- err
+				return true
+			},
+		)
+
+		if err != nil {
+			responses <- err
+		}
+	}
+
+	d.pool.Put(buf)
+
+	timeout := d.config.Clock.After(d.config.Timeout)
+
+	pending := len(peers)
+
+	var answered int
+
+	// wait for a ping from a node we haven't contacted, which will only
+	// reach us if there is no nat or firewall dropping unsolicited packets
+	for {
+		select {
+		case <-d.nat.signal:
+			if d.nat.reachedSince(start) {
+				d.nat.set(ReachabilityPublic)
+				return ReachabilityPublic
+			}
+		case err := <-responses:
+			pending--
+
+			if err == nil {
+				answered++
+			}
+
+			if pending == 0 && answered == 0 {
+				// none of our peers responded, so we can't tell whether we can be reached
+				return d.nat.get()
+			}
+		case <-timeout:
+			if d.nat.reachedSince(start) {
+				// another test running at the same time took the signal
+				d.nat.set(ReachabilityPublic)
+				return ReachabilityPublic
+			}
+
+			// if a node we were introduced to reached us, we had already contacted it, so we still
+			// can't tell whether we can be reached. if no node reached us, then any nat dropped them
+			if answered == 0 || d.nat.introducedSince(start) {
+				return d.nat.get()
+			}
+
+			d.nat.set(ReachabilityPrivate)
+
+			return ReachabilityPrivate
+		case <-d.quit:
+			return d.nat.get()
+		}
+	}
+}
+
+// Punch opens a path through any nats in front of this node and the node at the address, so that they
+// can exchange events even if neither can be reached by nodes they haven't contacted. The relay must be
+// a node that both nodes have recently exchanged events with. It is asked to have the node ping this node,
+// while this node pings the node, until one of the pings makes it through
+func (d *DHT) Punch(address, relay string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan error, 1)
+
+	buf := d.pool.Get().(*flatbuffers.Builder)
+	defer d.pool.Put(buf)
+
+	rid := pseudorandomID()
+	req := eventTraversalPing(buf, rid, d.config.LocalID, d.nat.client(), d.config.ClientMode, d.config.NetworkID, false, false, addr, nil)
+
+	err = d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+		raddr,
+		rid,
+		req,
+		func(event *protocol.Event, err error) bool {
+			ch <- err
+			return true
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	err = <-ch
+	if err != nil {
+		return fmt.Errorf("relay failed to respond: %w", err)
+	}
+
+	for i := 0; i < punchAttempts; i++ {
+		_, _, err = d.Ping(address)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to reach node through its nat: %w", err)
+}
+
+// periodically tests whether the node can be reached by nodes it hasn't contacted
+func (d *DHT) checkReachability() {
+	d.CheckReachability()
+
+	ticker := d.config.Clock.NewTicker(reachabilityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C():
+			d.CheckReachability()
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATTrackerObserved(t *testing.T) {
+	n := newNATTracker(systemClock{})
+	defer n.close()
+
+	assert.Nil(t, n.observed())
+
+	addr := func(s string) *net.UDPAddr {
+		return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s))
+	}
+
+	n.observe(addr("10.0.0.1:9000"), addr("1.2.3.4:5000"))
+	n.observe(addr("10.0.0.2:9000"), addr("1.2.3.4:5000"))
+	n.observe(addr("10.0.0.3:9000"), addr("1.2.3.4:6000"))
+
+	// the address reported by most nodes wins
+	assert.Equal(t, "1.2.3.4:5000", n.observed().String())
+
+	// a node changing its report replaces its earlier report, rather than adding to it
+	n.observe(addr("10.0.0.3:9000"), addr("1.2.3.4:6000"))
+	n.observe(addr("10.0.0.3:9000"), addr("1.2.3.4:6000"))
+	assert.Equal(t, "1.2.3.4:5000", n.observed().String())
+
+	n.observe(addr("10.0.0.1:9000"), addr("1.2.3.4:6000"))
+	assert.Equal(t, "1.2.3.4:6000", n.observed().String())
+}
+
+func TestNATTrackerInbound(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	n := newNATTracker(clock)
+	defer n.close()
+
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9000}
+	start := clock.Now()
+
+	// requests from nodes we've recently contacted could have come through a nat
+	n.contact(peer)
+	n.inbound(peer, false)
+	assert.False(t, n.reachedSince(start))
+
+	n.inbound(peer, true)
+	assert.False(t, n.reachedSince(start))
+	assert.True(t, n.introducedSince(start))
+
+	// but not once the nat would have closed its path to us
+	clock.Advance(natMappingTimeout)
+	n.inbound(peer, false)
+	assert.True(t, n.reachedSince(start))
+}
+
+func TestNATTrackerPunchable(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	n := newNATTracker(clock)
+	defer n.close()
+
+	relay := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 9000}
+
+	// punches are only made for relays we have contacted
+	assert.False(t, n.punchable(relay))
+
+	n.contact(relay)
+
+	for i := 0; i < punchLimit.Burst; i++ {
+		assert.True(t, n.punchable(relay))
+	}
+
+	// and are rate limited
+	assert.False(t, n.punchable(relay))
+
+	clock.Advance(time.Second)
+	assert.True(t, n.punchable(relay))
+
+	// but not once the relay has fallen out of contact
+	clock.Advance(natMappingTimeout)
+	assert.False(t, n.punchable(relay))
+}
+
+func TestNATTrackerContactLimit(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	n := newNATTracker(clock)
+	defer n.close()
+
+	contact := func(i int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 9000}
+	}
+
+	for i := 0; i <= maxContacted; i++ {
+		n.contact(contact(i))
+	}
+
+	n.mu.Lock()
+	assert.LessOrEqual(t, len(n.contacted), maxContacted)
+	n.mu.Unlock()
+
+	// the latest contact is kept
+	assert.True(t, n.recent(contact(maxContacted)))
+}
+
+func TestDHTRepliesNotContacted(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 2)
+
+	spoofed := &net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 9000}
+	buf := flatbuffers.NewBuilder(1024)
+
+	// replying to a request doesn't count as contacting the node it claims to be from
+	nodes[0].listeners[0].handle(spoofed, eventPing(buf, pseudorandomID(), randomID(), false, false, 0))
+	assert.False(t, nodes[0].nat.recent(spoofed))
+
+	// but sending a request does
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000}
+	assert.True(t, nodes[0].nat.recent(peer))
+}
+
+// starts a node on a simulated network behind a nat with the public address
+func newNATNode(t *testing.T, network *SimNetwork, local, public, bootstrap string) *DHT {
+	require.Nil(t, network.NAT(local, public))
+
+	d, err := New(&Config{
+		LocalID:             Keccak256([]byte(local)),
+		ListenAddress:       local,
+		BootstrapAddresses:  []string{bootstrap},
+		Listeners:           1,
+		Network:             network,
+		Timeout:             time.Millisecond * 500,
+		SocketBatchSize:     16,
+		SocketBatchInterval: time.Millisecond * 10,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+// forgets the nodes a node has contacted, as if enough time has passed for any nat to have closed its paths to them
+func forgetContacts(network *SimNetwork, d *DHT) {
+	network.ExpireNATMappings()
+
+	d.nat.mu.Lock()
+	d.nat.contacted = make(map[netip.AddrPort]time.Time)
+	d.nat.mu.Unlock()
+}
+
+func TestDHTReachability(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 64)
+
+	// a node that has contacted every other node can't tell whether they reached it through a nat
+	public := nodes[len(nodes)-1]
+	forgetContacts(network, public)
+
+	assert.Equal(t, ReachabilityPublic, public.CheckReachability())
+	assert.Equal(t, ReachabilityPublic, public.Reachability())
+	assert.Equal(t, simAddress(len(nodes)-1), public.ObservedAddress().String())
+
+	private := newNATNode(t, network, "192.168.0.2:9000", "10.1.0.1:9000", simAddress(0))
+
+	// peers are only asked to help once they've advertised that they can
+	assert.Eventually(t, func() bool {
+		forgetContacts(network, private)
+		return private.CheckReachability() == ReachabilityPrivate
+	}, time.Second*5, time.Millisecond)
+	assert.Equal(t, ReachabilityPrivate, private.Reachability())
+	assert.Equal(t, "10.1.0.1:9000", private.ObservedAddress().String())
+	assert.Greater(t, network.Stats().Filtered, uint64(0))
+
+	// once the node has told its peers it's a client, they stop giving its address to other nodes
+	_, _, err := private.Ping(simAddress(0))
+	require.Nil(t, err)
+
+	var found bool
+
+	for _, p := range nodes[0].Peers() {
+		if p.Address.String() == "10.1.0.1:9000" {
+			found = true
+			assert.True(t, p.Client)
+		}
+	}
+
+	assert.True(t, found)
+
+	for _, n := range nodes[0].routing.closestServing(private.config.LocalID, K) {
+		assert.NotEqual(t, private.config.LocalID, n.id)
+	}
+}
+
+func TestDHTPunch(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	newSimCluster(t, network, 64)
+
+	b := newNATNode(t, network, "192.168.1.2:9000", "10.1.0.2:9000", simAddress(0))
+
+	assert.Eventually(t, func() bool {
+		forgetContacts(network, b)
+		return b.CheckReachability() == ReachabilityPrivate
+	}, time.Second*5, time.Millisecond)
+
+	// the relay must be in contact with both nodes
+	_, _, err := b.Ping(simAddress(0))
+	require.Nil(t, err)
+
+	a := newNATNode(t, network, "192.168.0.2:9000", "10.1.0.1:9000", simAddress(0))
+
+	// the nodes nats drop each others packets
+	_, _, err = a.Ping("10.1.0.2:9000")
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+
+	// until a node they are both in contact with introduces them
+	require.Nil(t, a.Punch("10.1.0.2:9000", simAddress(0)))
+
+	_, _, err = a.Ping("10.1.0.2:9000")
+	require.Nil(t, err)
+
+	// only nodes the relay is in contact with will be introduced
+	assert.NotNil(t, a.Punch("10.1.0.3:9000", simAddress(0)))
+}
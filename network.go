@@ -0,0 +1,97 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// PacketConn a connection that the dht's listeners read and write batches of packets through.
+// The address of each message must be a *net.UDPAddr. Once closed, reads and writes
+// must return an error that wraps net.ErrClosed
+type PacketConn interface {
+	// ReadBatch blocks until at least one packet has been received, then reads as
+	// many packets as are available into the messages, returning the number read
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	// WriteBatch sends the first buffer of each message to the message's address
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	// LocalAddr returns the address the connection is listening on
+	LocalAddr() net.Addr
+	// Close closes the connection, unblocking any reads
+	Close() error
+}
+
+// Network creates the connections that the dht listens on. Each of the dht's listeners
+// calls ListenPacket with the same address, so the network must allow the address to be reused
+type Network interface {
+	ListenPacket(address string) (PacketConn, error)
+}
+
+// the default network, which listens on udp sockets
+type udpNetwork struct {
+	// the size in bytes of each sockets send and receive buffer
+	bufferSize int
+}
+
+func (n *udpNetwork) ListenPacket(address string) (PacketConn, error) {
+	cfg := net.ListenConfig{
+		Control: control,
+	}
+
+	c, err := cfg.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.(*net.UDPConn).SetReadBuffer(n.bufferSize)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	err = c.(*net.UDPConn).SetWriteBuffer(n.bufferSize)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return ipv4.NewPacketConn(c), nil
+}
+
+// "borrow" this from github.com/libp2p/go-reuseport as we don't care about other operating systems right now :)
+func control(network, address string, c syscall.RawConn) error {
+	var err error
+
+	c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if err != nil {
+			return
+		}
+
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		if err != nil {
+			return
+		}
+	})
+
+	return err
+}
@@ -44,6 +44,13 @@ type node struct {
 	latency time.Duration
 	// the number of failed attempts to communicate with this node
 	failCount int32
+	// the protocol version and capabilities advertised by the node
+	version      uint32
+	capabilities uint64
+	// set once the node has advertised its version and capabilities
+	negotiated uint32
+	// set if the node has advertised that it can't be reached by nodes it hasn't contacted
+	client uint32
 	// test mode
 	testMode bool
 }
@@ -59,3 +66,8 @@ func pseudorandomID() []byte {
 	mrand.Read(id)
 	return id
 }
+
+// returns true if the node is known at the given address
+func (n *node) at(address *net.UDPAddr) bool {
+	return n.address.IP.Equal(address.IP) && n.address.Port == address.Port
+}
@@ -16,17 +16,118 @@
 
 package emo
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
-// FindOption for configuring find requests
-type FindOption struct {
+var (
+	// ErrInsufficientReplicas returned when values were found, but not by as many nodes as were required
+	ErrInsufficientReplicas = errors.New("value not found on enough nodes")
+)
+
+// FindOption for configuring find requests. Options can be combined
+// and are applied in the order they are provided
+type FindOption func(o *findOptions)
+
+// the combined options of a find request
+type findOptions struct {
+	// only return values created after this time
 	from time.Time
+	// only return values created before this time
+	until time.Time
+	// the maximum number of values to return, or 0 if there is no limit
+	limit int
+	// only search our own storage
+	localOnly bool
+	// don't search our own storage
+	skipLocal bool
+	// the number of nodes that must return a value before it is returned to the user
+	replicas int
+	// the maximum amount of time to wait for the request to complete
+	timeout time.Duration
+	// receives the progress of the lookup
+	tracer Tracer
+	// called once the request has completed
+	done func(err error)
+}
+
+// validates the combination of options
+func (o *findOptions) validate() error {
+	if o.localOnly && o.skipLocal {
+		return errors.New("local only and skip local options cannot be combined")
+	}
+
+	if o.localOnly && o.replicas > 1 {
+		return errors.New("local only queries cannot require more than one replica")
+	}
+
+	if !o.from.IsZero() && !o.until.IsZero() && o.until.Before(o.from) {
+		return errors.New("values until must not be before values from")
+	}
+
+	if o.limit < 0 || o.replicas < 0 || o.timeout < 0 {
+		return errors.New("find options must not be negative")
+	}
+
+	return nil
 }
 
 // ValuesFrom filters results to only those that were created after a given timestmap
 // this is useful for repeat queries where duplicates ideally should be avoided
-func ValuesFrom(from time.Time) *FindOption {
-	return &FindOption{
-		from: from,
+func ValuesFrom(from time.Time) FindOption {
+	return func(o *findOptions) {
+		o.from = from
+	}
+}
+
+// ValuesUntil filters results to only those that were created before a given timestamp
+func ValuesUntil(until time.Time) FindOption {
+	return func(o *findOptions) {
+		o.until = until
+	}
+}
+
+// MaxResults limits the number of values that will be returned. Values are returned in the order they were created,
+// so this can be combined with ValuesFrom to page through keys with many values
+func MaxResults(limit int) FindOption {
+	return func(o *findOptions) {
+		o.limit = limit
+	}
+}
+
+// LocalOnly only returns values held by this node, without querying the network
+func LocalOnly() FindOption {
+	return func(o *findOptions) {
+		o.localOnly = true
+	}
+}
+
+// SkipLocal ignores any values held by this node and always queries the network
+func SkipLocal() FindOption {
+	return func(o *findOptions) {
+		o.skipLocal = true
+	}
+}
+
+// Replicas only returns values once they have been returned by the given number of nodes,
+// which can be used to avoid values that are held by a single, potentially malicious, node
+func Replicas(replicas int) FindOption {
+	return func(o *findOptions) {
+		o.replicas = replicas
+	}
+}
+
+// FindTimeout sets the maximum amount of time to wait for the find request to complete
+func FindTimeout(timeout time.Duration) FindOption {
+	return func(o *findOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithTracer traces the lookup made by a single find request, in addition to any tracer that has been configured
+func WithTracer(tracer Tracer) FindOption {
+	return func(o *findOptions) {
+		o.tracer = tracer
 	}
 }
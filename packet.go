@@ -18,9 +18,9 @@ package emo
 
 import (
 	"encoding/binary"
-	"hash/maphash"
+	"net"
+	"net/netip"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -38,29 +38,97 @@ const (
 	// MaxPayloadSize the maximum payload of our packet. The max packet size,
 	// minus 24 bytes for our fragment header
 	MaxPayloadSize = MaxPacketSize - PacketHeaderSize
+
+	// MaxPartialPackets the maximum number of incomplete packets that
+	// will be held for reassembly from a single source address
+	MaxPartialPackets = 64
+
+	// MaxTotalPartialPackets the maximum number of incomplete packets
+	// that will be held for reassembly across all source addresses
+	MaxTotalPartialPackets = 4096
+
+	// MaxRetainedPackets the maximum number of sent fragmented packets
+	// that will be retained so lost fragments can be retransmitted
+	MaxRetainedPackets = 512
+
+	// the size of the buffer used to build and reassemble packets
+	packetBufferSize = 1<<17 - 1
+	// the amount of time an incomplete packet is held before it is discarded
+	partialPacketExpiry = time.Second * 5
+	// the amount of time we wait for the next fragment of an incomplete
+	// packet before asking the sender to retransmit its missing fragments
+	nackDelay = time.Millisecond * 200
+	// the maximum number of times we will request missing fragments for a packet
+	maxNacks = 5
+	// the maximum number of times a sent packet will be retransmitted
+	maxRetransmits = 5
+	// control packet sent to request the retransmission of missing fragments
+	controlNack = 1
+	// the size of a nack control packet, its header followed by a bitmap of the missing fragments
+	nackPacketSize = PacketHeaderSize + 32
 )
 
+// identifies a packet being reassembled by the address that sent it and its event id,
+// so fragments sent from one peer can't be used to corrupt packets sent by another
+type fragmentKey struct {
+	source netip.AddrPort
+	id     [KEY_BYTES]byte
+}
+
+// a fragmented packet that has been sent to a peer, retained
+// so that any lost fragments can be retransmitted
+type sentPacket struct {
+	// the fragments of the packet, including their headers
+	frames []byte
+	// the number of fragments in the packet
+	frg int
+	// the time this packet will be discarded
+	ttl time.Time
+	// the number of times fragments have been retransmitted
+	retransmits int
+}
+
+// a request for missing fragments that needs to be sent to a peer
+type nack struct {
+	to   *net.UDPAddr
+	data []byte
+}
+
 // pool for building and reassembling udp packets
 type packetManager struct {
-	packets sync.Map
+	// incomplete packets that are being reassembled
+	packets map[fragmentKey]*packet
+	// the number of incomplete packets held for each source address
+	sources map[netip.Addr]int
+	// fragmented packets we have sent, keyed by their destination
+	sent    map[fragmentKey]*sentPacket
 	pool    sync.Pool
-	hasher  maphash.Hash
+	metrics Metrics
+	clock   Clock
+	// closed to stop the cleanup of expired packets, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
 	mu      sync.Mutex
 }
 
-func newPacketManager() *packetManager {
+func newPacketManager(metrics Metrics, clock Clock) *packetManager {
 	m := &packetManager{
+		metrics: metrics,
+		clock:   clock,
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		packets: make(map[fragmentKey]*packet),
+		sources: make(map[netip.Addr]int),
+		sent:    make(map[fragmentKey]*sentPacket),
 		pool: sync.Pool{
 			New: func() any {
 				return &packet{
-					buf: make([]byte, 1<<17-1),
+					buf: make([]byte, packetBufferSize),
 				}
 			},
 		},
 	}
 
-	m.hasher.SetSeed(maphash.MakeSeed())
-
 	go m.cleanup()
 
 	return m
@@ -68,7 +136,7 @@ func newPacketManager() *packetManager {
 
 // marks a packet as done and returns it to the pool
 func (m *packetManager) done(p *packet) {
-	if len(p.buf) < 1<<17-1 {
+	if len(p.buf) < packetBufferSize {
 		return
 	}
 
@@ -115,7 +183,13 @@ func (m *packetManager) fragment(id, data []byte) *packet {
 }
 
 // assembles a packet into an event. if there are missing fragments, this will return nil
-func (m *packetManager) assemble(f []byte) *packet {
+func (m *packetManager) assemble(from *net.UDPAddr, f []byte) *packet {
+	// drop any fragments with headers that don't describe a valid packet
+	if !validFragment(f) {
+		m.metrics.AddCounter("emo_packet_dropped_total", 1, "reason", "invalid")
+		return nil
+	}
+
 	// shortcut this if the event isn't fragmented
 	if f[KEY_BYTES+1] == 1 {
 		return &packet{
@@ -124,77 +198,261 @@ func (m *packetManager) assemble(f []byte) *packet {
 		}
 	}
 
-	// TODO : avoid locking here
-	m.mu.Lock()
+	ip := addrIP(from)
 
-	m.hasher.Reset()
-	m.hasher.Write(f[:KEY_BYTES])
-	k := m.hasher.Sum64()
+	k := fragmentKey{
+		source: netip.AddrPortFrom(ip, uint16(from.Port)),
+	}
 
-	m.mu.Unlock()
+	copy(k.id[:], f[:KEY_BYTES])
 
-	var p *packet
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	// load the packet from our packet cache
 	// or create it if its a new fragmented packet
 	// we've not seen before
-	pi, ok := m.packets.Load(k)
+	p, ok := m.packets[k]
 	if !ok {
+		// don't allow a single source or the combination of all
+		// sources to exhaust our memory with incomplete packets
+		if m.sources[ip] >= MaxPartialPackets || len(m.packets) >= MaxTotalPartialPackets {
+			m.metrics.AddCounter("emo_packet_dropped_total", 1, "reason", "limit")
+			return nil
+		}
+
 		p = m.pool.Get().(*packet)
 		p.frg = int(f[KEY_BYTES+1])
 		p.len = int(binary.LittleEndian.Uint16(f[KEY_BYTES+2:]))
 		p.pos = 0
-		p.ttl = time.Now().Add(time.Second * 5)
-
-		// this may be racy if two listeners
-		// receive different fragments at the same
-		// time and the cache does not contain a packet
-		// for them!!
-		pl, ok := m.packets.LoadOrStore(k, p)
-		if ok {
-			// return our unused packet to the pool
-			m.pool.Put(p)
-
-			p = pl.(*packet)
-		}
-	} else {
-		p = pi.(*packet)
+		p.ttl = m.clock.Now().Add(partialPacketExpiry)
+		p.source = ip
+		p.received = [4]uint64{}
+		p.nacks = 0
+
+		m.packets[k] = p
+		m.sources[ip]++
 	}
 
+	p.updated = m.clock.Now()
+
 	// add the fragment to the packet. if it's complete, return the packet
 	if p.add(f) {
-		m.packets.Delete(k)
+		m.remove(k, p)
 		return p
 	}
 
 	return nil
 }
 
+// retain keeps a copy of a fragmented packet that has been sent so that
+// any fragments the receiver reports as missing can be retransmitted
+func (m *packetManager) retain(to *net.UDPAddr, id []byte, p *packet) {
+	if p.frg < 2 {
+		return
+	}
+
+	k := fragmentKey{
+		source: netip.AddrPortFrom(addrIP(to), uint16(to.Port)),
+	}
+
+	copy(k.id[:], id)
+
+	sp := &sentPacket{
+		frames: make([]byte, p.len),
+		frg:    p.frg,
+		ttl:    m.clock.Now().Add(partialPacketExpiry),
+	}
+
+	copy(sp.frames, p.buf[:p.len])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.sent) >= MaxRetainedPackets {
+		return
+	}
+
+	m.sent[k] = sp
+}
+
+// retransmit handles a request for missing fragments from a peer, returning
+// the fragments that should be resent to it
+func (m *packetManager) retransmit(from *net.UDPAddr, f []byte) [][]byte {
+	if len(f) != nackPacketSize || f[KEY_BYTES+1] != controlNack {
+		return nil
+	}
+
+	k := fragmentKey{
+		source: netip.AddrPortFrom(addrIP(from), uint16(from.Port)),
+	}
+
+	copy(k.id[:], f[:KEY_BYTES])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// only retransmit to the address we originally sent the packet to,
+	// so the request can't be used to direct traffic at another host
+	sp, ok := m.sent[k]
+	if !ok || sp.retransmits >= maxRetransmits {
+		return nil
+	}
+
+	sp.retransmits++
+
+	var frames [][]byte
+
+	for i := 0; i < sp.frg; i++ {
+		if binary.LittleEndian.Uint64(f[PacketHeaderSize+(i/64)*8:])&(1<<(i%64)) == 0 {
+			continue
+		}
+
+		start := i * MaxPacketSize
+		end := min(start+MaxPacketSize, len(sp.frames))
+
+		frames = append(frames, sp.frames[start:end])
+	}
+
+	return frames
+}
+
+// nacks returns requests for the missing fragments of any incomplete packets
+// that have not received a fragment recently
+func (m *packetManager) nacks(now time.Time) []nack {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ns []nack
+
+	for k, p := range m.packets {
+		if p.nacks >= maxNacks || now.Sub(p.updated) < nackDelay {
+			continue
+		}
+
+		p.nacks++
+		p.updated = now
+
+		n := make([]byte, nackPacketSize)
+		copy(n, k.id[:])
+		n[KEY_BYTES+1] = controlNack
+
+		// set a bit for each of the fragments we are missing
+		for i := 0; i < p.frg; i++ {
+			if p.received[i/64]&(1<<(i%64)) == 0 {
+				n[PacketHeaderSize+i/8] |= 1 << (i % 8)
+			}
+		}
+
+		ns = append(ns, nack{
+			to:   net.UDPAddrFromAddrPort(k.source),
+			data: n,
+		})
+	}
+
+	return ns
+}
+
+// isControlPacket returns true if the packet is a control packet
+// and not a fragment of an event
+func isControlPacket(f []byte) bool {
+	return len(f) >= PacketHeaderSize && f[KEY_BYTES] == 0
+}
+
+// returns the number of incomplete packets and the number of sent packets that have been retained
+func (m *packetManager) size() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.packets), len(m.sent)
+}
+
+// removes an incomplete packet from the cache. must be called with the lock held
+func (m *packetManager) remove(k fragmentKey, p *packet) {
+	delete(m.packets, k)
+
+	m.sources[p.source]--
+	if m.sources[p.source] < 1 {
+		delete(m.sources, p.source)
+	}
+}
+
+// validFragment checks that a fragments header is well formed and
+// that its data will fit in the packet it will be assembled into
+func validFragment(f []byte) bool {
+	if len(f) < PacketHeaderSize {
+		return false
+	}
+
+	part := int(f[KEY_BYTES])
+	total := int(f[KEY_BYTES+1])
+	size := int(binary.LittleEndian.Uint16(f[KEY_BYTES+2:]))
+
+	if part < 1 || part > total || total*MaxPayloadSize > packetBufferSize {
+		return false
+	}
+
+	// the fragment must not contain more data than the packet or a fragment can hold
+	data := len(f) - PacketHeaderSize
+
+	return data <= MaxPayloadSize && size <= total*MaxPayloadSize && (part-1)*MaxPayloadSize+data <= size
+}
+
 func (m *packetManager) cleanup() {
+	defer close(m.stopped)
+
 	for {
-		time.Sleep(time.Second * 5)
-		now := time.Now()
-
-		m.packets.Range(func(key, value any) bool {
-			p := value.(*packet)
-			if !p.complete() && now.After(p.ttl) {
-				// remove packets that
-				m.packets.Delete(key)
+		select {
+		case <-m.quit:
+			return
+		case <-m.clock.After(partialPacketExpiry):
+		}
+
+		now := m.clock.Now()
+
+		m.mu.Lock()
+
+		for k, p := range m.packets {
+			if now.After(p.ttl) {
+				// remove packets that have not been completed in time
+				m.remove(k, p)
+				m.pool.Put(p)
+				m.metrics.AddCounter("emo_packet_dropped_total", 1, "reason", "expired")
 			}
-			return true
-		})
+		}
+
+		for k, sp := range m.sent {
+			if now.After(sp.ttl) {
+				delete(m.sent, k)
+			}
+		}
+
+		m.mu.Unlock()
 	}
 }
 
+// stops the cleanup of expired packets and waits for it to finish
+func (m *packetManager) close() {
+	close(m.quit)
+	<-m.stopped
+}
+
 /*
 We need to fragment events into smaller chunks if they do not fit into an
 IP packet.
 
-Each fragment will have an additional 24 byte header that allows the
+Each fragment will have an additional 36 byte header that allows the
 receiving end to determine which fragmented part belongs to what UDP packet:
 
-| 20 bytes | byte | byte  | 2 bytes |
+| 32 bytes | byte | byte  | 2 bytes |
 | event id | part | total | size    |
+
+If a fragment is lost, the receiver can request that the sender retransmit
+it by sending a control packet with a part of 0, followed by a bitmap of
+each of the fragments it is missing:
+
+| 32 bytes | byte | byte | 2 bytes | 32 bytes |
+| event id | 0    | nack | unused  | missing  |
 */
 type packet struct {
 	// 128kb buffer used to construct packet fragments
@@ -204,38 +462,70 @@ type packet struct {
 	// the length of the data in the buffer
 	len int
 	// the position in the buffer we currently are
-	pos int32
+	pos int
 	// the time this packet expires if not completed
 	ttl time.Time
+	// the address that sent the fragments of this packet
+	source netip.Addr
+	// bitmap of the fragments that have been received
+	received [4]uint64
+	// the last time a fragment was received or missing fragments were requested
+	updated time.Time
+	// the number of times we have requested missing fragments
+	nacks int
 }
 
 // returns the next fragment to transmit. if there's none left to send, it returns nil
 func (p *packet) next() []byte {
-	if int(p.pos) >= p.len {
+	if p.pos >= p.len {
 		return nil
 	}
 
 	ps := MaxPacketSize
 
 	// caculate the size of this packet
-	if int(p.pos)+ps > int(p.len) {
-		ps = p.len - int(p.pos)
+	if p.pos+ps > p.len {
+		ps = p.len - p.pos
 	}
 
-	p.pos = p.pos + int32(ps)
+	p.pos = p.pos + ps
 
-	return p.buf[int(p.pos)-ps : p.pos]
+	return p.buf[p.pos-ps : p.pos]
 }
 
 // adds copies the fragments data to the packet buffer
 // returns true if all of the fragments are present
 func (p *packet) add(f []byte) bool {
-	offset := int(f[KEY_BYTES]) - 1
+	part := int(f[KEY_BYTES]) - 1
 	data := f[PacketHeaderSize:]
 
-	copy(p.buf[MaxPayloadSize*offset:], data)
+	// the fragment must describe the same packet as the first fragment we received
+	if int(f[KEY_BYTES+1]) != p.frg || int(binary.LittleEndian.Uint16(f[KEY_BYTES+2:])) != p.len {
+		return false
+	}
+
+	// every fragment apart from the last must be full
+	expected := MaxPayloadSize
+	if part == p.frg-1 {
+		expected = p.len - part*MaxPayloadSize
+	}
+
+	if len(data) != expected {
+		return false
+	}
+
+	// ignore fragments we have already received
+	if p.received[part/64]&(1<<(part%64)) != 0 {
+		return false
+	}
+
+	p.received[part/64] |= 1 << (part % 64)
+
+	copy(p.buf[MaxPayloadSize*part:], data)
+
+	p.pos = p.pos + len(data)
 
-	return atomic.AddInt32(&p.pos, int32(len(data))) == int32(p.len)
+	return p.complete()
 }
 
 // data returns the full data in the packets buffer
@@ -243,11 +533,9 @@ func (p *packet) data() []byte {
 	return p.buf[:p.len]
 }
 
-// returns true if we have a completed set of fragments
-// we could have used a set with different fragments, but
-// as we can work out if a packet is complete if the size
-// of the buffer is bigger than the size of a fragments payload
-// multiplied by the number of fragments
+// returns true if we have a completed set of fragments. as duplicate
+// fragments are rejected and every fragment must be the correct size,
+// the packet is complete once we have received all of its data
 func (p *packet) complete() bool {
-	return atomic.LoadInt32(&p.pos) == int32(p.len)
+	return p.pos == p.len
 }
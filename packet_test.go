@@ -18,14 +18,20 @@ package emo
 
 import (
 	"crypto/rand"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+var testAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
 func TestPacketManagerFragment(t *testing.T) {
-	m := newPacketManager()
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
 
 	// build a packet that's exactly 3 fragments
 	id := randomID()
@@ -94,7 +100,8 @@ func TestPacketManagerFragment(t *testing.T) {
 }
 
 func TestPacketManagerAssemble(t *testing.T) {
-	m := newPacketManager()
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
 
 	id := randomID()
 	data := make([]byte, MaxPayloadSize*5)
@@ -113,12 +120,12 @@ func TestPacketManagerAssemble(t *testing.T) {
 
 	// assemble them "out of order" (in this case, just reverse order)
 	for i := p.frg - 1; i > 0; i-- {
-		p := m.assemble(fragments[i])
+		p := m.assemble(testAddr, fragments[i])
 		assert.Nil(t, p)
 	}
 
 	// on the last fragment, we should be returned a full packet
-	p = m.assemble(fragments[0])
+	p = m.assemble(testAddr, fragments[0])
 	assert.NotNil(t, p)
 	assert.Equal(t, data, p.data())
 
@@ -126,7 +133,8 @@ func TestPacketManagerAssemble(t *testing.T) {
 }
 
 func TestPacketManagerFragmentAssemble(t *testing.T) {
-	m := newPacketManager()
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
 
 	id := randomID()
 	data := make([]byte, MaxPayloadSize/2)
@@ -139,7 +147,7 @@ func TestPacketManagerFragmentAssemble(t *testing.T) {
 	assert.Len(t, f, len(data)+PacketHeaderSize)
 
 	// on the last fragment, we should be returned a full packet
-	p = m.assemble(f)
+	p = m.assemble(testAddr, f)
 	assert.NotNil(t, p)
 	assert.Equal(t, data, p.data())
 
@@ -163,10 +171,263 @@ func TestPacketManagerFragmentAssemble(t *testing.T) {
 	var p2 *packet
 
 	for i := range fragments {
-		p2 = m.assemble(fragments[i])
+		p2 = m.assemble(testAddr, fragments[i])
 	}
 
 	assert.Equal(t, data, p2.data())
 
 	m.done(p)
 }
+
+func testFragments(m *packetManager, id, data []byte) [][]byte {
+	p := m.fragment(id, data)
+	defer m.done(p)
+
+	var fragments [][]byte
+
+	for f := p.next(); f != nil; f = p.next() {
+		fragments = append(fragments, append([]byte(nil), f...))
+	}
+
+	return fragments
+}
+
+func TestPacketManagerAssembleDuplicates(t *testing.T) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	id := randomID()
+	data := make([]byte, MaxPayloadSize*3)
+	rand.Read(data)
+
+	fragments := testFragments(m, id, data)
+	require.Len(t, fragments, 3)
+
+	// duplicated fragments should not complete the packet early
+	assert.Nil(t, m.assemble(testAddr, fragments[0]))
+	assert.Nil(t, m.assemble(testAddr, fragments[0]))
+	assert.Nil(t, m.assemble(testAddr, fragments[1]))
+	assert.Nil(t, m.assemble(testAddr, fragments[1]))
+
+	p := m.assemble(testAddr, fragments[2])
+	require.NotNil(t, p)
+	assert.Equal(t, data, p.data())
+}
+
+func TestPacketManagerAssembleSpoofed(t *testing.T) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	id := randomID()
+	data := make([]byte, MaxPayloadSize*2)
+	rand.Read(data)
+
+	spoofed := make([]byte, MaxPayloadSize*2)
+	rand.Read(spoofed)
+
+	fragments := testFragments(m, id, data)
+	sfragments := testFragments(m, id, spoofed)
+
+	attacker := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9000}
+
+	// fragments sent by another peer with the same event
+	// id should not be combined with our fragments
+	assert.Nil(t, m.assemble(testAddr, fragments[0]))
+	assert.Nil(t, m.assemble(attacker, sfragments[1]))
+
+	p := m.assemble(testAddr, fragments[1])
+	require.NotNil(t, p)
+	assert.Equal(t, data, p.data())
+
+	// fragments with an inconsistent size or part count should be rejected
+	id = randomID()
+	fragments = testFragments(m, id, data)
+	sfragments = testFragments(m, id, make([]byte, MaxPayloadSize*3))
+
+	assert.Nil(t, m.assemble(testAddr, fragments[0]))
+	assert.Nil(t, m.assemble(testAddr, sfragments[1]))
+
+	p = m.assemble(testAddr, fragments[1])
+	require.NotNil(t, p)
+	assert.Equal(t, data, p.data())
+}
+
+func TestPacketManagerAssembleInvalid(t *testing.T) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	data := make([]byte, MaxPayloadSize*2)
+	rand.Read(data)
+
+	fragments := testFragments(m, randomID(), data)
+
+	// truncated header
+	assert.Nil(t, m.assemble(testAddr, fragments[0][:PacketHeaderSize-1]))
+
+	// part index of zero
+	f := append([]byte(nil), fragments[0]...)
+	f[KEY_BYTES] = 0
+	assert.Nil(t, m.assemble(testAddr, f))
+
+	// part index greater than the total
+	f[KEY_BYTES] = 3
+	assert.Nil(t, m.assemble(testAddr, f))
+
+	// more fragments than will fit in a packet
+	f[KEY_BYTES] = 255
+	f[KEY_BYTES+1] = 255
+	assert.Nil(t, m.assemble(testAddr, f))
+
+	assert.Len(t, m.packets, 0)
+}
+
+func TestPacketManagerAssembleLimits(t *testing.T) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	data := make([]byte, MaxPayloadSize*2)
+
+	for i := 0; i < MaxPartialPackets*2; i++ {
+		fragments := testFragments(m, randomID(), data)
+		assert.Nil(t, m.assemble(testAddr, fragments[0]))
+	}
+
+	assert.Len(t, m.packets, MaxPartialPackets)
+
+	// another port on the same address should share the same limit
+	fragments := testFragments(m, randomID(), data)
+	assert.Nil(t, m.assemble(&net.UDPAddr{IP: testAddr.IP, Port: 9001}, fragments[0]))
+	assert.Len(t, m.packets, MaxPartialPackets)
+
+	// other addresses should not be affected
+	other := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9000}
+
+	assert.Nil(t, m.assemble(other, fragments[0]))
+	assert.NotNil(t, m.assemble(other, fragments[1]))
+}
+
+func TestPacketManagerAssembleConcurrent(t *testing.T) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				data := make([]byte, MaxPayloadSize*4)
+				rand.Read(data)
+
+				fragments := testFragments(m, randomID(), data)
+
+				var fwg sync.WaitGroup
+				var completed sync.Map
+
+				// deliver each fragment from a different goroutine to simulate
+				// the fragments being received by different listeners
+				for k := range fragments {
+					fwg.Add(1)
+
+					go func(f []byte) {
+						defer fwg.Done()
+
+						p := m.assemble(testAddr, f)
+						if p != nil {
+							completed.Store(string(p.data()), true)
+						}
+					}(fragments[k])
+				}
+
+				fwg.Wait()
+
+				_, ok := completed.Load(string(data))
+				assert.True(t, ok)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestPacketManagerRetransmit(t *testing.T) {
+	sender := newPacketManager(noopMetrics{}, systemClock{})
+	defer sender.close()
+	receiver := newPacketManager(noopMetrics{}, systemClock{})
+	defer receiver.close()
+
+	senderAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	receiverAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9001}
+
+	id := randomID()
+	data := make([]byte, VALUE_BYTES)
+	rand.Read(data)
+
+	p := sender.fragment(id, data)
+	sender.retain(receiverAddr, id, p)
+	sender.done(p)
+
+	fragments := testFragments(sender, id, data)
+	require.Len(t, fragments, 23)
+
+	// lose a fragment from the start, middle and end of the packet
+	lost := map[int]bool{0: true, 11: true, 22: true}
+
+	for i, f := range fragments {
+		if !lost[i] {
+			assert.Nil(t, receiver.assemble(senderAddr, f))
+		}
+	}
+
+	// no fragments should be requested until the packet has stalled
+	assert.Empty(t, receiver.nacks(time.Now()))
+
+	nacks := receiver.nacks(time.Now().Add(nackDelay))
+	require.Len(t, nacks, 1)
+	assert.Equal(t, senderAddr.String(), nacks[0].to.String())
+	assert.True(t, isControlPacket(nacks[0].data))
+
+	// the nack should not be accepted from any other address
+	assert.Empty(t, sender.retransmit(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9001}, nacks[0].data))
+
+	frames := sender.retransmit(receiverAddr, nacks[0].data)
+	require.Len(t, frames, 3)
+
+	var completed *packet
+
+	for _, f := range frames {
+		completed = receiver.assemble(senderAddr, f)
+	}
+
+	require.NotNil(t, completed)
+	assert.Equal(t, data, completed.data())
+
+	// the sender should eventually stop retransmitting the packet
+	for i := 1; i < maxRetransmits; i++ {
+		assert.NotEmpty(t, sender.retransmit(receiverAddr, nacks[0].data))
+	}
+
+	assert.Empty(t, sender.retransmit(receiverAddr, nacks[0].data))
+}
+
+func TestPacketManagerNackLimit(t *testing.T) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	data := make([]byte, MaxPayloadSize*3)
+	fragments := testFragments(m, randomID(), data)
+
+	assert.Nil(t, m.assemble(testAddr, fragments[0]))
+
+	now := time.Now()
+
+	// missing fragments should only be requested a limited number of times
+	for i := 1; i <= maxNacks; i++ {
+		assert.Len(t, m.nacks(now.Add(nackDelay*time.Duration(i))), 1)
+	}
+
+	assert.Empty(t, m.nacks(now.Add(nackDelay*(maxNacks+1))))
+}
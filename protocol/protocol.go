@@ -7,27 +7,78 @@ import (
 	"strconv"
 )
 
+type ErrorCode int32
+
+const (
+	ErrorCodeUNKNOWN         ErrorCode = 0
+	ErrorCodeUNSUPPORTED     ErrorCode = 1
+	ErrorCodeMALFORMED       ErrorCode = 2
+	ErrorCodeRATE_LIMITED    ErrorCode = 3
+	ErrorCodeQUOTA_EXCEEDED  ErrorCode = 4
+	ErrorCodeSTORAGE_FAILURE ErrorCode = 5
+)
+
+var EnumNamesErrorCode = map[ErrorCode]string{
+	ErrorCodeUNKNOWN:         "UNKNOWN",
+	ErrorCodeUNSUPPORTED:     "UNSUPPORTED",
+	ErrorCodeMALFORMED:       "MALFORMED",
+	ErrorCodeRATE_LIMITED:    "RATE_LIMITED",
+	ErrorCodeQUOTA_EXCEEDED:  "QUOTA_EXCEEDED",
+	ErrorCodeSTORAGE_FAILURE: "STORAGE_FAILURE",
+}
+
+var EnumValuesErrorCode = map[string]ErrorCode{
+	"UNKNOWN":         ErrorCodeUNKNOWN,
+	"UNSUPPORTED":     ErrorCodeUNSUPPORTED,
+	"MALFORMED":       ErrorCodeMALFORMED,
+	"RATE_LIMITED":    ErrorCodeRATE_LIMITED,
+	"QUOTA_EXCEEDED":  ErrorCodeQUOTA_EXCEEDED,
+	"STORAGE_FAILURE": ErrorCodeSTORAGE_FAILURE,
+}
+
+func (v ErrorCode) String() string {
+	if s, ok := EnumNamesErrorCode[v]; ok {
+		return s
+	}
+	return "ErrorCode(" + strconv.FormatInt(int64(v), 10) + ")"
+}
+
 type Operation byte
 
 const (
-	OperationNONE      Operation = 0
-	OperationFindNode  Operation = 1
-	OperationFindValue Operation = 2
-	OperationStore     Operation = 3
+	OperationNONE         Operation = 0
+	OperationFindNode     Operation = 1
+	OperationFindValue    Operation = 2
+	OperationStore        Operation = 3
+	OperationAddProvider  Operation = 4
+	OperationGetProviders Operation = 5
+	OperationSubscribe    Operation = 6
+	OperationNotify       Operation = 7
+	OperationError        Operation = 8
 )
 
 var EnumNamesOperation = map[Operation]string{
-	OperationNONE:      "NONE",
-	OperationFindNode:  "FindNode",
-	OperationFindValue: "FindValue",
-	OperationStore:     "Store",
+	OperationNONE:         "NONE",
+	OperationFindNode:     "FindNode",
+	OperationFindValue:    "FindValue",
+	OperationStore:        "Store",
+	OperationAddProvider:  "AddProvider",
+	OperationGetProviders: "GetProviders",
+	OperationSubscribe:    "Subscribe",
+	OperationNotify:       "Notify",
+	OperationError:        "Error",
 }
 
 var EnumValuesOperation = map[string]Operation{
-	"NONE":      OperationNONE,
-	"FindNode":  OperationFindNode,
-	"FindValue": OperationFindValue,
-	"Store":     OperationStore,
+	"NONE":         OperationNONE,
+	"FindNode":     OperationFindNode,
+	"FindValue":    OperationFindValue,
+	"Store":        OperationStore,
+	"AddProvider":  OperationAddProvider,
+	"GetProviders": OperationGetProviders,
+	"Subscribe":    OperationSubscribe,
+	"Notify":       OperationNotify,
+	"Error":        OperationError,
 }
 
 func (v Operation) String() string {
@@ -40,27 +91,42 @@ func (v Operation) String() string {
 type EventType int8
 
 const (
-	EventTypePING       EventType = 0
-	EventTypePONG       EventType = 1
-	EventTypeSTORE      EventType = 2
-	EventTypeFIND_NODE  EventType = 3
-	EventTypeFIND_VALUE EventType = 4
+	EventTypePING          EventType = 0
+	EventTypePONG          EventType = 1
+	EventTypeSTORE         EventType = 2
+	EventTypeFIND_NODE     EventType = 3
+	EventTypeFIND_VALUE    EventType = 4
+	EventTypeADD_PROVIDER  EventType = 5
+	EventTypeGET_PROVIDERS EventType = 6
+	EventTypeSUBSCRIBE     EventType = 7
+	EventTypeNOTIFY        EventType = 8
+	EventTypeERROR         EventType = 9
 )
 
 var EnumNamesEventType = map[EventType]string{
-	EventTypePING:       "PING",
-	EventTypePONG:       "PONG",
-	EventTypeSTORE:      "STORE",
-	EventTypeFIND_NODE:  "FIND_NODE",
-	EventTypeFIND_VALUE: "FIND_VALUE",
+	EventTypePING:          "PING",
+	EventTypePONG:          "PONG",
+	EventTypeSTORE:         "STORE",
+	EventTypeFIND_NODE:     "FIND_NODE",
+	EventTypeFIND_VALUE:    "FIND_VALUE",
+	EventTypeADD_PROVIDER:  "ADD_PROVIDER",
+	EventTypeGET_PROVIDERS: "GET_PROVIDERS",
+	EventTypeSUBSCRIBE:     "SUBSCRIBE",
+	EventTypeNOTIFY:        "NOTIFY",
+	EventTypeERROR:         "ERROR",
 }
 
 var EnumValuesEventType = map[string]EventType{
-	"PING":       EventTypePING,
-	"PONG":       EventTypePONG,
-	"STORE":      EventTypeSTORE,
-	"FIND_NODE":  EventTypeFIND_NODE,
-	"FIND_VALUE": EventTypeFIND_VALUE,
+	"PING":          EventTypePING,
+	"PONG":          EventTypePONG,
+	"STORE":         EventTypeSTORE,
+	"FIND_NODE":     EventTypeFIND_NODE,
+	"FIND_VALUE":    EventTypeFIND_VALUE,
+	"ADD_PROVIDER":  EventTypeADD_PROVIDER,
+	"GET_PROVIDERS": EventTypeGET_PROVIDERS,
+	"SUBSCRIBE":     EventTypeSUBSCRIBE,
+	"NOTIFY":        EventTypeNOTIFY,
+	"ERROR":         EventTypeERROR,
 }
 
 func (v EventType) String() string {
@@ -582,8 +648,66 @@ func (rcv *FindValue) MutateFound(n int64) bool {
 	return rcv._tab.MutateInt64Slot(12, n)
 }
 
+func (rcv *FindValue) Limit() int32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+	if o != 0 {
+		return rcv._tab.GetInt32(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *FindValue) MutateLimit(n int32) bool {
+	return rcv._tab.MutateInt32Slot(14, n)
+}
+
+func (rcv *FindValue) Cursor(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *FindValue) CursorLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *FindValue) CursorBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *FindValue) MutateCursor(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *FindValue) Until() int64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(18))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *FindValue) MutateUntil(n int64) bool {
+	return rcv._tab.MutateInt64Slot(18, n)
+}
+
 func FindValueStart(builder *flatbuffers.Builder) {
-	builder.StartObject(5)
+	builder.StartObject(8)
 }
 func FindValueAddKey(builder *flatbuffers.Builder, key flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(key), 0)
@@ -609,6 +733,18 @@ func FindValueAddFrom(builder *flatbuffers.Builder, from int64) {
 func FindValueAddFound(builder *flatbuffers.Builder, found int64) {
 	builder.PrependInt64Slot(4, found, 0)
 }
+func FindValueAddLimit(builder *flatbuffers.Builder, limit int32) {
+	builder.PrependInt32Slot(5, limit, 0)
+}
+func FindValueAddCursor(builder *flatbuffers.Builder, cursor flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(6, flatbuffers.UOffsetT(cursor), 0)
+}
+func FindValueStartCursorVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func FindValueAddUntil(builder *flatbuffers.Builder, until int64) {
+	builder.PrependInt64Slot(7, until, 0)
+}
 func FindValueEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
@@ -679,42 +815,42 @@ func StoreStartValuesVector(builder *flatbuffers.Builder, numElems int) flatbuff
 func StoreEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
-type Event struct {
+type AddProvider struct {
 	_tab flatbuffers.Table
 }
 
-func GetRootAsEvent(buf []byte, offset flatbuffers.UOffsetT) *Event {
+func GetRootAsAddProvider(buf []byte, offset flatbuffers.UOffsetT) *AddProvider {
 	n := flatbuffers.GetUOffsetT(buf[offset:])
-	x := &Event{}
+	x := &AddProvider{}
 	x.Init(buf, n+offset)
 	return x
 }
 
-func FinishEventBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+func FinishAddProviderBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
 	builder.Finish(offset)
 }
 
-func GetSizePrefixedRootAsEvent(buf []byte, offset flatbuffers.UOffsetT) *Event {
+func GetSizePrefixedRootAsAddProvider(buf []byte, offset flatbuffers.UOffsetT) *AddProvider {
 	n := flatbuffers.GetUOffsetT(buf[offset+flatbuffers.SizeUint32:])
-	x := &Event{}
+	x := &AddProvider{}
 	x.Init(buf, n+offset+flatbuffers.SizeUint32)
 	return x
 }
 
-func FinishSizePrefixedEventBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+func FinishSizePrefixedAddProviderBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
 	builder.FinishSizePrefixed(offset)
 }
 
-func (rcv *Event) Init(buf []byte, i flatbuffers.UOffsetT) {
+func (rcv *AddProvider) Init(buf []byte, i flatbuffers.UOffsetT) {
 	rcv._tab.Bytes = buf
 	rcv._tab.Pos = i
 }
 
-func (rcv *Event) Table() flatbuffers.Table {
+func (rcv *AddProvider) Table() flatbuffers.Table {
 	return rcv._tab
 }
 
-func (rcv *Event) Id(j int) byte {
+func (rcv *AddProvider) Key(j int) byte {
 	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		a := rcv._tab.Vector(o)
@@ -723,7 +859,7 @@ func (rcv *Event) Id(j int) byte {
 	return 0
 }
 
-func (rcv *Event) IdLength() int {
+func (rcv *AddProvider) KeyLength() int {
 	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		return rcv._tab.VectorLen(o)
@@ -731,7 +867,7 @@ func (rcv *Event) IdLength() int {
 	return 0
 }
 
-func (rcv *Event) IdBytes() []byte {
+func (rcv *AddProvider) KeyBytes() []byte {
 	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		return rcv._tab.ByteVector(o + rcv._tab.Pos)
@@ -739,7 +875,7 @@ func (rcv *Event) IdBytes() []byte {
 	return nil
 }
 
-func (rcv *Event) MutateId(j int, n byte) bool {
+func (rcv *AddProvider) MutateKey(j int, n byte) bool {
 	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		a := rcv._tab.Vector(o)
@@ -748,8 +884,70 @@ func (rcv *Event) MutateId(j int, n byte) bool {
 	return false
 }
 
-func (rcv *Event) Sender(j int) byte {
+func (rcv *AddProvider) Ttl() int64 {
 	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *AddProvider) MutateTtl(n int64) bool {
+	return rcv._tab.MutateInt64Slot(6, n)
+}
+
+func AddProviderStart(builder *flatbuffers.Builder) {
+	builder.StartObject(2)
+}
+func AddProviderAddKey(builder *flatbuffers.Builder, key flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(key), 0)
+}
+func AddProviderStartKeyVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func AddProviderAddTtl(builder *flatbuffers.Builder, ttl int64) {
+	builder.PrependInt64Slot(1, ttl, 0)
+}
+func AddProviderEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
+	return builder.EndObject()
+}
+type GetProviders struct {
+	_tab flatbuffers.Table
+}
+
+func GetRootAsGetProviders(buf []byte, offset flatbuffers.UOffsetT) *GetProviders {
+	n := flatbuffers.GetUOffsetT(buf[offset:])
+	x := &GetProviders{}
+	x.Init(buf, n+offset)
+	return x
+}
+
+func FinishGetProvidersBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.Finish(offset)
+}
+
+func GetSizePrefixedRootAsGetProviders(buf []byte, offset flatbuffers.UOffsetT) *GetProviders {
+	n := flatbuffers.GetUOffsetT(buf[offset+flatbuffers.SizeUint32:])
+	x := &GetProviders{}
+	x.Init(buf, n+offset+flatbuffers.SizeUint32)
+	return x
+}
+
+func FinishSizePrefixedGetProvidersBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.FinishSizePrefixed(offset)
+}
+
+func (rcv *GetProviders) Init(buf []byte, i flatbuffers.UOffsetT) {
+	rcv._tab.Bytes = buf
+	rcv._tab.Pos = i
+}
+
+func (rcv *GetProviders) Table() flatbuffers.Table {
+	return rcv._tab
+}
+
+func (rcv *GetProviders) Key(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		a := rcv._tab.Vector(o)
 		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
@@ -757,24 +955,24 @@ func (rcv *Event) Sender(j int) byte {
 	return 0
 }
 
-func (rcv *Event) SenderLength() int {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+func (rcv *GetProviders) KeyLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		return rcv._tab.VectorLen(o)
 	}
 	return 0
 }
 
-func (rcv *Event) SenderBytes() []byte {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+func (rcv *GetProviders) KeyBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		return rcv._tab.ByteVector(o + rcv._tab.Pos)
 	}
 	return nil
 }
 
-func (rcv *Event) MutateSender(j int, n byte) bool {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+func (rcv *GetProviders) MutateKey(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
 		a := rcv._tab.Vector(o)
 		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
@@ -782,77 +980,739 @@ func (rcv *Event) MutateSender(j int, n byte) bool {
 	return false
 }
 
-func (rcv *Event) Event() EventType {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
+func (rcv *GetProviders) Providers(obj *Node, j int) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
 	if o != 0 {
-		return EventType(rcv._tab.GetInt8(o + rcv._tab.Pos))
+		x := rcv._tab.Vector(o)
+		x += flatbuffers.UOffsetT(j) * 4
+		x = rcv._tab.Indirect(x)
+		obj.Init(rcv._tab.Bytes, x)
+		return true
 	}
-	return 0
+	return false
 }
 
-func (rcv *Event) MutateEvent(n EventType) bool {
-	return rcv._tab.MutateInt8Slot(8, int8(n))
+func (rcv *GetProviders) ProvidersLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
 }
 
-func (rcv *Event) Response() bool {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(10))
+func (rcv *GetProviders) Nodes(obj *Node, j int) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
 	if o != 0 {
-		return rcv._tab.GetBool(o + rcv._tab.Pos)
+		x := rcv._tab.Vector(o)
+		x += flatbuffers.UOffsetT(j) * 4
+		x = rcv._tab.Indirect(x)
+		obj.Init(rcv._tab.Bytes, x)
+		return true
 	}
 	return false
 }
 
-func (rcv *Event) MutateResponse(n bool) bool {
-	return rcv._tab.MutateBoolSlot(10, n)
+func (rcv *GetProviders) NodesLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
 }
 
-func (rcv *Event) PayloadType() Operation {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+func GetProvidersStart(builder *flatbuffers.Builder) {
+	builder.StartObject(3)
+}
+func GetProvidersAddKey(builder *flatbuffers.Builder, key flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(key), 0)
+}
+func GetProvidersStartKeyVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func GetProvidersAddProviders(builder *flatbuffers.Builder, providers flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(1, flatbuffers.UOffsetT(providers), 0)
+}
+func GetProvidersStartProvidersVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(4, numElems, 4)
+}
+func GetProvidersAddNodes(builder *flatbuffers.Builder, nodes flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(2, flatbuffers.UOffsetT(nodes), 0)
+}
+func GetProvidersStartNodesVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(4, numElems, 4)
+}
+func GetProvidersEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
+	return builder.EndObject()
+}
+type Subscribe struct {
+	_tab flatbuffers.Table
+}
+
+func GetRootAsSubscribe(buf []byte, offset flatbuffers.UOffsetT) *Subscribe {
+	n := flatbuffers.GetUOffsetT(buf[offset:])
+	x := &Subscribe{}
+	x.Init(buf, n+offset)
+	return x
+}
+
+func FinishSubscribeBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.Finish(offset)
+}
+
+func GetSizePrefixedRootAsSubscribe(buf []byte, offset flatbuffers.UOffsetT) *Subscribe {
+	n := flatbuffers.GetUOffsetT(buf[offset+flatbuffers.SizeUint32:])
+	x := &Subscribe{}
+	x.Init(buf, n+offset+flatbuffers.SizeUint32)
+	return x
+}
+
+func FinishSizePrefixedSubscribeBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.FinishSizePrefixed(offset)
+}
+
+func (rcv *Subscribe) Init(buf []byte, i flatbuffers.UOffsetT) {
+	rcv._tab.Bytes = buf
+	rcv._tab.Pos = i
+}
+
+func (rcv *Subscribe) Table() flatbuffers.Table {
+	return rcv._tab
+}
+
+func (rcv *Subscribe) Key(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
-		return Operation(rcv._tab.GetByte(o + rcv._tab.Pos))
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
 	}
 	return 0
 }
 
-func (rcv *Event) MutatePayloadType(n Operation) bool {
-	return rcv._tab.MutateByteSlot(12, byte(n))
+func (rcv *Subscribe) KeyLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
 }
 
-func (rcv *Event) Payload(obj *flatbuffers.Table) bool {
-	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+func (rcv *Subscribe) KeyBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
 	if o != 0 {
-		rcv._tab.Union(obj, o)
-		return true
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Subscribe) MutateKey(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
 	}
 	return false
 }
 
-func EventStart(builder *flatbuffers.Builder) {
-	builder.StartObject(6)
+func (rcv *Subscribe) Lease() int64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
 }
-func EventAddId(builder *flatbuffers.Builder, id flatbuffers.UOffsetT) {
-	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(id), 0)
+
+func (rcv *Subscribe) MutateLease(n int64) bool {
+	return rcv._tab.MutateInt64Slot(6, n)
 }
-func EventStartIdVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
-	return builder.StartVector(1, numElems, 1)
+
+func SubscribeStart(builder *flatbuffers.Builder) {
+	builder.StartObject(2)
 }
-func EventAddSender(builder *flatbuffers.Builder, sender flatbuffers.UOffsetT) {
-	builder.PrependUOffsetTSlot(1, flatbuffers.UOffsetT(sender), 0)
+func SubscribeAddKey(builder *flatbuffers.Builder, key flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(key), 0)
 }
-func EventStartSenderVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+func SubscribeStartKeyVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(1, numElems, 1)
 }
-func EventAddEvent(builder *flatbuffers.Builder, event EventType) {
-	builder.PrependInt8Slot(2, int8(event), 0)
+func SubscribeAddLease(builder *flatbuffers.Builder, lease int64) {
+	builder.PrependInt64Slot(1, lease, 0)
 }
-func EventAddResponse(builder *flatbuffers.Builder, response bool) {
-	builder.PrependBoolSlot(3, response, false)
+func SubscribeEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
+	return builder.EndObject()
 }
-func EventAddPayloadType(builder *flatbuffers.Builder, payloadType Operation) {
-	builder.PrependByteSlot(4, byte(payloadType), 0)
+type Notify struct {
+	_tab flatbuffers.Table
 }
-func EventAddPayload(builder *flatbuffers.Builder, payload flatbuffers.UOffsetT) {
-	builder.PrependUOffsetTSlot(5, flatbuffers.UOffsetT(payload), 0)
+
+func GetRootAsNotify(buf []byte, offset flatbuffers.UOffsetT) *Notify {
+	n := flatbuffers.GetUOffsetT(buf[offset:])
+	x := &Notify{}
+	x.Init(buf, n+offset)
+	return x
+}
+
+func FinishNotifyBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.Finish(offset)
+}
+
+func GetSizePrefixedRootAsNotify(buf []byte, offset flatbuffers.UOffsetT) *Notify {
+	n := flatbuffers.GetUOffsetT(buf[offset+flatbuffers.SizeUint32:])
+	x := &Notify{}
+	x.Init(buf, n+offset+flatbuffers.SizeUint32)
+	return x
+}
+
+func FinishSizePrefixedNotifyBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.FinishSizePrefixed(offset)
+}
+
+func (rcv *Notify) Init(buf []byte, i flatbuffers.UOffsetT) {
+	rcv._tab.Bytes = buf
+	rcv._tab.Pos = i
+}
+
+func (rcv *Notify) Table() flatbuffers.Table {
+	return rcv._tab
+}
+
+func (rcv *Notify) Key(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *Notify) KeyLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Notify) KeyBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Notify) MutateKey(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *Notify) Values(obj *Value, j int) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		x := rcv._tab.Vector(o)
+		x += flatbuffers.UOffsetT(j) * 4
+		x = rcv._tab.Indirect(x)
+		obj.Init(rcv._tab.Bytes, x)
+		return true
+	}
+	return false
+}
+
+func (rcv *Notify) ValuesLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func NotifyStart(builder *flatbuffers.Builder) {
+	builder.StartObject(2)
+}
+func NotifyAddKey(builder *flatbuffers.Builder, key flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(key), 0)
+}
+func NotifyStartKeyVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func NotifyAddValues(builder *flatbuffers.Builder, values flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(1, flatbuffers.UOffsetT(values), 0)
+}
+func NotifyStartValuesVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(4, numElems, 4)
+}
+func NotifyEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
+	return builder.EndObject()
+}
+type Error struct {
+	_tab flatbuffers.Table
+}
+
+func GetRootAsError(buf []byte, offset flatbuffers.UOffsetT) *Error {
+	n := flatbuffers.GetUOffsetT(buf[offset:])
+	x := &Error{}
+	x.Init(buf, n+offset)
+	return x
+}
+
+func FinishErrorBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.Finish(offset)
+}
+
+func GetSizePrefixedRootAsError(buf []byte, offset flatbuffers.UOffsetT) *Error {
+	n := flatbuffers.GetUOffsetT(buf[offset+flatbuffers.SizeUint32:])
+	x := &Error{}
+	x.Init(buf, n+offset+flatbuffers.SizeUint32)
+	return x
+}
+
+func FinishSizePrefixedErrorBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.FinishSizePrefixed(offset)
+}
+
+func (rcv *Error) Init(buf []byte, i flatbuffers.UOffsetT) {
+	rcv._tab.Bytes = buf
+	rcv._tab.Pos = i
+}
+
+func (rcv *Error) Table() flatbuffers.Table {
+	return rcv._tab
+}
+
+func (rcv *Error) Code() ErrorCode {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		return ErrorCode(rcv._tab.GetInt32(o + rcv._tab.Pos))
+	}
+	return 0
+}
+
+func (rcv *Error) MutateCode(n ErrorCode) bool {
+	return rcv._tab.MutateInt32Slot(4, int32(n))
+}
+
+func (rcv *Error) Message() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func ErrorStart(builder *flatbuffers.Builder) {
+	builder.StartObject(2)
+}
+func ErrorAddCode(builder *flatbuffers.Builder, code ErrorCode) {
+	builder.PrependInt32Slot(0, int32(code), 0)
+}
+func ErrorAddMessage(builder *flatbuffers.Builder, message flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(1, flatbuffers.UOffsetT(message), 0)
+}
+func ErrorEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
+	return builder.EndObject()
+}
+type Event struct {
+	_tab flatbuffers.Table
+}
+
+func GetRootAsEvent(buf []byte, offset flatbuffers.UOffsetT) *Event {
+	n := flatbuffers.GetUOffsetT(buf[offset:])
+	x := &Event{}
+	x.Init(buf, n+offset)
+	return x
+}
+
+func FinishEventBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.Finish(offset)
+}
+
+func GetSizePrefixedRootAsEvent(buf []byte, offset flatbuffers.UOffsetT) *Event {
+	n := flatbuffers.GetUOffsetT(buf[offset+flatbuffers.SizeUint32:])
+	x := &Event{}
+	x.Init(buf, n+offset+flatbuffers.SizeUint32)
+	return x
+}
+
+func FinishSizePrefixedEventBuffer(builder *flatbuffers.Builder, offset flatbuffers.UOffsetT) {
+	builder.FinishSizePrefixed(offset)
+}
+
+func (rcv *Event) Init(buf []byte, i flatbuffers.UOffsetT) {
+	rcv._tab.Bytes = buf
+	rcv._tab.Pos = i
+}
+
+func (rcv *Event) Table() flatbuffers.Table {
+	return rcv._tab
+}
+
+func (rcv *Event) Id(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *Event) IdLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Event) IdBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Event) MutateId(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(4))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *Event) Sender(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *Event) SenderLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Event) SenderBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Event) MutateSender(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *Event) Event() EventType {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
+	if o != 0 {
+		return EventType(rcv._tab.GetInt8(o + rcv._tab.Pos))
+	}
+	return 0
+}
+
+func (rcv *Event) MutateEvent(n EventType) bool {
+	return rcv._tab.MutateInt8Slot(8, int8(n))
+}
+
+func (rcv *Event) Response() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(10))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Event) MutateResponse(n bool) bool {
+	return rcv._tab.MutateBoolSlot(10, n)
+}
+
+func (rcv *Event) PayloadType() Operation {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+	if o != 0 {
+		return Operation(rcv._tab.GetByte(o + rcv._tab.Pos))
+	}
+	return 0
+}
+
+func (rcv *Event) MutatePayloadType(n Operation) bool {
+	return rcv._tab.MutateByteSlot(12, byte(n))
+}
+
+func (rcv *Event) Payload(obj *flatbuffers.Table) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+	if o != 0 {
+		rcv._tab.Union(obj, o)
+		return true
+	}
+	return false
+}
+
+func (rcv *Event) Version() uint16 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		return rcv._tab.GetUint16(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *Event) MutateVersion(n uint16) bool {
+	return rcv._tab.MutateUint16Slot(16, n)
+}
+
+func (rcv *Event) Capabilities() uint64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(18))
+	if o != 0 {
+		return rcv._tab.GetUint64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *Event) MutateCapabilities(n uint64) bool {
+	return rcv._tab.MutateUint64Slot(18, n)
+}
+
+func (rcv *Event) Observed(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(20))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *Event) ObservedLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(20))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Event) ObservedBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(20))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Event) MutateObserved(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(20))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *Event) Client() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(22))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Event) MutateClient(n bool) bool {
+	return rcv._tab.MutateBoolSlot(22, n)
+}
+
+func (rcv *Event) Punch(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *Event) PunchLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Event) PunchBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Event) MutatePunch(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *Event) Relay(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(26))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *Event) RelayLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(26))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Event) RelayBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(26))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Event) MutateRelay(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(26))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
+func (rcv *Event) Dialback() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(28))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Event) MutateDialback(n bool) bool {
+	return rcv._tab.MutateBoolSlot(28, n)
+}
+
+func (rcv *Event) Introduced() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(30))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Event) MutateIntroduced(n bool) bool {
+	return rcv._tab.MutateBoolSlot(30, n)
+}
+
+func (rcv *Event) Network() uint32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(32))
+	if o != 0 {
+		return rcv._tab.GetUint32(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *Event) MutateNetwork(n uint32) bool {
+	return rcv._tab.MutateUint32Slot(32, n)
+}
+
+func (rcv *Event) Passive() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(34))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Event) MutatePassive(n bool) bool {
+	return rcv._tab.MutateBoolSlot(34, n)
+}
+
+func EventStart(builder *flatbuffers.Builder) {
+	builder.StartObject(16)
+}
+func EventAddId(builder *flatbuffers.Builder, id flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(id), 0)
+}
+func EventStartIdVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func EventAddSender(builder *flatbuffers.Builder, sender flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(1, flatbuffers.UOffsetT(sender), 0)
+}
+func EventStartSenderVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func EventAddEvent(builder *flatbuffers.Builder, event EventType) {
+	builder.PrependInt8Slot(2, int8(event), 0)
+}
+func EventAddResponse(builder *flatbuffers.Builder, response bool) {
+	builder.PrependBoolSlot(3, response, false)
+}
+func EventAddPayloadType(builder *flatbuffers.Builder, payloadType Operation) {
+	builder.PrependByteSlot(4, byte(payloadType), 0)
+}
+func EventAddPayload(builder *flatbuffers.Builder, payload flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(5, flatbuffers.UOffsetT(payload), 0)
+}
+func EventAddVersion(builder *flatbuffers.Builder, version uint16) {
+	builder.PrependUint16Slot(6, version, 0)
+}
+func EventAddCapabilities(builder *flatbuffers.Builder, capabilities uint64) {
+	builder.PrependUint64Slot(7, capabilities, 0)
+}
+func EventAddObserved(builder *flatbuffers.Builder, observed flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(8, flatbuffers.UOffsetT(observed), 0)
+}
+func EventStartObservedVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func EventAddClient(builder *flatbuffers.Builder, client bool) {
+	builder.PrependBoolSlot(9, client, false)
+}
+func EventAddPunch(builder *flatbuffers.Builder, punch flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(10, flatbuffers.UOffsetT(punch), 0)
+}
+func EventStartPunchVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func EventAddRelay(builder *flatbuffers.Builder, relay flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(11, flatbuffers.UOffsetT(relay), 0)
+}
+func EventStartRelayVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
+func EventAddDialback(builder *flatbuffers.Builder, dialback bool) {
+	builder.PrependBoolSlot(12, dialback, false)
+}
+func EventAddIntroduced(builder *flatbuffers.Builder, introduced bool) {
+	builder.PrependBoolSlot(13, introduced, false)
+}
+func EventAddNetwork(builder *flatbuffers.Builder, network uint32) {
+	builder.PrependUint32Slot(14, network, 0)
+}
+func EventAddPassive(builder *flatbuffers.Builder, passive bool) {
+	builder.PrependBoolSlot(15, passive, false)
 }
 func EventEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
@@ -0,0 +1,507 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/tos-network/emo/protocol"
+)
+
+const (
+	// DefaultProviderTTL the default amount of time a provider record is kept for
+	DefaultProviderTTL = time.Hour * 24
+	// MaxProvidersPerKey the maximum number of providers that will be stored for a single key
+	MaxProvidersPerKey = K * 2
+	// MaxProviderKeys the maximum number of keys that provider records will be stored for
+	MaxProviderKeys = 1 << 14
+	// MaxProviderRecords the maximum number of provider records that will be stored across all keys
+	MaxProviderRecords = 1 << 16
+	// MaxProviderTTL the maximum amount of time we will store a provider record for
+	MaxProviderTTL = time.Hour * 48
+)
+
+// Provider a node that has announced it can serve the content for a key
+type Provider struct {
+	// ID the node id of the provider
+	ID []byte
+	// Address the address the provider announced itself from
+	Address *net.UDPAddr
+	// expiry time of the provider record
+	expires time.Time
+}
+
+// stores the providers of keys, separately from values
+type providerStore struct {
+	providers map[string][]*Provider
+	// the number of records held across all keys
+	records int
+	clock   Clock
+	// closed to stop the cleanup of expired providers, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+}
+
+func newProviderStore(clock Clock) *providerStore {
+	s := &providerStore{
+		providers: make(map[string][]*Provider),
+		clock:     clock,
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go s.cleanup()
+
+	return s
+}
+
+// add adds or refreshes a provider for a key. records are refreshed by the provider announcing itself
+// from the same address, so a node claiming its id can't move the record to another address.
+// returns false if the key or the store has too many providers
+func (s *providerStore) add(key, id []byte, address *net.UDPAddr, ttl time.Duration) bool {
+	if ttl > MaxProviderTTL {
+		ttl = MaxProviderTTL
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps, ok := s.providers[string(key)]
+
+	for _, p := range ps {
+		if bytes.Equal(p.ID, id) && p.Address.IP.Equal(address.IP) && p.Address.Port == address.Port {
+			p.expires = s.clock.Now().Add(ttl)
+			return true
+		}
+	}
+
+	if len(ps) >= MaxProvidersPerKey || s.records >= MaxProviderRecords {
+		return false
+	}
+
+	if !ok && len(s.providers) >= MaxProviderKeys {
+		return false
+	}
+
+	pid := make([]byte, len(id))
+	copy(pid, id)
+
+	s.providers[string(key)] = append(ps, &Provider{
+		ID:      pid,
+		Address: address,
+		expires: s.clock.Now().Add(ttl),
+	})
+
+	s.records++
+
+	return true
+}
+
+// get returns up to limit providers for a key
+func (s *providerStore) get(key []byte, limit int) []*Provider {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+
+	var ps []*Provider
+
+	for _, p := range s.providers[string(key)] {
+		if len(ps) >= limit {
+			break
+		}
+
+		if p.expires.After(now) {
+			// copy the record as it may be refreshed while the caller is using it
+			c := *p
+			ps = append(ps, &c)
+		}
+	}
+
+	return ps
+}
+
+func (s *providerStore) cleanup() {
+	defer close(s.stopped)
+
+	for {
+		// scan the store to check for providers that have expired
+		select {
+		case <-s.quit:
+			return
+		case <-s.clock.After(time.Minute):
+		}
+
+		now := s.clock.Now()
+
+		s.mu.Lock()
+
+		for k, ps := range s.providers {
+			live := ps[:0]
+
+			for _, p := range ps {
+				if p.expires.After(now) {
+					live = append(live, p)
+				}
+			}
+
+			s.records = s.records - (len(ps) - len(live))
+
+			if len(live) == 0 {
+				delete(s.providers, k)
+				continue
+			}
+
+			s.providers[k] = live
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// stops the cleanup of expired providers and waits for it to finish
+func (s *providerStore) close() {
+	close(s.quit)
+	<-s.stopped
+}
+
+// Provide announces to the nodes closest to the key that this node can serve its content.
+// The address other nodes record for us is the address they receive the announcement from
+func (d *DHT) Provide(key []byte, callback func(err error)) {
+	if len(key) != KEY_BYTES {
+		callback(errors.New("key must be 32 bytes in length"))
+		return
+	}
+
+	// get the k closest nodes to store the provider record on
+	ns := d.routing.closestN(key, K)
+
+	if len(ns) < 1 {
+		callback(errors.New("no nodes found"))
+		return
+	}
+
+	// we don't know the address other nodes see us at, so we rely on the other
+	// closest nodes to store our record. nodes that have told us they don't
+	// support provider records are skipped
+	targets := make([]*node, 0, len(ns))
+
+	for _, n := range ns {
+		if bytes.Equal(n.id, d.config.LocalID) || !d.routing.supports(n.id, protocol.EventTypeADD_PROVIDER) {
+			continue
+		}
+
+		targets = append(targets, n)
+	}
+
+	if len(targets) < 1 {
+		if len(ns) == 1 && bytes.Equal(ns[0].id, d.config.LocalID) {
+			callback(nil)
+			return
+		}
+
+		callback(ErrUnsupportedEvent)
+		return
+	}
+
+	var r int32
+	var once sync.Once
+
+	buf := d.pool.Get().(*flatbuffers.Builder)
+	defer d.pool.Put(buf)
+
+	for _, n := range targets {
+		rid := pseudorandomID()
+		req := eventAddProviderRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, key, d.config.ProviderTTL)
+
+		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+			n.address,
+			rid,
+			req,
+			func(event *protocol.Event, err error) bool {
+				if err != nil {
+					once.Do(func() {
+						callback(err)
+					})
+					return true
+				}
+
+				if atomic.AddInt32(&r, 1) == int32(len(targets)) {
+					once.Do(func() {
+						callback(nil)
+					})
+				}
+
+				return true
+			},
+		)
+
+		if err != nil {
+			once.Do(func() {
+				callback(err)
+			})
+			return
+		}
+	}
+}
+
+// FindProviders finds up to limit providers that have announced they can serve the content for a key
+func (d *DHT) FindProviders(ctx context.Context, key []byte, limit int) ([]*Provider, error) {
+	if len(key) != KEY_BYTES {
+		return nil, errors.New("key must be 32 bytes in length")
+	}
+
+	if limit < 1 {
+		limit = K
+	}
+
+	f := &providerSearch{
+		dht:     d,
+		key:     key,
+		limit:   limit,
+		journey: newJourney(d.config.LocalID, key, K),
+		seen:    make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// include any providers we know about locally
+	f.add(d.providers.get(key, limit))
+
+	ns := d.routing.closestN(key, K)
+	if len(ns) == 0 {
+		return f.result(errors.New("no nodes found"))
+	}
+
+	f.journey.add(ns)
+
+	if !f.finished() {
+		f.next()
+	}
+
+	select {
+	case <-ctx.Done():
+		f.journey.finish(true)
+		return f.result(ctx.Err())
+	case <-f.done:
+		return f.result(nil)
+	}
+}
+
+// tracks the providers found by a FindProviders request
+type providerSearch struct {
+	dht       *DHT
+	key       []byte
+	limit     int
+	journey   *journey
+	providers []*Provider
+	seen      map[string]struct{}
+	done      chan struct{}
+	closed    bool
+	mu        sync.Mutex
+}
+
+// adds any providers we have not already seen
+func (f *providerSearch) add(providers []*Provider) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, p := range providers {
+		if len(f.providers) >= f.limit {
+			break
+		}
+
+		_, ok := f.seen[string(p.ID)]
+		if ok {
+			continue
+		}
+
+		f.seen[string(p.ID)] = struct{}{}
+		f.providers = append(f.providers, p)
+	}
+
+	if len(f.providers) >= f.limit {
+		f.close()
+	}
+}
+
+func (f *providerSearch) finished() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.closed
+}
+
+// signals that the search has finished. the caller must hold the mutex
+func (f *providerSearch) close() {
+	if f.closed {
+		return
+	}
+
+	f.closed = true
+	close(f.done)
+}
+
+// returns the providers found so far, only returning an error if none were found
+func (f *providerSearch) result(err error) ([]*Provider, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.providers) > 0 {
+		return f.providers, nil
+	}
+
+	if err == nil {
+		err = errors.New("no providers found")
+	}
+
+	return nil, err
+}
+
+// sends requests to the next best nodes in the journey
+func (f *providerSearch) next() {
+	ns := f.journey.next(ALPHA)
+	if ns == nil {
+		if f.journey.finish(false) {
+			f.mu.Lock()
+			f.close()
+			f.mu.Unlock()
+		}
+		return
+	}
+
+	buf := f.dht.pool.Get().(*flatbuffers.Builder)
+
+	// set if a node won't send us a response, which
+	// would otherwise trigger the next requests
+	var skipped bool
+
+	for _, n := range ns {
+		// skip nodes that have told us they don't support provider records
+		if !f.dht.routing.supports(n.id, protocol.EventTypeGET_PROVIDERS) {
+			f.journey.responseReceived()
+			skipped = true
+			continue
+		}
+
+		rid := pseudorandomID()
+		req := eventGetProvidersRequest(buf, rid, f.dht.config.LocalID, f.dht.config.ClientMode, f.dht.config.NetworkID, f.key)
+
+		err := f.dht.listeners[(atomic.AddInt32(&f.dht.cl, 1)-1)%int32(len(f.dht.listeners))].request(
+			n.address,
+			rid,
+			req,
+			f.callback(n.id),
+		)
+
+		if err != nil {
+			f.journey.responseReceived()
+			skipped = true
+		}
+	}
+
+	f.dht.pool.Put(buf)
+
+	// try the next best nodes, finishing the search if there are none left
+	if skipped {
+		f.next()
+	}
+}
+
+// returns the callback used to handle responses to our get providers requests
+func (f *providerSearch) callback(id []byte) func(event *protocol.Event, err error) bool {
+	return func(event *protocol.Event, err error) bool {
+		completed, _ := f.journey.responseReceived()
+		if completed {
+			return true
+		}
+
+		if err != nil {
+			if errors.Is(err, ErrRequestTimeout) {
+				f.dht.routing.remove(id)
+			}
+
+			// try the next best nodes, finishing the search if there are none left
+			f.next()
+
+			return true
+		}
+
+		payloadTable := new(flatbuffers.Table)
+
+		if !event.Payload(payloadTable) {
+			f.next()
+			return true
+		}
+
+		g := new(protocol.GetProviders)
+		g.Init(payloadTable.Bytes, payloadTable.Pos)
+
+		// the event has been verified, so the node
+		// id and address will be the correct length
+		providers := make([]*Provider, 0, g.ProvidersLength())
+
+		for i := 0; i < g.ProvidersLength(); i++ {
+			nd := new(protocol.Node)
+
+			if g.Providers(nd, i) {
+				pid := make([]byte, KEY_BYTES)
+				copy(pid, nd.IdBytes())
+
+				providers = append(providers, &Provider{
+					ID:      pid,
+					Address: decodeAddress(nd.AddressBytes()),
+				})
+			}
+		}
+
+		f.add(providers)
+
+		if f.finished() {
+			f.journey.finish(true)
+			return true
+		}
+
+		nodes := make([]*node, 0, g.NodesLength())
+
+		for i := 0; i < g.NodesLength(); i++ {
+			nd := new(protocol.Node)
+
+			if g.Nodes(nd, i) {
+				nid := make([]byte, KEY_BYTES)
+				copy(nid, nd.IdBytes())
+
+				nodes = append(nodes, &node{
+					id:      nid,
+					address: decodeAddress(nd.AddressBytes()),
+				})
+			}
+		}
+
+		f.journey.add(nodes)
+		f.next()
+
+		return true
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderStore(t *testing.T) {
+	s := newProviderStore(systemClock{})
+	defer s.close()
+
+	key := randomID()
+	id := randomID()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	assert.True(t, s.add(key, id, addr, time.Hour))
+	assert.Empty(t, s.get(randomID(), K))
+
+	ps := s.get(key, K)
+	require.Len(t, ps, 1)
+	assert.Equal(t, id, ps[0].ID)
+	assert.Equal(t, addr, ps[0].Address)
+
+	// announcing again should refresh the existing record
+	assert.True(t, s.add(key, id, addr, time.Hour))
+	require.Len(t, s.get(key, K), 1)
+
+	// but announcing the same id from another address should not move the existing record
+	naddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9001}
+
+	assert.True(t, s.add(key, id, naddr, time.Hour))
+
+	ps = s.get(key, K)
+	require.Len(t, ps, 2)
+	assert.Equal(t, addr, ps[0].Address)
+	assert.Equal(t, naddr, ps[1].Address)
+
+	// the number of providers for a key should be bounded
+	for i := 2; i < MaxProvidersPerKey; i++ {
+		assert.True(t, s.add(key, randomID(), addr, time.Hour))
+	}
+
+	assert.False(t, s.add(key, randomID(), addr, time.Hour))
+	assert.Len(t, s.get(key, MaxProvidersPerKey*2), MaxProvidersPerKey)
+	assert.Len(t, s.get(key, 5), 5)
+
+	// expired providers should not be returned
+	key = randomID()
+
+	assert.True(t, s.add(key, randomID(), addr, -time.Second))
+	assert.Empty(t, s.get(key, K))
+}
+
+func TestProviderStoreLimits(t *testing.T) {
+	s := newProviderStore(systemClock{})
+	defer s.close()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	// the number of keys should be bounded
+	for i := 0; i < MaxProviderKeys; i++ {
+		require.True(t, s.add(randomID(), randomID(), addr, time.Hour))
+	}
+
+	assert.False(t, s.add(randomID(), randomID(), addr, time.Hour))
+
+	// as should the number of records across all keys
+	s.mu.Lock()
+	keys := make([][]byte, 0, len(s.providers))
+	for k := range s.providers {
+		keys = append(keys, []byte(k))
+	}
+	s.mu.Unlock()
+
+	var added int
+
+	for _, k := range keys {
+		for i := 1; i < MaxProvidersPerKey && s.add(k, randomID(), addr, time.Hour); i++ {
+			added++
+		}
+	}
+
+	assert.Equal(t, MaxProviderRecords, MaxProviderKeys+added)
+	assert.False(t, s.add(keys[0], randomID(), addr, time.Hour))
+}
+
+func TestDHTClusterProvideFindProviders(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	var dhts []*DHT
+
+	// add some nodes to the network
+	for i := 0; i < 3; i++ {
+		c := &Config{
+			LocalID:       randomID(),
+			ListenAddress: fmt.Sprintf("127.0.0.1:%d", 9001+i),
+			BootstrapAddresses: []string{
+				bc.ListenAddress,
+			},
+			Listeners: 1,
+		}
+
+		dht, err := New(c)
+		require.Nil(t, err)
+		defer dht.Close()
+
+		dhts = append(dhts, dht)
+	}
+
+	key := randomID()
+	ch := make(chan error, 1)
+
+	dhts[0].Provide(key, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	ps, err := dhts[2].FindProviders(ctx, key, 10)
+	require.Nil(t, err)
+	require.Len(t, ps, 1)
+
+	// the provider should be recorded with the address it announced from
+	assert.Equal(t, dhts[0].config.LocalID, ps[0].ID)
+	assert.Equal(t, "127.0.0.1:9001", ps[0].Address.String())
+
+	// keys without providers should return an error
+	_, err = dhts[2].FindProviders(ctx, randomID(), 10)
+	assert.NotNil(t, err)
+}
+
+func TestDHTFindProvidersUnsupported(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 8)
+
+	// none of the node's peers support provider records
+	for _, p := range nodes[0].Peers() {
+		nodes[0].routing.advertise(p.ID, p.Address, ProtocolVersion, 0, false)
+	}
+
+	ch := make(chan error, 1)
+
+	go func() {
+		_, err := nodes[0].FindProviders(context.Background(), randomID(), 1)
+		ch <- err
+	}()
+
+	select {
+	case err := <-ch:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("find providers did not finish")
+	}
+}
+
+func TestDHTSpoofedProvider(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 2)
+
+	victim, err := network.ListenPacket("10.9.9.9:9000")
+	require.Nil(t, err)
+	defer victim.Close()
+
+	key := randomID()
+	buf := flatbuffers.NewBuilder(1024)
+
+	// an announcement that claims to come from another host
+	nodes[0].listeners[0].handle(victim.LocalAddr().(*net.UDPAddr), eventAddProviderRequest(buf, randomID(), randomID(), false, 0, key, time.Hour))
+
+	// should only send it a ping, which it won't answer
+	assert.NotEmpty(t, simRead(t, victim, time.Second))
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Empty(t, nodes[0].providers.get(key, K))
+}
@@ -0,0 +1,535 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"errors"
+	"hash/maphash"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/tos-network/emo/protocol"
+)
+
+const (
+	// DefaultSubscriptionLease the default amount of time a subscription is held by other nodes before it must be renewed
+	DefaultSubscriptionLease = time.Minute * 10
+	// MaxSubscriptionLease the maximum amount of time we will hold a subscription for without it being renewed
+	MaxSubscriptionLease = time.Hour
+	// MaxSubscribersPerKey the maximum number of subscribers that will be notified for a single key
+	MaxSubscribersPerKey = 256
+	// MaxSubscribedKeys the maximum number of keys that remote nodes can subscribe to
+	MaxSubscribedKeys = 1 << 14
+	// the amount of time an address that has answered one of our pings can subscribe
+	// or announce itself as a provider without being pinged again
+	proofExpiry = MaxSubscriptionLease
+)
+
+// the rate notifications are sent to a single subscriber address, across all of the keys it has subscribed to
+var notifyLimit = RateLimit{Rate: 50, Burst: 200}
+
+// a remote node that has subscribed to a key
+type subscriber struct {
+	id      []byte
+	address *net.UDPAddr
+	expires time.Time
+}
+
+// Subscription receives notifications of values that are stored under a key
+type Subscription struct {
+	dht     *DHT
+	key     []byte
+	handler func(value []byte)
+	// ids of the nodes we have subscribed with
+	nodes map[string]struct{}
+	// values we have already delivered to the handler, used to
+	// ignore the same value being published by several nodes
+	seen   map[uint64]time.Time
+	hasher maphash.Hash
+	closed bool
+	mu     sync.Mutex
+}
+
+// tracks the subscribers of keys stored on this node, along with
+// the subscriptions this node has made
+type pubsub struct {
+	// remote nodes subscribed to keys we store
+	subscribers map[string][]*subscriber
+	// our own subscriptions
+	subscriptions map[string][]*Subscription
+	// addresses that have proven they aren't spoofed by answering one of our pings, and when they last did
+	proven map[netip.AddrPort]time.Time
+	// limits the rate notifications are sent to each subscriber address
+	notifications map[netip.AddrPort]*tokenBucket
+	logger        *slog.Logger
+	clock         Clock
+	// closed to stop the cleanup of expired subscribers, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+}
+
+func newPubSub(logger *slog.Logger, clock Clock) *pubsub {
+	p := &pubsub{
+		subscribers:   make(map[string][]*subscriber),
+		subscriptions: make(map[string][]*Subscription),
+		proven:        make(map[netip.AddrPort]time.Time),
+		notifications: make(map[netip.AddrPort]*tokenBucket),
+		logger:        logger,
+		clock:         clock,
+		quit:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	go p.cleanup()
+
+	return p
+}
+
+// subscribe adds or renews a subscriber to a key. a lease of zero removes the subscriber. subscribers
+// are matched on both their id and address, so a node claiming the id of a subscriber can't renew,
+// cancel or redirect its subscription. returns false if the key or the node has too many subscribers
+func (p *pubsub) subscribe(key, id []byte, address *net.UDPAddr, lease time.Duration) bool {
+	if lease > MaxSubscriptionLease {
+		lease = MaxSubscriptionLease
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, ok := p.subscribers[string(key)]
+
+	for i, s := range ss {
+		if !bytes.Equal(s.id, id) || !s.address.IP.Equal(address.IP) || s.address.Port != address.Port {
+			continue
+		}
+
+		if lease <= 0 {
+			ss[i] = ss[len(ss)-1]
+			ss = ss[:len(ss)-1]
+
+			if len(ss) == 0 {
+				delete(p.subscribers, string(key))
+			} else {
+				p.subscribers[string(key)] = ss
+			}
+
+			return true
+		}
+
+		s.expires = p.clock.Now().Add(lease)
+
+		return true
+	}
+
+	if lease <= 0 {
+		return true
+	}
+
+	if len(ss) >= MaxSubscribersPerKey {
+		return false
+	}
+
+	if !ok && len(p.subscribers) >= MaxSubscribedKeys {
+		return false
+	}
+
+	sid := make([]byte, len(id))
+	copy(sid, id)
+
+	p.subscribers[string(key)] = append(ss, &subscriber{
+		id:      sid,
+		address: address,
+		expires: p.clock.Now().Add(lease),
+	})
+
+	return true
+}
+
+// records that a node answered a ping sent to its address, so subscriptions
+// and provider records from the address aren't spoofed
+func (p *pubsub) prove(address *net.UDPAddr) {
+	now := p.clock.Now()
+
+	p.mu.Lock()
+	p.proven[addrPort(address)] = now
+	p.mu.Unlock()
+}
+
+// returns true if a node has recently answered a ping sent to the address
+func (p *pubsub) isProven(address *net.UDPAddr) bool {
+	now := p.clock.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proved, ok := p.proven[addrPort(address)]
+
+	return ok && now.Sub(proved) < proofExpiry
+}
+
+// publish notifies the subscribers of a key of new values that have been stored under it
+func (p *pubsub) publish(buf *flatbuffers.Builder, localID []byte, passive bool, network uint32, key []byte, values []*Value, write func(to *net.UDPAddr, id, data []byte) error) {
+	now := p.clock.Now()
+
+	p.mu.Lock()
+
+	var addrs []*net.UDPAddr
+
+	for _, s := range p.subscribers[string(key)] {
+		if !s.expires.After(now) {
+			continue
+		}
+
+		ap := addrPort(s.address)
+
+		b, ok := p.notifications[ap]
+		if !ok {
+			b = &tokenBucket{}
+			p.notifications[ap] = b
+		}
+
+		// don't let stores to keys the address has subscribed to flood it with notifications
+		if !b.take(notifyLimit, now) {
+			p.logger.Debug("dropped notification to subscriber", addrAttr(s.address), hexAttr(logKey, key))
+			continue
+		}
+
+		addrs = append(addrs, s.address)
+	}
+
+	// also notify any of our own subscriptions to the key
+	local := append([]*Subscription(nil), p.subscriptions[string(key)]...)
+
+	p.mu.Unlock()
+
+	for _, s := range local {
+		for _, v := range values {
+			s.deliver(v.Value)
+		}
+	}
+
+	for _, addr := range addrs {
+		rid := pseudorandomID()
+		n := eventNotify(buf, rid, localID, passive, network, key, values)
+
+		err := write(addr, rid, n)
+		if err != nil {
+			p.logger.Warn("failed to notify subscriber", addrAttr(addr), hexAttr(logKey, key), errAttr(err))
+		}
+	}
+}
+
+// notified delivers the values of a notification sent by
+// another node to any of our subscriptions to the key
+func (p *pubsub) notified(sender, key []byte, values []*Value) {
+	p.mu.Lock()
+	local := append([]*Subscription(nil), p.subscriptions[string(key)]...)
+	p.mu.Unlock()
+
+	for _, s := range local {
+		// only accept notifications from nodes we have subscribed with
+		if !s.subscribedWith(sender) {
+			continue
+		}
+
+		for _, v := range values {
+			s.deliver(v.Value)
+		}
+	}
+}
+
+func (p *pubsub) add(s *Subscription) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.subscriptions[string(s.key)] = append(p.subscriptions[string(s.key)], s)
+}
+
+func (p *pubsub) remove(s *Subscription) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss := p.subscriptions[string(s.key)]
+
+	for i := range ss {
+		if ss[i] == s {
+			ss[i] = ss[len(ss)-1]
+			ss = ss[:len(ss)-1]
+			break
+		}
+	}
+
+	if len(ss) == 0 {
+		delete(p.subscriptions, string(s.key))
+		return
+	}
+
+	p.subscriptions[string(s.key)] = ss
+}
+
+// returns all of our own active subscriptions
+func (p *pubsub) active() []*Subscription {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var ss []*Subscription
+
+	for _, s := range p.subscriptions {
+		ss = append(ss, s...)
+	}
+
+	return ss
+}
+
+func (p *pubsub) cleanup() {
+	defer close(p.stopped)
+
+	for {
+		// scan for subscribers whose leases have expired
+		select {
+		case <-p.quit:
+			return
+		case <-p.clock.After(time.Minute):
+		}
+
+		now := p.clock.Now()
+
+		p.mu.Lock()
+
+		for k, ss := range p.subscribers {
+			live := ss[:0]
+
+			for _, s := range ss {
+				if s.expires.After(now) {
+					live = append(live, s)
+				}
+			}
+
+			if len(live) == 0 {
+				delete(p.subscribers, k)
+				continue
+			}
+
+			p.subscribers[k] = live
+		}
+
+		for ap, proved := range p.proven {
+			if now.Sub(proved) >= proofExpiry {
+				delete(p.proven, ap)
+			}
+		}
+
+		// buckets that haven't been used for a minute are full, so can be recreated when needed
+		for ap, b := range p.notifications {
+			if now.Sub(b.last) >= time.Minute {
+				delete(p.notifications, ap)
+			}
+		}
+
+		p.mu.Unlock()
+
+		for _, s := range p.active() {
+			s.expire(now)
+		}
+	}
+}
+
+// stops the cleanup of expired subscribers and waits for it to finish
+func (p *pubsub) close() {
+	close(p.quit)
+	<-p.stopped
+}
+
+// delivers a value to the subscriptions handler if it has not been seen before. values are identified
+// by their key and value alone, as the same value is stored with a new created time when it is refreshed
+func (s *Subscription) deliver(value []byte) {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+
+	s.hasher.Reset()
+	s.hasher.Write(s.key)
+	s.hasher.Write(value)
+	h := s.hasher.Sum64()
+
+	_, ok := s.seen[h]
+	if ok {
+		s.mu.Unlock()
+		return
+	}
+
+	s.seen[h] = s.dht.config.Clock.Now()
+
+	s.mu.Unlock()
+
+	s.handler(value)
+}
+
+// removes values we have delivered that are old enough to no longer be published
+func (s *Subscription) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for h, t := range s.seen {
+		if now.Sub(t) > s.dht.config.SubscriptionLease {
+			delete(s.seen, h)
+		}
+	}
+}
+
+func (s *Subscription) subscribedWith(id []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.nodes[string(id)]
+
+	return ok
+}
+
+// Key returns the key the subscription is for
+func (s *Subscription) Key() []byte {
+	return s.key
+}
+
+// Cancel stops the subscription, removing it from the nodes it was registered with
+func (s *Subscription) Cancel() {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+
+	s.closed = true
+
+	s.mu.Unlock()
+
+	s.dht.pubsub.remove(s)
+
+	// a lease of zero removes the subscription
+	s.dht.subscribe(s, 0)
+}
+
+// Subscribe registers interest in a key with the nodes closest to it. The handler will be
+// invoked with each new value stored under the key. Subscriptions are renewed until they are
+// cancelled. The handler is invoked from the listeners goroutine, so it should not block, and
+// the value will not be safe to use outside of the handler unless it is copied
+func (d *DHT) Subscribe(key []byte, handler func(value []byte)) (*Subscription, error) {
+	if len(key) != KEY_BYTES {
+		return nil, errors.New("key must be 32 bytes in length")
+	}
+
+	s := &Subscription{
+		dht:     d,
+		key:     key,
+		handler: handler,
+		nodes:   make(map[string]struct{}),
+		seen:    make(map[uint64]time.Time),
+	}
+
+	s.hasher.SetSeed(maphash.MakeSeed())
+
+	d.pubsub.add(s)
+
+	err := d.subscribe(s, d.config.SubscriptionLease)
+	if err != nil {
+		d.pubsub.remove(s)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// sends a subscribe request to the K closest nodes to the subscriptions key
+func (d *DHT) subscribe(s *Subscription, lease time.Duration) error {
+	ns := d.routing.closestN(s.key, K)
+
+	if len(ns) < 1 {
+		return errors.New("no nodes found")
+	}
+
+	buf := d.pool.Get().(*flatbuffers.Builder)
+	defer d.pool.Put(buf)
+
+	for _, n := range ns {
+		// values stored on this node are delivered to our
+		// subscriptions directly when they are published
+		if bytes.Equal(n.id, d.config.LocalID) {
+			continue
+		}
+
+		// nodes that don't support subscriptions will never notify us
+		if !d.routing.supports(n.id, protocol.EventTypeSUBSCRIBE) {
+			continue
+		}
+
+		s.mu.Lock()
+		s.nodes[string(n.id)] = struct{}{}
+		s.mu.Unlock()
+
+		rid := pseudorandomID()
+		req := eventSubscribeRequest(buf, rid, d.config.LocalID, d.config.ClientMode, d.config.NetworkID, s.key, lease)
+
+		err := d.listeners[(atomic.AddInt32(&d.cl, 1)-1)%int32(len(d.listeners))].request(
+			n.address,
+			rid,
+			req,
+			func(event *protocol.Event, err error) bool {
+				// subscriptions are renewed periodically, so any
+				// failed nodes will be retried on the next renewal
+				return true
+			},
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// periodically renews the leases of our subscriptions with the nodes closest to their keys
+func (d *DHT) renewSubscriptions() {
+	defer d.wg.Done()
+	ticker := d.config.Clock.NewTicker(d.config.SubscriptionLease / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C():
+			for _, s := range d.pubsub.active() {
+				err := d.subscribe(s, d.config.SubscriptionLease)
+				if err != nil && !errors.Is(err, net.ErrClosed) {
+					d.logger.Warn("failed to renew subscription", hexAttr(logKey, s.key), errAttr(err))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubSubscribers(t *testing.T) {
+	p := newPubSub(slog.Default(), systemClock{})
+	defer p.close()
+
+	key := randomID()
+	id := randomID()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	var notified []*net.UDPAddr
+
+	write := func(to *net.UDPAddr, id, data []byte) error {
+		notified = append(notified, to)
+		return nil
+	}
+
+	buf := flatbuffers.NewBuilder(1024)
+	values := []*Value{{Key: key, Value: []byte("value"), Created: time.Now()}}
+
+	assert.True(t, p.subscribe(key, id, addr, time.Minute))
+
+	p.publish(buf, randomID(), false, 0, key, values, write)
+	assert.Len(t, notified, 1)
+
+	// values stored under other keys should not be published to the subscriber
+	p.publish(buf, randomID(), false, 0, randomID(), values, write)
+	assert.Len(t, notified, 1)
+
+	// a subscription with the same id from another address should not cancel or redirect the subscriber
+	spoofed := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9000}
+
+	assert.True(t, p.subscribe(key, id, spoofed, 0))
+
+	p.publish(buf, randomID(), false, 0, key, values, write)
+	require.Len(t, notified, 2)
+	assert.Equal(t, addr, notified[1])
+
+	assert.True(t, p.subscribe(key, id, spoofed, time.Minute))
+
+	p.mu.Lock()
+	require.Len(t, p.subscribers[string(key)], 2)
+	assert.Equal(t, addr, p.subscribers[string(key)][0].address)
+	p.mu.Unlock()
+
+	assert.True(t, p.subscribe(key, id, spoofed, 0))
+
+	// a lease of zero should remove the subscriber
+	assert.True(t, p.subscribe(key, id, addr, 0))
+
+	p.publish(buf, randomID(), false, 0, key, values, write)
+	assert.Len(t, notified, 2)
+
+	// expired subscribers should not be notified
+	assert.True(t, p.subscribe(key, id, addr, -time.Second))
+
+	p.publish(buf, randomID(), false, 0, key, values, write)
+	assert.Len(t, notified, 2)
+
+	// the number of subscribers to a key should be bounded
+	key = randomID()
+
+	for i := 0; i < MaxSubscribersPerKey; i++ {
+		assert.True(t, p.subscribe(key, randomID(), addr, time.Minute))
+	}
+
+	assert.False(t, p.subscribe(key, randomID(), addr, time.Minute))
+
+	// as should the number of keys that can be subscribed to
+	for i := 1; i < MaxSubscribedKeys; i++ {
+		require.True(t, p.subscribe(randomID(), id, addr, time.Minute))
+	}
+
+	assert.False(t, p.subscribe(randomID(), id, addr, time.Minute))
+}
+
+func TestPubSubNotifyLimit(t *testing.T) {
+	p := newPubSub(slog.Default(), NewFakeClock(time.Now()))
+	defer p.close()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	var notified int
+
+	write := func(to *net.UDPAddr, id, data []byte) error {
+		notified++
+		return nil
+	}
+
+	buf := flatbuffers.NewBuilder(1024)
+
+	// subscribing to many keys from one address shouldn't let stores flood it with notifications
+	for i := 0; i < notifyLimit.Burst*2; i++ {
+		key := randomID()
+		require.True(t, p.subscribe(key, randomID(), addr, time.Minute))
+		p.publish(buf, randomID(), false, 0, key, []*Value{{Key: key, Value: []byte("value")}}, write)
+	}
+
+	assert.Equal(t, notifyLimit.Burst, notified)
+}
+
+func TestDHTSpoofedSubscribe(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 2)
+
+	victim, err := network.ListenPacket("10.9.9.9:9000")
+	require.Nil(t, err)
+	defer victim.Close()
+
+	key := randomID()
+	buf := flatbuffers.NewBuilder(1024)
+
+	// a subscription that claims to come from another host
+	nodes[0].listeners[0].handle(victim.LocalAddr().(*net.UDPAddr), eventSubscribeRequest(buf, randomID(), randomID(), false, 0, key, time.Hour))
+
+	// should only send it a ping, which it won't answer
+	assert.NotEmpty(t, simRead(t, victim, time.Second))
+
+	time.Sleep(time.Millisecond * 100)
+
+	nodes[0].pubsub.mu.Lock()
+	assert.Empty(t, nodes[0].pubsub.subscribers[string(key)])
+	nodes[0].pubsub.mu.Unlock()
+}
+
+func TestDHTClusterSubscribe(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	var dhts []*DHT
+
+	// add some nodes to the network
+	for i := 0; i < 3; i++ {
+		c := &Config{
+			LocalID:       randomID(),
+			ListenAddress: fmt.Sprintf("127.0.0.1:%d", 9001+i),
+			BootstrapAddresses: []string{
+				bc.ListenAddress,
+			},
+			Listeners: 1,
+		}
+
+		dht, err := New(c)
+		require.Nil(t, err)
+		defer dht.Close()
+
+		dhts = append(dhts, dht)
+	}
+
+	key := randomID()
+
+	var mu sync.Mutex
+	var received [][]byte
+
+	ch := make(chan []byte, 10)
+
+	sub, err := dhts[0].Subscribe(key, func(value []byte) {
+		v := append([]byte(nil), value...)
+
+		mu.Lock()
+		received = append(received, v)
+		mu.Unlock()
+
+		ch <- v
+	})
+
+	require.Nil(t, err)
+
+	// wait for the subscriptions to be registered
+	time.Sleep(time.Millisecond * 200)
+
+	value := randomID()
+	errs := make(chan error, 1)
+
+	dhts[2].Store(key, value, time.Hour, func(err error) {
+		errs <- err
+	})
+
+	require.Nil(t, <-errs)
+
+	select {
+	case v := <-ch:
+		assert.Equal(t, value, v)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for notification")
+	}
+
+	// the value should only be delivered once, even
+	// though it was published by several nodes
+	time.Sleep(time.Millisecond * 200)
+
+	mu.Lock()
+	assert.Len(t, received, 1)
+	mu.Unlock()
+
+	// storing the value again with a new created time, as happens when it is refreshed, should not deliver it again
+	dhts[1].Store(key, value, time.Hour, func(err error) {
+		errs <- err
+	})
+
+	require.Nil(t, <-errs)
+
+	time.Sleep(time.Millisecond * 200)
+
+	mu.Lock()
+	assert.Len(t, received, 1)
+	mu.Unlock()
+
+	// values stored after the subscription is cancelled should not be delivered
+	sub.Cancel()
+
+	time.Sleep(time.Millisecond * 200)
+
+	dhts[1].Store(key, randomID(), time.Hour, func(err error) {
+		errs <- err
+	})
+
+	require.Nil(t, <-errs)
+
+	time.Sleep(time.Millisecond * 200)
+
+	mu.Lock()
+	assert.Len(t, received, 1)
+	mu.Unlock()
+}
@@ -0,0 +1,451 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tos-network/emo/protocol"
+)
+
+const (
+	// DefaultBanThreshold the misbehaviour score at which a peer is temporarily banned
+	DefaultBanThreshold = 100
+	// DefaultBanDuration the amount of time a misbehaving peer is banned for
+	DefaultBanDuration = time.Minute * 10
+
+	// the period over which a peers misbehaviour score is halved
+	scoreHalfLife = time.Minute * 5
+	// the amount of time a peer can be idle before its state is removed
+	limiterIdleExpiry = time.Minute * 10
+	// the maximum number of addresses and node ids that state is tracked for
+	maxLimiterPeers = 1 << 16
+	// the number of peers that are evicted at once when the maximum is reached
+	limiterEvictBatch = 256
+)
+
+var (
+	// errMalformedEvent returned when an event cannot be decoded
+	errMalformedEvent = errors.New("malformed event")
+	// errOversizedValue returned when a store request exceeds the maximum key or value size
+	errOversizedValue = errors.New("oversized value")
+)
+
+// misbehaviour penalties added to a peers score
+const (
+	// a request that exceeded its rate limit
+	penaltyRateLimited = 1
+	// an event that could not be decoded
+	penaltyMalformed = 20
+	// a store request containing keys or values that are too large
+	penaltyOversized = 25
+)
+
+// RateLimit configures a token bucket that limits the number of requests a peer can make
+type RateLimit struct {
+	// Rate the number of requests per second that are replenished to the bucket
+	Rate float64
+	// Burst the maximum number of requests that can be made at once
+	Burst int
+}
+
+// DefaultRateLimits returns a set of rate limits suitable for public facing nodes
+func DefaultRateLimits() map[protocol.EventType]RateLimit {
+	return map[protocol.EventType]RateLimit{
+		protocol.EventTypePING:          {Rate: 10, Burst: 20},
+		protocol.EventTypeSTORE:         {Rate: 100, Burst: 500},
+		protocol.EventTypeFIND_NODE:     {Rate: 50, Burst: 100},
+		protocol.EventTypeFIND_VALUE:    {Rate: 100, Burst: 500},
+		protocol.EventTypeADD_PROVIDER:  {Rate: 20, Burst: 100},
+		protocol.EventTypeGET_PROVIDERS: {Rate: 50, Burst: 100},
+		protocol.EventTypeSUBSCRIBE:     {Rate: 10, Burst: 50},
+		protocol.EventTypeNOTIFY:        {Rate: 100, Burst: 500},
+	}
+}
+
+// LimiterStats counters describing the requests that have been rate limited or rejected
+type LimiterStats struct {
+	// Allowed the number of requests that were accepted
+	Allowed uint64
+	// Limited the number of requests that were dropped for exceeding a rate limit
+	Limited uint64
+	// Dropped the number of packets that were dropped as they were sent by a banned peer
+	Dropped uint64
+	// Malformed the number of events that could not be decoded
+	Malformed uint64
+	// Oversized the number of store requests that contained oversized keys or values
+	Oversized uint64
+	// Foreign the number of events that were dropped as they were sent by a node in another network
+	Foreign uint64
+	// Bans the number of bans that have been issued
+	Bans uint64
+	// Banned the number of peers that are currently banned
+	Banned int
+}
+
+// a token bucket for a single event type
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take attempts to take a token from the bucket, returning false if there are none left
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens = b.tokens + now.Sub(b.last).Seconds()*limit.Rate
+		if b.tokens > float64(limit.Burst) {
+			b.tokens = float64(limit.Burst)
+		}
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// the rate limiting and misbehaviour state of a peer,
+// identified either by its ip address or its node id
+type peerState struct {
+	// token buckets for each event type
+	buckets map[protocol.EventType]*tokenBucket
+	// the current misbehaviour score
+	score float64
+	// the last time the score was updated
+	scored time.Time
+	// the time the peer is banned until
+	banned time.Time
+	// the last time we received a request from this peer
+	seen time.Time
+}
+
+// returns the token bucket for an event type, creating it if it does not exist
+func (p *peerState) bucket(event protocol.EventType) *tokenBucket {
+	b, ok := p.buckets[event]
+	if !ok {
+		b = &tokenBucket{}
+		p.buckets[event] = b
+	}
+
+	return b
+}
+
+// decays the score based on the time since it was last updated
+func (p *peerState) decay(now time.Time) {
+	if p.score > 0 && now.After(p.scored) {
+		p.score = p.score * math.Exp2(-float64(now.Sub(p.scored))/float64(scoreHalfLife))
+	}
+
+	p.scored = now
+}
+
+// limiter enforces per peer rate limits and bans peers that misbehave
+type limiter struct {
+	// the rate limits for each type of event, nil if rate limiting is disabled
+	limits map[protocol.EventType]RateLimit
+	// the score at which a peer is banned
+	threshold float64
+	// the amount of time a peer is banned for
+	duration time.Duration
+	// state tracked by the senders ip address
+	addresses map[netip.Addr]*peerState
+	// rate limits tracked by the node id of senders that are bound to their address
+	nodes map[string]*peerState
+	// counters
+	allowed   atomic.Uint64
+	limited   atomic.Uint64
+	dropped   atomic.Uint64
+	malformed atomic.Uint64
+	oversized atomic.Uint64
+	foreign   atomic.Uint64
+	bans      atomic.Uint64
+	clock     Clock
+	// closed to stop the cleanup of idle peers, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+}
+
+func newLimiter(limits map[protocol.EventType]RateLimit, threshold float64, duration time.Duration, clock Clock) *limiter {
+	l := &limiter{
+		limits:    limits,
+		clock:     clock,
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		threshold: threshold,
+		duration:  duration,
+		addresses: make(map[netip.Addr]*peerState),
+		nodes:     make(map[string]*peerState),
+	}
+
+	go l.cleanup()
+
+	return l
+}
+
+// banned returns true if the address has been banned
+func (l *limiter) banned(addr *net.UDPAddr) bool {
+	ip := addrIP(addr)
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.addresses[ip]
+	if ok && now.Before(p.banned) {
+		l.dropped.Add(1)
+		return true
+	}
+
+	return false
+}
+
+// allow returns true if a request of the given type from the sender is within its rate limits and
+// its address is not banned. the sender's node id isn't authenticated, so it should only be given
+// once the routing table holds the node at this address, otherwise it should be nil
+func (l *limiter) allow(addr *net.UDPAddr, sender []byte, event protocol.EventType) bool {
+	ip := addrIP(addr)
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits == nil {
+		// rate limiting is disabled, so only check for existing bans
+		ap, ok := l.addresses[ip]
+		if ok && now.Before(ap.banned) {
+			l.dropped.Add(1)
+			return false
+		}
+
+		l.allowed.Add(1)
+		return true
+	}
+
+	ap := trackPeer(l.addresses, ip, now)
+
+	if now.Before(ap.banned) {
+		l.dropped.Add(1)
+		return false
+	}
+
+	limit, ok := l.limits[event]
+	if !ok {
+		l.allowed.Add(1)
+		return true
+	}
+
+	// take from the node's bucket as well so a known node can't
+	// avoid its limits by rotating the address it sends from
+	allowed := ap.bucket(event).take(limit, now)
+
+	if len(sender) == KEY_BYTES {
+		np := trackPeer(l.nodes, string(sender), now)
+		allowed = np.bucket(event).take(limit, now) && allowed
+	}
+
+	if allowed {
+		l.allowed.Add(1)
+		return true
+	}
+
+	l.limited.Add(1)
+	l.score(ap, penaltyRateLimited, now)
+
+	return false
+}
+
+// penalize increases the misbehaviour score of an address based on the error that was encountered
+// when handling its request. only the address is penalized, as the node id of the sender could be
+// spoofed to get another node banned
+func (l *limiter) penalize(addr *net.UDPAddr, err error) {
+	var penalty float64
+
+	switch {
+	case errors.Is(err, errMalformedEvent):
+		l.malformed.Add(1)
+		penalty = penaltyMalformed
+	case errors.Is(err, errOversizedValue):
+		l.oversized.Add(1)
+		penalty = penaltyOversized
+	default:
+		return
+	}
+
+	ip := addrIP(addr)
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.score(trackPeer(l.addresses, ip, now), penalty, now)
+}
+
+// records that an event from a node in another network was dropped
+func (l *limiter) dropForeign() {
+	l.foreign.Add(1)
+}
+
+// stats returns the current limiter counters
+func (l *limiter) stats() LimiterStats {
+	now := l.clock.Now()
+
+	var banned int
+
+	l.mu.Lock()
+
+	for _, p := range l.addresses {
+		if now.Before(p.banned) {
+			banned++
+		}
+	}
+
+	l.mu.Unlock()
+
+	return LimiterStats{
+		Allowed:   l.allowed.Load(),
+		Limited:   l.limited.Load(),
+		Dropped:   l.dropped.Load(),
+		Malformed: l.malformed.Load(),
+		Oversized: l.oversized.Load(),
+		Foreign:   l.foreign.Load(),
+		Bans:      l.bans.Load(),
+		Banned:    banned,
+	}
+}
+
+// returns the state of a peer, creating it if it does not exist, and marks it as seen. if the
+// maximum number of peers are already tracked, a batch of them are evicted to make room
+func trackPeer[K comparable](peers map[K]*peerState, key K, now time.Time) *peerState {
+	p, ok := peers[key]
+	if !ok {
+		if len(peers) >= maxLimiterPeers {
+			evictPeers(peers, now)
+		}
+
+		p = &peerState{
+			buckets: make(map[protocol.EventType]*tokenBucket),
+			scored:  now,
+		}
+
+		peers[key] = p
+	}
+
+	p.seen = now
+
+	return p
+}
+
+// evicts a batch of peers in random order. peers that aren't banned are evicted first,
+// so flooding us with new addresses or node ids can't be used to lift an existing ban
+func evictPeers[K comparable](peers map[K]*peerState, now time.Time) {
+	var evicted int
+
+	for k, p := range peers {
+		if evicted >= limiterEvictBatch {
+			return
+		}
+
+		if now.Before(p.banned) {
+			continue
+		}
+
+		delete(peers, k)
+		evicted++
+	}
+
+	// every peer we track is banned, so some of them have to go
+	for k := range peers {
+		if evicted >= limiterEvictBatch {
+			return
+		}
+
+		delete(peers, k)
+		evicted++
+	}
+}
+
+// adds a penalty to the state of an address, banning it if it exceeds the threshold
+func (l *limiter) score(p *peerState, penalty float64, now time.Time) {
+	if now.Before(p.banned) {
+		return
+	}
+
+	p.decay(now)
+	p.score = p.score + penalty
+
+	if p.score >= l.threshold {
+		p.banned = now.Add(l.duration)
+		p.score = 0
+		l.bans.Add(1)
+	}
+}
+
+func (l *limiter) cleanup() {
+	defer close(l.stopped)
+
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-l.clock.After(time.Minute):
+		}
+
+		now := l.clock.Now()
+
+		l.mu.Lock()
+
+		for k, p := range l.addresses {
+			if now.Sub(p.seen) > limiterIdleExpiry && now.After(p.banned) {
+				delete(l.addresses, k)
+			}
+		}
+
+		for k, p := range l.nodes {
+			if now.Sub(p.seen) > limiterIdleExpiry && now.After(p.banned) {
+				delete(l.nodes, k)
+			}
+		}
+
+		l.mu.Unlock()
+	}
+}
+
+// stops the cleanup of idle peers and waits for it to finish
+func (l *limiter) close() {
+	close(l.quit)
+	<-l.stopped
+}
+
+// addrIP returns the ip address of a udp address, ignoring the port
+func addrIP(addr *net.UDPAddr) netip.Addr {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return ip.Unmap()
+}
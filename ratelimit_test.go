@@ -0,0 +1,202 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tos-network/emo/protocol"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+
+	limit := RateLimit{Rate: 10, Burst: 5}
+	now := time.Now()
+
+	// the bucket should start full
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.take(limit, now))
+	}
+
+	assert.False(t, b.take(limit, now))
+
+	// 100ms should replenish a single token
+	now = now.Add(time.Millisecond * 100)
+
+	assert.True(t, b.take(limit, now))
+	assert.False(t, b.take(limit, now))
+
+	// the bucket should never exceed its burst size
+	now = now.Add(time.Hour)
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.take(limit, now))
+	}
+
+	assert.False(t, b.take(limit, now))
+}
+
+func TestLimiterRateLimit(t *testing.T) {
+	l := newLimiter(map[protocol.EventType]RateLimit{
+		protocol.EventTypePING: {Rate: 1, Burst: 2},
+	}, DefaultBanThreshold, DefaultBanDuration, systemClock{})
+	defer l.close()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	id := randomID()
+
+	assert.True(t, l.allow(addr, id, protocol.EventTypePING))
+	assert.True(t, l.allow(addr, id, protocol.EventTypePING))
+	assert.False(t, l.allow(addr, id, protocol.EventTypePING))
+
+	// other event types are not limited
+	assert.True(t, l.allow(addr, id, protocol.EventTypeSTORE))
+
+	// changing the port should not reset the limits of the address
+	assert.False(t, l.allow(&net.UDPAddr{IP: addr.IP, Port: 9001}, randomID(), protocol.EventTypePING))
+
+	// changing the address should not reset the limits of a bound node id
+	assert.False(t, l.allow(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9000}, id, protocol.EventTypePING))
+
+	// but requests that don't have a bound node id are only limited by their address
+	assert.True(t, l.allow(&net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 9000}, nil, protocol.EventTypePING))
+
+	stats := l.stats()
+	assert.Equal(t, uint64(4), stats.Allowed)
+	assert.Equal(t, uint64(3), stats.Limited)
+}
+
+func TestLimiterBan(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := newLimiter(nil, DefaultBanThreshold, DefaultBanDuration, clock)
+	defer l.close()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+	id := randomID()
+
+	assert.False(t, l.banned(addr))
+	assert.True(t, l.allow(addr, id, protocol.EventTypeSTORE))
+
+	for i := 0; i < DefaultBanThreshold/penaltyOversized; i++ {
+		l.penalize(addr, errOversizedValue)
+	}
+
+	assert.True(t, l.banned(addr))
+	assert.False(t, l.allow(addr, id, protocol.EventTypeSTORE))
+
+	// the node id can be spoofed, so it should not be banned from other addresses
+	assert.True(t, l.allow(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9000}, id, protocol.EventTypeSTORE))
+
+	stats := l.stats()
+	assert.Equal(t, uint64(4), stats.Oversized)
+	assert.Equal(t, uint64(1), stats.Bans)
+	assert.Equal(t, 1, stats.Banned)
+
+	// the ban is lifted once it has expired
+	clock.Advance(DefaultBanDuration + time.Second)
+
+	assert.False(t, l.banned(addr))
+	assert.True(t, l.allow(addr, id, protocol.EventTypeSTORE))
+	assert.Equal(t, 0, l.stats().Banned)
+}
+
+func TestPeerStateDecay(t *testing.T) {
+	now := time.Now()
+
+	p := &peerState{score: 80, scored: now}
+
+	p.decay(now.Add(scoreHalfLife))
+	assert.Equal(t, float64(40), p.score)
+
+	p.decay(now.Add(scoreHalfLife * 3))
+	assert.Equal(t, float64(10), p.score)
+
+	// time that is less than a half life should not be lost
+	now = now.Add(scoreHalfLife * 3)
+
+	for i := 1; i <= 10; i++ {
+		p.decay(now.Add(scoreHalfLife / 10 * time.Duration(i)))
+	}
+
+	assert.InDelta(t, float64(5), p.score, 0.0001)
+}
+
+func TestLimiterEviction(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := newLimiter(DefaultRateLimits(), DefaultBanThreshold, DefaultBanDuration, clock)
+	defer l.close()
+
+	banned := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}
+
+	for i := 0; i < DefaultBanThreshold/penaltyOversized; i++ {
+		l.penalize(banned, errOversizedValue)
+	}
+
+	require.True(t, l.banned(banned))
+
+	// a flood of requests from new addresses and node ids should not grow the limiters state without bound
+	for i := 0; i < maxLimiterPeers*2; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 9000}
+		assert.True(t, l.allow(addr, randomID(), protocol.EventTypePING))
+	}
+
+	l.mu.Lock()
+	assert.LessOrEqual(t, len(l.addresses), maxLimiterPeers)
+	assert.LessOrEqual(t, len(l.nodes), maxLimiterPeers)
+	l.mu.Unlock()
+
+	// or lift existing bans
+	assert.True(t, l.banned(banned))
+}
+
+func TestDHTSpoofedNodeID(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond, Seed: 1})
+
+	nodes := newSimCluster(t, network, 2)
+
+	attacker := &net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 9000}
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000}
+	buf := flatbuffers.NewBuilder(1024)
+
+	require.True(t, nodes[0].routing.at(nodes[1].config.LocalID, peer))
+
+	// malformed requests that claim to come from a known peer. the
+	// score decays between requests, so send one more than needed
+	for i := 0; i <= DefaultBanThreshold/penaltyMalformed; i++ {
+		rid := pseudorandomID()
+		nodes[0].listeners[0].handle(attacker, eventFindValueRequest(buf, rid, nodes[1].config.LocalID, false, 0, randomID()[:8], time.Now(), time.Time{}, 0, nil))
+	}
+
+	// should only ban the address they were sent from
+	assert.True(t, nodes[0].limiter.banned(attacker))
+	assert.False(t, nodes[0].limiter.banned(peer))
+	assert.True(t, nodes[0].limiter.allow(peer, nodes[1].config.LocalID, protocol.EventTypeSTORE))
+
+	ch := make(chan error, 1)
+
+	nodes[1].Store(randomID(), randomID(), time.Hour, func(err error) {
+		ch <- err
+	})
+
+	assert.Nil(t, <-ch)
+}
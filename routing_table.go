@@ -21,6 +21,8 @@ import (
 	"net"
 	"sort"
 	"time"
+
+	"github.com/tos-network/emo/protocol"
 )
 
 // routing table stores buckets of every known node on the network
@@ -31,11 +33,12 @@ type routingTable struct {
 }
 
 // newRoutingTable creates a new routing table
-func newRoutingTable(localNode *node) *routingTable {
+func newRoutingTable(localNode *node, clock Clock) *routingTable {
 	buckets := make([]bucket, KEY_BITS)
 
 	for i := range buckets {
 		buckets[i].nodes = make([]*node, K)
+		buckets[i].clock = clock
 	}
 
 	return &routingTable{
@@ -63,6 +66,28 @@ func (t *routingTable) remove(id []byte) {
 	t.buckets[bucketID(t.localNode.id, id)].remove(id, true)
 }
 
+// records the protocol version, capabilities and reachability advertised by a node. the advertisement
+// is ignored if it was not received from the address the node is held at, as the sender may be spoofed
+func (t *routingTable) advertise(id []byte, address *net.UDPAddr, version uint16, capabilities uint64, client bool) {
+	t.buckets[bucketID(t.localNode.id, id)].advertise(id, address, version, capabilities, client)
+}
+
+// returns true if a node can be sent an event. nodes we don't
+// know the capabilities of are assumed to support it
+func (t *routingTable) supports(id []byte, event protocol.EventType) bool {
+	return t.buckets[bucketID(t.localNode.id, id)].supports(id, event)
+}
+
+// returns true if a node is in the routing table at the given address
+func (t *routingTable) at(id []byte, address *net.UDPAddr) bool {
+	return t.buckets[bucketID(t.localNode.id, id)].at(id, address)
+}
+
+// returns true if a node is in the routing table at the given address and has advertised the capability
+func (t *routingTable) capable(id []byte, address *net.UDPAddr, c Capability) bool {
+	return t.buckets[bucketID(t.localNode.id, id)].capable(id, address, c)
+}
+
 func (rt *routingTable) getBucketIndex(b *bucket) int {
 	for i := 0; i < KEY_BITS; i++ {
 		if &rt.buckets[i] == b {
@@ -120,6 +145,19 @@ func (t *routingTable) closest(id []byte) *node {
 
 // finds the closest known nodes for a given key
 func (t *routingTable) closestN(id []byte, count int) []*node {
+	return t.closestMatching(id, count, nil)
+}
+
+// finds the closest known nodes for a given key that can be given to other nodes,
+// leaving out nodes that can't be reached by nodes they haven't contacted
+func (t *routingTable) closestServing(id []byte, count int) []*node {
+	return t.closestMatching(id, count, func(n *node) bool {
+		return !n.isClient()
+	})
+}
+
+// finds the closest known nodes for a given key that match the filter, if one is given
+func (t *routingTable) closestMatching(id []byte, count int, match func(n *node) bool) []*node {
 	offset := bucketID(t.localNode.id, id)
 
 	var nodes []*node
@@ -132,7 +170,9 @@ func (t *routingTable) closestN(id []byte, count int) []*node {
 	for {
 		if offset > -1 && offset < KEY_BITS {
 			t.buckets[offset].iterate(func(n *node) {
-				nodes = append(nodes, n)
+				if match == nil || match(n) {
+					nodes = append(nodes, n)
+				}
 			})
 
 			if len(nodes) >= count {
@@ -28,7 +28,7 @@ import (
 func TestRoutingTableFindNearest(t *testing.T) {
 	rt := newRoutingTable(&node{
 		id: randomID(),
-	})
+	}, systemClock{})
 
 	// generate a random target key we want to look up
 	target := randomID()
@@ -71,7 +71,7 @@ func TestRoutingTableFindNearest(t *testing.T) {
 func TestRoutingTableFindNearestN(t *testing.T) {
 	rt := newRoutingTable(&node{
 		id: randomID(),
-	})
+	}, systemClock{})
 
 	// generate a random target key we want to look up
 	target := randomID()
@@ -116,7 +116,7 @@ func TestRoutingTableFindNearestN(t *testing.T) {
 func BenchmarkRoutingTableFindNearest(b *testing.B) {
 	rt := newRoutingTable(&node{
 		id: randomID(),
-	})
+	}, systemClock{})
 
 	// insert 10000 nodes into the routing table
 	for i := 0; i < 10000; i++ {
@@ -136,7 +136,7 @@ func BenchmarkRoutingTableFindNearest(b *testing.B) {
 func BenchmarkRoutingTableFindNearestN(b *testing.B) {
 	rt := newRoutingTable(&node{
 		id: randomID(),
-	})
+	}, systemClock{})
 
 	// insert 10000 nodes into the routing table
 	for i := 0; i < 10000; i++ {
@@ -156,7 +156,7 @@ func BenchmarkRoutingTableFindNearestN(b *testing.B) {
 func BenchmarkRoutingTableInsert(b *testing.B) {
 	rt := newRoutingTable(&node{
 		id: randomID(),
-	})
+	}, systemClock{})
 
 	nodes := make([][]byte, 10000)
 
@@ -177,7 +177,7 @@ func BenchmarkRoutingTableInsert(b *testing.B) {
 func BenchmarkRoutingTableSeen(b *testing.B) {
 	rt := newRoutingTable(&node{
 		id: randomID(),
-	})
+	}, systemClock{})
 
 	nodes := make([][]byte, 10000)
 
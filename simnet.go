@@ -0,0 +1,460 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// DefaultSimQueueSize the number of packets a simulated connection holds before dropping packets
+const DefaultSimQueueSize = 1024
+
+// SimConfig the conditions of the links between the nodes of a simulated network
+type SimConfig struct {
+	// Latency the one way delay of each packet
+	Latency time.Duration
+	// Jitter the maximum random amount of time added to the latency of each packet
+	Jitter time.Duration
+	// Loss the probability that a packet is dropped, between 0 and 1
+	Loss float64
+	// Reorder the probability that a packet is held back so that it arrives after packets sent after it, between 0 and 1
+	Reorder float64
+	// QueueSize the number of packets each connection holds before further packets are dropped
+	QueueSize int
+	// Seed seeds the random decisions made for each packet, so a simulation can be repeated
+	Seed int64
+}
+
+// SimStats the number of packets sent through a simulated network and what happened to them
+type SimStats struct {
+	// Sent the number of packets sent
+	Sent uint64
+	// Delivered the number of packets queued to be read by their receiver
+	Delivered uint64
+	// Lost the number of packets randomly dropped
+	Lost uint64
+	// Partitioned the number of packets dropped because the sender and receiver were partitioned
+	Partitioned uint64
+	// Undeliverable the number of packets dropped because nothing was listening on their address, or its queue was full
+	Undeliverable uint64
+	// Filtered the number of packets dropped by a nat because the receiver had not sent a packet to their sender
+	Filtered uint64
+}
+
+// SimNetwork an in-memory network that simulates the latency, loss and partitioning of a real
+// network. It can be used as the Network of many nodes in the same process to test them
+// at a scale and under conditions that are impractical with real sockets
+type SimNetwork struct {
+	config SimConfig
+	random *rand.Rand
+	// the connections listening on each address. packets are
+	// spread across connections that share the same address
+	conns map[netip.AddrPort][]*simConn
+	// the partition each address is in. addresses
+	// in different partitions can't reach each other
+	partitions map[netip.AddrPort]int
+	// the nats that addresses are behind, keyed by the address behind the nat and by its public address
+	nats   map[netip.AddrPort]*simNAT
+	public map[netip.AddrPort]*simNAT
+	// the next port to assign to connections that listen on port 0
+	port uint16
+	// counts the packets delivered to each address
+	next  map[netip.AddrPort]int
+	stats SimStats
+	mu    sync.Mutex
+}
+
+// a simulated nat in front of a single address
+type simNAT struct {
+	local  netip.AddrPort
+	public netip.AddrPort
+	// the addresses that the address behind the nat has sent packets to
+	peers map[netip.AddrPort]struct{}
+}
+
+// a packet in flight between two simulated connections
+type simPacket struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+// NewSimNetwork creates a simulated network
+func NewSimNetwork(config SimConfig) *SimNetwork {
+	if config.QueueSize < 1 {
+		config.QueueSize = DefaultSimQueueSize
+	}
+
+	return &SimNetwork{
+		config:     config,
+		random:     rand.New(rand.NewSource(config.Seed)),
+		conns:      make(map[netip.AddrPort][]*simConn),
+		partitions: make(map[netip.AddrPort]int),
+		nats:       make(map[netip.AddrPort]*simNAT),
+		public:     make(map[netip.AddrPort]*simNAT),
+		next:       make(map[netip.AddrPort]int),
+		port:       32768,
+	}
+}
+
+// ListenPacket creates a connection on the simulated network. The address must have
+// a specific ip, and will be assigned an unused port if its port is 0
+func (n *SimNetwork) ListenPacket(address string) (PacketConn, error) {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if ap.Addr().IsUnspecified() {
+		return nil, fmt.Errorf("simulated connections must listen on a specific ip, not %s", ap.Addr())
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ap.Port() == 0 {
+		for {
+			n.port++
+			ap = netip.AddrPortFrom(ap.Addr(), n.port)
+			if len(n.conns[ap]) == 0 {
+				break
+			}
+		}
+	}
+
+	c := &simConn{
+		network: n,
+		key:     ap,
+		addr:    net.UDPAddrFromAddrPort(ap),
+		inbox:   make(chan simPacket, n.config.QueueSize),
+		closed:  make(chan struct{}),
+	}
+
+	n.conns[ap] = append(n.conns[ap], c)
+
+	return c, nil
+}
+
+// SetConditions changes the latency, jitter, loss and reordering of the network's links
+func (n *SimNetwork) SetConditions(config SimConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.config.Latency = config.Latency
+	n.config.Jitter = config.Jitter
+	n.config.Loss = config.Loss
+	n.config.Reorder = config.Reorder
+}
+
+// Partition splits the network so that the addresses in each group can only reach the other
+// addresses in the same group. Addresses that are not in any group can reach each other
+func (n *SimNetwork) Partition(groups ...[]string) error {
+	partitions := make(map[netip.AddrPort]int)
+
+	for i, g := range groups {
+		for _, address := range g {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+
+			partitions[ap] = i + 1
+		}
+	}
+
+	n.mu.Lock()
+	n.partitions = partitions
+	n.mu.Unlock()
+
+	return nil
+}
+
+// Heal removes any partitions
+func (n *SimNetwork) Heal() {
+	n.mu.Lock()
+	n.partitions = make(map[netip.AddrPort]int)
+	n.mu.Unlock()
+}
+
+// NAT places an address behind a nat with a public address. Packets sent from the address appear to come from
+// the public address, and packets sent to the public address are only delivered to the address if it has sent
+// a packet to their sender, like a nat with address and port dependent filtering
+func (n *SimNetwork) NAT(local, public string) error {
+	lap, err := netip.ParseAddrPort(local)
+	if err != nil {
+		return err
+	}
+
+	pap, err := netip.ParseAddrPort(public)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.public[pap] != nil || len(n.conns[pap]) > 0 {
+		return fmt.Errorf("public address %s is already in use", pap)
+	}
+
+	nat := &simNAT{
+		local:  lap,
+		public: pap,
+		peers:  make(map[netip.AddrPort]struct{}),
+	}
+
+	n.nats[lap] = nat
+	n.public[pap] = nat
+
+	return nil
+}
+
+// ExpireNATMappings closes the paths every nat has opened for the addresses its address has sent
+// packets to, as if they had all timed out
+func (n *SimNetwork) ExpireNATMappings() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, nat := range n.nats {
+		nat.peers = make(map[netip.AddrPort]struct{})
+	}
+}
+
+// Stats returns the number of packets sent through the network
+func (n *SimNetwork) Stats() SimStats {
+	return SimStats{
+		Sent:          atomic.LoadUint64(&n.stats.Sent),
+		Delivered:     atomic.LoadUint64(&n.stats.Delivered),
+		Lost:          atomic.LoadUint64(&n.stats.Lost),
+		Partitioned:   atomic.LoadUint64(&n.stats.Partitioned),
+		Undeliverable: atomic.LoadUint64(&n.stats.Undeliverable),
+		Filtered:      atomic.LoadUint64(&n.stats.Filtered),
+	}
+}
+
+// decides the fate of a packet, then delivers it after its delay
+func (n *SimNetwork) send(from *net.UDPAddr, to netip.AddrPort, data []byte) {
+	atomic.AddUint64(&n.stats.Sent, 1)
+
+	n.mu.Lock()
+
+	src := from.AddrPort()
+
+	// packets sent from behind a nat appear to come from its public address
+	nat, ok := n.nats[src]
+	if ok {
+		nat.peers[to] = struct{}{}
+		from = net.UDPAddrFromAddrPort(nat.public)
+	}
+
+	// and packets sent to its public address are only let through from addresses it has sent packets to
+	nat, ok = n.public[to]
+	if ok {
+		_, ok = nat.peers[from.AddrPort()]
+		if !ok {
+			n.mu.Unlock()
+			atomic.AddUint64(&n.stats.Filtered, 1)
+			return
+		}
+
+		to = nat.local
+	}
+
+	if n.partitions[src] != n.partitions[to] {
+		n.mu.Unlock()
+		atomic.AddUint64(&n.stats.Partitioned, 1)
+		return
+	}
+
+	// always draw the same number of random values for each packet, so the
+	// decisions made for later packets don't depend on earlier decisions
+	loss, jitter, reorder := n.random.Float64(), n.random.Int63(), n.random.Float64()
+
+	delay := n.config.Latency
+	if n.config.Jitter > 0 {
+		delay += time.Duration(jitter % int64(n.config.Jitter))
+	}
+
+	if reorder < n.config.Reorder {
+		// hold the packet back for longer than any packet sent after it could take
+		delay += n.config.Latency + n.config.Jitter + time.Millisecond
+	}
+
+	lost := loss < n.config.Loss
+
+	n.mu.Unlock()
+
+	if lost {
+		atomic.AddUint64(&n.stats.Lost, 1)
+		return
+	}
+
+	p := simPacket{
+		from: from,
+		data: data,
+	}
+
+	if delay <= 0 {
+		n.deliver(to, p)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		n.deliver(to, p)
+	})
+}
+
+// queues a packet on one of the connections listening on its address
+func (n *SimNetwork) deliver(to netip.AddrPort, p simPacket) {
+	n.mu.Lock()
+
+	var c *simConn
+
+	conns := n.conns[to]
+	if len(conns) > 0 {
+		c = conns[n.next[to]%len(conns)]
+		n.next[to]++
+	}
+
+	n.mu.Unlock()
+
+	if c == nil {
+		atomic.AddUint64(&n.stats.Undeliverable, 1)
+		return
+	}
+
+	select {
+	case c.inbox <- p:
+		atomic.AddUint64(&n.stats.Delivered, 1)
+	default:
+		// the receiver isn't keeping up, so drop the packet like a full socket buffer would
+		atomic.AddUint64(&n.stats.Undeliverable, 1)
+	}
+}
+
+func (n *SimNetwork) remove(c *simConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	conns := n.conns[c.key]
+
+	for i := range conns {
+		if conns[i] == c {
+			n.conns[c.key] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(n.conns[c.key]) == 0 {
+		delete(n.conns, c.key)
+		delete(n.next, c.key)
+	}
+}
+
+// a connection to a simulated network
+type simConn struct {
+	network *SimNetwork
+	key     netip.AddrPort
+	addr    *net.UDPAddr
+	inbox   chan simPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *simConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	if len(ms) < 1 {
+		return 0, nil
+	}
+
+	var p simPacket
+
+	select {
+	case p = <-c.inbox:
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+
+	c.read(&ms[0], p)
+
+	// read any other packets that are waiting without blocking
+	for i := 1; i < len(ms); i++ {
+		select {
+		case p = <-c.inbox:
+			c.read(&ms[i], p)
+		default:
+			return i, nil
+		}
+	}
+
+	return len(ms), nil
+}
+
+func (c *simConn) read(m *ipv4.Message, p simPacket) {
+	m.N = copy(m.Buffers[0], p.data)
+	m.Addr = p.from
+}
+
+func (c *simConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	for i := range ms {
+		to, ok := ms[i].Addr.(*net.UDPAddr)
+		if !ok {
+			return i, errors.New("simulated connections can only write to udp addresses")
+		}
+
+		// the message buffers are reused by the writer, so send a copy
+		data := make([]byte, len(ms[i].Buffers[0]))
+		copy(data, ms[i].Buffers[0])
+
+		// ipv4 addresses may be decoded as ipv4 mapped ipv6 addresses
+		ap := to.AddrPort()
+		ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+
+		c.network.send(c.addr, ap, data)
+	}
+
+	return len(ms), nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *simConn) Close() error {
+	err := net.ErrClosed
+
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+		err = nil
+	})
+
+	return err
+}
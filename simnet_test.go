@@ -0,0 +1,337 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+// starts a cluster of nodes on a simulated network. nodes are started in waves that each
+// double the size of the cluster, with each node bootstrapping from a node started in an
+// earlier wave. the nodes are closed when the test completes
+func newSimCluster(t testing.TB, network *SimNetwork, size int) []*DHT {
+	nodes := make([]*DHT, size)
+
+	start := func(i int) error {
+		c := &Config{
+			// derive the id from the address, so the layout of the cluster is the same every run
+			LocalID:       Keccak256([]byte(simAddress(i))),
+			ListenAddress: simAddress(i),
+			Listeners:     1,
+			Network:       network,
+			Timeout:       time.Second * 5,
+			// keep the memory and timers used by each node small
+			SocketBatchSize:     16,
+			SocketBatchInterval: time.Millisecond * 10,
+		}
+
+		if i > 0 {
+			c.BootstrapAddresses = []string{simAddress(i / 2)}
+		}
+
+		dht, err := New(c)
+		if err != nil {
+			return err
+		}
+
+		nodes[i] = dht
+
+		return nil
+	}
+
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			if n != nil {
+				n.Close()
+			}
+		}
+	})
+
+	require.Nil(t, start(0))
+
+	for wave := 1; wave < size; wave *= 2 {
+		var wg sync.WaitGroup
+
+		errs := make(chan error, wave)
+
+		for i := wave; i < wave*2 && i < size; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				errs <- start(i)
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.Nil(t, err)
+		}
+	}
+
+	return nodes
+}
+
+// the address of the nth node of a simulated cluster
+func simAddress(n int) string {
+	return fmt.Sprintf("10.%d.%d.%d:9000", n>>16&255, n>>8&255, n&255)
+}
+
+func simWrite(t *testing.T, c PacketConn, to net.Addr, data string) {
+	_, err := c.WriteBatch([]ipv4.Message{{Addr: to, Buffers: [][]byte{[]byte(data)}}}, 0)
+	require.Nil(t, err)
+}
+
+// reads a packet, returning an empty string if none arrives before the timeout.
+// the read is left running when it times out, so it should only be used when a
+// packet is expected
+func simRead(t *testing.T, c PacketConn, timeout time.Duration) string {
+	ch := make(chan string, 1)
+
+	go func() {
+		ms := []ipv4.Message{{Buffers: [][]byte{make([]byte, 1500)}}}
+
+		n, err := c.ReadBatch(ms, 0)
+		if err != nil || n < 1 {
+			ch <- ""
+			return
+		}
+
+		ch <- string(ms[0].Buffers[0][:ms[0].N])
+	}()
+
+	select {
+	case data := <-ch:
+		return data
+	case <-time.After(timeout):
+		return ""
+	}
+}
+
+func TestSimNetwork(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Latency: time.Millisecond * 20})
+
+	a, err := network.ListenPacket("10.0.0.1:9000")
+	require.Nil(t, err)
+	defer a.Close()
+
+	b, err := network.ListenPacket("10.0.0.2:0")
+	require.Nil(t, err)
+	defer b.Close()
+
+	_, err = network.ListenPacket("0.0.0.0:9000")
+	assert.NotNil(t, err)
+
+	// packets arrive after the latency of the link
+	start := time.Now()
+	simWrite(t, a, b.LocalAddr(), "hello")
+	assert.Equal(t, "hello", simRead(t, b, time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*20)
+
+	// partitioned addresses can't reach each other
+	require.Nil(t, network.Partition([]string{"10.0.0.1:9000"}))
+
+	simWrite(t, b, a.LocalAddr(), "partitioned")
+	assert.Equal(t, uint64(1), network.Stats().Partitioned)
+
+	network.Heal()
+
+	simWrite(t, b, a.LocalAddr(), "healed")
+	assert.Equal(t, "healed", simRead(t, a, time.Second))
+
+	// every packet is lost
+	network.SetConditions(SimConfig{Loss: 1})
+
+	simWrite(t, a, b.LocalAddr(), "lost")
+	assert.Equal(t, uint64(1), network.Stats().Lost)
+
+	stats := network.Stats()
+	assert.Equal(t, uint64(4), stats.Sent)
+	assert.Equal(t, uint64(2), stats.Delivered)
+	assert.Equal(t, uint64(1), stats.Partitioned)
+	assert.Equal(t, uint64(1), stats.Lost)
+
+	// reads are unblocked when the connection is closed
+	require.Nil(t, b.Close())
+
+	_, err = b.ReadBatch([]ipv4.Message{{Buffers: [][]byte{make([]byte, 1500)}}}, 0)
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestSimNetworkReorder(t *testing.T) {
+	network := NewSimNetwork(SimConfig{Reorder: 0.5, Seed: 1})
+
+	a, err := network.ListenPacket("10.0.0.1:9000")
+	require.Nil(t, err)
+	defer a.Close()
+
+	b, err := network.ListenPacket("10.0.0.2:9000")
+	require.Nil(t, err)
+	defer b.Close()
+
+	for i := 0; i < 100; i++ {
+		simWrite(t, a, b.LocalAddr(), fmt.Sprint(i))
+	}
+
+	var received []string
+
+	for i := 0; i < 100; i++ {
+		received = append(received, simRead(t, b, time.Second))
+	}
+
+	// every packet arrives, but not in the order they were sent
+	assert.Len(t, received, 100)
+	assert.NotContains(t, received, "")
+	assert.NotEqual(t, "0", received[0]+received[1]+received[2])
+}
+
+func TestSimClusterStoreFind(t *testing.T) {
+	network := NewSimNetwork(SimConfig{
+		Latency: time.Millisecond,
+		Jitter:  time.Millisecond,
+		Seed:    1,
+	})
+
+	nodes := newSimCluster(t, network, 1000)
+
+	keys := make([][]byte, 50)
+
+	// store values from a spread of nodes
+	for i := range keys {
+		keys[i] = Keccak256([]byte(fmt.Sprint("key-", i)))
+
+		ch := make(chan error, 1)
+
+		nodes[(i*37)%len(nodes)].Store(keys[i], keys[i], time.Hour, func(err error) {
+			ch <- err
+		})
+
+		require.Nil(t, <-ch)
+	}
+
+	// and find them from others. values are only stored on the nodes closest to the key in
+	// the storing node's routing table, which won't always be the nodes a lookup converges
+	// on in a network this large, so only expect most of the values to be found
+	var found int
+
+	for i, k := range keys {
+		values, err := nodes[(i*53+11)%len(nodes)].FindAll(k)
+		if err == nil {
+			assert.Equal(t, [][]byte{k}, values)
+			found++
+		}
+	}
+
+	t.Logf("found %d/%d values", found, len(keys))
+	assert.GreaterOrEqual(t, found, len(keys)*7/10)
+
+	t.Logf("%+v", network.Stats())
+}
+
+func TestSimClusterPartition(t *testing.T) {
+	network := NewSimNetwork(SimConfig{
+		Latency: time.Millisecond,
+		Jitter:  time.Millisecond,
+		Seed:    1,
+	})
+
+	nodes := newSimCluster(t, network, 50)
+
+	key := Keccak256([]byte("key"))
+
+	ch := make(chan error, 1)
+
+	nodes[0].Store(key, key, time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	// a store fails if any of its requests are lost, so only degrade the network once the value is stored
+	network.SetConditions(SimConfig{
+		Latency: time.Millisecond * 5,
+		Jitter:  time.Millisecond * 5,
+		Loss:    0.01,
+		Reorder: 0.05,
+	})
+
+	// cut the last node off from the rest of the network
+	isolated := len(nodes) - 1
+	require.Nil(t, network.Partition([]string{simAddress(isolated)}))
+
+	_, err := nodes[isolated].FindAll(key, SkipLocal(), FindTimeout(time.Second))
+	assert.NotNil(t, err)
+	assert.Greater(t, network.Stats().Partitioned, uint64(0))
+
+	network.Heal()
+
+	values, err := nodes[isolated].FindAll(key, SkipLocal())
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{key}, values)
+}
+
+func TestSimNetworkNAT(t *testing.T) {
+	network := NewSimNetwork(SimConfig{})
+
+	require.Nil(t, network.NAT("192.168.0.2:9000", "10.1.0.1:9000"))
+	assert.NotNil(t, network.NAT("192.168.0.3:9000", "10.1.0.1:9000"))
+
+	a, err := network.ListenPacket("192.168.0.2:9000")
+	require.Nil(t, err)
+	defer a.Close()
+
+	b, err := network.ListenPacket("10.0.0.2:9000")
+	require.Nil(t, err)
+	defer b.Close()
+
+	public := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 9000}
+
+	// packets from nodes the address behind the nat hasn't sent to are dropped
+	simWrite(t, b, public, "unsolicited")
+	assert.Equal(t, uint64(1), network.Stats().Filtered)
+
+	// packets sent from behind the nat appear to come from its public address
+	simWrite(t, a, b.LocalAddr(), "hello")
+
+	ms := []ipv4.Message{{Buffers: [][]byte{make([]byte, 1500)}}}
+
+	_, err = b.ReadBatch(ms, 0)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(ms[0].Buffers[0][:ms[0].N]))
+	assert.Equal(t, public.String(), ms[0].Addr.String())
+
+	// and replies are let through
+	simWrite(t, b, public, "reply")
+	assert.Equal(t, "reply", simRead(t, a, time.Second))
+	assert.Equal(t, uint64(1), network.Stats().Filtered)
+
+	// until the nats path to the sender times out
+	network.ExpireNATMappings()
+
+	simWrite(t, b, public, "expired")
+	assert.Equal(t, uint64(2), network.Stats().Filtered)
+}
@@ -17,12 +17,27 @@
 package emo
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"hash/maphash"
-	"log"
+	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// the size of a find value cursor, the created time of the last value
+	// returned, followed by the number of values returned with that created time
+	cursorBytes = 12
+	// the maximum size of the values returned in a single find value response
+	maxPageBytes = MaxEventSize - 1024
+	// the maximum number of pages of values that will be requested from a single node
+	maxValuePages = 256
+)
+
 // StorageType defines the type of storage to use.
 type StorageType string
 
@@ -33,21 +48,34 @@ const (
 
 // InitializeStorage initializes the storage based on the configuration.
 func InitializeStorage(cfg *Config) (Storage, error) {
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+
 	switch cfg.StorageBackend {
 	case InMemoryStorage:
-		return newInMemoryStorage(), nil
+		return newInMemoryStorage(cfg.Clock), nil
 	case LevelDBStorage:
-		log.Println("Using LevelDB storage")
 		if cfg.LevelDBPath == "" {
 			if cfg.DataDir == "" {
 				cfg.DataDir = DefaultDataDir()
 			}
 			cfg.LevelDBPath = ChaindataDir(cfg.DataDir)
 		}
-		log.Printf("Using LevelDB storage at %s\n", cfg.LevelDBPath)
-		return NewDatabase(cfg.LevelDBPath)
+
+		logger := configLogger(cfg)
+		logger.Info("using leveldb storage", slog.String("path", cfg.LevelDBPath))
+
+		db, err := newDatabase(cfg.LevelDBPath, cfg.Clock)
+		if err != nil {
+			return nil, err
+		}
+
+		db.logger = logger
+
+		return db, nil
 	default:
-		return newInMemoryStorage(), nil
+		return newInMemoryStorage(cfg.Clock), nil
 	}
 }
 
@@ -58,6 +86,34 @@ type Storage interface {
 	Iterate(cb func(value *Value) bool)
 }
 
+// StorageInserter can be implemented by a Storage to report which values it has not held before,
+// so that subscribers are only notified of new values and not of values that are refreshed or replicated
+type StorageInserter interface {
+	// Insert stores a value like Set, also returning true if the value was not already held
+	Insert(key, value []byte, created time.Time, ttl time.Duration) (inserted bool, ok bool)
+}
+
+// stores a value, returning true if the storage did not already hold it. storage that doesn't implement
+// StorageInserter is checked for the value before it is stored, which may race with concurrent stores
+func insertValue(s Storage, key, value []byte, created time.Time, ttl time.Duration) (bool, bool) {
+	si, ok := s.(StorageInserter)
+	if ok {
+		return si.Insert(key, value, created, ttl)
+	}
+
+	held := false
+
+	vs, _ := s.Get(key, time.Time{})
+	for _, v := range vs {
+		if bytes.Equal(v.Value, value) {
+			held = true
+			break
+		}
+	}
+
+	return !held, s.Set(key, value, created, ttl)
+}
+
 // Value represents the value to be stored
 type Value struct {
 	Key     []byte
@@ -67,41 +123,73 @@ type Value struct {
 	expires time.Time
 }
 
+// returns the time the value expires. storage that doesn't keep
+// the expiry time will expire the value ttl after it was created
+func (v *Value) expiry() time.Time {
+	if v.expires.IsZero() {
+		return v.Created.Add(v.TTL)
+	}
+	return v.expires
+}
+
 type item struct {
 	contains map[uint64]struct{}
 	values   []*Value
-	mu       sync.Mutex
+	// set when all of the items values have expired and it has been removed from the store
+	removed bool
+	mu      sync.Mutex
 }
 
-func (i *item) insert(hash uint64, value *Value) bool {
+// inserts a value, keeping the values ordered by the time they were created. returns true if it
+// was added and false if it already exists. returns an error if the item has been removed from the store
+func (i *item) insert(hash uint64, value *Value) (bool, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
+	if i.removed {
+		return false, errItemRemoved
+	}
+
 	_, ok := i.contains[hash]
 	if ok {
-		return true
+		return false, nil
 	}
 
-	// TODO this will be really slow, but good enough for now
 	i.contains[hash] = struct{}{}
-	i.values = append(i.values, value)
+	i.values = insertSorted(i.values, value)
 
-	return true
+	return true, nil
 }
 
+// returned when inserting into an item that has been removed from the store
+var errItemRemoved = errors.New("item removed")
+
 // implement simple storage for now storage
 type storage struct {
 	store  sync.Map
 	hasher sync.Pool
+	// the number of keys and values held, their size in bytes and the number of values that have expired
+	keys    atomic.Int64
+	values  atomic.Int64
+	bytes   atomic.Int64
+	expired atomic.Uint64
+	clock   Clock
+	// closed to stop the cleanup of expired values, which closes stopped once it has stopped
+	quit      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
-func newInMemoryStorage() *storage {
+func newInMemoryStorage(clock Clock) *storage {
 	// TODO : this will probably cause collisions
 	// that need to be handled!
 	seed := maphash.MakeSeed()
 
 	s := &storage{
-		store: sync.Map{},
+		store:   sync.Map{},
+		clock:   clock,
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
 		hasher: sync.Pool{
 			New: func() any {
 				var hasher maphash.Hash
@@ -133,32 +221,40 @@ func (s *storage) Get(k []byte, from time.Time) ([]*Value, bool) {
 
 	it := v.(*item)
 
+	// take a snapshot of the values, limiting its capacity so that
+	// values inserted after this won't be visible to the caller
+	it.mu.Lock()
+	values := it.values[:len(it.values):len(it.values)]
+	it.mu.Unlock()
+
 	// if we don't need to filter the query, then return all values
 	if from.IsZero() {
-		return v.(*item).values, true
+		return values, true
 	}
 
-	var index int
-
-	// filter the query to values after a given date
-	for i := 0; i < len(it.values); i++ {
-		if it.values[i].Created.Before(from) {
-			// TODO : might be a bit wonky if created from timestamps are not in order
-			index++
-		}
-	}
+	// filter the query to values after a given date. values are ordered by the
+	// time they were created, so skip all of the values created before it
+	index := sort.Search(len(values), func(i int) bool {
+		return !values[i].Created.Before(from)
+	})
 
 	// we have no results left that are valid for the query
-	if index >= len(it.values) {
+	if index >= len(values) {
 		return nil, false
 	}
 
 	// TODO : actually store and return multiple values
-	return it.values[index:], true
+	return values[index:], true
 }
 
 // Set sets a key value pair for a given ttl
 func (s *storage) Set(k, v []byte, created time.Time, ttl time.Duration) bool {
+	_, ok := s.Insert(k, v, created, ttl)
+	return ok
+}
+
+// Insert sets a key value pair for a given ttl, returning true if the value was not already stored
+func (s *storage) Insert(k, v []byte, created time.Time, ttl time.Duration) (bool, bool) {
 	// we keep a copy of the key and value as it's actually
 	// read from a buffer that's going to be reused
 	// so we need to store this as a copy to avoid
@@ -188,25 +284,85 @@ func (s *storage) Set(k, v []byte, created time.Time, ttl time.Duration) bool {
 		Value:   vc,
 		TTL:     ttl,
 		Created: created,
-		expires: time.Now().Add(ttl),
+		expires: s.clock.Now().Add(ttl),
 	}
 
-	// loading first is apparently faster?
-	actual, ok := s.store.Load(key)
-	if ok {
-		return actual.(*item).insert(vh, value)
+	for {
+		// loading first is apparently faster?
+		actual, ok := s.store.Load(key)
+		if !ok {
+			actual, ok = s.store.LoadOrStore(key, &item{
+				contains: map[uint64]struct{}{vh: {}},
+				values:   []*Value{value},
+			})
+
+			if !ok {
+				s.keys.Add(1)
+				s.added(value, 1)
+				return true, true
+			}
+		}
+
+		added, err := actual.(*item).insert(vh, value)
+		if err != nil {
+			// the key expired while we were inserting, so try again
+			continue
+		}
+
+		if added {
+			s.added(value, 1)
+		}
+
+		return added, true
 	}
+}
 
-	actual, ok = s.store.LoadOrStore(key, &item{
-		contains: map[uint64]struct{}{vh: {}},
-		values:   []*Value{value},
-	})
+// Delete removes all values of a key, returning false if the key does not exist
+func (s *storage) Delete(k []byte) bool {
+	h := s.hasher.Get().(*maphash.Hash)
 
+	h.Reset()
+	h.Write(k)
+	key := h.Sum64()
+
+	s.hasher.Put(h)
+
+	v, ok := s.store.LoadAndDelete(key)
 	if !ok {
-		return true
+		return false
+	}
+
+	it := v.(*item)
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	// the values of the key expired while we were removing it
+	if it.removed {
+		return false
+	}
+
+	// stop any concurrent sets from inserting into the removed item
+	it.removed = true
+
+	for _, value := range it.values {
+		s.added(value, -1)
 	}
 
-	return actual.(*item).insert(vh, value)
+	s.keys.Add(-1)
+
+	return true
+}
+
+// updates the number and size of the values held when a value is added or removed
+func (s *storage) added(value *Value, n int64) {
+	s.values.Add(n)
+	s.bytes.Add(n * int64(len(value.Key)+len(value.Value)))
+}
+
+// Stats returns the number of keys and values held, their size in bytes and the number of values that have expired
+func (s *storage) Stats() (keys, values, bytes, expired uint64) {
+	return uint64(s.keys.Load()), uint64(s.values.Load()), uint64(s.bytes.Load()), s.expired.Load()
 }
 
 // Iterate iterates over keys in the storage
@@ -218,6 +374,7 @@ func (s *storage) Iterate(cb func(v *Value) bool) {
 
 		for i := range item.values {
 			if !cb(item.values[i]) {
+				item.mu.Unlock()
 				return false
 			}
 		}
@@ -229,25 +386,219 @@ func (s *storage) Iterate(cb func(v *Value) bool) {
 }
 
 func (s *storage) cleanup() {
+	defer close(s.stopped)
+
 	for {
 		// scan the storage to check for values that have expired
-		time.Sleep(time.Minute)
+		select {
+		case <-s.quit:
+			return
+		case <-s.clock.After(time.Minute):
+		}
 
-		now := time.Now()
+		s.expire(s.clock.Now())
+	}
+}
 
-		s.store.Range(func(ky any, vl any) bool {
-			item := vl.(*item)
-			item.mu.Lock()
+// Close stops the cleanup of expired values and waits for it to finish
+func (s *storage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
 
-			for i := range item.values {
-				if item.values[i].expires.After(now) {
-					s.store.Delete(ky)
-				}
-			}
+	<-s.stopped
 
-			item.mu.Unlock()
+	return nil
+}
 
+// removes all values that have expired before the given time
+func (s *storage) expire(now time.Time) {
+	s.store.Range(func(ky any, vl any) bool {
+		item := vl.(*item)
+		item.mu.Lock()
+
+		// the key was deleted while we were scanning the storage
+		if item.removed {
+			item.mu.Unlock()
 			return true
+		}
+
+		// callers of Get may hold a snapshot of the values,
+		// so the unexpired values are copied to a new slice
+		var live []*Value
+
+		for _, v := range item.values {
+			if v.expires.After(now) {
+				live = append(live, v)
+				continue
+			}
+
+			h := s.hasher.Get().(*maphash.Hash)
+			h.Reset()
+			h.Write(v.Value)
+			delete(item.contains, h.Sum64())
+			s.hasher.Put(h)
+
+			s.added(v, -1)
+			s.expired.Add(1)
+		}
+
+		item.values = live
+
+		if len(live) == 0 {
+			item.removed = true
+			s.store.Delete(ky)
+			s.keys.Add(-1)
+		}
+
+		item.mu.Unlock()
+
+		return true
+	})
+}
+
+// returns true if a value is ordered before another, by the time it was created and then by its contents
+func valueBefore(a, b *Value) bool {
+	if a.Created.Equal(b.Created) {
+		return bytes.Compare(a.Value, b.Value) < 0
+	}
+	return a.Created.Before(b.Created)
+}
+
+// sortValues returns the values ordered by the time they were created. values that are already
+// ordered, such as those held by the built in storages, are returned as they are, otherwise a
+// sorted copy is returned
+func sortValues(vs []*Value) []*Value {
+	if sort.SliceIsSorted(vs, func(i, j int) bool { return valueBefore(vs[i], vs[j]) }) {
+		return vs
+	}
+
+	sorted := make([]*Value, len(vs))
+	copy(sorted, vs)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return valueBefore(sorted[i], sorted[j])
+	})
+
+	return sorted
+}
+
+// insertSorted inserts a value into values that are ordered by the time they were created. values
+// are usually created after the values already held, so are appended. otherwise the values are
+// copied, as callers of Get may hold a snapshot of them
+func insertSorted(vs []*Value, value *Value) []*Value {
+	n := sort.Search(len(vs), func(i int) bool {
+		return valueBefore(value, vs[i])
+	})
+
+	if n == len(vs) {
+		return append(vs, value)
+	}
+
+	inserted := make([]*Value, 0, len(vs)+1)
+	inserted = append(inserted, vs[:n]...)
+	inserted = append(inserted, value)
+
+	return append(inserted, vs[n:]...)
+}
+
+// valuesUntil returns the values that were created before the given time. if until is zero, all values are returned
+func valuesUntil(vs []*Value, until time.Time) []*Value {
+	if until.IsZero() {
+		return vs
+	}
+
+	filtered := make([]*Value, 0, len(vs))
+
+	for _, v := range vs {
+		if !v.Created.After(until) {
+			filtered = append(filtered, v)
+		}
+	}
+
+	return filtered
+}
+
+// pageValues returns the sorted values that follow the cursor, limited to the given number of values
+// and the amount that can fit into a single event. If there are more values, the cursor for the
+// next page is returned
+func pageValues(vs []*Value, cursor []byte, limit int) ([]*Value, []byte) {
+	var start int
+
+	if len(cursor) == cursorBytes {
+		created := int64(binary.LittleEndian.Uint64(cursor))
+		skip := int(binary.LittleEndian.Uint32(cursor[8:]))
+
+		// skip all values created before the cursor, along with
+		// the values created at the same time that have been returned
+		start = sort.Search(len(vs), func(i int) bool {
+			return vs[i].Created.UnixNano() >= created
 		})
+
+		for start < len(vs) && skip > 0 && vs[start].Created.UnixNano() == created {
+			start++
+			skip--
+		}
+	}
+
+	end := start
+	size := 0
+
+	for end < len(vs) {
+		if limit > 0 && end-start >= limit {
+			break
+		}
+
+		// 50 is the overhead of the data in the value table
+		vsize := len(vs[end].Key) + len(vs[end].Value) + 50
+
+		// always return at least one value so the requester can make progress
+		if end > start && size+vsize > maxPageBytes {
+			break
+		}
+
+		size = size + vsize
+		end++
+	}
+
+	if end >= len(vs) {
+		return vs[start:end], nil
+	}
+
+	// the cursor is the created time of the last value and the number of
+	// values with that created time we have returned, including previous pages
+	last := vs[end-1].Created.UnixNano()
+
+	var count int
+	for i := end - 1; i >= 0 && vs[i].Created.UnixNano() == last; i-- {
+		count++
 	}
+
+	next := make([]byte, cursorBytes)
+	binary.LittleEndian.PutUint64(next, uint64(last))
+	binary.LittleEndian.PutUint32(next[8:], uint32(count))
+
+	return vs[start:end], next
+}
+
+// cursorAfter returns true if a cursor is past the previous cursor, or if it is the first cursor
+// returned when previous is nil. cursors that don't advance would otherwise let a node keep us
+// requesting the same page forever
+func cursorAfter(cursor, previous []byte) bool {
+	if len(cursor) != cursorBytes {
+		return false
+	}
+
+	if previous == nil {
+		return true
+	}
+
+	created := int64(binary.LittleEndian.Uint64(cursor))
+	pcreated := int64(binary.LittleEndian.Uint64(previous))
+
+	if created != pcreated {
+		return created > pcreated
+	}
+
+	return binary.LittleEndian.Uint32(cursor[8:]) > binary.LittleEndian.Uint32(previous[8:])
 }
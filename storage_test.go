@@ -0,0 +1,260 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortValues(t *testing.T) {
+	now := time.Now()
+
+	vs := []*Value{
+		{Value: []byte("c"), Created: now.Add(time.Second)},
+		{Value: []byte("b"), Created: now},
+		{Value: []byte("a"), Created: now},
+	}
+
+	sorted := sortValues(vs)
+
+	assert.Equal(t, []byte("a"), sorted[0].Value)
+	assert.Equal(t, []byte("b"), sorted[1].Value)
+	assert.Equal(t, []byte("c"), sorted[2].Value)
+
+	// the original values should not be reordered
+	assert.Equal(t, []byte("c"), vs[0].Value)
+
+	// values that are already ordered should not be copied
+	assert.Same(t, &sorted[0], &sortValues(sorted)[0])
+}
+
+func TestPageValues(t *testing.T) {
+	now := time.Now()
+
+	var vs []*Value
+
+	// create values where several share the same created time
+	for i := 0; i < 100; i++ {
+		vs = append(vs, &Value{
+			Key:     randomID(),
+			Value:   randomID(),
+			Created: now.Add(time.Duration(i/3) * time.Millisecond),
+		})
+	}
+
+	vs = sortValues(vs)
+
+	var paged []*Value
+	var cursor []byte
+
+	// page through all of the values, 7 at a time
+	for {
+		page, next := pageValues(vs, cursor, 7)
+		require.NotEmpty(t, page)
+		assert.LessOrEqual(t, len(page), 7)
+
+		paged = append(paged, page...)
+
+		if next == nil {
+			break
+		}
+
+		assert.Len(t, next, cursorBytes)
+		cursor = next
+	}
+
+	assert.Equal(t, vs, paged)
+
+	// pages should be limited to the size of a single event
+	vs = vs[:0]
+
+	for i := 0; i < 10; i++ {
+		vs = append(vs, &Value{
+			Key:     randomID(),
+			Value:   make([]byte, VALUE_BYTES),
+			Created: now.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+
+	page, next := pageValues(vs, nil, 0)
+	assert.Len(t, page, 1)
+	assert.NotNil(t, next)
+
+	page, next = pageValues(vs, next, 0)
+	assert.Len(t, page, 1)
+	assert.Equal(t, vs[1], page[0])
+	assert.NotNil(t, next)
+}
+
+func TestCursorAfter(t *testing.T) {
+	now := time.Now()
+
+	cursor := func(created time.Time, count int) []byte {
+		c := make([]byte, cursorBytes)
+		binary.LittleEndian.PutUint64(c, uint64(created.UnixNano()))
+		binary.LittleEndian.PutUint32(c[8:], uint32(count))
+		return c
+	}
+
+	assert.True(t, cursorAfter(cursor(now, 1), nil))
+	assert.True(t, cursorAfter(cursor(now, 2), cursor(now, 1)))
+	assert.True(t, cursorAfter(cursor(now.Add(time.Millisecond), 1), cursor(now, 2)))
+
+	// cursors that don't advance, or are malformed, should not be followed
+	assert.False(t, cursorAfter(cursor(now, 1), cursor(now, 1)))
+	assert.False(t, cursorAfter(cursor(now, 3), cursor(now.Add(time.Millisecond), 1)))
+	assert.False(t, cursorAfter(cursor(now, 1)[:8], nil))
+}
+
+func TestStorageExpire(t *testing.T) {
+	s := newInMemoryStorage(systemClock{})
+	defer s.Close()
+
+	key := randomID()
+	now := time.Now()
+
+	assert.True(t, s.Set(key, []byte("a"), now, time.Minute))
+	assert.True(t, s.Set(key, []byte("b"), now, time.Hour))
+	assert.True(t, s.Set(key, []byte("b"), now, time.Hour))
+	assert.True(t, s.Set(randomID(), []byte("c"), now, time.Minute))
+
+	keys, values, bytes, expired := s.Stats()
+	assert.Equal(t, uint64(2), keys)
+	assert.Equal(t, uint64(3), values)
+	assert.Equal(t, uint64(KEY_BYTES*3+3), bytes)
+	assert.Zero(t, expired)
+
+	// only values that have expired should be removed
+	s.expire(now.Add(time.Minute * 2))
+
+	vs, ok := s.Get(key, time.Time{})
+	require.True(t, ok)
+	require.Len(t, vs, 1)
+	assert.Equal(t, []byte("b"), vs[0].Value)
+
+	keys, values, bytes, expired = s.Stats()
+	assert.Equal(t, uint64(1), keys)
+	assert.Equal(t, uint64(1), values)
+	assert.Equal(t, uint64(KEY_BYTES+1), bytes)
+	assert.Equal(t, uint64(2), expired)
+
+	// expired values can be stored again
+	assert.True(t, s.Set(key, []byte("a"), now, time.Minute))
+
+	vs, ok = s.Get(key, time.Time{})
+	require.True(t, ok)
+	assert.Len(t, vs, 2)
+}
+
+func TestStorageDelete(t *testing.T) {
+	s := newInMemoryStorage(systemClock{})
+	defer s.Close()
+
+	key := randomID()
+	now := time.Now()
+
+	assert.True(t, s.Set(key, []byte("a"), now, time.Hour))
+	assert.True(t, s.Set(key, []byte("b"), now, time.Hour))
+	assert.True(t, s.Set(randomID(), []byte("c"), now, time.Hour))
+
+	assert.True(t, s.Delete(key))
+	assert.False(t, s.Delete(key))
+
+	_, ok := s.Get(key, time.Time{})
+	assert.False(t, ok)
+
+	keys, values, bytes, _ := s.Stats()
+	assert.Equal(t, uint64(1), keys)
+	assert.Equal(t, uint64(1), values)
+	assert.Equal(t, uint64(KEY_BYTES+1), bytes)
+
+	// deleted keys can be stored again
+	assert.True(t, s.Set(key, []byte("a"), now, time.Hour))
+
+	vs, ok := s.Get(key, time.Time{})
+	require.True(t, ok)
+	assert.Len(t, vs, 1)
+}
+
+func TestStorageInsert(t *testing.T) {
+	s := newInMemoryStorage(systemClock{})
+	defer s.Close()
+
+	key := randomID()
+	now := time.Now()
+
+	inserted, ok := s.Insert(key, []byte("a"), now, time.Hour)
+	assert.True(t, ok)
+	assert.True(t, inserted)
+
+	// refreshing a value with a new created time should not report it as inserted
+	inserted, ok = s.Insert(key, []byte("a"), now.Add(time.Minute), time.Hour)
+	assert.True(t, ok)
+	assert.False(t, inserted)
+
+	// storage that can't report inserts is checked for the value first
+	inserted, ok = insertValue(&noopStorage{}, key, []byte("a"), now, time.Hour)
+	assert.True(t, ok)
+	assert.True(t, inserted)
+
+	inserted, ok = insertValue(struct{ Storage }{s}, key, []byte("a"), now, time.Hour)
+	assert.True(t, ok)
+	assert.False(t, inserted)
+}
+
+func TestStorageInsertOrder(t *testing.T) {
+	s := newInMemoryStorage(systemClock{})
+	defer s.Close()
+
+	key := randomID()
+	now := time.Now()
+
+	assert.True(t, s.Set(key, []byte("b"), now.Add(time.Second), time.Hour))
+	assert.True(t, s.Set(key, []byte("d"), now.Add(time.Second*3), time.Hour))
+
+	snapshot, ok := s.Get(key, time.Time{})
+	require.True(t, ok)
+
+	// values should be held in the order they were created, regardless of the order they were stored
+	assert.True(t, s.Set(key, []byte("c"), now.Add(time.Second*2), time.Hour))
+	assert.True(t, s.Set(key, []byte("a"), now, time.Hour))
+	assert.True(t, s.Set(key, []byte("e"), now.Add(time.Second*4), time.Hour))
+
+	vs, ok := s.Get(key, time.Time{})
+	require.True(t, ok)
+	require.Len(t, vs, 5)
+
+	for i, v := range vs {
+		assert.Equal(t, []byte{byte('a' + i)}, v.Value)
+	}
+
+	// snapshots taken before the values were inserted should not change
+	require.Len(t, snapshot, 2)
+	assert.Equal(t, []byte("b"), snapshot[0].Value)
+	assert.Equal(t, []byte("d"), snapshot[1].Value)
+
+	// and values created before a time should be skipped
+	vs, ok = s.Get(key, now.Add(time.Second*2))
+	require.True(t, ok)
+	require.Len(t, vs, 3)
+	assert.Equal(t, []byte("c"), vs[0].Value)
+}
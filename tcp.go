@@ -0,0 +1,414 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTCPPoolSize the number of connections to other nodes a TCPTransport keeps open
+	DefaultTCPPoolSize = 64
+	// DefaultTCPDialTimeout the amount of time a TCPTransport waits to connect to or write to another node
+	DefaultTCPDialTimeout = time.Second * 5
+	// DefaultTCPIdleTimeout the amount of time a TCPTransport keeps a connection open without receiving anything
+	DefaultTCPIdleTimeout = time.Minute * 2
+	// the size of the header a connection starts with, the port the dialer is listening on
+	tcpHandshakeSize = 2
+	// the size of the length prefixed to each event
+	tcpLengthSize = 4
+	// the largest event that will be sent or received, the same as the largest event sent over udp
+	maxTCPEventSize = packetBufferSize
+)
+
+// TCPConfig configuration parameters for a TCPTransport
+type TCPConfig struct {
+	// PoolSize the number of connections to other nodes that are kept open.
+	// The least recently used connection is closed to make room for new connections
+	PoolSize int
+	// DialTimeout the amount of time to wait to connect to or write to another node
+	DialTimeout time.Duration
+	// IdleTimeout the amount of time a connection is kept open without receiving anything
+	IdleTimeout time.Duration
+}
+
+// TCPTransport a transport that sends each event over a tcp connection, prefixed by its length.
+// Connections to other nodes are pooled and reused. A node's tcp address has the same ip and port
+// as its udp address, so nodes using it as their fallback transport listen on both
+type TCPTransport struct {
+	config  TCPConfig
+	handler func(from *net.UDPAddr, data []byte)
+	// accepts connections from other nodes
+	listener net.Listener
+	// the port other nodes should reply to us on
+	port uint16
+	// connections we have dialed, keyed by the address of the node
+	conns map[netip.AddrPort]*tcpConn
+	// connections other nodes have dialed
+	inbound map[net.Conn]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+// a pooled connection to another node
+type tcpConn struct {
+	conn net.Conn
+	// the last time the connection was used, to find the least recently used connection
+	used time.Time
+	mu   sync.Mutex
+}
+
+// NewTCPTransport creates a tcp transport
+func NewTCPTransport(config TCPConfig) *TCPTransport {
+	if config.PoolSize < 1 {
+		config.PoolSize = DefaultTCPPoolSize
+	}
+
+	if config.DialTimeout < 1 {
+		config.DialTimeout = DefaultTCPDialTimeout
+	}
+
+	if config.IdleTimeout < 1 {
+		config.IdleTimeout = DefaultTCPIdleTimeout
+	}
+
+	return &TCPTransport{
+		config:  config,
+		conns:   make(map[netip.AddrPort]*tcpConn),
+		inbound: make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen listens for connections on the tcp address with the same ip and port as the udp address
+func (t *TCPTransport) Listen(address string, handler func(from *net.UDPAddr, data []byte)) error {
+	cfg := net.ListenConfig{
+		Control: control,
+	}
+
+	l, err := cfg.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.listener = l
+	t.handler = handler
+	t.port = uint16(l.Addr().(*net.TCPAddr).Port)
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.accept()
+	}()
+
+	return nil
+}
+
+func (t *TCPTransport) accept() {
+	for {
+		c, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// the error is most likely temporary, such as running out of file descriptors
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+
+		t.mu.Lock()
+
+		if t.closed {
+			t.mu.Unlock()
+			c.Close()
+			return
+		}
+
+		t.inbound[c] = struct{}{}
+		t.wg.Add(1)
+
+		t.mu.Unlock()
+
+		go func() {
+			defer t.wg.Done()
+			t.receive(c)
+		}()
+	}
+}
+
+// reads the events sent over a connection another node has dialed
+func (t *TCPTransport) receive(c net.Conn) {
+	defer func() {
+		c.Close()
+
+		t.mu.Lock()
+		delete(t.inbound, c)
+		t.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+
+	var header [tcpLengthSize]byte
+
+	c.SetReadDeadline(time.Now().Add(t.config.IdleTimeout))
+
+	_, err := io.ReadFull(r, header[:tcpHandshakeSize])
+	if err != nil {
+		return
+	}
+
+	// replies are sent to the port the node is listening on, not the port it dialed from
+	from := &net.UDPAddr{
+		IP:   c.RemoteAddr().(*net.TCPAddr).IP,
+		Port: int(binary.LittleEndian.Uint16(header[:tcpHandshakeSize])),
+	}
+
+	buf := make([]byte, 1500)
+
+	for {
+		c.SetReadDeadline(time.Now().Add(t.config.IdleTimeout))
+
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return
+		}
+
+		size := int(binary.LittleEndian.Uint32(header[:]))
+		if size > maxTCPEventSize {
+			// the node is not following the protocol, so drop the connection
+			return
+		}
+
+		if size > len(buf) {
+			buf = make([]byte, size)
+		}
+
+		_, err = io.ReadFull(r, buf[:size])
+		if err != nil {
+			return
+		}
+
+		t.handler(from, buf[:size])
+	}
+}
+
+// Send sends an event to a node, connecting to it if there is no open connection to it
+func (t *TCPTransport) Send(to *net.UDPAddr, data []byte) error {
+	if len(data) > maxTCPEventSize {
+		return fmt.Errorf("event of %d bytes is larger than the maximum of %d bytes", len(data), maxTCPEventSize)
+	}
+
+	k := addrPort(to)
+
+	c, pooled, err := t.conn(k)
+	if err != nil {
+		return err
+	}
+
+	err = c.write(data, t.config.DialTimeout)
+	if err == nil || !pooled {
+		if err != nil {
+			t.remove(k, c)
+		}
+		return err
+	}
+
+	// the pooled connection may have been closed by the
+	// other node since it was last used, so try a new one
+	t.remove(k, c)
+
+	c, _, err = t.conn(k)
+	if err != nil {
+		return err
+	}
+
+	err = c.write(data, t.config.DialTimeout)
+	if err != nil {
+		t.remove(k, c)
+	}
+
+	return err
+}
+
+// returns the pooled connection to a node, or dials a new connection.
+// returns true if the connection was already open
+func (t *TCPTransport) conn(k netip.AddrPort) (*tcpConn, bool, error) {
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return nil, false, net.ErrClosed
+	}
+
+	c, ok := t.conns[k]
+	if ok {
+		c.used = time.Now()
+		t.mu.Unlock()
+		return c, true, nil
+	}
+
+	port := t.port
+
+	t.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", k.String(), t.config.DialTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c = &tcpConn{conn: nc, used: time.Now()}
+
+	// tell the node which port to reply to us on
+	var header [tcpHandshakeSize]byte
+	binary.LittleEndian.PutUint16(header[:], port)
+
+	nc.SetWriteDeadline(time.Now().Add(t.config.DialTimeout))
+
+	_, err = nc.Write(header[:])
+	if err != nil {
+		nc.Close()
+		return nil, false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		nc.Close()
+		return nil, false, net.ErrClosed
+	}
+
+	existing, ok := t.conns[k]
+	if ok {
+		// another send connected to the node at the same time, so use its connection
+		nc.Close()
+		existing.used = time.Now()
+		return existing, true, nil
+	}
+
+	if len(t.conns) >= t.config.PoolSize {
+		t.evict()
+	}
+
+	t.conns[k] = c
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.watch(k, c)
+	}()
+
+	return c, false, nil
+}
+
+// closes the least recently used connection. the caller must hold the mutex
+func (t *TCPTransport) evict() {
+	var lk netip.AddrPort
+	var lc *tcpConn
+
+	for k, c := range t.conns {
+		if lc == nil || c.used.Before(lc.used) {
+			lk, lc = k, c
+		}
+	}
+
+	if lc != nil {
+		delete(t.conns, lk)
+		lc.conn.Close()
+	}
+}
+
+// removes a connection from the pool once the other node has closed it. nothing
+// is sent to us over the connections we dial, as nodes reply over their own
+func (t *TCPTransport) watch(k netip.AddrPort, c *tcpConn) {
+	io.Copy(io.Discard, c.conn)
+	t.remove(k, c)
+}
+
+// removes a connection from the pool and closes it
+func (t *TCPTransport) remove(k netip.AddrPort, c *tcpConn) {
+	t.mu.Lock()
+
+	if t.conns[k] == c {
+		delete(t.conns, k)
+	}
+
+	t.mu.Unlock()
+
+	c.conn.Close()
+}
+
+// writes an event prefixed by its length
+func (c *tcpConn) write(data []byte, timeout time.Duration) error {
+	var header [tcpLengthSize]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(data)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+
+	bufs := net.Buffers{header[:], data}
+
+	_, err := bufs.WriteTo(c.conn)
+
+	return err
+}
+
+// Close stops accepting connections and closes all open connections
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return net.ErrClosed
+	}
+
+	t.closed = true
+
+	var err error
+
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+
+	for _, c := range t.conns {
+		c.conn.Close()
+	}
+
+	for c := range t.inbound {
+		c.Close()
+	}
+
+	t.mu.Unlock()
+
+	t.wg.Wait()
+
+	return err
+}
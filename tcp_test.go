@@ -0,0 +1,250 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPTransport(t *testing.T) {
+	type event struct {
+		from *net.UDPAddr
+		data []byte
+	}
+
+	received := make(chan event, 10)
+
+	a := NewTCPTransport(TCPConfig{PoolSize: 1})
+	defer a.Close()
+
+	b := NewTCPTransport(TCPConfig{})
+	defer b.Close()
+
+	c := NewTCPTransport(TCPConfig{})
+	defer c.Close()
+
+	require.Nil(t, a.Listen("127.0.0.1:9000", func(from *net.UDPAddr, data []byte) {}))
+
+	for _, tr := range []*TCPTransport{b, c} {
+		err := tr.Listen("127.0.0.1:0", func(from *net.UDPAddr, data []byte) {
+			received <- event{from: from, data: append([]byte(nil), data...)}
+		})
+		require.Nil(t, err)
+	}
+
+	baddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.listener.Addr().(*net.TCPAddr).Port}
+	caddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.listener.Addr().(*net.TCPAddr).Port}
+
+	// events larger than a udp packet are sent whole
+	large := bytes.Repeat([]byte("a"), 20000)
+
+	require.Nil(t, a.Send(baddr, []byte("hello")))
+	require.Nil(t, a.Send(baddr, large))
+
+	for _, expected := range [][]byte{[]byte("hello"), large} {
+		select {
+		case e := <-received:
+			assert.Equal(t, expected, e.data)
+			// the sender is identified by the address it listens on
+			assert.Equal(t, 9000, e.from.Port)
+		case <-time.After(time.Second):
+			require.FailNow(t, "event not received")
+		}
+	}
+
+	// the connection is reused
+	a.mu.Lock()
+	assert.Len(t, a.conns, 1)
+	a.mu.Unlock()
+
+	// connecting to another node evicts the least recently used connection
+	require.Nil(t, a.Send(caddr, []byte("world")))
+
+	select {
+	case e := <-received:
+		assert.Equal(t, []byte("world"), e.data)
+	case <-time.After(time.Second):
+		require.FailNow(t, "event not received")
+	}
+
+	a.mu.Lock()
+	assert.Len(t, a.conns, 1)
+	a.mu.Unlock()
+
+	// a new connection is made if the pooled connection has been closed
+	require.Nil(t, c.Close())
+
+	d := NewTCPTransport(TCPConfig{})
+	defer d.Close()
+
+	require.Nil(t, d.Listen(caddr.String(), func(from *net.UDPAddr, data []byte) {
+		received <- event{from: from, data: append([]byte(nil), data...)}
+	}))
+
+	assert.Eventually(t, func() bool {
+		return a.Send(caddr, []byte("again")) == nil
+	}, time.Second, time.Millisecond*10)
+
+	select {
+	case e := <-received:
+		assert.Equal(t, []byte("again"), e.data)
+	case <-time.After(time.Second):
+		require.FailNow(t, "event not received")
+	}
+
+	assert.NotNil(t, a.Send(baddr, make([]byte, maxTCPEventSize+1)))
+}
+
+// starts two nodes that use udp over the simulated network and tcp as their fallback
+func newFallbackNodes(t *testing.T, network *SimNetwork, timeout time.Duration, threshold int) (*DHT, *DHT) {
+	bdht, err := New(&Config{
+		LocalID:           randomID(),
+		ListenAddress:     "127.0.0.1:9000",
+		Listeners:         1,
+		Network:           network,
+		Fallback:          NewTCPTransport(TCPConfig{}),
+		FallbackThreshold: threshold,
+		Timeout:           timeout,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { bdht.Close() })
+
+	odht, err := New(&Config{
+		LocalID:            randomID(),
+		ListenAddress:      "127.0.0.1:9001",
+		BootstrapAddresses: []string{"127.0.0.1:9000"},
+		Listeners:          1,
+		Network:            network,
+		Fallback:           NewTCPTransport(TCPConfig{}),
+		FallbackThreshold:  threshold,
+		Timeout:            timeout,
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { odht.Close() })
+
+	return bdht, odht
+}
+
+func TestDHTFallbackLargeEvents(t *testing.T) {
+	network := NewSimNetwork(SimConfig{})
+
+	bdht, odht := newFallbackNodes(t, network, time.Second*5, MaxPayloadSize)
+
+	// a value that would be split into a dozen packets over udp
+	key := randomID()
+	value := bytes.Repeat([]byte("a"), 16*1024)
+
+	sent := network.Stats().Sent
+
+	ch := make(chan error, 1)
+
+	bdht.Store(key, value, time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	vch := make(chan []byte, 1)
+
+	odht.Find(key, func(v []byte, err error) {
+		require.Nil(t, err)
+		vch <- v
+	}, SkipLocal())
+
+	assert.Equal(t, value, <-vch)
+
+	// only the small responses are sent over udp
+	assert.Less(t, network.Stats().Sent-sent, uint64(8))
+}
+
+func TestDHTFallbackUDPBlocked(t *testing.T) {
+	network := NewSimNetwork(SimConfig{})
+
+	bdht, _ := newFallbackNodes(t, network, time.Millisecond*200, 0)
+
+	// udp between the nodes is blocked
+	require.Nil(t, network.Partition([]string{"127.0.0.1:9000"}, []string{"127.0.0.1:9001"}))
+
+	for i := 0; i < fallbackFailures; i++ {
+		_, _, err := bdht.Ping("127.0.0.1:9001")
+		assert.ErrorIs(t, err, ErrRequestTimeout)
+	}
+
+	// once the node repeatedly fails to respond over udp, it's reached over tcp
+	id, _, err := bdht.Ping("127.0.0.1:9001")
+	require.Nil(t, err)
+	assert.Len(t, id, KEY_BYTES)
+}
+
+func TestFallbackRouter(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	f := newFallbackRouter(NewTCPTransport(TCPConfig{}), DefaultFallbackThreshold, clock)
+	defer f.close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	// events that are split into fragments are still sent over udp by default
+	assert.False(t, f.use(addr, MaxPayloadSize*16))
+	assert.True(t, f.use(addr, MaxEventSize+1))
+
+	// a node that occasionally fails to respond is still sent events over udp
+	for i := 0; i < fallbackFailures*2; i++ {
+		f.fail(addr)
+		f.succeed(addr)
+	}
+
+	assert.False(t, f.use(addr, 1))
+
+	// until it fails to respond to several requests in a row
+	for i := 0; i < fallbackFailures; i++ {
+		f.fail(addr)
+	}
+
+	assert.True(t, f.use(addr, 1))
+
+	// nodes that are no longer sent events over the fallback transport,
+	// and failures that are no longer in a row, should be removed
+	f.fail(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+
+	clock.BlockUntil(1)
+	clock.Advance(fallbackPeriod + time.Minute*2)
+	clock.BlockUntil(1)
+
+	f.mu.Lock()
+	assert.Empty(t, f.peers)
+	assert.Empty(t, f.failures)
+	f.mu.Unlock()
+
+	// and the number of nodes tracked should be bounded
+	for i := 0; i < maxFallbackPeers*2; i++ {
+		to := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 9000}
+		f.fail(to)
+		f.prefer(to)
+	}
+
+	f.mu.Lock()
+	assert.LessOrEqual(t, len(f.peers), maxFallbackPeers)
+	assert.LessOrEqual(t, len(f.failures), maxFallbackPeers)
+	f.mu.Unlock()
+}
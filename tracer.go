@@ -0,0 +1,386 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LookupKind the type of lookup being traced
+type LookupKind string
+
+const (
+	// FindValueLookup a lookup for the values of a key
+	FindValueLookup LookupKind = "find_value"
+	// FindNodeLookup a lookup for the nodes closest to a target
+	FindNodeLookup LookupKind = "find_node"
+)
+
+// Lookup describes a single lookup traversing the network
+type Lookup struct {
+	// ID uniquely identifies the lookup on this node
+	ID uint64
+	// Kind the type of lookup
+	Kind LookupKind
+	// Target the key or node id being looked up
+	Target []byte
+	// Started the time the lookup was started
+	Started time.Time
+}
+
+// Query a request sent to a single node as part of a lookup
+type Query struct {
+	// Lookup the lookup the query was sent for
+	Lookup *Lookup
+	// Peer the id of the node that was queried. This will be nil for bootstrap nodes
+	Peer []byte
+	// Address the address of the node that was queried
+	Address *net.UDPAddr
+	// Sent the time the query was sent
+	Sent time.Time
+}
+
+// Response the outcome of a single query
+type Response struct {
+	// Latency the time between sending the query and receiving the response
+	Latency time.Duration
+	// Values the number of values returned by the node
+	Values int
+	// Nodes the number of closer nodes returned by the node
+	Nodes int
+	// Err the error returned by the node, if any
+	Err error
+}
+
+// LookupResult summarises a lookup once its journey has finished
+type LookupResult struct {
+	// Queries the number of queries that were sent
+	Queries int
+	// Responses the number of queries that were responded to
+	Responses int
+	// Timeouts the number of queries that timed out
+	Timeouts int
+	// Values the number of values that were returned by nodes
+	Values int
+	// Duration the total time the lookup took
+	Duration time.Duration
+	// Err the reason the lookup failed, or nil if it completed successfully
+	Err error
+}
+
+// Tracer receives the progress of lookups as they traverse the network. Implementations must be
+// safe for concurrent use and should not block, as they are called when handling responses
+type Tracer interface {
+	// OnQuerySent is called when a query is sent to a node
+	OnQuerySent(q *Query)
+	// OnResponse is called when a node responds to a query
+	OnResponse(q *Query, r *Response)
+	// OnTimeout is called when a node fails to respond to a query in time
+	OnTimeout(q *Query)
+	// OnJourneyFinished is called once when a lookup has finished
+	OnJourneyFinished(l *Lookup, r *LookupResult)
+}
+
+// combines multiple tracers, ignoring any that are nil
+func tracers(ts ...Tracer) Tracer {
+	var combined multiTracer
+
+	for _, t := range ts {
+		if t != nil {
+			combined = append(combined, t)
+		}
+	}
+
+	switch len(combined) {
+	case 0:
+		return nil
+	case 1:
+		return combined[0]
+	default:
+		return combined
+	}
+}
+
+// attaches the configured tracer and any tracer provided by the caller to a journey
+func (d *DHT) trace(j *journey, kind LookupKind, target []byte, tracer Tracer) {
+	t := tracers(d.config.Tracer, tracer)
+	if t == nil {
+		return
+	}
+
+	j.trace(t, &Lookup{
+		ID:      atomic.AddUint64(&d.lookups, 1),
+		Kind:    kind,
+		Target:  target,
+		Started: d.config.Clock.Now(),
+	}, d.config.Clock)
+}
+
+type multiTracer []Tracer
+
+func (m multiTracer) OnQuerySent(q *Query) {
+	for _, t := range m {
+		t.OnQuerySent(q)
+	}
+}
+
+func (m multiTracer) OnResponse(q *Query, r *Response) {
+	for _, t := range m {
+		t.OnResponse(q, r)
+	}
+}
+
+func (m multiTracer) OnTimeout(q *Query) {
+	for _, t := range m {
+		t.OnTimeout(q)
+	}
+}
+
+func (m multiTracer) OnJourneyFinished(l *Lookup, r *LookupResult) {
+	for _, t := range m {
+		t.OnJourneyFinished(l, r)
+	}
+}
+
+// TraceStep a single step recorded by a Trace
+type TraceStep struct {
+	// Time the time the step was recorded
+	Time time.Time
+	// Event one of sent, response or timeout
+	Event string
+	// Peer the id of the node that was queried
+	Peer []byte
+	// Address the address of the node that was queried
+	Address *net.UDPAddr
+	// Response the response received, if any
+	Response *Response
+}
+
+// Trace records the steps of the lookups it is attached to.
+// It can be attached to a single Find call with WithTracer
+type Trace struct {
+	steps  []TraceStep
+	result *LookupResult
+	mu     sync.Mutex
+}
+
+// NewTrace creates a new trace
+func NewTrace() *Trace {
+	return &Trace{}
+}
+
+// OnQuerySent records a query being sent
+func (t *Trace) OnQuerySent(q *Query) {
+	t.record(q, "sent", nil)
+}
+
+// OnResponse records a response being received
+func (t *Trace) OnResponse(q *Query, r *Response) {
+	t.record(q, "response", r)
+}
+
+// OnTimeout records a query timing out
+func (t *Trace) OnTimeout(q *Query) {
+	t.record(q, "timeout", nil)
+}
+
+// OnJourneyFinished records the result of the lookup
+func (t *Trace) OnJourneyFinished(l *Lookup, r *LookupResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.result = r
+}
+
+func (t *Trace) record(q *Query, event string, r *Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.steps = append(t.steps, TraceStep{
+		Time:     time.Now(),
+		Event:    event,
+		Peer:     q.Peer,
+		Address:  q.Address,
+		Response: r,
+	})
+}
+
+// Steps returns the steps recorded so far
+func (t *Trace) Steps() []TraceStep {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	steps := make([]TraceStep, len(t.steps))
+	copy(steps, t.steps)
+
+	return steps
+}
+
+// Result returns the result of the lookup, or nil if it has not finished
+func (t *Trace) Result() *LookupResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.result
+}
+
+// String formats the recorded steps, one per line
+func (t *Trace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sb strings.Builder
+
+	for _, s := range t.steps {
+		fmt.Fprintf(&sb, "%s %-8s %s %s", s.Time.Format("15:04:05.000000"), s.Event, hex.EncodeToString(s.Peer), s.Address)
+
+		if s.Response != nil {
+			fmt.Fprintf(&sb, " latency=%s values=%d nodes=%d", s.Response.Latency, s.Response.Values, s.Response.Nodes)
+
+			if s.Response.Err != nil {
+				fmt.Fprintf(&sb, " err=%q", s.Response.Err)
+			}
+		}
+
+		sb.WriteByte('\n')
+	}
+
+	if t.result != nil {
+		fmt.Fprintf(&sb, "finished queries=%d responses=%d timeouts=%d values=%d duration=%s", t.result.Queries, t.result.Responses, t.result.Timeouts, t.result.Values, t.result.Duration)
+
+		if t.result.Err != nil {
+			fmt.Fprintf(&sb, " err=%q", t.result.Err)
+		}
+
+		sb.WriteByte('\n')
+	}
+
+	return sb.String()
+}
+
+// Attribute a key value pair attached to a span or span event
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span the subset of an OpenTelemetry span used by SpanTracer
+type Span interface {
+	// AddEvent adds an event to the span
+	AddEvent(name string, attributes ...Attribute)
+	// RecordError records an error on the span
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// SpanTracer a Tracer that records each lookup as a span, with an event for each
+// query and response. It can be used to export lookups to OpenTelemetry by providing
+// a function that starts spans with an OpenTelemetry tracer
+type SpanTracer struct {
+	start func(name string, attributes ...Attribute) Span
+	spans map[uint64]Span
+	mu    sync.Mutex
+}
+
+// NewSpanTracer creates a tracer that starts a span for each lookup with the provided function
+func NewSpanTracer(start func(name string, attributes ...Attribute) Span) *SpanTracer {
+	return &SpanTracer{
+		start: start,
+		spans: make(map[uint64]Span),
+	}
+}
+
+// returns the span for a lookup, starting it if it does not exist
+func (s *SpanTracer) span(l *Lookup) Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.spans[l.ID]
+	if !ok {
+		sp = s.start(
+			"emo."+string(l.Kind),
+			Attribute{Key: "emo.lookup.id", Value: l.ID},
+			Attribute{Key: "emo.lookup.target", Value: hex.EncodeToString(l.Target)},
+		)
+		s.spans[l.ID] = sp
+	}
+
+	return sp
+}
+
+// OnQuerySent adds a query sent event to the lookup's span
+func (s *SpanTracer) OnQuerySent(q *Query) {
+	s.span(q.Lookup).AddEvent("query.sent", queryAttributes(q)...)
+}
+
+// OnResponse adds a query response event to the lookup's span
+func (s *SpanTracer) OnResponse(q *Query, r *Response) {
+	attributes := append(
+		queryAttributes(q),
+		Attribute{Key: "emo.response.latency_ms", Value: float64(r.Latency) / float64(time.Millisecond)},
+		Attribute{Key: "emo.response.values", Value: r.Values},
+		Attribute{Key: "emo.response.nodes", Value: r.Nodes},
+	)
+
+	if r.Err != nil {
+		attributes = append(attributes, Attribute{Key: "emo.response.error", Value: r.Err.Error()})
+	}
+
+	s.span(q.Lookup).AddEvent("query.response", attributes...)
+}
+
+// OnTimeout adds a query timeout event to the lookup's span
+func (s *SpanTracer) OnTimeout(q *Query) {
+	s.span(q.Lookup).AddEvent("query.timeout", queryAttributes(q)...)
+}
+
+// OnJourneyFinished ends the lookup's span, recording any error
+func (s *SpanTracer) OnJourneyFinished(l *Lookup, r *LookupResult) {
+	sp := s.span(l)
+
+	s.mu.Lock()
+	delete(s.spans, l.ID)
+	s.mu.Unlock()
+
+	sp.AddEvent(
+		"lookup.finished",
+		Attribute{Key: "emo.lookup.queries", Value: r.Queries},
+		Attribute{Key: "emo.lookup.responses", Value: r.Responses},
+		Attribute{Key: "emo.lookup.timeouts", Value: r.Timeouts},
+		Attribute{Key: "emo.lookup.values", Value: r.Values},
+	)
+
+	if r.Err != nil {
+		sp.RecordError(r.Err)
+	}
+
+	sp.End()
+}
+
+func queryAttributes(q *Query) []Attribute {
+	return []Attribute{
+		{Key: "emo.peer.id", Value: hex.EncodeToString(q.Peer)},
+		{Key: "emo.peer.address", Value: q.Address.String()},
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceFind(t *testing.T) {
+	bc := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9000",
+		Listeners:     1,
+	}
+
+	// create a new bootstrap node
+	bdht, err := New(bc)
+	require.Nil(t, err)
+	defer bdht.Close()
+
+	// wait some time for the listeners to start
+	time.Sleep(time.Millisecond * 200)
+
+	// trace all lookups made by the node, including the find node lookup made when joining
+	joined := NewTrace()
+
+	c := &Config{
+		LocalID:       randomID(),
+		ListenAddress: "127.0.0.1:9001",
+		BootstrapAddresses: []string{
+			bc.ListenAddress,
+		},
+		Listeners: 1,
+		Tracer:    joined,
+	}
+
+	dht, err := New(c)
+	require.Nil(t, err)
+	defer dht.Close()
+
+	require.NotNil(t, joined.Result())
+	assert.Nil(t, joined.Result().Err)
+	assert.GreaterOrEqual(t, joined.Result().Queries, 1)
+
+	key := randomID()
+
+	ch := make(chan error, 1)
+
+	dht.Store(key, []byte("value"), time.Hour, func(err error) {
+		ch <- err
+	})
+
+	require.Nil(t, <-ch)
+
+	// trace a single find request for a value held by the bootstrap node
+	tr := NewTrace()
+
+	dht.Find(key, func(value []byte, err error) {
+		ch <- err
+	}, SkipLocal(), WithTracer(tr))
+
+	require.Nil(t, <-ch)
+
+	require.Eventually(t, func() bool {
+		return tr.Result() != nil
+	}, time.Second, time.Millisecond*10)
+
+	steps := tr.Steps()
+	require.Len(t, steps, 2)
+
+	assert.Equal(t, "sent", steps[0].Event)
+	assert.Equal(t, bc.LocalID, steps[0].Peer)
+	assert.Equal(t, "response", steps[1].Event)
+	assert.Equal(t, 1, steps[1].Response.Values)
+
+	assert.Equal(t, 1, tr.Result().Queries)
+	assert.Equal(t, 1, tr.Result().Responses)
+	assert.Equal(t, 1, tr.Result().Values)
+	assert.Nil(t, tr.Result().Err)
+	assert.Contains(t, tr.String(), "finished queries=1 responses=1 timeouts=0 values=1")
+
+	// trace a find request for a value that does not exist
+	tr = NewTrace()
+
+	dht.Find(randomID(), func(value []byte, err error) {
+		ch <- err
+	}, WithTracer(tr))
+
+	require.NotNil(t, <-ch)
+	require.NotNil(t, tr.Result())
+	assert.EqualError(t, tr.Result().Err, "value not found")
+	assert.Equal(t, 0, tr.Result().Values)
+}
+
+type testSpan struct {
+	name   string
+	events []string
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) AddEvent(name string, attributes ...Attribute) {
+	s.events = append(s.events, name)
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+func TestSpanTracer(t *testing.T) {
+	var spans []*testSpan
+
+	st := NewSpanTracer(func(name string, attributes ...Attribute) Span {
+		s := &testSpan{name: name}
+		spans = append(spans, s)
+		return s
+	})
+
+	l := &Lookup{ID: 1, Kind: FindValueLookup, Target: randomID(), Started: time.Now()}
+	q := &Query{Lookup: l, Peer: randomID(), Address: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}, Sent: time.Now()}
+
+	st.OnQuerySent(q)
+	st.OnTimeout(q)
+	st.OnQuerySent(q)
+	st.OnResponse(q, &Response{Latency: time.Millisecond, Nodes: 3})
+	st.OnJourneyFinished(l, &LookupResult{Queries: 2, Responses: 1, Timeouts: 1, Err: errors.New("value not found")})
+
+	require.Len(t, spans, 1)
+	assert.Equal(t, "emo.find_value", spans[0].name)
+	assert.Equal(t, []string{"query.sent", "query.timeout", "query.sent", "query.response", "lookup.finished"}, spans[0].events)
+	assert.EqualError(t, spans[0].err, "value not found")
+	assert.True(t, spans[0].ended)
+	assert.Empty(t, st.spans)
+}
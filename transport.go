@@ -0,0 +1,510 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/tos-network/emo/protocol"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// DefaultFallbackThreshold the size in bytes above which events are sent over the fallback transport.
+	// By default only events too large to be sent over udp are, so events split into several packets
+	// still use udp, where their lost fragments are retransmitted
+	DefaultFallbackThreshold = MaxEventSize
+	// the amount of time events are sent to a node over the fallback
+	// transport after it has repeatedly failed to respond over udp
+	fallbackPeriod = time.Minute * 10
+	// the number of requests in a row a node must fail to respond
+	// to over udp before it is sent events over the fallback transport
+	fallbackFailures = 3
+	// the maximum number of nodes the fallback router tracks, in both
+	// the nodes sent events over the fallback transport and their failures
+	maxFallbackPeers = 1 << 14
+	// the number of tracked nodes evicted at once when the fallback router is full
+	fallbackEvictBatch = 256
+)
+
+// Transport carries events between nodes. Nodes are addressed by the udp address they
+// listen on, which a transport that isn't udp should map to an address of its own
+type Transport interface {
+	// Listen starts receiving events sent to the address, passing each one to the handler
+	// along with the address of the node that sent it. The data is only valid until the
+	// handler returns. The handler may be called from several goroutines at once
+	Listen(address string, handler func(from *net.UDPAddr, data []byte)) error
+	// Send sends an event to the node listening on the address
+	Send(to *net.UDPAddr, data []byte) error
+	// Close stops receiving events and closes any connections
+	Close() error
+}
+
+// the default transport, which splits events into packets and writes them to a
+// udp socket in batches, reassembling the packets of the events it receives
+type udpTransport struct {
+	// creates the socket
+	network Network
+	// udp socket
+	conn PacketConn
+	// packet manager for large packets
+	packet *packetManager
+	// drops packets from banned peers before they are reassembled
+	limiter *limiter
+	// receives measurements of the batches we read and write
+	metrics Metrics
+	// collection of messages that will be read to in batch from the underlying socket
+	readBatch []ipv4.Message
+	// collection of messages that will be written in batch to the underlying socket
+	writeBatch []ipv4.Message
+	// size of the current write batch
+	writeBatchSize int
+	// the period with which the current batch is written to the socket if not full
+	interval time.Duration
+	// logger with the id of this node attached
+	logger *slog.Logger
+	// mutex to protect writes to the write batch
+	mu sync.Mutex
+	// channel to signal the transport to shutdown
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newUDPTransport(network Network, packet *packetManager, limiter *limiter, metrics Metrics, logger *slog.Logger, batchSize int, interval time.Duration) *udpTransport {
+	t := &udpTransport{
+		network:    network,
+		packet:     packet,
+		limiter:    limiter,
+		metrics:    metrics,
+		logger:     logger,
+		interval:   interval,
+		writeBatch: make([]ipv4.Message, batchSize),
+		readBatch:  make([]ipv4.Message, batchSize),
+		quit:       make(chan struct{}),
+	}
+
+	for i := range t.writeBatch {
+		t.readBatch[i].Buffers = [][]byte{make([]byte, 1500)}
+		t.writeBatch[i].Buffers = [][]byte{make([]byte, 1500)}
+	}
+
+	return t
+}
+
+func (t *udpTransport) Listen(address string, handler func(from *net.UDPAddr, data []byte)) error {
+	c, err := t.network.ListenPacket(address)
+	if err != nil {
+		return err
+	}
+
+	t.conn = c
+
+	t.wg.Add(2)
+	go func() {
+		defer t.wg.Done()
+		t.flusher()
+	}()
+	go func() {
+		defer t.wg.Done()
+		t.process(handler)
+	}()
+
+	return nil
+}
+
+func (t *udpTransport) process(handler func(from *net.UDPAddr, data []byte)) {
+	for {
+		select {
+		case <-t.quit:
+			return
+		default:
+			bs, err := t.conn.ReadBatch(t.readBatch, 0)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					// network connection closed, so
+					// we can shutdown
+					return
+				}
+				panic(err)
+			}
+
+			t.metrics.Observe("emo_listener_read_batch_size", float64(bs))
+
+			for i := 0; i < bs; i++ {
+				t.handle(t.readBatch[i].Addr.(*net.UDPAddr), t.readBatch[i].Buffers[0][:t.readBatch[i].N], handler)
+			}
+		}
+	}
+}
+
+// handles a single packet read from the socket. any panic caused by
+// the packet is recovered so it can't take down the rest of the node
+func (t *udpTransport) handle(addr *net.UDPAddr, f []byte, handler func(from *net.UDPAddr, data []byte)) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			t.logger.Error("recovered from panic handling packet", addrAttr(addr), slog.Any("panic", r))
+			t.limiter.penalize(addr, errMalformedEvent)
+		}
+	}()
+
+	// drop anything sent from a peer that has been banned
+	if t.limiter.banned(addr) {
+		return
+	}
+
+	// the receiver of a fragmented packet we sent is missing
+	// some fragments, so send them again
+	if isControlPacket(f) {
+		frames := t.packet.retransmit(addr, f)
+		if len(frames) > 0 {
+			err := t.writeFrames(addr, frames)
+			if err != nil {
+				t.logger.Warn("failed to retransmit fragments", addrAttr(addr), errAttr(err))
+			}
+		}
+		return
+	}
+
+	// if we have a fragmented packet, continue reading data
+	p := t.packet.assemble(addr, f)
+	if p == nil {
+		return
+	}
+
+	defer t.packet.done(p)
+
+	handler(addr, p.data())
+}
+
+func (t *udpTransport) Send(to *net.UDPAddr, data []byte) error {
+	id := protocol.GetRootAsEvent(data, 0).IdBytes()
+
+	p := t.packet.fragment(id, data)
+	defer t.packet.done(p)
+
+	// keep a copy of fragmented packets in case the
+	// receiver asks us to retransmit any lost fragments
+	t.packet.retain(to, id, p)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for f := p.next(); f != nil; f = p.next() {
+		err := t.writeFrame(to, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writes a set of already fragmented frames to the given address
+func (t *udpTransport) writeFrames(to *net.UDPAddr, frames [][]byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, f := range frames {
+		err := t.writeFrame(to, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adds a single frame to the write batch, flushing the batch if it is full.
+// the caller must hold the transports mutex
+func (t *udpTransport) writeFrame(to *net.UDPAddr, f []byte) error {
+	t.writeBatch[t.writeBatchSize].Addr = to
+	// set the len of the buffer without allocating a new buffer
+	t.writeBatch[t.writeBatchSize].Buffers[0] = t.writeBatch[t.writeBatchSize].Buffers[0][:len(f)]
+	// copy the data from the fragment buffer into the message buffer
+	copy(t.writeBatch[t.writeBatchSize].Buffers[0], f)
+
+	t.writeBatchSize++
+
+	if t.writeBatchSize >= len(t.writeBatch) {
+		return t.flush(false)
+	}
+
+	return nil
+}
+
+func (t *udpTransport) flusher() {
+	// this uses the system time rather than the configured
+	// clock, as it paces writes, not the protocol
+	ftimer := time.NewTicker(t.interval)
+	defer ftimer.Stop()
+
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ftimer.C:
+			err := t.flush(true)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				panic(err)
+			}
+		}
+	}
+}
+
+func (t *udpTransport) flush(lock bool) error {
+	if lock {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	}
+
+	if t.writeBatchSize < 1 {
+		return nil
+	}
+
+	start := time.Now()
+
+	_, err := t.conn.WriteBatch(t.writeBatch[:t.writeBatchSize], 0)
+	if err != nil {
+		return err
+	}
+
+	t.metrics.Observe("emo_listener_write_batch_size", float64(t.writeBatchSize))
+	t.metrics.Observe("emo_listener_flush_seconds", time.Since(start).Seconds())
+
+	// reset the batch
+	t.writeBatchSize = 0
+
+	return nil
+}
+
+// Close shuts down the transport, waiting for its goroutines to stop
+func (t *udpTransport) Close() error {
+	close(t.quit)
+
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+
+	t.wg.Wait()
+
+	return err
+}
+
+// decides which events are sent over the fallback transport
+type fallbackRouter struct {
+	transport Transport
+	// the size above which events are sent over the fallback transport
+	threshold int
+	// nodes that have not responded to requests sent over udp, and the time udp will be tried again
+	peers map[netip.AddrPort]time.Time
+	// the number of requests in a row that nodes have failed to respond to over udp
+	failures map[netip.AddrPort]*fallbackFailure
+	clock    Clock
+	// closed to stop the cleanup of expired nodes, which closes stopped once it has stopped
+	quit    chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+}
+
+// the requests in a row a node has failed to respond to over udp
+type fallbackFailure struct {
+	count int
+	last  time.Time
+}
+
+func newFallbackRouter(transport Transport, threshold int, clock Clock) *fallbackRouter {
+	f := &fallbackRouter{
+		transport: transport,
+		threshold: threshold,
+		peers:     make(map[netip.AddrPort]time.Time),
+		failures:  make(map[netip.AddrPort]*fallbackFailure),
+		clock:     clock,
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go f.cleanup()
+
+	return f
+}
+
+// returns true if an event should be sent over the fallback transport
+func (f *fallbackRouter) use(to *net.UDPAddr, size int) bool {
+	if f == nil {
+		return false
+	}
+
+	if size > f.threshold {
+		return true
+	}
+
+	k := addrPort(to)
+	now := f.clock.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	until, ok := f.peers[k]
+	if ok && now.After(until) {
+		// try udp again
+		delete(f.peers, k)
+		return false
+	}
+
+	return ok
+}
+
+// records that a node failed to respond to a request sent over udp, sending it events over
+// the fallback transport once it has failed to respond to several requests in a row
+func (f *fallbackRouter) fail(to *net.UDPAddr) {
+	if f == nil {
+		return
+	}
+
+	k := addrPort(to)
+	now := f.clock.Now()
+
+	f.mu.Lock()
+
+	ff, ok := f.failures[k]
+	if !ok {
+		if len(f.failures) >= maxFallbackPeers {
+			evictBatch(f.failures, fallbackEvictBatch)
+		}
+
+		ff = &fallbackFailure{}
+		f.failures[k] = ff
+	}
+
+	ff.count++
+	ff.last = now
+
+	failed := ff.count >= fallbackFailures
+
+	if failed {
+		delete(f.failures, k)
+	}
+
+	f.mu.Unlock()
+
+	if failed {
+		f.prefer(to)
+	}
+}
+
+// records that a node responded to a request sent over udp
+func (f *fallbackRouter) succeed(to *net.UDPAddr) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	delete(f.failures, addrPort(to))
+	f.mu.Unlock()
+}
+
+// sends events to a node over the fallback transport for a while, as it has either
+// repeatedly failed to respond over udp or has reached us over the fallback transport
+func (f *fallbackRouter) prefer(to *net.UDPAddr) {
+	if f == nil {
+		return
+	}
+
+	k := addrPort(to)
+	until := f.clock.Now().Add(fallbackPeriod)
+
+	f.mu.Lock()
+
+	_, ok := f.peers[k]
+	if !ok && len(f.peers) >= maxFallbackPeers {
+		evictBatch(f.peers, fallbackEvictBatch)
+	}
+
+	f.peers[k] = until
+
+	f.mu.Unlock()
+}
+
+func (f *fallbackRouter) cleanup() {
+	defer close(f.stopped)
+
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-f.clock.After(time.Minute):
+		}
+
+		now := f.clock.Now()
+
+		f.mu.Lock()
+
+		for k, until := range f.peers {
+			if now.After(until) {
+				delete(f.peers, k)
+			}
+		}
+
+		// failures that haven't been added to for a while are no longer in a row
+		for k, ff := range f.failures {
+			if now.Sub(ff.last) > fallbackPeriod {
+				delete(f.failures, k)
+			}
+		}
+
+		f.mu.Unlock()
+	}
+}
+
+// stops the cleanup of expired nodes and waits for it to finish
+func (f *fallbackRouter) close() {
+	if f == nil {
+		return
+	}
+
+	close(f.quit)
+	<-f.stopped
+}
+
+// evicts a batch of entries from a map in random order
+func evictBatch[K comparable, V any](m map[K]V, n int) {
+	var evicted int
+
+	for k := range m {
+		if evicted >= n {
+			return
+		}
+
+		delete(m, k)
+		evicted++
+	}
+}
+
+func addrPort(addr *net.UDPAddr) netip.AddrPort {
+	return netip.AddrPortFrom(addrIP(addr), uint16(addr.Port))
+}
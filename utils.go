@@ -38,3 +38,13 @@ func DefaultDataDir() string {
 func ChaindataDir(dataDir string) string {
 	return filepath.Join(dataDir, "gtos", "chaindata")
 }
+
+// AdminSocketPath returns the path to the daemon's admin api socket.
+func AdminSocketPath(dataDir string) string {
+	return filepath.Join(dataDir, "emo.sock")
+}
+
+// IdentityPath returns the path to the daemon's identity file.
+func IdentityPath(dataDir string) string {
+	return filepath.Join(dataDir, "emo.key")
+}
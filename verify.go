@@ -0,0 +1,624 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/tos-network/emo/protocol"
+)
+
+const (
+	// the size of an encoded node address, a 4 byte ipv4 address and a 2 byte port
+	nodeAddressBytes = 6
+	// the maximum length of the message in an error event
+	maxErrorMessageBytes = 256
+)
+
+// field slots of each of the tables in the wire protocol
+const (
+	slotNodeID      = 0
+	slotNodeAddress = 1
+
+	slotValueKey     = 0
+	slotValueValue   = 1
+	slotValueTTL     = 2
+	slotValueCreated = 3
+
+	slotFindNodeKey   = 0
+	slotFindNodeNodes = 1
+
+	slotFindValueKey    = 0
+	slotFindValueValues = 1
+	slotFindValueNodes  = 2
+	slotFindValueFrom   = 3
+	slotFindValueFound  = 4
+	slotFindValueLimit  = 5
+	slotFindValueCursor = 6
+	slotFindValueUntil  = 7
+
+	slotStoreValues = 0
+
+	slotAddProviderKey = 0
+	slotAddProviderTTL = 1
+
+	slotGetProvidersKey       = 0
+	slotGetProvidersProviders = 1
+	slotGetProvidersNodes     = 2
+
+	slotSubscribeKey   = 0
+	slotSubscribeLease = 1
+
+	slotNotifyKey    = 0
+	slotNotifyValues = 1
+
+	slotErrorCode    = 0
+	slotErrorMessage = 1
+
+	slotEventID          = 0
+	slotEventSender      = 1
+	slotEventEvent       = 2
+	slotEventResponse    = 3
+	slotEventPayloadType = 4
+	slotEventPayload     = 5
+	slotEventVersion     = 6
+	slotEventCapability  = 7
+	slotEventObserved    = 8
+	slotEventClient      = 9
+	slotEventPunch       = 10
+	slotEventRelay       = 11
+	slotEventDialback    = 12
+	slotEventIntroduced  = 13
+	slotEventNetwork     = 14
+	slotEventPassive     = 15
+)
+
+// verifyEvent checks that every table and vector in an untrusted event
+// is within the bounds of the buffer and that all ids, keys and addresses
+// have the correct length, before returning the decoded event. if only the
+// payload is malformed, the event is returned along with the error so the
+// sender can be told, but nothing other than its header may be read
+func verifyEvent(data []byte) (*protocol.Event, error) {
+	v := verifier{buf: data}
+
+	root, err := v.root()
+	if err != nil {
+		return nil, err
+	}
+
+	et, err := v.table(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.bytes(et, slotEventID, KEY_BYTES, KEY_BYTES, true)
+	if err != nil {
+		return nil, fmt.Errorf("event id: %w", err)
+	}
+
+	err = v.bytes(et, slotEventSender, KEY_BYTES, KEY_BYTES, true)
+	if err != nil {
+		return nil, fmt.Errorf("event sender: %w", err)
+	}
+
+	for _, slot := range []int{slotEventEvent, slotEventResponse, slotEventPayloadType} {
+		err = v.scalar(et, slot, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = v.scalar(et, slotEventVersion, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.scalar(et, slotEventCapability, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.scalar(et, slotEventNetwork, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, slot := range []int{slotEventClient, slotEventDialback, slotEventIntroduced, slotEventPassive} {
+		err = v.scalar(et, slot, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = v.bytes(et, slotEventObserved, nodeAddressBytes, nodeAddressBytes, false)
+	if err != nil {
+		return nil, fmt.Errorf("event observed address: %w", err)
+	}
+
+	err = v.bytes(et, slotEventPunch, nodeAddressBytes, nodeAddressBytes, false)
+	if err != nil {
+		return nil, fmt.Errorf("event punch address: %w", err)
+	}
+
+	err = v.bytes(et, slotEventRelay, nodeAddressBytes, nodeAddressBytes, false)
+	if err != nil {
+		return nil, fmt.Errorf("event relay address: %w", err)
+	}
+
+	e := protocol.GetRootAsEvent(data, 0)
+
+	pt, ok, err := v.indirect(et, slotEventPayload)
+	if err != nil {
+		return e, fmt.Errorf("event payload: %w", err)
+	}
+
+	switch e.Event() {
+	case protocol.EventTypePING, protocol.EventTypePONG:
+		return e, nil
+	case protocol.EventTypeSTORE:
+		if !ok {
+			if e.Response() {
+				return e, nil
+			}
+			return e, fmt.Errorf("store request missing payload: %w", errMalformedEvent)
+		}
+		err = v.store(pt)
+	case protocol.EventTypeFIND_NODE:
+		if !ok {
+			return e, fmt.Errorf("find node missing payload: %w", errMalformedEvent)
+		}
+		err = v.findNode(pt, !e.Response())
+	case protocol.EventTypeFIND_VALUE:
+		if !ok {
+			return e, fmt.Errorf("find value missing payload: %w", errMalformedEvent)
+		}
+		err = v.findValue(pt, !e.Response())
+	case protocol.EventTypeADD_PROVIDER:
+		if !ok {
+			if e.Response() {
+				return e, nil
+			}
+			return e, fmt.Errorf("add provider request missing payload: %w", errMalformedEvent)
+		}
+		err = v.addProvider(pt)
+	case protocol.EventTypeGET_PROVIDERS:
+		if !ok {
+			return e, fmt.Errorf("get providers missing payload: %w", errMalformedEvent)
+		}
+		err = v.getProviders(pt, !e.Response())
+	case protocol.EventTypeSUBSCRIBE:
+		if !ok {
+			if e.Response() {
+				return e, nil
+			}
+			return e, fmt.Errorf("subscribe request missing payload: %w", errMalformedEvent)
+		}
+		err = v.subscribe(pt)
+	case protocol.EventTypeNOTIFY:
+		if !ok {
+			return e, fmt.Errorf("notify missing payload: %w", errMalformedEvent)
+		}
+		err = v.notify(pt)
+	case protocol.EventTypeERROR:
+		if !ok {
+			return e, fmt.Errorf("error missing payload: %w", errMalformedEvent)
+		}
+		err = v.errorEvent(pt)
+	default:
+		// events added by newer versions of the protocol are answered with
+		// an error, so only the header of the event is verified and its
+		// payload must not be accessed
+		return e, nil
+	}
+
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// a verified table and its vtable
+type vtable struct {
+	// position of the table in the buffer
+	pos uint64
+	// position of the vtable in the buffer
+	vpos uint64
+	// size of the vtable in bytes
+	vsize uint64
+	// size of the table in bytes
+	tsize uint64
+}
+
+// verifier bounds checks flatbuffers tables before they are accessed
+type verifier struct {
+	buf []byte
+	// the number of tables that have been verified, used
+	// to limit the amount of work a single event can cause
+	tables int
+}
+
+func (v *verifier) fail(format string, args ...any) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), errMalformedEvent)
+}
+
+// checks that a region of the buffer is in bounds
+func (v *verifier) inBounds(pos, size uint64) bool {
+	return pos+size >= pos && pos+size <= uint64(len(v.buf))
+}
+
+func (v *verifier) uint16(pos uint64) uint64 {
+	return uint64(binary.LittleEndian.Uint16(v.buf[pos:]))
+}
+
+func (v *verifier) uint32(pos uint64) uint64 {
+	return uint64(binary.LittleEndian.Uint32(v.buf[pos:]))
+}
+
+// returns the position of the root table
+func (v *verifier) root() (uint64, error) {
+	if !v.inBounds(0, 4) {
+		return 0, v.fail("buffer too small")
+	}
+
+	return v.uint32(0), nil
+}
+
+// verifies the table and vtable at the given position
+func (v *verifier) table(pos uint64) (*vtable, error) {
+	v.tables++
+
+	// there can't be more tables than 4 byte offsets in the buffer
+	if v.tables > len(v.buf)/4 {
+		return nil, v.fail("too many tables")
+	}
+
+	if !v.inBounds(pos, 4) {
+		return nil, v.fail("table out of bounds")
+	}
+
+	// the vtable is located at the position of the table minus the signed offset
+	soffset := int64(int32(binary.LittleEndian.Uint32(v.buf[pos:])))
+	vpos := int64(pos) - soffset
+
+	if vpos < 0 || !v.inBounds(uint64(vpos), 4) {
+		return nil, v.fail("vtable out of bounds")
+	}
+
+	t := &vtable{
+		pos:  pos,
+		vpos: uint64(vpos),
+	}
+
+	t.vsize = v.uint16(t.vpos)
+	t.tsize = v.uint16(t.vpos + 2)
+
+	if t.vsize < 4 || t.vsize%2 != 0 || !v.inBounds(t.vpos, t.vsize) {
+		return nil, v.fail("invalid vtable size")
+	}
+
+	if t.tsize < 4 || !v.inBounds(t.pos, t.tsize) {
+		return nil, v.fail("invalid table size")
+	}
+
+	return t, nil
+}
+
+// returns the offset of a field within its table, or 0 if the field is not set
+func (v *verifier) field(t *vtable, slot int) uint64 {
+	vo := uint64(4 + slot*2)
+	if vo+2 > t.vsize {
+		return 0
+	}
+
+	return v.uint16(t.vpos + vo)
+}
+
+// verifies that a scalar field of a given size fits inside of its table
+func (v *verifier) scalar(t *vtable, slot int, size uint64) error {
+	fo := v.field(t, slot)
+	if fo == 0 {
+		return nil
+	}
+
+	if fo+size > t.tsize {
+		return v.fail("field %d out of bounds", slot)
+	}
+
+	return nil
+}
+
+// verifies an offset field and returns the position it points to
+func (v *verifier) indirect(t *vtable, slot int) (uint64, bool, error) {
+	fo := v.field(t, slot)
+	if fo == 0 {
+		return 0, false, nil
+	}
+
+	if fo+4 > t.tsize {
+		return 0, false, v.fail("field %d out of bounds", slot)
+	}
+
+	pos := t.pos + fo
+
+	target := pos + v.uint32(pos)
+	if !v.inBounds(target, 0) {
+		return 0, false, v.fail("field %d target out of bounds", slot)
+	}
+
+	return target, true, nil
+}
+
+// verifies a vector field, returning its length and the position of its first element
+func (v *verifier) vector(t *vtable, slot int, elemSize uint64) (uint64, uint64, bool, error) {
+	pos, ok, err := v.indirect(t, slot)
+	if err != nil || !ok {
+		return 0, 0, ok, err
+	}
+
+	if !v.inBounds(pos, 4) {
+		return 0, 0, false, v.fail("vector %d out of bounds", slot)
+	}
+
+	length := v.uint32(pos)
+
+	if !v.inBounds(pos+4, length*elemSize) {
+		return 0, 0, false, v.fail("vector %d elements out of bounds", slot)
+	}
+
+	return length, pos + 4, true, nil
+}
+
+// verifies a byte vector field has a length within the given bounds
+func (v *verifier) bytes(t *vtable, slot int, minLength, maxLength uint64, required bool) error {
+	length, _, ok, err := v.vector(t, slot, 1)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if required {
+			return v.fail("missing field %d", slot)
+		}
+		return nil
+	}
+
+	if length < minLength || length > maxLength {
+		return v.fail("field %d has invalid length %d", slot, length)
+	}
+
+	return nil
+}
+
+// verifies a vector of tables, calling the provided function for each table
+func (v *verifier) tableVector(t *vtable, slot int, fn func(pos uint64) error) error {
+	length, pos, ok, err := v.vector(t, slot, 4)
+	if err != nil || !ok {
+		return err
+	}
+
+	for i := uint64(0); i < length; i++ {
+		ep := pos + i*4
+
+		err = fn(ep + v.uint32(ep))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *verifier) node(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotNodeID, KEY_BYTES, KEY_BYTES, true)
+	if err != nil {
+		return fmt.Errorf("node id: %w", err)
+	}
+
+	err = v.bytes(t, slotNodeAddress, nodeAddressBytes, nodeAddressBytes, true)
+	if err != nil {
+		return fmt.Errorf("node address: %w", err)
+	}
+
+	return nil
+}
+
+func (v *verifier) value(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotValueKey, KEY_BYTES, KEY_BYTES, false)
+	if err != nil {
+		return fmt.Errorf("value key: %w", err)
+	}
+
+	length, _, _, err := v.vector(t, slotValueValue, 1)
+	if err != nil {
+		return fmt.Errorf("value: %w", err)
+	}
+
+	if length > VALUE_BYTES {
+		return fmt.Errorf("value of %d bytes: %w", length, errOversizedValue)
+	}
+
+	err = v.scalar(t, slotValueTTL, 8)
+	if err != nil {
+		return err
+	}
+
+	return v.scalar(t, slotValueCreated, 8)
+}
+
+func (v *verifier) store(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	return v.tableVector(t, slotStoreValues, v.value)
+}
+
+func (v *verifier) findNode(pos uint64, request bool) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotFindNodeKey, KEY_BYTES, KEY_BYTES, request)
+	if err != nil {
+		return fmt.Errorf("find node key: %w", err)
+	}
+
+	return v.tableVector(t, slotFindNodeNodes, v.node)
+}
+
+func (v *verifier) findValue(pos uint64, request bool) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotFindValueKey, KEY_BYTES, KEY_BYTES, request)
+	if err != nil {
+		return fmt.Errorf("find value key: %w", err)
+	}
+
+	err = v.tableVector(t, slotFindValueValues, v.value)
+	if err != nil {
+		return err
+	}
+
+	err = v.tableVector(t, slotFindValueNodes, v.node)
+	if err != nil {
+		return err
+	}
+
+	err = v.scalar(t, slotFindValueFrom, 8)
+	if err != nil {
+		return err
+	}
+
+	err = v.scalar(t, slotFindValueFound, 8)
+	if err != nil {
+		return err
+	}
+
+	err = v.scalar(t, slotFindValueLimit, 4)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotFindValueCursor, cursorBytes, cursorBytes, false)
+	if err != nil {
+		return fmt.Errorf("find value cursor: %w", err)
+	}
+
+	err = v.scalar(t, slotFindValueUntil, 8)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (v *verifier) addProvider(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotAddProviderKey, KEY_BYTES, KEY_BYTES, true)
+	if err != nil {
+		return fmt.Errorf("add provider key: %w", err)
+	}
+
+	return v.scalar(t, slotAddProviderTTL, 8)
+}
+
+func (v *verifier) getProviders(pos uint64, request bool) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotGetProvidersKey, KEY_BYTES, KEY_BYTES, request)
+	if err != nil {
+		return fmt.Errorf("get providers key: %w", err)
+	}
+
+	err = v.tableVector(t, slotGetProvidersProviders, v.node)
+	if err != nil {
+		return err
+	}
+
+	return v.tableVector(t, slotGetProvidersNodes, v.node)
+}
+
+func (v *verifier) subscribe(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotSubscribeKey, KEY_BYTES, KEY_BYTES, true)
+	if err != nil {
+		return fmt.Errorf("subscribe key: %w", err)
+	}
+
+	return v.scalar(t, slotSubscribeLease, 8)
+}
+
+func (v *verifier) notify(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotNotifyKey, KEY_BYTES, KEY_BYTES, true)
+	if err != nil {
+		return fmt.Errorf("notify key: %w", err)
+	}
+
+	return v.tableVector(t, slotNotifyValues, v.value)
+}
+
+func (v *verifier) errorEvent(pos uint64) error {
+	t, err := v.table(pos)
+	if err != nil {
+		return err
+	}
+
+	err = v.scalar(t, slotErrorCode, 4)
+	if err != nil {
+		return err
+	}
+
+	err = v.bytes(t, slotErrorMessage, 0, maxErrorMessageBytes, false)
+	if err != nil {
+		return fmt.Errorf("error message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2024 Terminos Storage Protocol
+// This file is part of the tos library.
+//
+// The tos library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The tos library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the tos library. If not, see <http://www.gnu.org/licenses/>.
+
+package emo
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tos-network/emo/protocol"
+)
+
+// builds a set of valid events of every type
+func testEvents() [][]byte {
+	buf := flatbuffers.NewBuilder(1024)
+
+	values := []*Value{
+		{Key: randomID(), Value: []byte("value"), TTL: time.Hour, Created: time.Now()},
+		{Key: randomID(), Value: make([]byte, 4000), TTL: time.Hour, Created: time.Now()},
+	}
+
+	nodes := []*node{
+		{id: randomID(), address: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}},
+		{id: randomID(), address: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9001}},
+	}
+
+	providers := []*Provider{
+		{ID: randomID(), Address: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 9002}},
+	}
+
+	copied := func(b []byte) []byte {
+		c := make([]byte, len(b))
+		copy(c, b)
+		return c
+	}
+
+	return [][]byte{
+		copied(eventPing(buf, randomID(), randomID(), false, false, 0)),
+		copied(eventPing(buf, randomID(), randomID(), false, false, 7)),
+		copied(eventPong(buf, randomID(), randomID(), true, true, 0, nodes[0].address)),
+		copied(eventTraversalPing(buf, randomID(), randomID(), true, true, 0, true, true, nodes[0].address, nodes[1].address)),
+		copied(eventStoreRequest(buf, randomID(), randomID(), false, 0, values)),
+		copied(eventStoreResponse(buf, randomID(), randomID(), false, 0)),
+		copied(eventFindNodeRequest(buf, randomID(), randomID(), false, 0, randomID())),
+		copied(eventFindNodeResponse(buf, randomID(), randomID(), false, 0, nodes)),
+		copied(eventFindValueRequest(buf, randomID(), randomID(), false, 0, randomID(), time.Now(), time.Now().Add(time.Hour), 10, make([]byte, cursorBytes))),
+		copied(eventFindValueFoundResponse(buf, randomID(), randomID(), false, 0, values, 2, make([]byte, cursorBytes))),
+		copied(eventFindValueNotFoundResponse(buf, randomID(), randomID(), false, 0, nodes)),
+		copied(eventAddProviderRequest(buf, randomID(), randomID(), false, 0, randomID(), time.Hour)),
+		copied(eventAddProviderResponse(buf, randomID(), randomID(), false, 0)),
+		copied(eventGetProvidersRequest(buf, randomID(), randomID(), false, 0, randomID())),
+		copied(eventGetProvidersResponse(buf, randomID(), randomID(), false, 0, providers, nodes)),
+		copied(eventSubscribeRequest(buf, randomID(), randomID(), false, 0, randomID(), time.Minute)),
+		copied(eventSubscribeResponse(buf, randomID(), randomID(), false, 0)),
+		copied(eventNotify(buf, randomID(), randomID(), false, 0, randomID(), values)),
+		copied(eventError(buf, randomID(), randomID(), false, 0, protocol.ErrorCodeUNSUPPORTED, "unsupported event type 100")),
+	}
+}
+
+// reads every field of an event, which will panic if the event is not well formed
+func readEvent(e *protocol.Event) {
+	e.IdBytes()
+	e.SenderBytes()
+	e.Event()
+	e.Response()
+	e.Version()
+	e.Capabilities()
+	e.ObservedBytes()
+	e.Client()
+	e.PunchBytes()
+	e.RelayBytes()
+	e.Dialback()
+	e.Introduced()
+	e.Network()
+	e.Passive()
+
+	payload := new(flatbuffers.Table)
+	if !e.Payload(payload) {
+		return
+	}
+
+	readNode := func(n *protocol.Node) {
+		decodeAddress(n.AddressBytes())
+		n.IdBytes()
+	}
+
+	readValue := func(v *protocol.Value) {
+		v.KeyBytes()
+		v.ValueBytes()
+		v.Ttl()
+		v.Created()
+	}
+
+	switch e.Event() {
+	case protocol.EventTypeSTORE:
+		s := new(protocol.Store)
+		s.Init(payload.Bytes, payload.Pos)
+
+		for i := 0; i < s.ValuesLength(); i++ {
+			v := new(protocol.Value)
+			s.Values(v, i)
+			readValue(v)
+		}
+	case protocol.EventTypeFIND_NODE:
+		f := new(protocol.FindNode)
+		f.Init(payload.Bytes, payload.Pos)
+		f.KeyBytes()
+
+		for i := 0; i < f.NodesLength(); i++ {
+			n := new(protocol.Node)
+			f.Nodes(n, i)
+			readNode(n)
+		}
+	case protocol.EventTypeFIND_VALUE:
+		f := new(protocol.FindValue)
+		f.Init(payload.Bytes, payload.Pos)
+		f.KeyBytes()
+		f.From()
+		f.Found()
+		f.Limit()
+		f.CursorBytes()
+		f.Until()
+
+		for i := 0; i < f.ValuesLength(); i++ {
+			v := new(protocol.Value)
+			f.Values(v, i)
+			readValue(v)
+		}
+
+		for i := 0; i < f.NodesLength(); i++ {
+			n := new(protocol.Node)
+			f.Nodes(n, i)
+			readNode(n)
+		}
+	case protocol.EventTypeADD_PROVIDER:
+		a := new(protocol.AddProvider)
+		a.Init(payload.Bytes, payload.Pos)
+		a.KeyBytes()
+		a.Ttl()
+	case protocol.EventTypeGET_PROVIDERS:
+		g := new(protocol.GetProviders)
+		g.Init(payload.Bytes, payload.Pos)
+		g.KeyBytes()
+
+		for i := 0; i < g.ProvidersLength(); i++ {
+			n := new(protocol.Node)
+			g.Providers(n, i)
+			readNode(n)
+		}
+
+		for i := 0; i < g.NodesLength(); i++ {
+			n := new(protocol.Node)
+			g.Nodes(n, i)
+			readNode(n)
+		}
+	case protocol.EventTypeSUBSCRIBE:
+		s := new(protocol.Subscribe)
+		s.Init(payload.Bytes, payload.Pos)
+		s.KeyBytes()
+		s.Lease()
+	case protocol.EventTypeNOTIFY:
+		n := new(protocol.Notify)
+		n.Init(payload.Bytes, payload.Pos)
+		n.KeyBytes()
+
+		for i := 0; i < n.ValuesLength(); i++ {
+			v := new(protocol.Value)
+			n.Values(v, i)
+			readValue(v)
+		}
+	case protocol.EventTypeERROR:
+		er := new(protocol.Error)
+		er.Init(payload.Bytes, payload.Pos)
+		er.Code()
+		er.Message()
+	}
+}
+
+func TestVerifyEvent(t *testing.T) {
+	for _, data := range testEvents() {
+		e, err := verifyEvent(data)
+		require.Nil(t, err)
+		readEvent(e)
+
+		// any truncation of the event should fail verification
+		for i := 0; i < len(data); i += 7 {
+			_, err := verifyEvent(data[:i])
+			assert.ErrorIs(t, err, errMalformedEvent)
+		}
+	}
+}
+
+func TestVerifyEventInvalidLengths(t *testing.T) {
+	buf := flatbuffers.NewBuilder(1024)
+
+	// short sender id
+	_, err := verifyEvent(eventPing(buf, randomID(), randomID()[:20], false, false, 0))
+	assert.ErrorIs(t, err, errMalformedEvent)
+
+	// short key
+	_, err = verifyEvent(eventFindNodeRequest(buf, randomID(), randomID(), false, 0, randomID()[:8]))
+	assert.ErrorIs(t, err, errMalformedEvent)
+
+	// oversized value
+	_, err = verifyEvent(eventStoreRequest(buf, randomID(), randomID(), false, 0, []*Value{
+		{Key: randomID(), Value: make([]byte, VALUE_BYTES+1)},
+	}))
+	assert.ErrorIs(t, err, errOversizedValue)
+}
+
+func FuzzEventDecode(f *testing.F) {
+	m := newPacketManager(noopMetrics{}, systemClock{})
+	defer m.close()
+
+	for _, data := range testEvents() {
+		p := m.fragment(randomID(), data)
+
+		for fr := p.next(); fr != nil; fr = p.next() {
+			f.Add(append([]byte(nil), fr...))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := m.assemble(testAddr, data)
+		if p == nil {
+			return
+		}
+
+		e, err := verifyEvent(p.data())
+		if err != nil {
+			return
+		}
+
+		readEvent(e)
+	})
+}